@@ -19,6 +19,7 @@ import (
 	"path/filepath"
 
 	"github.com/tim-hardcastle/Pipefish/source/hub"
+	"github.com/tim-hardcastle/Pipefish/source/lsp"
 )
 
 func main() {
@@ -37,7 +38,15 @@ func main() {
 			return
 		case "-r", "--run", "run":
 			hub.StartServiceFromCli()
+		case "build":
+			hub.BuildImageFromCli()
 		case "-t", "--tui", "tui": // Left blank to avoid the default.
+		case "lsp":
+			if err := lsp.Serve(os.Stdin, os.Stdout); err != nil {
+				os.Stderr.WriteString("\nPipefish language server stopped: " + err.Error() + "\n")
+				os.Exit(1)
+			}
+			return
 		default:
 			os.Stdout.WriteString("\nPipefish doesn't recognize the command '" + os.Args[1] + "'.\n")
 			println()
@@ -49,6 +58,7 @@ func main() {
 	fmt.Print(hub.Logo())
 
 	h := hub.New(os.Stdin, os.Stdout)
+	h.SetImageCache(hub.DefaultImageCache())
 	appDir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
 	f, err := os.Open(filepath.Join(appDir, filepath.FromSlash("/user/hub.dat")))
 	if err != nil {
@@ -426,6 +426,15 @@ func (se *SuffixExpression) String() string {
 	return out.String()
 }
 
+type TransactionExpression struct {
+	Token token.Token
+	Right Node
+}
+
+func (t *TransactionExpression) Children() []Node       { return []Node{t.Right} }
+func (t *TransactionExpression) GetToken() *token.Token { return &t.Token }
+func (t *TransactionExpression) String() string         { return "transaction" }
+
 type TryExpression struct {
 	Token   token.Token
 	VarName string
@@ -633,6 +642,7 @@ type PrsrFunction struct {
 	Given    Node         // The 'given' block: nil if there isn't one.
 	Cmd      bool         // Whether it's a command or not.
 	Private  bool         // Whether it's private or not.
+	Access   []string     // The groups which may call it from outside the service, or nil if anyone may.
 	Number   uint32       // The order in which the function was compiled by the vmMaker. Initialized as DUMMY.
 	Compiler any          // A vile kludge at the last minute to make the interfaces work without restructuring the whole program. TODO --- something else.
 	Position uint32       // PREFIX, INFIX, SUFFIX.
@@ -652,6 +662,7 @@ type FnTreeNode struct {
 type TypeNodePair struct { // This exists because we need an *ordered* collection of type-node pairs.
 	Type     values.AbstractType
 	IsVararg bool
+	Bling    string // If the type is bling, which bling it is, since all bling has the same type.
 	Node     *FnTreeNode
 }
 
@@ -0,0 +1,143 @@
+package auth
+
+// Authentication for the administered hub. A `Provider` checks the credentials a user supplies and
+// says who they are. The hub checks usernames and passwords either against the `_Users` table of
+// its database, which is where `hub register` puts them, or against a static users file; and it
+// gives a user who logs in over HTTP a signed bearer token from `Tokens`, which is itself a
+// `Provider`, so that their requests needn't carry their password.
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/tim-hardcastle/Pipefish/source/database"
+)
+
+// What a user supplies to prove who they are: either a username and password, or a token.
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+type User struct {
+	Name    string
+	Service string // The service the user should talk to when they log in, or "" for none in particular.
+}
+
+type Provider interface {
+	Authenticate(c Credentials) (User, error)
+}
+
+var ErrUnrecognized = errors.New("the hub doesn't recognize that combination of username and password")
+
+// Checks usernames and passwords against the tables of the hub's database.
+type SqlProvider struct {
+	db *sql.DB
+}
+
+func NewSqlProvider(db *sql.DB) *SqlProvider {
+	return &SqlProvider{db: db}
+}
+
+func (p *SqlProvider) Authenticate(c Credentials) (User, error) {
+	if p.db == nil {
+		return User{}, errors.New("database has not been configured")
+	}
+	serviceName, err := database.ValidateUser(p.db, c.Username, c.Password)
+	if err != nil {
+		return User{}, err
+	}
+	return User{Name: c.Username, Service: serviceName}, nil
+}
+
+// Checks usernames and passwords against a static file, which has one user to a line in the form
+//
+//	<username>:<bcrypt hash of password>[:<service>]
+//
+// which is the format of the files made by 'htpasswd -B', with the service the user should talk
+// to as an optional extra. Blank lines and lines starting with '#' are ignored. The file is read
+// again whenever it changes, so users can be added and removed without restarting the hub.
+type FileProvider struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]fileUser
+}
+
+type fileUser struct {
+	hash    string
+	service string
+}
+
+func NewFileProvider(path string) (*FileProvider, error) {
+	p := &FileProvider{path: path}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *FileProvider) Path() string {
+	return p.path
+}
+
+func (p *FileProvider) Authenticate(c Credentials) (User, error) {
+	if err := p.load(); err != nil {
+		return User{}, err
+	}
+	p.mu.Lock()
+	user, ok := p.users[c.Username]
+	p.mu.Unlock()
+	if !ok || bcrypt.CompareHashAndPassword([]byte(user.hash), []byte(c.Password)) != nil {
+		return User{}, ErrUnrecognized
+	}
+	return User{Name: c.Username, Service: user.service}, nil
+}
+
+func (p *FileProvider) load() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.users != nil && info.ModTime().Equal(p.modTime) {
+		return nil
+	}
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := map[string]fileUser{}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+			return errors.New("malformed line " + strconv.Itoa(lineNumber) + " in users file '" + p.path + "'")
+		}
+		user := fileUser{hash: fields[1]}
+		if len(fields) == 3 {
+			user.service = fields[2]
+		}
+		users[fields[0]] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	p.users, p.modTime = users, info.ModTime()
+	return nil
+}
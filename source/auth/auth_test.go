@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTokens(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	tokens := NewTokens([]byte("secret"), time.Hour)
+	tokens.Now = func() time.Time { return now }
+	token, expires, err := tokens.Issue(User{Name: "alice", Service: "shop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("token expires at %v, expected %v", expires, now.Add(time.Hour))
+	}
+	user, err := tokens.Authenticate(Credentials{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "alice" || user.Service != "shop" {
+		t.Errorf("token says user is %+v", user)
+	}
+
+	other := NewTokens([]byte("other secret"), time.Hour)
+	other.Now = tokens.Now
+	tests := []struct {
+		name     string
+		tokens   *Tokens
+		token    string
+		expected error
+	}{
+		{"wrong secret", other, token, ErrBadToken},
+		{"tampered", tokens, token[:len(token)-2] + "xx", ErrBadToken},
+		{"malformed", tokens, "not.a-token", ErrBadToken},
+	}
+	for _, test := range tests {
+		if _, err := test.tokens.Authenticate(Credentials{Token: test.token}); err != test.expected {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, test.expected)
+		}
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := tokens.Authenticate(Credentials{Token: token}); err != ErrExpiredToken {
+		t.Errorf("got error %v for expired token", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	tokens := NewTokens([]byte("secret"), time.Minute)
+	tokens.Now = func() time.Time { return now }
+	revoked, _, _ := tokens.Issue(User{Name: "alice"})
+	kept, _, _ := tokens.Issue(User{Name: "alice"})
+	if err := tokens.Revoke(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Authenticate(Credentials{Token: revoked}); err != ErrRevokedToken {
+		t.Errorf("got error %v for revoked token", err)
+	}
+	if _, err := tokens.Authenticate(Credentials{Token: kept}); err != nil {
+		t.Errorf("got error %v for token which wasn't revoked", err)
+	}
+	if err := tokens.Revoke(revoked); err != ErrRevokedToken {
+		t.Errorf("got error %v revoking token twice", err)
+	}
+	// Once the revoked token has expired, the hub can forget about it.
+	now = now.Add(time.Minute)
+	other, _, _ := tokens.Issue(User{Name: "bob"})
+	tokens.Revoke(other)
+	if len(tokens.revoked) != 1 {
+		t.Errorf("%d tokens remembered as revoked, expected 1", len(tokens.revoked))
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	write := func(contents string) {
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# Users\n\nalice:" + string(hash) + ":shop\nbob:" + string(hash) + "\n")
+	users, err := NewFileProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username, password, service string
+		expected                    error
+	}{
+		{"alice", "password", "shop", nil},
+		{"bob", "password", "", nil},
+		{"alice", "wrong", "", ErrUnrecognized},
+		{"carol", "password", "", ErrUnrecognized},
+	}
+	for _, test := range tests {
+		user, err := users.Authenticate(Credentials{Username: test.username, Password: test.password})
+		if err != test.expected || user.Service != test.service {
+			t.Errorf("%s/%s: got %+v and error %v", test.username, test.password, user, err)
+		}
+	}
+
+	// The file is read again when it changes.
+	write("carol:" + string(hash) + "\n")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if _, err := users.Authenticate(Credentials{Username: "carol", Password: "password"}); err != nil {
+		t.Errorf("got error %v after adding user", err)
+	}
+	if _, err := users.Authenticate(Credentials{Username: "alice", Password: "password"}); err != ErrUnrecognized {
+		t.Errorf("got error %v after removing user", err)
+	}
+
+	write("carol\n")
+	os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute))
+	if _, err := users.Authenticate(Credentials{Username: "carol", Password: "password"}); err == nil {
+		t.Errorf("no error from malformed users file")
+	}
+}
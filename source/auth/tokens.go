@@ -0,0 +1,155 @@
+package auth
+
+// Signed bearer tokens, in the form of JSON Web Tokens signed with HMAC-SHA256. The hub issues one
+// to a user who logs in over HTTP, and then checks the signature and expiry of the token sent with
+// each request rather than a password.
+//
+// A token can be revoked before it expires, e.g. when the user logs out. The hub only needs to
+// remember that a token has been revoked until it would have expired anyway, so the list of revoked
+// tokens is kept in memory and pruned as they expire. It's forgotten if the hub is restarted, which
+// is one reason to keep the lifetime of the tokens short.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadToken     = errors.New("the token is malformed or wasn't signed by this hub")
+	ErrExpiredToken = errors.New("the token has expired")
+	ErrRevokedToken = errors.New("the token has been revoked")
+)
+
+type Tokens struct {
+	secret   []byte
+	lifetime time.Duration
+	Now      func() time.Time // The clock, which can be replaced to test expiry.
+	mu       sync.Mutex
+	revoked  map[string]time.Time // The IDs of the revoked tokens, with when they would have expired.
+}
+
+func NewTokens(secret []byte, lifetime time.Duration) *Tokens {
+	return &Tokens{secret: secret, lifetime: lifetime, Now: time.Now, revoked: map[string]time.Time{}}
+}
+
+type claims struct {
+	Subject   string `json:"sub"`
+	Service   string `json:"svc,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// The header is always the same, since we only make one kind of token.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Changes the lifetime of the tokens issued from now on.
+func (t *Tokens) SetLifetime(lifetime time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lifetime = lifetime
+}
+
+// Issues a token saying who the user is, returning it and when it expires.
+func (t *Tokens) Issue(user User) (string, time.Time, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", time.Time{}, err
+	}
+	t.mu.Lock()
+	lifetime := t.lifetime
+	t.mu.Unlock()
+	now := t.Now()
+	expires := now.Add(lifetime)
+	payload, err := json.Marshal(claims{Subject: user.Name, Service: user.Service, IssuedAt: now.Unix(),
+		ExpiresAt: expires.Unix(), ID: hex.EncodeToString(id)})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + t.sign(unsigned), expires, nil
+}
+
+func (t *Tokens) Authenticate(c Credentials) (User, error) {
+	cl, err := t.verify(c.Token)
+	if err != nil {
+		return User{}, err
+	}
+	return User{Name: cl.Subject, Service: cl.Service}, nil
+}
+
+// Revokes a token, which must be a valid one, since otherwise there'd be nothing to revoke.
+func (t *Tokens) Revoke(token string) error {
+	cl, err := t.verify(token)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.Now()
+	for id, expires := range t.revoked {
+		if now.Unix() >= expires.Unix() {
+			delete(t.revoked, id)
+		}
+	}
+	t.revoked[cl.ID] = time.Unix(cl.ExpiresAt, 0)
+	return nil
+}
+
+func (t *Tokens) verify(token string) (claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader ||
+		!hmac.Equal([]byte(parts[2]), []byte(t.sign(parts[0]+"."+parts[1]))) {
+		return claims{}, ErrBadToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims{}, ErrBadToken
+	}
+	var cl claims
+	if err := json.Unmarshal(payload, &cl); err != nil {
+		return claims{}, ErrBadToken
+	}
+	if t.Now().Unix() >= cl.ExpiresAt {
+		return claims{}, ErrExpiredToken
+	}
+	t.mu.Lock()
+	_, revoked := t.revoked[cl.ID]
+	t.mu.Unlock()
+	if revoked {
+		return claims{}, ErrRevokedToken
+	}
+	return cl, nil
+}
+
+func (t *Tokens) sign(s string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Reads the secret the tokens are signed with from the file, or if there is no such file, makes
+// a new secret and writes it there, so that the tokens a hub issues survive restarting it.
+func LoadOrCreateSecret(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(contents)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, os.WriteFile(path, []byte(hex.EncodeToString(secret)+"\n"), 0600)
+}
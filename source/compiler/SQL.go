@@ -1,8 +1,11 @@
 package compiler
 
 import (
+	"database/sql"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/tim-hardcastle/Pipefish/source/values"
 
@@ -15,79 +18,312 @@ import (
 // So when this works properly we can write that bit of the hub entirely in Charm and dispense with the
 // 'database.go' file.
 
-func (vm *Vm) evalPostSQL(query string, pfArgs []values.Value) values.Value {
-	goArgs := pfToGoPointers(pfArgs)
+// The types we can put into and get out of the database are `int`, `float`, `bool`, `string` and
+// `varchar`, and any of these with `?` to make the column nullable; enums, which we write by name and
+// read either by name or by ordinal; clones of any of these, which are stored as their parent types;
+// and the `Time` struct, which is stored as a timestamp.
 
-	_, err := (vm.Database).Exec(query, goArgs...)
-	if err != nil {
-		return values.Value{values.ERROR, nil}
+// What we need from a `*sql.DB` or a `*sql.Tx`.
+type sqlRunner interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// A snippet such as `SQL(analytics) ---` goes to the database of that name, otherwise to the service's
+// own database; inside a `transaction` block the queries to the service's own database go through the
+// transaction, and those to named databases go straight to them. Returns false if there's no such database.
+func (vm *Vm) sqlRunner(database string) (sqlRunner, bool) {
+	if database != "" {
+		db, ok := vm.NamedDatabases[database]
+		return db, ok && db != nil
+	}
+	if vm.transaction != nil {
+		return vm.transaction, true
+	}
+	return vm.Database, vm.Database != nil
+}
+
+func (vm *Vm) noDatabaseError(database string, tokLoc uint32) values.Value {
+	if database != "" {
+		return vm.makeError("sql/exists/named", tokLoc, database)
 	}
+	return vm.makeError("sql/exists", tokLoc)
+}
+
+// Starts the transaction of a `transaction` block, or if we're already inside one, makes a savepoint
+// so that the inner block can be rolled back without rolling back the outer one.
+func (vm *Vm) beginTransaction(tokLoc uint32) values.Value {
+	if vm.Database == nil {
+		return vm.makeError("sql/exists", tokLoc)
+	}
+	if vm.transactionDepth == 0 {
+		tx, err := vm.Database.Begin()
+		if err != nil {
+			return vm.makeError("sql/transaction", tokLoc, "begin", err.Error())
+		}
+		vm.transaction = tx
+	} else {
+		if _, err := vm.transaction.Exec("SAVEPOINT " + savepointName(vm.transactionDepth)); err != nil {
+			return vm.makeError("sql/transaction", tokLoc, "begin", err.Error())
+		}
+	}
+	vm.transactionDepth++
 	return values.Value{values.SUCCESSFUL_VALUE, nil}
 }
 
-func (vm *Vm) evalGetSQL(structTypeNumber values.ValueType, query string, pfArgs []values.Value) values.Value {
-	goArgs := pfToGoPointers(pfArgs)
-	rows, err := (vm.Database).Query(query, goArgs...)
-	if err != nil {
-		return values.Value{values.ERROR, nil}
+// Ends the innermost `transaction` block, given the value its body returned: if this is an error
+// we roll back and return it, otherwise we commit.
+func (vm *Vm) endTransaction(result values.Value, tokLoc uint32) values.Value {
+	if result.T == values.ERROR {
+		vm.closeTransaction(false)
+		return result
 	}
-	defer rows.Close()
+	if err := vm.closeTransaction(true); err != nil {
+		return vm.makeError("sql/transaction", tokLoc, "commit", err.Error())
+	}
+	return values.Value{values.SUCCESSFUL_VALUE, nil}
+}
 
-	targetStrings := []string{} // TODO --- can we set this up on initialization?
-	targetInts := []int{}
-	targetBools := []bool{}
-	pointerList := []any{}
-	for _, v := range vm.ConcreteTypeInfo[structTypeNumber].(StructType).AbstractStructFields {
-		switch {
-		case v.Contains(values.INT):
-			targetInts = append(targetInts, 0)
-			pointerList = append(pointerList, &targetInts[len(targetInts)-1])
-		case v.Contains(values.BOOL):
-			targetBools = append(targetBools, false)
-			pointerList = append(pointerList, &targetBools[len(targetBools)-1])
-		case v.Contains(values.STRING):
-			targetStrings = append(targetStrings, "")
-			pointerList = append(pointerList, &targetStrings[len(targetStrings)-1])
-		default:
-			return values.Value{values.ERROR, nil}
+func (vm *Vm) closeTransaction(commit bool) error {
+	vm.transactionDepth--
+	if vm.transactionDepth == 0 {
+		tx := vm.transaction
+		vm.transaction = nil
+		if commit {
+			return tx.Commit()
 		}
+		return tx.Rollback()
 	}
+	savepoint := savepointName(vm.transactionDepth)
+	if !commit {
+		if _, err := vm.transaction.Exec("ROLLBACK TO SAVEPOINT " + savepoint); err != nil {
+			return err
+		}
+	}
+	_, err := vm.transaction.Exec("RELEASE SAVEPOINT " + savepoint)
+	return err
+}
 
+// Rolls back any transactions still open above the given depth, for when a run is abandoned halfway.
+func (vm *Vm) abandonTransactions(depth int) {
+	for vm.transactionDepth > depth {
+		vm.closeTransaction(false)
+	}
+}
+
+func savepointName(depth int) string {
+	return "pipefish_" + strconv.Itoa(depth)
+}
+
+func (vm *Vm) evalPostSQL(database, query string, pfArgs []values.Value, tokLoc uint32) values.Value {
+	runner, ok := vm.sqlRunner(database)
+	if !ok {
+		return vm.noDatabaseError(database, tokLoc)
+	}
+	goArgs, errVal := vm.pfToSqlArgs(pfArgs, tokLoc)
+	if errVal.T == values.ERROR {
+		return errVal
+	}
+	_, err := runner.Exec(query, goArgs...)
+	if err != nil {
+		return vm.makeError("sql/out", tokLoc, err.Error())
+	}
+	return values.Value{values.SUCCESSFUL_VALUE, nil}
+}
+
+// Returns a list of values of the given struct type, one for each row returned by the query.
+func (vm *Vm) evalGetSQL(target values.AbstractType, database, query string, pfArgs []values.Value, tokLoc uint32) values.Value {
+	if len(target.Types) != 1 || !vm.ConcreteTypeInfo[target.Types[0]].IsStruct() {
+		return vm.makeError("sql/in/type/a", tokLoc, vm.DescribeAbstractType(target, LITERAL))
+	}
+	structTypeNumber := target.Types[0]
+	structInfo := vm.ConcreteTypeInfo[structTypeNumber].(StructType)
+	runner, ok := vm.sqlRunner(database)
+	if !ok {
+		return vm.noDatabaseError(database, tokLoc)
+	}
+	goArgs, errVal := vm.pfToSqlArgs(pfArgs, tokLoc)
+	if errVal.T == values.ERROR {
+		return errVal
+	}
+	rows, err := runner.Query(query, goArgs...)
+	if err != nil {
+		return vm.makeError("sql/in/read", tokLoc, err.Error())
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return vm.makeError("sql/in/read", tokLoc, err.Error())
+	}
+	if len(columns) != len(structInfo.AbstractStructFields) {
+		return vm.makeError("sql/in/columns", tokLoc, len(columns), vm.DescribeType(structTypeNumber, LITERAL), len(structInfo.AbstractStructFields))
+	}
+	targets := make([]any, len(columns))
+	pointerList := make([]any, len(columns))
+	for i := range targets {
+		pointerList[i] = &targets[i]
+	}
 	vec := vector.Empty
 	for rows.Next() {
 		if err := rows.Scan(pointerList...); err != nil {
-			return values.Value{values.ERROR, nil}
-		}
-		fields := make([]values.Value, 0, len(pointerList))
-		for _, p := range pointerList {
-			var pfVal values.Value
-			if p == nil {
-				pfVal = values.Value{values.NULL, nil}
-			} else {
-				switch goValue := p.(type) {
-				case *string:
-					pfVal = values.Value{values.STRING, *goValue}
-				case *int:
-					pfVal = values.Value{values.INT, *goValue}
-				case *bool:
-					pfVal = values.Value{values.BOOL, *goValue}
-				default:
-					return values.Value{values.ERROR, nil}
-				}
+			return vm.makeError("sql/in/scan", tokLoc, err.Error())
+		}
+		fields := make([]values.Value, 0, len(targets))
+		for i, goValue := range targets {
+			pfVal, ok := vm.sqlToPf(goValue, structInfo.AbstractStructFields[i])
+			if !ok {
+				return vm.makeError("sql/in/type/b", tokLoc, columns[i], describeSqlValue(goValue), vm.DescribeAbstractType(structInfo.AbstractStructFields[i], LITERAL))
 			}
 			fields = append(fields, pfVal)
 		}
 		vec = vec.Conj(values.Value{structTypeNumber, fields})
 	}
+	if err := rows.Err(); err != nil {
+		return vm.makeError("sql/in/read", tokLoc, err.Error())
+	}
 	return values.Value{values.LIST, vec}
 }
 
+// Converts a value scanned from the database into a value of one of the types of the abstract type.
+func (vm *Vm) sqlToPf(goValue any, pfType values.AbstractType) (values.Value, bool) {
+	if goValue == nil {
+		return values.Value{values.NULL, nil}, pfType.Contains(values.NULL)
+	}
+	for _, ty := range pfType.Types {
+		if result, ok := vm.sqlToConcreteType(goValue, ty, pfType.Varchar); ok {
+			return result, true
+		}
+	}
+	return values.UNDEF, false
+}
+
+func (vm *Vm) sqlToConcreteType(goValue any, ty values.ValueType, varchar uint32) (values.Value, bool) {
+	if bytes, ok := goValue.([]byte); ok {
+		goValue = string(bytes)
+	}
+	switch typeInfo := vm.ConcreteTypeInfo[ty].(type) {
+	case EnumType:
+		switch goValue := goValue.(type) {
+		case string:
+			for i, el := range typeInfo.ElementNames {
+				if el == goValue {
+					return values.Value{ty, i}, true
+				}
+			}
+			// An ordinal in a column with text affinity, as in SQLite.
+			if i, err := strconv.Atoi(goValue); err == nil && 0 <= i && i < len(typeInfo.ElementNames) {
+				return values.Value{ty, i}, true
+			}
+		case int64:
+			if 0 <= goValue && goValue < int64(len(typeInfo.ElementNames)) {
+				return values.Value{ty, int(goValue)}, true
+			}
+		}
+		return values.UNDEF, false
+	case CloneType:
+		result, ok := vm.sqlToConcreteType(goValue, typeInfo.Parent, DUMMY)
+		result.T = ty
+		return result, ok
+	case StructType:
+		if !vm.isTimeType(ty) {
+			return values.UNDEF, false
+		}
+		switch goValue := goValue.(type) {
+		case time.Time:
+			return vm.goTimeToPf(goValue, ty), true
+		case string:
+			for _, layout := range sqlTimeLayouts {
+				if t, err := time.Parse(layout, goValue); err == nil {
+					return vm.goTimeToPf(t, ty), true
+				}
+			}
+		}
+		return values.UNDEF, false
+	}
+	switch ty {
+	case values.INT:
+		if i, ok := goValue.(int64); ok {
+			return values.Value{values.INT, int(i)}, true
+		}
+	case values.FLOAT:
+		switch goValue := goValue.(type) {
+		case float64:
+			return values.Value{values.FLOAT, goValue}, true
+		case int64:
+			return values.Value{values.FLOAT, float64(goValue)}, true
+		case string: // Some drivers return NUMERIC and DECIMAL columns as strings.
+			if f, err := strconv.ParseFloat(goValue, 64); err == nil {
+				return values.Value{values.FLOAT, f}, true
+			}
+		}
+	case values.BOOL:
+		switch goValue := goValue.(type) {
+		case bool:
+			return values.Value{values.BOOL, goValue}, true
+		case int64: // As in SQLite and MySQL.
+			if goValue == 0 || goValue == 1 {
+				return values.Value{values.BOOL, goValue == 1}, true
+			}
+		}
+	case values.STRING:
+		if s, ok := goValue.(string); ok && (varchar >= DUMMY || utf8.RuneCountInString(s) <= int(varchar)) {
+			return values.Value{values.STRING, s}, true
+		}
+	}
+	return values.UNDEF, false
+}
+
+// The layouts in which the drivers which return timestamps as text might return them.
+var sqlTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05.999999999", "2006-01-02"}
+
+func describeSqlValue(goValue any) string {
+	switch goValue := goValue.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return strconv.Quote(string(goValue))
+	case string:
+		return strconv.Quote(goValue)
+	case int64:
+		return strconv.FormatInt(goValue, 10)
+	case float64:
+		return strconv.FormatFloat(goValue, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(goValue)
+	case time.Time:
+		return goValue.Format(time.RFC3339Nano)
+	}
+	return "value"
+}
+
+// The `Time` struct is defined in `builtins.pf`.
+func (vm *Vm) isTimeType(ty values.ValueType) bool {
+	structInfo, ok := vm.ConcreteTypeInfo[ty].(StructType)
+	return ok && structInfo.Name == "Time" && structInfo.isMandatoryImport()
+}
+
+func (vm *Vm) goTimeToPf(t time.Time, ty values.ValueType) values.Value {
+	return values.Value{ty, []values.Value{{values.INT, t.Year()}, {values.INT, int(t.Month())}, {values.INT, t.Day()},
+		{values.INT, t.Hour()}, {values.INT, t.Minute()}, {values.INT, t.Second()}, {values.INT, t.Nanosecond()},
+		{values.STRING, t.Location().String()}}}
+}
+
+func pfTimeToGo(v values.Value) (time.Time, bool) {
+	fields := v.V.([]values.Value)
+	location, err := time.LoadLocation(fields[7].V.(string))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Date(fields[0].V.(int), time.Month(fields[1].V.(int)), fields[2].V.(int), fields[3].V.(int),
+		fields[4].V.(int), fields[5].V.(int), fields[6].V.(int), location), true
+}
+
 func (vm *Vm) getSqlSig(pfStructType values.ValueType) (string, bool) {
 	var buf strings.Builder
 	buf.WriteString("(")
 	sep := ""
 	for i, v := range vm.ConcreteTypeInfo[pfStructType].(StructType).AbstractStructFields {
-		sqlType := getSqlType(v)
+		sqlType := vm.getSqlType(v)
 		if sqlType == "" {
 			return "", false
 		}
@@ -101,53 +337,88 @@ func (vm *Vm) getSqlSig(pfStructType values.ValueType) (string, bool) {
 	return buf.String(), true
 }
 
-func getSqlType(pfType values.AbstractType) string {
-	switch {
-	case pfType.Equals(values.AbstractType{[]values.ValueType{values.INT}, 0}):
-		return "INTEGER NOT NULL"
-	case pfType.Equals((values.AbstractType{[]values.ValueType{values.NULL, values.INT}, 0})):
-		return "INTEGER"
-	case pfType.Equals(values.AbstractType{[]values.ValueType{values.STRING}, DUMMY}):
-		return "STRING NOT NULL"
-	case pfType.Equals(values.AbstractType{[]values.ValueType{values.NULL, values.STRING}, DUMMY}):
-		return "STRING"
-	case pfType.IsVarchar():
-		return "VARCHAR(" + strconv.Itoa(int(pfType.Varchar)) + ") NOT NULL"
-	case pfType.IsVarcharOrNull():
-		return "VARCHAR(" + strconv.Itoa(int(pfType.Varchar)) + ")"
-	case pfType.Equals(values.AbstractType{[]values.ValueType{values.BOOL}, 0}):
-		return "BOOL NOT NULL"
-	case pfType.Equals(values.AbstractType{[]values.ValueType{values.NULL, values.BOOL}, 0}):
-		return "BOOL"
-	default:
+func (vm *Vm) getSqlType(pfType values.AbstractType) string {
+	nullability := " NOT NULL"
+	if pfType.Contains(values.NULL) {
+		nullability = ""
+		pfType = pfType.Without(values.AbstractType{[]values.ValueType{values.NULL}, 0})
+	}
+	if len(pfType.Types) != 1 {
+		return ""
+	}
+	ty := pfType.Types[0]
+	if cloneInfo, ok := vm.ConcreteTypeInfo[ty].(CloneType); ok {
+		ty = cloneInfo.Parent
+	}
+	switch typeInfo := vm.ConcreteTypeInfo[ty].(type) {
+	case EnumType:
+		longest := 0
+		for _, el := range typeInfo.ElementNames {
+			longest = max(longest, utf8.RuneCountInString(el))
+		}
+		return "VARCHAR(" + strconv.Itoa(longest) + ")" + nullability
+	case StructType:
+		if vm.isTimeType(ty) {
+			return "TIMESTAMP" + nullability
+		}
 		return ""
 	}
+	switch ty {
+	case values.INT:
+		return "INTEGER" + nullability
+	case values.FLOAT:
+		return "DOUBLE PRECISION" + nullability
+	case values.BOOL:
+		return "BOOL" + nullability
+	case values.STRING:
+		if pfType.Varchar < DUMMY {
+			return "VARCHAR(" + strconv.Itoa(int(pfType.Varchar)) + ")" + nullability
+		}
+		return "STRING" + nullability
+	}
+	return ""
 }
 
-func pfToGoPointers(pfValues []values.Value) []any {
+// The values to be injected into the query of an SQL snippet.
+func (vm *Vm) sqlInjections(bindle *SnippetBindle) []values.Value {
+	injector := make([]values.Value, 0, len(bindle.valueLocs))
+	for i := 1; i < len(bindle.valueLocs); i = i + 2 {
+		injector = append(injector, vm.Mem[bindle.valueLocs[i]])
+	}
+	return injector
+}
+
+// Converts the values injected into a snippet into values for the database driver, or returns an
+// error if one of them can't be converted.
+func (vm *Vm) pfToSqlArgs(pfValues []values.Value, tokLoc uint32) ([]any, values.Value) {
 	goValues := make([]any, 0, len(pfValues))
 	for _, pfV := range pfValues {
-		result := getGoValue(pfV)
-		if result == nil {
-			goValues = append(goValues, nil)
-		} else {
-			goValues = append(goValues, &result)
+		result, ok := vm.pfToSql(pfV)
+		if !ok {
+			return nil, vm.makeError("sql/out/type", tokLoc, vm.DescribeType(pfV.T, LITERAL))
 		}
+		goValues = append(goValues, result)
 	}
-	return goValues
+	return goValues, values.OK
 }
 
-func getGoValue(pfValue values.Value) any {
+func (vm *Vm) pfToSql(pfValue values.Value) (any, bool) {
+	switch typeInfo := vm.ConcreteTypeInfo[pfValue.T].(type) {
+	case EnumType:
+		return typeInfo.ElementNames[pfValue.V.(int)], true
+	case CloneType:
+		return vm.pfToSql(values.Value{typeInfo.Parent, pfValue.V})
+	case StructType:
+		if vm.isTimeType(pfValue.T) {
+			return pfTimeToGo(pfValue)
+		}
+		return nil, false
+	}
 	switch pfValue.T {
 	case values.NULL:
-		return nil
-	case values.STRING:
-		return pfValue.V.(string)
-	case values.INT:
-		return pfValue.V.(int)
-	case values.BOOL:
-		return pfValue.V.(bool)
-	default:
-		return nil
+		return nil, true
+	case values.STRING, values.INT, values.BOOL, values.FLOAT:
+		return pfValue.V, true
 	}
+	return nil, false
 }
@@ -1,35 +1,61 @@
 package compiler
 
 import (
+	"errors"
+	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/tim-hardcastle/Pipefish/source/ast"
+
 	"github.com/tim-hardcastle/Pipefish/source/err"
 	"github.com/tim-hardcastle/Pipefish/source/p2p"
 	"github.com/tim-hardcastle/Pipefish/source/settings"
+	"github.com/tim-hardcastle/Pipefish/source/text"
 	"github.com/tim-hardcastle/Pipefish/source/token"
 	"github.com/tim-hardcastle/Pipefish/source/values"
 )
 
 // We have two types of external service, defined below: one for services on the same hub, one for services on
-// a different hub.
+// a different hub. The error returned by `evaluate` is for when the call couldn't be made at all: if the external
+// service returns an error value, then that's the value.
 type ExternalCallHandler interface {
-	evaluate(mc *Vm, line string) values.Value
+	evaluate(mc *Vm, call *externalCall) (values.Value, error)
 
 	problem() *err.Error
-	GetAPI() string
+	GetAPI() (string, error)
 }
 
 type ExternalCallToHubHandler struct {
 	ExternalServiceCp *Compiler
+	Namespace         string   // The namespace of the stub of the external service in the calling service, e.g. "foo.".
+	UseLiterals       bool     // Whether to send every call as a line of Pipefish, as to another hub.
+	link              *hubLink // A pointer, since the handler is kept by value.
+}
+
+func NewExternalCallToHubHandler(externalServiceCp *Compiler, namespace string) ExternalCallToHubHandler {
+	return ExternalCallToHubHandler{ExternalServiceCp: externalServiceCp, Namespace: namespace, link: &hubLink{}}
 }
 
-// There is a somewhat faster way of doing this when the services are on the same hub, since we would just need
-// to change the type numbers. TODO. Until then, this serves as a good test bed for the external services on other hubs.
-func (ex ExternalCallToHubHandler) evaluate(mc *Vm, line string) values.Value {
-	exVal := ex.ExternalServiceCp.Do(line)
+// Since the services are on the same hub, we can usually give the values to the external service directly
+// (see `hubLink`); when we can't, the call goes as a line of Pipefish, and the result comes back as one.
+// Either way, the call takes turns with anything else using the external service's vm, such as the
+// HTTP requests the hub gives it, and is subject to the context of the call which made it.
+func (ex ExternalCallToHubHandler) evaluate(mc *Vm, call *externalCall) (values.Value, error) {
+	ctx, cancel := mc.callContext()
+	defer cancel()
+	if lock := ex.ExternalServiceCp.Vm.Lock; lock != nil {
+		defer lock()()
+	}
+	if !ex.UseLiterals && ex.link != nil {
+		if result, ok := ex.link.call(ctx, mc, ex.ExternalServiceCp, ex.Namespace, call); ok {
+			return result, nil
+		}
+	}
+	exVal := ex.ExternalServiceCp.DoContext(ctx, mc.literalCall(call))
 	serialize := ex.ExternalServiceCp.Vm.Literal(exVal)
-	return mc.OwningCompiler.Do(serialize)
+	return mc.OwningCompiler.Do(serialize), nil
 }
 
 func (es ExternalCallToHubHandler) problem() *err.Error {
@@ -39,38 +65,117 @@ func (es ExternalCallToHubHandler) problem() *err.Error {
 	return nil
 }
 
-func (es ExternalCallToHubHandler) GetAPI() string {
-	return es.ExternalServiceCp.SerializeApi()
+func (es ExternalCallToHubHandler) GetAPI() (string, error) {
+	return es.ExternalServiceCp.SerializeApi(), nil
+}
+
+// Stands in for an external service while the service using it is tested, calling the stub service for the
+// functions and commands it defines, and returning an `UnscriptedError` for the rest. Its API is the
+// serialized API of the real service, if that was saved with the stub, so that the service using it
+// compiles just as it would with the real one.
+type ExternalStubHandler struct {
+	Stub ExternalCallToHubHandler
+	API  string // The serialized API of the real service, or "" to use the stub's own.
+}
+
+func NewExternalStubHandler(stubCp *Compiler, namespace, api string) ExternalStubHandler {
+	return ExternalStubHandler{Stub: NewExternalCallToHubHandler(stubCp, namespace), API: api}
+}
+
+func (es ExternalStubHandler) evaluate(mc *Vm, call *externalCall) (values.Value, error) {
+	if call.namespace == "" && !es.Stub.ExternalServiceCp.HasApiFunction(call.name) {
+		return values.Value{}, &UnscriptedError{Function: call.name}
+	}
+	return es.Stub.evaluate(mc, call)
+}
+
+func (es ExternalStubHandler) problem() *err.Error {
+	return es.Stub.problem()
+}
+
+func (es ExternalStubHandler) GetAPI() (string, error) {
+	if es.API == "" {
+		return es.Stub.GetAPI()
+	}
+	return es.API, nil
+}
+
+// Returned by a stub when it's asked for something it has no response to.
+type UnscriptedError struct {
+	Function string
+}
+
+func (e *UnscriptedError) Error() string {
+	return "no response has been scripted for " + e.Function
 }
 
 type ExternalHttpCallHandler struct {
-	Host     string
-	Service  string
-	Username string
-	Password string
+	Host      string
+	Service   string
+	Namespace string       // As for `ExternalCallToHubHandler`, for decoding the values the hub sends.
+	Session   *p2p.Session // Which logs on to the hub if it's administered, and retries and times out the calls.
 }
 
-func (es ExternalHttpCallHandler) evaluate(mc *Vm, line string) values.Value {
+// Calls to functions may be retried, since they have no side-effects; calls to commands aren't,
+// since the hub may have done the command before the connection failed. We ask for the result in
+// the wire format, and if the hub can't send it that way, then it comes back as a literal.
+func (es ExternalHttpCallHandler) evaluate(mc *Vm, call *externalCall) (values.Value, error) {
+	line := mc.literalCall(call)
 	if settings.SHOW_XCALLS {
 		println("Line is", line)
 	}
-	exValAsString := p2p.Do(es.Host, line, es.Username, es.Password)
+	reply, e := es.Session.DoForValue(line, !call.isCommand)
+	if e != nil {
+		return values.Value{}, e
+	}
+	if reply.Value != nil {
+		val, e := mc.DecodeValue(reply.Value, es.Namespace)
+		if e != nil {
+			return values.Value{}, &p2p.Error{Kind: p2p.ErrResponse, Host: es.Host, Detail: e.Error()}
+		}
+		return val, nil
+	}
 	if settings.SHOW_XCALLS {
-		println("Returned string is", exValAsString)
+		println("Returned string is", reply.Literal)
 	}
-	val := mc.OwningCompiler.Do(exValAsString)
+	val := mc.OwningCompiler.Do(reply.Literal)
 	if settings.SHOW_XCALLS {
 		println("Value is", mc.DefaultDescription(val))
 	}
-	return val
+	return val, nil
 }
 
 func (es ExternalHttpCallHandler) problem() *err.Error {
 	return nil
 }
 
-func (es ExternalHttpCallHandler) GetAPI() string {
-	return p2p.Do(es.Host, "hub serialize \""+es.Service+"\"", es.Username, es.Password)
+func (es ExternalHttpCallHandler) GetAPI() (string, error) {
+	return es.Session.Do("hub serialize \""+es.Service+"\"", true)
+}
+
+// Turns the error from a failed call to an external service into a Pipefish error, whose id
+// says whether the hub couldn't be reached, refused the credentials, or returned an error value.
+func externalError(e error, service string, tok *token.Token) *err.Error {
+	var p2pError *p2p.Error
+	var remoteError *p2p.RemoteError
+	var unscriptedError *UnscriptedError
+	var result *err.Error
+	switch {
+	case errors.As(e, &unscriptedError):
+		result = err.CreateErr("ext/unscripted", tok, service, unscriptedError.Function)
+	case errors.As(e, &remoteError):
+		result = err.CreateErr("ext/remote", tok, service, remoteError.ErrorId, remoteError.Message)
+	case errors.As(e, &p2pError) && p2pError.Kind == p2p.ErrRejected:
+		result = err.CreateErr("ext/rejected", tok, service, p2pError.Host, p2pError.Detail)
+	case errors.As(e, &p2pError) && p2pError.Kind == p2p.ErrResponse:
+		result = err.CreateErr("ext/response", tok, service, p2pError.Host, p2pError.Detail)
+	case errors.As(e, &p2pError):
+		result = err.CreateErr("ext/unreachable", tok, service, p2pError.Host, p2pError.Detail)
+	default:
+		result = err.CreateErr("ext/unreachable", tok, service, "", e.Error())
+	}
+	result.Trace = []*token.Token{tok}
+	return result
 }
 
 // For a description of the file format, see README-api-serialization.md
@@ -109,23 +214,38 @@ func (cp *Compiler) SerializeApi() string {
 		}
 	}
 
-	var nativeAbstractTypes = []string{"any", "struct", "snippet"}
-
-	for i := len(nativeAbstractTypes); i < len(cp.Vm.AbstractTypes); i++ {
-		ty := cp.Vm.AbstractTypes[i]
+	// The builtin abstract types, the ones named after concrete types, and the nullable versions of
+	// all of them are made by the stub for itself, so we only serialize the ones the service declared.
+	concreteTypeNames := map[string]bool{}
+	for _, info := range cp.Vm.ConcreteTypeInfo {
+		concreteTypeNames[info.GetName(DEFAULT)] = true
+	}
+	for _, ty := range cp.Vm.AbstractTypes {
+		if _, ok := cp.P.Common.Types[ty.Name]; ok || concreteTypeNames[ty.Name] || strings.HasSuffix(ty.Name, "?") {
+			continue
+		}
 		if !(cp.IsPrivate(ty.AT)) && !ty.IsMandatoryImport() {
 			buf.WriteString("ABSTRACT | ")
 			buf.WriteString(ty.Name)
 			buf.WriteString(" | ")
 			buf.WriteString(cp.serializeAbstractType(ty.AT))
+			buf.WriteString("\n")
 		}
-		buf.WriteString("\n")
 	}
 
-	for name, fns := range cp.P.FunctionTable {
-		for defOrCmd := 0; defOrCmd < 2; defOrCmd++ { // In the function table the commands and functions are all jumbled up. But we want the commands first, for neatness, so we'll do two passes.
-			for _, fn := range fns {
-				if fn.Private || settings.MandatoryImportSet().Contains(fn.Body.GetToken().Source) {
+	names := make([]string, 0, len(cp.P.FunctionTable)) // We sort the names so that the API is always serialized the same way.
+	for name := range cp.P.FunctionTable {
+		if !concreteTypeNames[name] { // Otherwise these are the constructors, which the stub also makes for itself.
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	// In the function table the commands and functions are all jumbled up. But the commands must come first,
+	// since the stub has only one section of each, so we'll do two passes.
+	for defOrCmd := 0; defOrCmd < 2; defOrCmd++ {
+		for _, name := range names {
+			for _, fn := range cp.P.FunctionTable[name] {
+				if !isApiFunction(fn) {
 					continue
 				}
 				if fn.Cmd {
@@ -157,6 +277,132 @@ func (cp *Compiler) SerializeApi() string {
 	return buf.String()
 }
 
+// Whether the function or command is part of the public API of the service.
+func isApiFunction(fn *ast.PrsrFunction) bool {
+	source := fn.Body.GetToken().Source
+	if source == "" && fn.Tok != nil { // Then it's a constructor, and we go by where the type was declared.
+		source = fn.Tok.Source
+	}
+	return !fn.Private && !settings.MandatoryImportSet().Contains(source)
+}
+
+// Returned when a function or command is called by name with arguments in JSON.
+var (
+	ErrNoSuchFunction     = errors.New("no public function or command of that name")
+	ErrNoMatchingOverload = errors.New("no public function or command of that name fits the arguments")
+)
+
+// Returns true if the service has a public function or command of the given name.
+func (cp *Compiler) HasApiFunction(name string) bool {
+	for _, fn := range cp.P.FunctionTable[name] {
+		if isApiFunction(fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the first of the public overloads of the function or command of the given name whose
+// signature fits the arguments, which are JSON as decoded by a `json.Decoder` with `UseNumber`
+// set, and converts the arguments to the types it expects. As the function table is in order
+// of specificity, this is the overload that dispatch would choose given the converted values.
+//
+// Functions with reference variables can't be called this way, since there's nothing for
+// the reference to refer to.
+func (cp *Compiler) MatchJsonArguments(name string, args []any) (*ast.PrsrFunction, []values.Value, error) {
+	fns, ok := cp.P.FunctionTable[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNoSuchFunction, text.Emph(name))
+	}
+	problems := []string{}
+	for _, fn := range fns {
+		if !isApiFunction(fn) {
+			continue
+		}
+		vals, e := cp.matchJsonArgumentsToSig(fn, args)
+		if e == nil {
+			return fn, vals, nil
+		}
+		problems = append(problems, e.Error())
+	}
+	if len(problems) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNoSuchFunction, text.Emph(name))
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrNoMatchingOverload, strings.Join(problems, "; "))
+}
+
+func (cp *Compiler) matchJsonArgumentsToSig(fn *ast.PrsrFunction, args []any) ([]values.Value, error) {
+	params := []int{}
+	for i, pair := range fn.NameSig {
+		switch {
+		case pair.VarType == "bling":
+		case pair.VarType == "ref":
+			return nil, errors.New(text.Emph(fn.NameSig.String()) + " has reference variables")
+		case strings.HasPrefix(pair.VarType, "...") && i != len(fn.NameSig)-1:
+			return nil, errors.New(text.Emph(fn.NameSig.String()) + " has variadic parameters before its end")
+		default:
+			params = append(params, i)
+		}
+	}
+	variadic := len(params) > 0 && strings.HasPrefix(fn.NameSig[params[len(params)-1]].VarType, "...")
+	if !(len(args) == len(params) || variadic && len(args) >= len(params)-1) {
+		return nil, errors.New(text.Emph(fn.NameSig.String()) + " takes " + strconv.Itoa(len(params)) + " arguments, not " + strconv.Itoa(len(args)))
+	}
+	vals := make([]values.Value, 0, len(args))
+	for i, arg := range args {
+		param := params[min(i, len(params)-1)]
+		v, e := cp.Vm.JsonToPipefish(arg, fn.Sig[param].VarType, "$["+strconv.Itoa(i)+"]")
+		if e != nil {
+			return nil, e
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+// Returns a line which calls the function with the values supplied, and the environment in
+// which to compile it, which binds the values to the names the line uses for them. As this
+// reserves memory, the caller should roll back the vm afterwards.
+func (cp *Compiler) MakeCallLine(fn *ast.PrsrFunction, vals []values.Value) (string, *Environment) {
+	env := NewEnvironment()
+	env.Ext = cp.GlobalVars
+	names := make([]string, len(vals))
+	for i, v := range vals {
+		names[i] = "jsonArgument" + strconv.Itoa(i)
+		cp.Reserve(v.T, v.V, fn.Tok)
+		cp.AddVariable(env, names[i], LOCAL_VARIABLE, AltType(v.T), fn.Tok)
+	}
+	var buf strings.Builder
+	if fn.Position == PREFIX || fn.Position == UNFIX {
+		buf.WriteString(fn.FName)
+	}
+	group := []string{}
+	writeGroup := func() {
+		if len(group) > 0 {
+			buf.WriteString(" (" + strings.Join(group, ", ") + ")")
+			group = group[:0]
+		}
+	}
+	arg := 0
+	for i, pair := range fn.NameSig {
+		switch {
+		case pair.VarType == "bling":
+			writeGroup()
+			buf.WriteString(" " + pair.VarName)
+		case i == len(fn.NameSig)-1 && strings.HasPrefix(pair.VarType, "..."):
+			group = append(group, names[arg:]...)
+		default:
+			group = append(group, names[arg])
+			arg++
+		}
+	}
+	writeGroup()
+	if fn.Position == SUFFIX {
+		buf.WriteString(" " + fn.FName)
+	}
+	return strings.TrimSpace(buf.String()), env
+}
+
 func (cp *Compiler) serializeAbstractType(ty values.AbstractType) string {
 	return strings.ReplaceAll(cp.Vm.DescribeAbstractType(ty, LITERAL), "/", " ")
 }
@@ -38,6 +38,7 @@ var BUILTINS = map[string]functionAndReturnType{
 	"get_from_external":         {(*Compiler).btGetFromSpecialSnippet, AltType(values.SUCCESSFUL_VALUE, values.ERROR)},
 	"get_from_input":            {(*Compiler).btGetFromInput, AltType(values.SUCCESSFUL_VALUE)},
 	"get_from_SQL":              {(*Compiler).btGetFromSpecialSnippet, AltType(values.SUCCESSFUL_VALUE, values.ERROR)},
+	"get_from_SQL_as":           {(*Compiler).btGetFromSQLAs, AltType(values.SUCCESSFUL_VALUE, values.ERROR)},
 	"gt_floats":                 {(*Compiler).btGtFloats, AltType(values.BOOL)},
 	"gte_floats":                {(*Compiler).btGteFloats, AltType(values.BOOL)},
 	"gt_ints":                   {(*Compiler).btGtInts, AltType(values.BOOL)},
@@ -45,6 +46,8 @@ var BUILTINS = map[string]functionAndReturnType{
 	"int_of_enum":               {(*Compiler).btIntOfEnum, AltType(values.INT)},
 	"int_of_float":              {(*Compiler).btIntOfFloat, AltType(values.INT)},
 	"int_of_string":             {(*Compiler).btIntOfString, AltType(values.ERROR, values.INT)},
+	"json_decode":               {(*Compiler).btJsonDecode, AltType()}, // Types have to be figured out at call site.
+	"json_encode":               {(*Compiler).btJsonEncode, AltType(values.ERROR, values.STRING)},
 	"keys_of_map":               {(*Compiler).btKeysOfMap, AltType(values.LIST)},
 	"keys_of_struct":            {(*Compiler).btKeysOfStruct, AltType(values.LIST)},
 	"label_of_string":           {(*Compiler).btLabelOfString, AltType(values.LABEL)},
@@ -200,6 +203,15 @@ func (cp *Compiler) btGetFromSpecialSnippet(tok *token.Token, dest uint32, args
 	cp.Emit(Asgm, dest, values.C_OK)
 }
 
+func (cp *Compiler) btGetFromSQLAs(tok *token.Token, dest uint32, args []uint32) {
+	cp.recordSqlReadAs(args[4], args[2])
+	cp.Emit(Gsql, cp.Vm.Mem[args[0]].V.(uint32), args[2], args[4], cp.reserveToken(tok))
+	cp.Emit(Qtyp, cp.Vm.Mem[args[0]].V.(uint32), uint32(values.ERROR), cp.CodeTop()+3)
+	cp.Emit(Asgm, dest, cp.Vm.Mem[args[0]].V.(uint32))
+	cp.Emit(Jmp, cp.CodeTop()+2)
+	cp.Emit(Asgm, dest, values.C_OK)
+}
+
 func (cp *Compiler) btGetFromInput(tok *token.Token, dest uint32, args []uint32) {
 	cp.Emit(Inpt, cp.Vm.Mem[args[0]].V.(uint32), args[2])
 	cp.Emit(Asgm, dest, values.C_OK)
@@ -233,6 +245,14 @@ func (cp *Compiler) btIntOfString(tok *token.Token, dest uint32, args []uint32)
 	cp.Emit(Ints, dest, args[0])
 }
 
+func (cp *Compiler) btJsonDecode(tok *token.Token, dest uint32, args []uint32) {
+	cp.Emit(Jsnd, dest, args[0], args[1], cp.reserveToken(tok))
+}
+
+func (cp *Compiler) btJsonEncode(tok *token.Token, dest uint32, args []uint32) {
+	cp.Emit(Jsne, dest, args[0], cp.reserveToken(tok))
+}
+
 func (cp *Compiler) btKeysOfMap(tok *token.Token, dest uint32, args []uint32) {
 	cp.Emit(KeyM, dest, args[0])
 }
@@ -351,7 +371,7 @@ func (cp *Compiler) btPostToOutput(tok *token.Token, dest uint32, args []uint32)
 }
 
 func (cp *Compiler) btPostSpecialSnippet(tok *token.Token, dest uint32, args []uint32) {
-	cp.Emit(Psnp, dest, args[0])
+	cp.Emit(Psnp, dest, args[0], cp.reserveToken(tok))
 }
 
 func (cp *Compiler) btPostToTerminal(tok *token.Token, dest uint32, args []uint32) {
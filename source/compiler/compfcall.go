@@ -41,6 +41,7 @@ type bindle struct {
 	access       CpAccess        // Whether the function call is coming from the REPL, the cmd section, etc.
 	override     bool            // A kludgy flag to pass back whether we have a forward declaration that would prevent constant folding.
 	libcall      bool            // Are we in a namespace?
+	caller       *Caller         // Who is calling, if the call is in something they typed into the REPL.
 	lowMem       uint32          // The lowest point in memory that the function uses. Hence the lowest point from which we could need to copy when putting memory on the recursionStack.
 }
 
@@ -69,6 +70,7 @@ func (cp *Compiler) createFunctionCall(argCompiler *Compiler, node ast.Callable,
 		types:        make(FiniteTupleType, len(args)),
 		access:       ac,
 		libcall:      libcall,
+		caller:       ctxt.Caller,
 		lowMem:       ctxt.LowMem, // Where the memory of the function we're compiling (if indeed we are) starts, and so the lowest point from which we may need to copy memory in case of recursion.
 	}
 	backtrackList := make([]uint32, len(args))
@@ -194,7 +196,7 @@ func (cp *Compiler) generateNewArgument(b *bindle) AlternateType {
 func (cp *Compiler) seekBling(b *bindle, bling string) AlternateType {
 	cp.cmP("Called seekBling.", b.tok)
 	for i, branch := range b.treePosition.Branch {
-		if branch.Type.Contains(values.BLING) {
+		if branch.Type.Contains(values.BLING) && branch.Bling == bling {
 			newBindle := *b
 			newBindle.branchNo = i
 			newBindle.varargsTime = false
@@ -597,6 +599,11 @@ func (cp *Compiler) seekFunctionCall(b *bindle) AlternateType {
 				cp.P.Throw("comp/private", b.tok)
 				return AltType(values.COMPILE_TIME_ERROR)
 			}
+			if !MayCall(b.caller, F.Access) {
+				cp.cmP("REPL trying to access a function the caller isn't permitted to. Returning error.", b.tok)
+				cp.P.Throw("comp/access", b.tok, b.caller.Name)
+				return AltType(values.COMPILE_TIME_ERROR)
+			}
 			// Deal with the case where the function is a builtin.
 			builtinTag := F.Builtin
 			functionAndType, ok := BUILTINS[builtinTag]
@@ -614,6 +621,8 @@ func (cp *Compiler) seekFunctionCall(b *bindle) AlternateType {
 						cp.Cm("Clone group is "+cp.TypeToCloneGroup[st].describe(cp.Vm), b.tok)
 						functionAndType.T = functionAndType.T.Union(cp.TypeToCloneGroup[st])
 					}
+				case "json_decode":
+					functionAndType.T = cp.Vm.AnyTypeScheme.Union(altType(values.ERROR))
 				case "first_in_tuple":
 					if len(b.types) == 0 {
 						functionAndType.T = altType(values.COMPILE_TIME_ERROR)
@@ -679,12 +688,17 @@ func (cp *Compiler) seekFunctionCall(b *bindle) AlternateType {
 			if F.Xcall != nil {
 				cp.cmP("Emitting xcall.", b.tok)
 				var remainingNamespace string
-				vmArgs := make([]uint32, 0, len(b.valLocs)+5)
+				vmArgs := make([]uint32, 0, len(b.valLocs)+7)
 				vmArgs = append(vmArgs, b.outLoc, F.Xcall.ExternalServiceOrdinal, F.Xcall.Position)
 				cp.Reserve(values.STRING, remainingNamespace, branch.Node.Fn.Body.GetToken())
 				vmArgs = append(vmArgs, cp.That())
 				cp.Reserve(values.STRING, F.Xcall.FunctionName, branch.Node.Fn.Body.GetToken())
 				vmArgs = append(vmArgs, cp.That())
+				isCommand := uint32(0)
+				if F.Command {
+					isCommand = 1
+				}
+				vmArgs = append(vmArgs, isCommand, cp.reserveToken(b.tok))
 				vmArgs = append(vmArgs, b.valLocs...)
 				cp.Emit(Extn, vmArgs...)
 				return F.RtnTypes
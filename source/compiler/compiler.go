@@ -1,6 +1,7 @@
 package compiler
 
 import (
+	"context"
 	"embed"
 	"errors"
 	"fmt"
@@ -39,13 +40,20 @@ type Compiler struct {
 	TypeToCloneGroup         map[values.ValueType]AlternateType // A map from any clonable or clone type to an alt type containing the parent type and its clones.
 	labelResolvingCompilers  []*Compiler                        // We use this to resolve the meaning of labels and enums.
 	TupleType                uint32                             // Location of a constant saying {TYPE, <type number of tuples>}, so that 'type (x tuple)' in the builtins has something to return. Query, why not just define 'type (x tuple) : tuple' ?
+	SourceTimestamps         map[string]int64                   // If the compiler was loaded from an image, the timestamps of all the sources it was compiled from; otherwise nil.
 
 	// Temporary state.
-	ThunkList       []ThunkData   // Records what thunks we made so we know what to unthunk at the top of the function.
-	RecursionStore  []BkRecursion // Places in the code where we need to go back and doctor it to make the recursion work for outer functions.
-	lambdaMemStarts []uint32      // A stack for the start (in memory, not code) of the lambda we're compiling so that if it turns out to be recursive we know the low bound of where to start saving memory from.
-	forData         [][]any       // A stack (one list for each nested 'for' loop) of lists of gotos etc generated by 'break' and 'continue'.
-	showCompile     bool          // Whether we show the internals of the compiler at compile time.
+	ThunkList       []ThunkData            // Records what thunks we made so we know what to unthunk at the top of the function.
+	RecursionStore  []BkRecursion          // Places in the code where we need to go back and doctor it to make the recursion work for outer functions.
+	lambdaMemStarts []uint32               // A stack for the start (in memory, not code) of the lambda we're compiling so that if it turns out to be recursive we know the low bound of where to start saving memory from.
+	forData         [][]any                // A stack (one list for each nested 'for' loop) of lists of gotos etc generated by 'break' and 'continue'.
+	loopsOutside    int                    // How many 'for' loops there are around the innermost 'transaction' block we're compiling, which 'break' and 'continue' mustn't leave.
+	showCompile     bool                   // Whether we show the internals of the compiler at compile time.
+	nodeTok         *token.Token           // The token of the node we're compiling, so that we can tell the debugger where each operation came from.
+	nodeTokNo       uint32                 // Its number in the vm's list of tokens, if we've put it there yet.
+	sqlSchemas      map[string]*sqlSchema  // The schemas the module imported for its databases, by the name of the database, "" being the service's own.
+	sqlSnippets     map[uint32]*sqlSnippet // The SQL snippets of the module by the number of their snippet factory, to be checked against the schemas.
+	snippetLocs     map[uint32]uint32      // The snippet factory which made the snippet at each location in memory, so 'get ... as' can find it.
 }
 
 // Initializes a compiler.
@@ -76,6 +84,7 @@ type Context struct {
 	Typecheck FiniteTupleType // The type(s) for the compiler to check for if isReturn is true; nil if no return types are defined.
 	LowMem    uint32          // Where the memory of the function we're compiling (if indeed we are) starts, and so the lowest point from which we may need to copy memory in case of recursion.
 	LogFlavor LogFlavor       // Whether we should be logging something and if so what.
+	Caller    *Caller         // Who is calling, if we're compiling something they typed into the REPL, so that we can check what it calls. (See permissions.go.)
 }
 
 // Unless we're going down a branch, we want the new context for each node compilation to have no forward type-checking.
@@ -101,9 +110,14 @@ const ( // We use this to keep track of what we're doing so we don't e.g. call a
 // It parses the line to an AST, initializes the context, calls `CompileNode` with the AST and the context
 // as arguments, runs the resulting code, rolls back the VM, and returns the value it got.
 func (cp *Compiler) Do(line string) values.Value {
+	return cp.DoContext(context.Background(), line)
+}
+
+// Like `Do`, but the line is run subject to the context.
+func (cp *Compiler) DoContext(ctx context.Context, line string) values.Value {
 	state := cp.GetState()
 	cT := cp.CodeTop()
-	node := cp.P.ParseLine("REPL input", line)
+	node := cp.P.ParseImperativeLine("REPL input", line)
 	if settings.SHOW_PARSER {
 		fmt.Println("Parsed line:", node.String())
 	}
@@ -117,8 +131,10 @@ func (cp *Compiler) Do(line string) values.Value {
 	}
 	cp.Emit(Ret)
 	cp.Cm("Calling Run from Do.", node.GetToken())
-	cp.Vm.Run(cT)
-	result := cp.Vm.Mem[cp.That()]
+	result, ok := cp.Vm.RunContext(ctx, cT)
+	if ok {
+		result = cp.Vm.Mem[cp.That()]
+	}
 	cp.Rollback(state, node.GetToken())
 	return result
 }
@@ -137,6 +153,9 @@ func (cp *Compiler) CompileNode(node ast.Node, ctxt Context) (AlternateType, boo
 	cT := cp.CodeTop()
 	env := ctxt.Env
 	ac := ctxt.Access
+	outerTok := cp.nodeTok
+	cp.nodeTok = node.GetToken()
+	defer func() { cp.nodeTok = outerTok }()
 NodeTypeSwitch:
 	switch node := node.(type) {
 	// Note that assignments in `given` blocks and var and const initialization are taken care of by the vmmaker, so we only have to deal with the cases where
@@ -781,6 +800,9 @@ NodeTypeSwitch:
 				cp.P.Throw("comp/break", node.GetToken())
 				break NodeTypeSwitch
 			}
+			if cp.leavesTransaction(node.GetToken()) {
+				break NodeTypeSwitch
+			}
 			rtnTypes, rtnConst = cp.CompileNode(node.Args[0], ctxt)
 			cp.addToForData(cp.vmBreakWithValue(cp.That()))
 			break
@@ -869,10 +891,26 @@ NodeTypeSwitch:
 		if node.GetToken().Type == token.EMDASH {
 			switch t := node.Args[0].(type) {
 			case *ast.TypeLiteral:
-				snF := cp.reserveSnippetFactory(t.Value, env, node, ctxt)
+				snF := cp.reserveSnippetFactory(t.Value, "", env, node, ctxt)
 				cp.put(MkSn, snF)
+				cp.noteSnippetLoc(snF)
 				rtnTypes, rtnConst = cp.TypeNameToTypeScheme[t.Value], false
 				break NodeTypeSwitch
+			case *ast.PrefixExpression: // Then it should be e.g. `SQL(analytics) ---`, naming the database.
+				if t.Operator != "SQL" || len(t.Args) != 1 {
+					cp.P.Throw("comp/snippet/database", t.GetToken())
+					break NodeTypeSwitch
+				}
+				dbName, ok := t.Args[0].(*ast.Identifier)
+				if !ok {
+					cp.P.Throw("comp/snippet/database", t.GetToken())
+					break NodeTypeSwitch
+				}
+				snF := cp.reserveSnippetFactory(t.Operator, dbName.Value, env, node, ctxt)
+				cp.put(MkSn, snF)
+				cp.noteSnippetLoc(snF)
+				rtnTypes, rtnConst = cp.TypeNameToTypeScheme[t.Operator], false
+				break NodeTypeSwitch
 			default:
 				cp.P.Throw("comp/snippet/type", node.Args[0].GetToken()) // There is no reason why this should be a first-class value, that would just be confusing. Hence the error.
 				break NodeTypeSwitch
@@ -908,6 +946,25 @@ NodeTypeSwitch:
 		}
 		cp.P.Throw("comp/known/suffix", node.GetToken())
 		break
+	case *ast.TransactionExpression:
+		if ctxt.Access != CMD && ctxt.Access != REPL {
+			cp.P.Throw("comp/transaction/access", node.GetToken())
+			break
+		}
+		cp.put(Tbeg, cp.reserveToken(node.GetToken()))
+		ifBeginFailed := cp.vmConditionalEarlyReturn(Qtyp, cp.That(), uint32(values.ERROR), cp.That())
+		loopsOutside := cp.loopsOutside
+		cp.loopsOutside = len(cp.forData)
+		transactionTypes, _ := cp.CompileNode(node.Right, ctxt.x())
+		cp.loopsOutside = loopsOutside
+		if transactionTypes.IsNoneOf(values.ERROR, values.SUCCESSFUL_VALUE) {
+			cp.P.Throw("comp/transaction/return", node.GetToken())
+			break
+		}
+		cp.put(Tend, cp.That(), cp.reserveToken(node.GetToken()))
+		cp.vmComeFrom(ifBeginFailed)
+		rtnTypes, rtnConst = AltType(values.SUCCESSFUL_VALUE, values.ERROR), false
+		break
 	case *ast.TryExpression:
 		ident := node.VarName
 		v, exists := env.GetVar(ident)
@@ -996,8 +1053,10 @@ NodeTypeSwitch:
 	if rtnConst && (!rtnTypes.hasSideEffects()) && cp.CodeTop() > cT {
 		cp.Emit(Ret)
 		cp.Cm("Calling Run from end of CompileNode as part of routine constant folding.", node.GetToken())
-		cp.Vm.Run(cT)
-		result := cp.Vm.Mem[cp.That()]
+		result, ok := cp.Vm.RunContext(cp.Vm.foldingContext(), cT)
+		if ok {
+			result = cp.Vm.Mem[cp.That()]
+		}
 		if result.T == values.TUPLE {
 			tType := FiniteTupleType{}
 			for _, v := range result.V.([]values.Value) {
@@ -1478,6 +1537,9 @@ func (cp *Compiler) emitContinue(tok *token.Token) {
 		cp.P.Throw("comp/for/continue", tok)
 		return
 	}
+	if cp.leavesTransaction(tok) {
+		return
+	}
 	cp.addToForData(cp.vmContinue())
 }
 
@@ -1503,9 +1565,22 @@ func (cp *Compiler) emitBreakWithoutValue(tok *token.Token) {
 		cp.P.Throw("comp/break/continue", tok)
 		return
 	}
+	if cp.leavesTransaction(tok) {
+		return
+	}
 	cp.addToForData(cp.vmBreakWithoutValue())
 }
 
+// A 'break' or 'continue' can't jump out of a 'transaction' block, since it would skip the end of
+// the transaction. Throws an error if it would.
+func (cp *Compiler) leavesTransaction(tok *token.Token) bool {
+	if len(cp.forData) > cp.loopsOutside {
+		return false
+	}
+	cp.P.Throw("comp/transaction/break", tok)
+	return true
+}
+
 func (cp *Compiler) addToForData(x any) {
 	cp.forData[len(cp.forData)-1] = append(cp.forData[len(cp.forData)-1], x)
 }
@@ -1754,8 +1829,10 @@ func (cp *Compiler) compileOneGivenChunk(node *ast.AssignmentExpression, ctxt Co
 					return
 				}
 				cp.Cm("Calling Run from compileOneGivenChunk to fold constant.", node.GetToken())
-				cp.Vm.Run(uint32(rollbackTo.Code))
-				v := cp.Vm.Mem[resultLocation]
+				v, ok := cp.Vm.RunContext(cp.Vm.foldingContext(), uint32(rollbackTo.Code))
+				if ok {
+					v = cp.Vm.Mem[resultLocation]
+				}
 				cp.Rollback(rollbackTo, node.GetToken())
 				cp.Reserve(v.T, v.V, node.GetToken())
 				continue
@@ -1812,7 +1889,7 @@ const (
 	HTML_SNIPPET
 )
 
-func (cp *Compiler) reserveSnippetFactory(t string, env *Environment, fnNode *ast.SuffixExpression, ctxt Context) uint32 {
+func (cp *Compiler) reserveSnippetFactory(t, database string, env *Environment, fnNode *ast.SuffixExpression, ctxt Context) uint32 {
 	cp.Cm("Reserving snippet factory.", &fnNode.Token)
 	snF := &SnippetFactory{snippetType: cp.ConcreteTypeNow(t), sourceString: fnNode.Token.Literal}
 	csk := VANILLA_SNIPPET
@@ -1822,8 +1899,14 @@ func (cp *Compiler) reserveSnippetFactory(t string, env *Environment, fnNode *as
 	case t == "HTML":
 		csk = HTML_SNIPPET
 	}
-	snF.bindle = cp.compileSnippet(fnNode.GetToken(), env, csk, snF.sourceString, ctxt)
+	var params []values.ValueType
+	snF.bindle, params = cp.compileSnippet(fnNode.GetToken(), env, csk, snF.sourceString, ctxt)
+	snF.bindle.database = database
 	cp.Vm.SnippetFactories = append(cp.Vm.SnippetFactories, snF)
+	if csk == SQL_SNIPPET {
+		cp.recordSqlSnippet(uint32(len(cp.Vm.SnippetFactories)-1), fnNode.GetToken(), database,
+			cp.Vm.Mem[snF.bindle.objectStringLoc].V.(string), params)
+	}
 	return uint32(len(cp.Vm.SnippetFactories) - 1)
 }
 
@@ -2107,13 +2190,16 @@ func (cp *Compiler) compileMappingOrFilter(lhsTypes AlternateType, lhsConst bool
 	return AltType(values.LIST), lhsConst && rhsConst
 }
 
-func (cp *Compiler) compileSnippet(tok *token.Token, newEnv *Environment, csk compiledSnippetKind, sText string, ctxt Context) *SnippetBindle {
+// Compiles a snippet, returning its bindle and, so that SQL snippets can be checked against the schema
+// of their database, the types of the values injected at each site, or UNDEFINED_TYPE where we can't tell.
+func (cp *Compiler) compileSnippet(tok *token.Token, newEnv *Environment, csk compiledSnippetKind, sText string, ctxt Context) (*SnippetBindle, []values.ValueType) {
 	cp.Cm("Compile snippet", tok)
 	bindle := SnippetBindle{compiledSnippetKind: csk}
+	params := []values.ValueType{}
 	bits, ok := text.GetTextWithBarsAsList(sText)
 	if !ok {
 		cp.P.Throw("comp/snippet/form/b", tok)
-		return &bindle
+		return &bindle, params
 	}
 	var buf strings.Builder
 	bindle.codeLoc = cp.CodeTop()
@@ -2150,9 +2236,14 @@ func (cp *Compiler) compileSnippet(tok *token.Token, newEnv *Environment, csk co
 				for i := 0; i < numberOfInjectionSites; i++ {
 					cp.put(IxTn, val, uint32(i))
 					bindle.valueLocs = append(bindle.valueLocs, cp.That())
+					params = append(params, values.UNDEFINED_TYPE)
 				}
 			} else { // We have a any element so we add it to the injectable values.
 				bindle.valueLocs = append(bindle.valueLocs, val)
+				params = append(params, values.UNDEFINED_TYPE)
+				if simpleType, ok := types[0].(SimpleType); ok && len(types) == 1 {
+					params[len(params)-1] = values.ValueType(simpleType)
+				}
 			}
 			sep := ""
 			for i := 0; i < numberOfInjectionSites; i++ {
@@ -2180,7 +2271,7 @@ func (cp *Compiler) compileSnippet(tok *token.Token, newEnv *Environment, csk co
 	}
 	cp.Reserve(values.STRING, buf.String(), tok)
 	bindle.objectStringLoc = cp.That()
-	return &bindle
+	return &bindle, params
 }
 
 // To keep the following function from being many functions, we're going to pass it a thing modifying its behavior. Which, yeah,
@@ -2405,8 +2496,13 @@ type CpFunc struct {
 	Xcall                   *XBindle // Information for making an external call, if non-nil.
 	Private                 bool     // True if it's private.
 	Command                 bool     // True if it's a command.
+	Access                  []string // The groups which may call it from outside the service, or nil if anyone may. (See permissions.go.)
 	GoNumber                uint32
 	HasGo                   bool
+	Name                    string       // The name of the function, so that the debugger can describe the callstack.
+	Env                     *Environment // The parameters and local variables of the function, for the debugger.
+	CodeStart               uint32       // Where the code of the function starts, including its 'given' block if any.
+	CodeEnd                 uint32       // And where it ends. This and the previous field are zero if the function has no compiled body.
 }
 
 // Information we need in the CpFunc struct to call an external service.
@@ -2466,6 +2562,11 @@ func (cp *Compiler) NeedsUpdate() (bool, error) {
 	if cp.Timestamp != currentTimeStamp {
 		return true, nil
 	}
+	for source, timestamp := range cp.SourceTimestamps {
+		if timestamp != sourceTimestamp(source) {
+			return true, nil
+		}
+	}
 	for _, importedCp := range cp.Modules {
 		impNeedsUpdate, impError := importedCp.NeedsUpdate()
 		if impNeedsUpdate || impError != nil {
@@ -2561,6 +2662,7 @@ func (cp *Compiler) vmComeFrom(items ...any) {
 // the destination is the next free memory address.
 func (cp *Compiler) Emit(opcode Opcode, args ...uint32) {
 	cp.Vm.Code = append(cp.Vm.Code, MakeOp(opcode, args...))
+	cp.Vm.CodeTokens = append(cp.Vm.CodeTokens, cp.nodeTokenNumber())
 	if cp.showCompile {
 		description := cp.Vm.DescribeCode(cp.CodeTop() - 1)
 		if !testing.Testing() {
@@ -2609,6 +2711,19 @@ func (cp *Compiler) reserveError(ec string, tok *token.Token, args ...any) uint3
 	return cp.That()
 }
 
+// Supplies the number of the token of the node being compiled, reserving it the first time an
+// operation is emitted for the node.
+func (cp *Compiler) nodeTokenNumber() uint32 {
+	if cp.nodeTok == nil {
+		return DUMMY
+	}
+	if cp.nodeTokNo < cp.TokenTop() && cp.Vm.Tokens[cp.nodeTokNo] == cp.nodeTok {
+		return cp.nodeTokNo
+	}
+	cp.nodeTokNo = cp.reserveToken(cp.nodeTok)
+	return cp.nodeTokNo
+}
+
 func (cp *Compiler) reserveToken(tok *token.Token) uint32 {
 	cp.Vm.Tokens = append(cp.Vm.Tokens, tok)
 	return cp.ThatToken()
@@ -2651,6 +2766,7 @@ func (cp *Compiler) GetState() vmState {
 func (cp *Compiler) Rollback(vms vmState, tok *token.Token) {
 	cp.Cm("Rolling back to address "+strconv.Itoa(vms.Code)+" and location "+strconv.Itoa(vms.mem)+".", tok)
 	cp.Vm.Code = cp.Vm.Code[:vms.Code]
+	cp.Vm.CodeTokens = cp.Vm.CodeTokens[:vms.Code]
 	cp.Vm.Mem = cp.Vm.Mem[:vms.mem]
 	cp.Vm.Tokens = cp.Vm.Tokens[:vms.tokens]
 	cp.Vm.LambdaFactories = cp.Vm.LambdaFactories[:vms.lambdaFactories]
@@ -2659,21 +2775,40 @@ func (cp *Compiler) Rollback(vms vmState, tok *token.Token) {
 
 // For calling `init` or `main`.
 func (cp *Compiler) CallIfExists(name string) (values.Value, error) {
+	return cp.CallIfExistsContext(context.Background(), name)
+}
+
+// Like `CallIfExists`, but the call is subject to the context as well as the service's limits.
+func (cp *Compiler) CallIfExistsContext(ctx context.Context, name string) (values.Value, error) {
+	if _, ok := cp.P.FunctionForest[name]; !ok {
+		return values.UNDEF, errors.New("`" + name + "` command does not exist.")
+	}
+	fnNumber, ok := cp.getParameterlessFunction(name)
+	if !ok {
+		return values.UNDEF, errors.New("`" + name + "` is defined with parameters.")
+	}
+	fn := cp.Fns[fnNumber]
+	if !fn.Command {
+		return values.UNDEF, errors.New("`" + name + "` is defined as a function, not a command.")
+	}
+	if result, ok := cp.Vm.RunContext(ctx, fn.CallTo); !ok {
+		return result, nil
+	}
+	return cp.Vm.Mem[fn.OutReg], nil
+}
+
+// Finds the number of the function of the given name which has no parameters, if there is one.
+func (cp *Compiler) getParameterlessFunction(name string) (uint32, bool) {
 	tree, ok := cp.P.FunctionForest[name]
 	if !ok {
-		return values.UNDEF, errors.New("`" + name + "` command does not exist.")
+		return DUMMY, false
 	}
 	for _, t := range tree.Tree.Branch {
 		if t.Type.Len() == 0 && t.Node.Fn != nil {
-			fn := cp.Fns[t.Node.Fn.Number]
-			if !fn.Command {
-				return values.UNDEF, errors.New("`" + name + "` is defined as a function, not a command.")
-			}
-			cp.Vm.Run(cp.Fns[t.Node.Fn.Number].CallTo)
-			return cp.Vm.Mem[cp.Fns[t.Node.Fn.Number].OutReg], nil
+			return t.Node.Fn.Number, true
 		}
 	}
-	return values.UNDEF, errors.New("`" + name + "` is defined with parameters.")
+	return DUMMY, false
 }
 
 // Functions for emitting comments on what the compiler is doing, if the option to do so in the `settings.go`
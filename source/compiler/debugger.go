@@ -0,0 +1,352 @@
+package compiler
+
+// A step debugger for the vm. When one is attached, `Run` calls `check` before each operation.
+// This works out which line of source code the operation was compiled from, by way of the
+// `CodeTokens` which the compiler emits alongside the code, and decides whether to stop there.
+// If it does stop, it hands control to a `DebugHandler`, which may be the hub or a client speaking
+// the Debug Adapter Protocol, and which can look at the callstack and at the local variables of each
+// function, named through the `Environment` the compiler kept for it.
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tim-hardcastle/Pipefish/source/settings"
+	"github.com/tim-hardcastle/Pipefish/source/text"
+	"github.com/tim-hardcastle/Pipefish/source/token"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+)
+
+// What the debugger should do when the handler gives it back control.
+type DebugAction int
+
+const (
+	DEBUG_RESUME    DebugAction = iota // Run until the next breakpoint.
+	DEBUG_STEP_IN                      // Stop at the next line, even if it's in a function we're calling.
+	DEBUG_STEP_OVER                    // Stop at the next line of this function, or of its caller if it returns.
+	DEBUG_STEP_OUT                     // Stop when this function returns.
+	DEBUG_DETACH                       // Detach the debugger and carry on.
+)
+
+// The reasons we give the handler for stopping.
+const (
+	STOPPED_AT_BREAKPOINT = "breakpoint"
+	STOPPED_AFTER_STEP    = "step"
+	STOPPED_BY_REQUEST    = "pause"
+)
+
+// Whatever is driving the debugger supplies one of these. When the vm stops, the debugger calls
+// `Stopped`, which should block until the user says what to do next.
+type DebugHandler interface {
+	Stopped(d *Debugger, reason string) DebugAction
+}
+
+type Debugger struct {
+	vm        *Vm
+	handler   DebugHandler
+	functions []*CpFunc      // The functions with compiled bodies, for finding out which function an address is in.
+	globals   []*Environment // The global variables and constants.
+
+	mu          sync.RWMutex            // Breakpoints may be set from another goroutine, e.g. by a DAP client, while the vm is running.
+	breakpoints map[string]map[int]bool // From the absolute path of a source file to its line numbers.
+	paths       map[string]string       // Caches the absolute paths of the token sources, which we need to look up breakpoints.
+	pause       atomic.Bool             // Set by `RequestPause` to stop at the next line.
+
+	action    DebugAction
+	stopTok   *token.Token // Where we last stopped ...
+	stopDepth int          // ... and how deep the callstack was.
+	prevTok   *token.Token // The same for the previous operation.
+	prevDepth int
+	runs      int         // How many calls to `Run` deep we are, so we know when the vm has gone back to sleep.
+	loc       uint32      // The address we're stopped at.
+	stopped   atomic.Bool // True while the handler has control. It's read from other goroutines, e.g. by a DAP client.
+}
+
+// A frame of the callstack.
+type StackFrame struct {
+	Name  string       // The name of the function, or an empty string if it's top-level code, e.g. from the REPL.
+	Token *token.Token // The token of the node being executed, which may be nil.
+	Path  string       // The absolute path of the source of the token, if it comes from a file.
+	Addr  uint32
+}
+
+// A variable as the debugger describes it.
+type DebugVariable struct {
+	Name  string
+	Type  string
+	Value string
+}
+
+// Attaches a new debugger to the vm of the compiler, and so to its modules, which share it.
+func (cp *Compiler) StartDebugging(handler DebugHandler) *Debugger {
+	d := &Debugger{vm: cp.Vm, handler: handler, globals: []*Environment{cp.GlobalVars, cp.GlobalConsts},
+		breakpoints: map[string]map[int]bool{}, paths: map[string]string{}}
+	seen := map[*Compiler]bool{}
+	var collect func(c *Compiler)
+	collect = func(c *Compiler) {
+		if seen[c] || c.Vm != cp.Vm {
+			return
+		}
+		seen[c] = true
+		for _, fn := range c.Fns {
+			if fn.CodeEnd > fn.CodeStart {
+				d.functions = append(d.functions, fn)
+			}
+		}
+		for _, module := range c.Modules {
+			collect(module)
+		}
+	}
+	collect(cp)
+	cp.Vm.Debugger = d
+	return d
+}
+
+// Detaches the debugger, if any.
+func (cp *Compiler) StopDebugging() {
+	cp.Vm.Debugger = nil
+}
+
+// Sets a breakpoint, returning false if no code was compiled from the given line, in which case
+// the debugger can never stop there.
+func (d *Debugger) SetBreakpoint(source string, line int) bool {
+	path := debugPath(source)
+	d.mu.Lock()
+	if d.breakpoints[path] == nil {
+		d.breakpoints[path] = map[int]bool{}
+	}
+	d.breakpoints[path][line] = true
+	d.mu.Unlock()
+	paths := map[string]string{} // We don't use `pathOf`, since its cache belongs to the goroutine running the vm.
+	for _, tokNo := range d.vm.CodeTokens {
+		if tokNo == DUMMY || d.vm.Tokens[tokNo].Line != line {
+			continue
+		}
+		source := d.vm.Tokens[tokNo].Source
+		if _, ok := paths[source]; !ok {
+			paths[source] = debugPath(source)
+		}
+		if paths[source] == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Clears the breakpoints in the given source file, or all of them if the source is empty.
+func (d *Debugger) ClearBreakpoints(source string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if source == "" {
+		d.breakpoints = map[string]map[int]bool{}
+		return
+	}
+	delete(d.breakpoints, debugPath(source))
+}
+
+// Lists the breakpoints as "filepath:line".
+func (d *Debugger) Breakpoints() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	result := []string{}
+	for path, lines := range d.breakpoints {
+		for line := range lines {
+			result = append(result, path+":"+strconv.Itoa(line))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Asks the debugger to stop at the next line it reaches.
+func (d *Debugger) RequestPause() {
+	d.pause.Store(true)
+}
+
+// True if the vm is stopped and the handler has control.
+func (d *Debugger) IsStopped() bool {
+	return d.stopped.Load()
+}
+
+// The callstack, innermost frame first. Only meaningful while stopped.
+func (d *Debugger) Stack() []StackFrame {
+	addrs := []uint32{d.loc}
+	for i := len(d.vm.callstack) - 1; i >= 0; i-- {
+		addrs = append(addrs, d.vm.callstack[i])
+	}
+	result := make([]StackFrame, 0, len(addrs))
+	for _, addr := range addrs {
+		frame := StackFrame{Token: d.vm.tokenAt(addr), Addr: addr}
+		if frame.Token != nil {
+			frame.Path = debugPath(frame.Token.Source)
+		}
+		if fn := d.functionAt(addr); fn != nil {
+			frame.Name = fn.Name
+		}
+		result = append(result, frame)
+	}
+	return result
+}
+
+// The parameters and local variables of the function in the given frame of the callstack. Note that
+// the values shown for outer frames of a recursive function will be those of the innermost call,
+// since the vm only saves the memory of the outer calls when it recurses.
+func (d *Debugger) Locals(frame int) []DebugVariable {
+	stack := d.Stack()
+	if frame < 0 || frame >= len(stack) {
+		return []DebugVariable{}
+	}
+	fn := d.functionAt(stack[frame].Addr)
+	if fn == nil || fn.Env == nil {
+		return []DebugVariable{}
+	}
+	return d.describeEnvironment(fn.Env)
+}
+
+// The global variables and constants of the service.
+func (d *Debugger) Globals() []DebugVariable {
+	result := []DebugVariable{}
+	for _, env := range d.globals {
+		result = append(result, d.describeEnvironment(env)...)
+	}
+	return result
+}
+
+// Finds a variable by name, looking first in the locals of the frame and then in the globals.
+func (d *Debugger) Variable(frame int, name string) (DebugVariable, bool) {
+	for _, v := range append(d.Locals(frame), d.Globals()...) {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return DebugVariable{}, false
+}
+
+// Describes the position of a token as "filepath:line".
+func (d *Debugger) DescribePosition(tok *token.Token) string {
+	if tok == nil {
+		return "unknown position"
+	}
+	return tok.Source + ":" + strconv.Itoa(tok.Line)
+}
+
+// Called by `Run` on the way in and out, so that we can tell when we start afresh.
+func (d *Debugger) enter() {
+	if d.runs == 0 {
+		d.action = DEBUG_RESUME
+		d.prevTok = nil
+		d.stopTok = nil
+	}
+	d.runs++
+}
+
+func (d *Debugger) exit() {
+	d.runs--
+}
+
+// Called by `Run` before each operation.
+func (d *Debugger) check(loc uint32) {
+	if d.stopped.Load() {
+		return
+	}
+	tok := d.vm.tokenAt(loc)
+	if tok == nil || settings.ThingsToIgnore.Contains(tok.Source) || strings.HasPrefix(tok.Source, "rsc-pf/") {
+		return
+	}
+	depth := len(d.vm.callstack)
+	newLine := d.prevTok == nil || tok.Line != d.prevTok.Line || tok.Source != d.prevTok.Source || depth != d.prevDepth
+	d.prevTok, d.prevDepth = tok, depth
+	if !newLine {
+		return
+	}
+	reason := ""
+	sameStopLine := d.stopTok != nil && tok.Line == d.stopTok.Line && tok.Source == d.stopTok.Source
+	switch {
+	case d.pause.Swap(false):
+		reason = STOPPED_BY_REQUEST
+	case d.action == DEBUG_STEP_IN && !(sameStopLine && depth == d.stopDepth):
+		reason = STOPPED_AFTER_STEP
+	case d.action == DEBUG_STEP_OVER && (depth < d.stopDepth || depth == d.stopDepth && !sameStopLine):
+		reason = STOPPED_AFTER_STEP
+	case d.action == DEBUG_STEP_OUT && depth < d.stopDepth:
+		reason = STOPPED_AFTER_STEP
+	case d.isBreakpoint(tok):
+		reason = STOPPED_AT_BREAKPOINT
+	}
+	if reason == "" {
+		return
+	}
+	d.loc, d.stopTok, d.stopDepth = loc, tok, depth
+	d.stopped.Store(true)
+	d.action = d.handler.Stopped(d, reason)
+	d.stopped.Store(false)
+	if d.action == DEBUG_DETACH {
+		d.vm.Debugger = nil
+	}
+}
+
+func (d *Debugger) isBreakpoint(tok *token.Token) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.breakpoints) == 0 {
+		return false
+	}
+	lines, ok := d.breakpoints[d.pathOf(tok.Source)]
+	return ok && lines[tok.Line]
+}
+
+// Finds the innermost function whose code contains the address.
+func (d *Debugger) functionAt(addr uint32) *CpFunc {
+	var result *CpFunc
+	for _, fn := range d.functions {
+		if fn.CodeStart <= addr && addr < fn.CodeEnd && (result == nil || fn.CodeEnd-fn.CodeStart < result.CodeEnd-result.CodeStart) {
+			result = fn
+		}
+	}
+	return result
+}
+
+func (d *Debugger) describeEnvironment(env *Environment) []DebugVariable {
+	result := []DebugVariable{}
+	for name, v := range env.Data {
+		val := d.vm.Mem[v.MLoc]
+		dv := DebugVariable{Name: name}
+		switch val.T {
+		case values.UNDEFINED_TYPE:
+			dv.Type, dv.Value = "", "not yet defined"
+		case values.THUNK:
+			dv.Type, dv.Value = "", "not yet evaluated"
+		default:
+			dv.Type, dv.Value = d.vm.DescribeType(val.T, LITERAL), d.vm.Literal(val)
+		}
+		result = append(result, dv)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Breakpoints may be set by filepath relative to wherever the user is, or absolute, and so we
+// compare absolute paths.
+func (d *Debugger) pathOf(source string) string {
+	if path, ok := d.paths[source]; ok {
+		return path
+	}
+	path := debugPath(source)
+	d.paths[source] = path
+	return path
+}
+
+func debugPath(source string) string {
+	if source == "" || source == "REPL input" {
+		return source
+	}
+	path, e := filepath.Abs(text.MakeFilepath(source))
+	if e != nil {
+		return source
+	}
+	return path
+}
@@ -42,6 +42,11 @@ func (vm *Vm) DescribeType(t values.ValueType, flavor descriptionFlavor) string
 	return vm.ConcreteTypeInfo[t].GetName(flavor)
 }
 
+// Describes a typescheme, e.g. the return types that the compiler has inferred for a function.
+func (vm *Vm) DescribeTypeScheme(t TypeScheme) string {
+	return t.describe(vm)
+}
+
 type descriptionFlavor int
 
 const (
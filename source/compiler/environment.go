@@ -35,6 +35,11 @@ type variable struct {
 	types  AlternateType
 }
 
+// The types the compiler has inferred that the variable can have.
+func (v *variable) Types() AlternateType {
+	return v.types
+}
+
 type Environment struct {
 	Data map[string]variable
 	Ext  *Environment
@@ -54,3 +59,43 @@ func (env *Environment) GetVar(name string) (*variable, bool) {
 	}
 	return env.Ext.GetVar(name)
 }
+
+// Returns the locations in memory of the global variables of the compiler and of the modules which
+// share its vm, by name, the names of the modules' variables being qualified by their namespaces.
+// The service variables, whose names begin with `$`, aren't included.
+func (cp *Compiler) GlobalVariableLocs() map[string]uint32 {
+	result := map[string]uint32{}
+	for name, v := range cp.globalVariables() {
+		result[name] = v.MLoc
+	}
+	return result
+}
+
+// As above, but returning the types the variables can have.
+func (cp *Compiler) GlobalVariableTypes() map[string]AlternateType {
+	result := map[string]AlternateType{}
+	for name, v := range cp.globalVariables() {
+		result[name] = v.types
+	}
+	return result
+}
+
+func (cp *Compiler) globalVariables() map[string]variable {
+	result := map[string]variable{}
+	cp.addGlobalVariables("", result, map[*Compiler]bool{})
+	return result
+}
+
+func (cp *Compiler) addGlobalVariables(prefix string, result map[string]variable, seen map[*Compiler]bool) {
+	seen[cp] = true
+	for name, v := range cp.GlobalVars.Data {
+		if (v.access == GLOBAL_VARIABLE_PUBLIC || v.access == GLOBAL_VARIABLE_PRIVATE) && name[0] != '$' {
+			result[prefix+name] = v
+		}
+	}
+	for namespace, module := range cp.Modules {
+		if module.Vm == cp.Vm && !seen[module] {
+			module.addGlobalVariables(prefix+namespace+".", result, seen)
+		}
+	}
+}
@@ -0,0 +1,1498 @@
+package compiler
+
+// Bytecode images. An image is a snapshot of everything the vm established at compile time: the
+// code, the memory, the type information, the tokens, the lambda and snippet factories, and so on,
+// plus the function tables and global environments of the compilers, so that a service can be
+// started from one without parsing or compiling anything.
+//
+// We also keep what the parsers know once they've finished initializing, i.e. the names of the
+// functions and types and the function trees we dispatch on, so that a compiler loaded from an
+// image can compile a line from the REPL without its sources. We don't keep the bodies of the
+// functions, which are only needed to compile them, but just their tokens. An image can't contain
+// the Go functions, and so we record where they came from and the initializer reopens the plugins
+// when it loads the image.
+//
+// The format is a header consisting of `IMAGE_MAGIC` and `IMAGE_VERSION`; the sources with their
+// timestamps; the tokens; and then the body, which is the vm, the function table, the functions as
+// the parsers see them, and the compilers, the first of which is the root. Numbers are written as
+// varints, and maps and sets in key order, so that the same service always produces the same image.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"src.elv.sh/pkg/persistent/vector"
+
+	"github.com/tim-hardcastle/Pipefish/source/ast"
+	"github.com/tim-hardcastle/Pipefish/source/dtypes"
+	"github.com/tim-hardcastle/Pipefish/source/err"
+	"github.com/tim-hardcastle/Pipefish/source/parser"
+	"github.com/tim-hardcastle/Pipefish/source/text"
+	"github.com/tim-hardcastle/Pipefish/source/token"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+)
+
+const IMAGE_MAGIC = "PIPEFISH IMAGE\n"
+
+// This should be incremented whenever the format changes, or the meaning of the things in it,
+// e.g. the numbering of the opcodes.
+const IMAGE_VERSION = 7
+
+// The kinds of payload a `Value` can have, by Go type.
+const (
+	imNIL uint8 = iota
+	imINT
+	imBOOL
+	imSTRING
+	imRUNE
+	imFLOAT
+	imUINT32
+	imUINT32S
+	imVALUES
+	imABSTRACT_TYPE
+	imVECTOR
+	imMAP
+	imSET
+	imERROR
+	imLAMBDA
+	imTHUNK
+	imSNIPPET_BINDLE
+	imVALUE_TYPE
+	imTOKEN
+	imVALUE
+)
+
+// The kinds of `TypeScheme`.
+const (
+	imSIMPLE uint8 = iota
+	imALTERNATE
+	imFINITE_TUPLE
+	imTYPED_TUPLE
+	imBLING
+)
+
+// The kinds of `typeInformation`.
+const (
+	imBUILTIN_TYPE uint8 = iota
+	imENUM_TYPE
+	imCLONE_TYPE
+	imSTRUCT_TYPE
+)
+
+// Writes an image of the compiler and of the modules that share its vm.
+func (cp *Compiler) WriteImage(w io.Writer) error {
+	if len(cp.Vm.ExternalCallHandlers) > 0 {
+		return errors.New("can't make an image of a service with external services")
+	}
+	compilers := cp.imageCompilers()
+	for _, c := range compilers {
+		for _, module := range c.Modules {
+			if module.Vm != cp.Vm {
+				return errors.New("can't make an image of a service with external services")
+			}
+		}
+	}
+	enc := &imageEncoder{tokens: map[*token.Token]uint32{}, fns: map[*CpFunc]uint32{}, prsrFns: map[*ast.PrsrFunction]uint32{}}
+	// The vm's own tokens go first, in order, even if they're nil or repeated, so that the numbers
+	// of the tokens in the operands and the `CodeTokens` are the same in the image.
+	for i, tok := range cp.Vm.Tokens {
+		enc.tokenList = append(enc.tokenList, tok)
+		if _, ok := enc.tokens[tok]; !ok && tok != nil {
+			enc.tokens[tok] = uint32(i)
+		}
+	}
+	for _, c := range compilers {
+		for _, fn := range c.Fns {
+			enc.addFunction(fn)
+		}
+	}
+	if cp.Vm.Stringify != nil {
+		enc.addFunction(cp.Vm.Stringify)
+	}
+	compilerNumbers := map[*Compiler]uint32{}
+	for i, c := range compilers {
+		compilerNumbers[c] = uint32(i)
+		enc.addPrsrFunctions(c)
+	}
+	// We encode the body first, since doing so may find more tokens, e.g. in errors.
+	enc.vm(cp.Vm)
+	enc.uint(uint64(len(enc.fnList)))
+	for _, fn := range enc.fnList {
+		enc.function(fn)
+	}
+	enc.abstractTypeMap(cp.P.Common.Types)
+	enc.uint(uint64(len(enc.prsrFnList)))
+	for _, fn := range enc.prsrFnList {
+		enc.prsrFunction(fn, compilerNumbers)
+	}
+	enc.uint(uint64(len(compilers)))
+	for _, c := range compilers {
+		enc.compiler(c, compilerNumbers)
+	}
+	if enc.e != nil {
+		return enc.e
+	}
+	body := enc.buf
+	enc.buf = []byte(IMAGE_MAGIC)
+	enc.uint(IMAGE_VERSION)
+	sources := make([]string, 0, len(cp.P.Common.Sources))
+	for source := range cp.P.Common.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	enc.uint(uint64(len(sources)))
+	for _, source := range sources {
+		enc.str(source)
+		enc.int(sourceTimestamp(source))
+		enc.strs(cp.P.Common.Sources[source])
+	}
+	enc.uint(uint64(len(enc.tokenList)))
+	for _, tok := range enc.tokenList {
+		enc.boolean(tok != nil)
+		if tok == nil {
+			continue
+		}
+		enc.str(string(tok.Type))
+		enc.str(tok.Literal)
+		enc.int(int64(tok.Line))
+		enc.int(int64(tok.ChStart))
+		enc.int(int64(tok.ChEnd))
+		enc.str(tok.Source)
+	}
+	if _, e := w.Write(enc.buf); e != nil {
+		return e
+	}
+	_, e := w.Write(body)
+	return e
+}
+
+// Reads an image written by `WriteImage`, returning the root compiler. The vm's Go functions are
+// left empty, for the initializer to fill in from the plugins, as are its database and handlers.
+func ReadImage(r io.Reader, vm *Vm) (*Compiler, error) {
+	data, e := io.ReadAll(r)
+	if e != nil {
+		return nil, e
+	}
+	if !bytes.HasPrefix(data, []byte(IMAGE_MAGIC)) {
+		return nil, errors.New("not a Pipefish image")
+	}
+	dec := &imageDecoder{buf: data[len(IMAGE_MAGIC):]}
+	if version := dec.uint(); version != IMAGE_VERSION {
+		return nil, errors.New("image is from a different version of Pipefish")
+	}
+	common := parser.NewCommonParserBindle()
+	sourceTimestamps := map[string]int64{}
+	for i := dec.length(); i > 0; i-- {
+		source := dec.str()
+		sourceTimestamps[source] = dec.int()
+		common.Sources[source] = dec.strs()
+	}
+	dec.tokenList = make([]*token.Token, dec.length())
+	for i := range dec.tokenList {
+		if !dec.boolean() {
+			continue
+		}
+		dec.tokenList[i] = &token.Token{Type: token.TokenType(dec.str()), Literal: dec.str(), Line: int(dec.int()),
+			ChStart: int(dec.int()), ChEnd: int(dec.int()), Source: dec.str()}
+	}
+	dec.vm(vm)
+	dec.fnList = make([]*CpFunc, dec.length())
+	for i := range dec.fnList {
+		dec.fnList[i] = &CpFunc{}
+	}
+	for _, fn := range dec.fnList {
+		dec.function(fn)
+	}
+	if dec.stringify != DUMMY {
+		vm.Stringify = dec.functionNumbered(dec.stringify)
+	}
+	common.Types = dec.abstractTypeMap()
+	dec.prsrFnList = make([]*ast.PrsrFunction, dec.length())
+	for i := range dec.prsrFnList {
+		dec.prsrFnList[i] = &ast.PrsrFunction{}
+	}
+	prsrFnCompilers := make([]uint32, len(dec.prsrFnList))
+	for i, fn := range dec.prsrFnList {
+		prsrFnCompilers[i] = dec.prsrFunction(fn)
+	}
+	compilers := make([]*Compiler, dec.length())
+	if dec.e == nil && len(compilers) == 0 {
+		dec.e = errors.New("image contains no compilers")
+	}
+	if dec.e != nil {
+		return nil, dec.e
+	}
+	sources := common.Sources // Because making the parsers will overwrite them.
+	common.Sources = map[string][]string{}
+	moduleNumbers := make([]map[string]uint32, len(compilers))
+	for i := range compilers {
+		compilers[i] = dec.compiler(vm, common)
+		compilers[i].SourceTimestamps = sourceTimestamps
+		moduleNumbers[i] = dec.u32Map()
+	}
+	if dec.e != nil {
+		return nil, dec.e
+	}
+	for i, cp := range compilers {
+		for name, n := range moduleNumbers[i] {
+			if n >= uint32(len(compilers)) {
+				return nil, errors.New("malformed image: bad module number")
+			}
+			cp.Modules[name] = compilers[n]
+			cp.P.NamespaceBranch[name] = &parser.ParserData{compilers[n].P, compilers[n].ScriptFilepath}
+		}
+	}
+	for i, fn := range dec.prsrFnList {
+		if n := prsrFnCompilers[i]; n != DUMMY {
+			if n >= uint32(len(compilers)) {
+				return nil, errors.New("malformed image: bad compiler number")
+			}
+			fn.Compiler = compilers[n]
+		}
+	}
+	common.Sources = sources
+	vm.OwningCompiler = compilers[0]
+	return compilers[0], nil
+}
+
+// The compiler and the modules that share its vm, each once only, root first.
+func (cp *Compiler) imageCompilers() []*Compiler {
+	result := []*Compiler{}
+	seen := map[*Compiler]bool{}
+	var collect func(c *Compiler)
+	collect = func(c *Compiler) {
+		if seen[c] || c.Vm != cp.Vm {
+			return
+		}
+		seen[c] = true
+		result = append(result, c)
+		for _, name := range sortedKeys(c.Modules) {
+			collect(c.Modules[name])
+		}
+	}
+	collect(cp)
+	return result
+}
+
+// Returns the time the source was last modified, or 0 if it isn't a file.
+func sourceTimestamp(source string) int64 {
+	if source == "" || source == "REPL input" {
+		return 0
+	}
+	file, e := os.Stat(text.MakeFilepath(source))
+	if e != nil {
+		return 0
+	}
+	return file.ModTime().UnixMilli()
+}
+
+type imageEncoder struct {
+	buf        []byte
+	tokens     map[*token.Token]uint32
+	tokenList  []*token.Token
+	fns        map[*CpFunc]uint32
+	fnList     []*CpFunc
+	prsrFns    map[*ast.PrsrFunction]uint32
+	prsrFnList []*ast.PrsrFunction
+	e          error
+}
+
+func (enc *imageEncoder) fail(e error) {
+	if enc.e == nil {
+		enc.e = e
+	}
+}
+
+func (enc *imageEncoder) addToken(tok *token.Token) uint32 {
+	if tok == nil {
+		return DUMMY
+	}
+	if n, ok := enc.tokens[tok]; ok {
+		return n
+	}
+	n := uint32(len(enc.tokenList))
+	enc.tokens[tok] = n
+	enc.tokenList = append(enc.tokenList, tok)
+	return n
+}
+
+func (enc *imageEncoder) addFunction(fn *CpFunc) uint32 {
+	if n, ok := enc.fns[fn]; ok {
+		return n
+	}
+	n := uint32(len(enc.fnList))
+	enc.fns[fn] = n
+	enc.fnList = append(enc.fnList, fn)
+	return n
+}
+
+// Adds the functions in the function table and the function trees of the compiler's parser.
+func (enc *imageEncoder) addPrsrFunctions(cp *Compiler) {
+	for _, name := range sortedKeys(cp.P.FunctionTable) {
+		for _, fn := range cp.P.FunctionTable[name] {
+			enc.addPrsrFunction(fn)
+		}
+	}
+	var addFromTree func(node *ast.FnTreeNode)
+	addFromTree = func(node *ast.FnTreeNode) {
+		enc.addPrsrFunction(node.Fn)
+		for _, branch := range node.Branch {
+			addFromTree(branch.Node)
+		}
+	}
+	for _, name := range sortedKeys(cp.P.FunctionForest) {
+		addFromTree(cp.P.FunctionForest[name].Tree)
+	}
+}
+
+func (enc *imageEncoder) addPrsrFunction(fn *ast.PrsrFunction) {
+	if _, ok := enc.prsrFns[fn]; ok || fn == nil {
+		return
+	}
+	enc.prsrFns[fn] = uint32(len(enc.prsrFnList))
+	enc.prsrFnList = append(enc.prsrFnList, fn)
+}
+
+func (enc *imageEncoder) uint(x uint64) {
+	enc.buf = binary.AppendUvarint(enc.buf, x)
+}
+
+func (enc *imageEncoder) int(x int64) {
+	enc.buf = binary.AppendVarint(enc.buf, x)
+}
+
+func (enc *imageEncoder) u32(x uint32) {
+	enc.uint(uint64(x))
+}
+
+func (enc *imageEncoder) byte(x uint8) {
+	enc.buf = append(enc.buf, x)
+}
+
+func (enc *imageEncoder) boolean(b bool) {
+	if b {
+		enc.byte(1)
+	} else {
+		enc.byte(0)
+	}
+}
+
+func (enc *imageEncoder) str(s string) {
+	enc.uint(uint64(len(s)))
+	enc.buf = append(enc.buf, s...)
+}
+
+func (enc *imageEncoder) strs(ss []string) {
+	enc.uint(uint64(len(ss)))
+	for _, s := range ss {
+		enc.str(s)
+	}
+}
+
+func (enc *imageEncoder) u32s(xs []uint32) {
+	enc.uint(uint64(len(xs)))
+	for _, x := range xs {
+		enc.u32(x)
+	}
+}
+
+func (enc *imageEncoder) bools(bs []bool) {
+	enc.uint(uint64(len(bs)))
+	for _, b := range bs {
+		enc.boolean(b)
+	}
+}
+
+func (enc *imageEncoder) token(tok *token.Token) {
+	enc.u32(enc.addToken(tok))
+}
+
+// We distinguish between nil and empty lists of types, since a nil list in the sig of a lambda
+// means that the parameter doesn't need typechecking.
+func (enc *imageEncoder) abstractType(aT values.AbstractType) {
+	if aT.Types == nil {
+		enc.uint(0)
+	} else {
+		enc.uint(uint64(len(aT.Types)) + 1)
+		for _, t := range aT.Types {
+			enc.u32(uint32(t))
+		}
+	}
+	enc.u32(aT.Varchar)
+}
+
+func (enc *imageEncoder) abstractTypes(aTs []values.AbstractType) {
+	enc.uint(uint64(len(aTs)))
+	for _, aT := range aTs {
+		enc.abstractType(aT)
+	}
+}
+
+func (enc *imageEncoder) abstractTypeMap(m map[string]values.AbstractType) {
+	keys := sortedKeys(m)
+	enc.uint(uint64(len(keys)))
+	for _, k := range keys {
+		enc.str(k)
+		enc.abstractType(m[k])
+	}
+}
+
+func (enc *imageEncoder) typeScheme(ts TypeScheme) {
+	switch ts := ts.(type) {
+	case SimpleType:
+		enc.byte(imSIMPLE)
+		enc.u32(uint32(ts))
+	case AlternateType:
+		enc.byte(imALTERNATE)
+		enc.altType(ts)
+	case FiniteTupleType:
+		enc.byte(imFINITE_TUPLE)
+		enc.altType(AlternateType(ts))
+	case TypedTupleType:
+		enc.byte(imTYPED_TUPLE)
+		enc.altType(ts.T)
+	case blingType:
+		enc.byte(imBLING)
+		enc.str(ts.tag)
+	default:
+		enc.fail(fmt.Errorf("can't make an image of a typescheme of Go type %T", ts))
+	}
+}
+
+func (enc *imageEncoder) altType(at AlternateType) {
+	enc.uint(uint64(len(at)))
+	for _, ts := range at {
+		enc.typeScheme(ts)
+	}
+}
+
+func (enc *imageEncoder) altTypeMap(m map[string]AlternateType) {
+	keys := sortedKeys(m)
+	enc.uint(uint64(len(keys)))
+	for _, k := range keys {
+		enc.str(k)
+		enc.altType(m[k])
+	}
+}
+
+func (enc *imageEncoder) values(vals []values.Value) {
+	enc.uint(uint64(len(vals)))
+	for _, v := range vals {
+		enc.value(v)
+	}
+}
+
+func (enc *imageEncoder) value(v values.Value) {
+	if v.T == values.ITERATOR { // Iterators can only be left in memory by code that has finished with them.
+		v = values.UNDEF
+	}
+	enc.u32(uint32(v.T))
+	enc.payload(v.V, false)
+}
+
+// Writes the payload of a value, or an argument of an error. If `lenient` is set, then we write
+// things we don't know how to serialize as strings, which is good enough for the arguments of
+// errors, which are only used to explain them.
+func (enc *imageEncoder) payload(x any, lenient bool) {
+	switch x := x.(type) {
+	case nil:
+		enc.byte(imNIL)
+	case int:
+		enc.byte(imINT)
+		enc.int(int64(x))
+	case bool:
+		enc.byte(imBOOL)
+		enc.boolean(x)
+	case string:
+		enc.byte(imSTRING)
+		enc.str(x)
+	case rune:
+		enc.byte(imRUNE)
+		enc.int(int64(x))
+	case float64:
+		enc.byte(imFLOAT)
+		enc.uint(math.Float64bits(x))
+	case uint32:
+		enc.byte(imUINT32)
+		enc.u32(x)
+	case []uint32:
+		enc.byte(imUINT32S)
+		enc.u32s(x)
+	case []values.Value:
+		enc.byte(imVALUES)
+		enc.values(x)
+	case values.AbstractType:
+		enc.byte(imABSTRACT_TYPE)
+		enc.abstractType(x)
+	case vector.Vector:
+		enc.byte(imVECTOR)
+		enc.uint(uint64(x.Len()))
+		for it := x.Iterator(); it.HasElem(); it.Next() {
+			enc.value(it.Elem().(values.Value))
+		}
+	case *values.Map:
+		enc.byte(imMAP)
+		enc.uint(uint64(x.Len()))
+		x.Range(func(k, v values.Value) {
+			enc.value(k)
+			enc.value(v)
+		})
+	case values.Set:
+		enc.byte(imSET)
+		enc.uint(uint64(x.Len()))
+		x.Range(func(v values.Value) {
+			enc.value(v)
+		})
+	case *err.Error:
+		enc.byte(imERROR)
+		enc.str(x.ErrorId)
+		enc.str(x.Message)
+		enc.uint(uint64(len(x.Args)))
+		for _, arg := range x.Args {
+			enc.payload(arg, true)
+		}
+		enc.values(x.Values)
+		enc.uint(uint64(len(x.Trace)))
+		for _, tok := range x.Trace {
+			enc.token(tok)
+		}
+		enc.token(x.Token)
+	case Lambda:
+		enc.byte(imLAMBDA)
+		enc.lambda(&x)
+	case ThunkValue:
+		enc.byte(imTHUNK)
+		enc.u32(x.MLoc)
+		enc.u32(x.CAddr)
+	case *SnippetBindle:
+		enc.byte(imSNIPPET_BINDLE)
+		enc.snippetBindle(x)
+	case values.ValueType:
+		enc.byte(imVALUE_TYPE)
+		enc.u32(uint32(x))
+	case *token.Token:
+		enc.byte(imTOKEN)
+		enc.token(x)
+	case values.Value:
+		enc.byte(imVALUE)
+		enc.value(x)
+	default:
+		if lenient {
+			enc.byte(imSTRING)
+			enc.str(fmt.Sprint(x))
+			return
+		}
+		enc.fail(fmt.Errorf("can't make an image of a value of Go type %T", x))
+	}
+}
+
+func (enc *imageEncoder) lambda(l *Lambda) {
+	if l.gocode != nil {
+		enc.fail(errors.New("can't make an image of a function returned from Go"))
+		return
+	}
+	enc.u32(l.capturesStart)
+	enc.u32(l.capturesEnd)
+	enc.u32(l.parametersEnd)
+	enc.u32(l.resultLocation)
+	enc.u32(l.addressToCall)
+	enc.values(l.captures)
+	enc.abstractTypes(l.sig)
+	enc.abstractTypes(l.rtnSig)
+	enc.token(l.tok)
+}
+
+// A nil bindle is written as though it were an empty one, which is what the vm does with it.
+func (enc *imageEncoder) snippetBindle(b *SnippetBindle) {
+	if b == nil {
+		b = &SnippetBindle{}
+	}
+	enc.uint(uint64(b.compiledSnippetKind))
+	enc.u32(b.codeLoc)
+	enc.u32(b.objectStringLoc)
+	enc.u32s(b.valueLocs)
+	enc.str(b.database)
+}
+
+func (enc *imageEncoder) typeInfo(info typeInformation) {
+	switch info := info.(type) {
+	case BuiltinType:
+		enc.byte(imBUILTIN_TYPE)
+		enc.str(info.name)
+		enc.str(info.path)
+	case EnumType:
+		enc.byte(imENUM_TYPE)
+		enc.str(info.Name)
+		enc.str(info.Path)
+		enc.strs(info.ElementNames)
+		enc.boolean(info.Private)
+		enc.boolean(info.IsMI)
+	case CloneType:
+		enc.byte(imCLONE_TYPE)
+		enc.str(info.Name)
+		enc.str(info.Path)
+		enc.u32(uint32(info.Parent))
+		enc.boolean(info.Private)
+		enc.boolean(info.IsSliceable)
+		enc.boolean(info.IsFilterable)
+		enc.boolean(info.IsMappable)
+		enc.boolean(info.IsMI)
+	case StructType:
+		enc.byte(imSTRUCT_TYPE)
+		enc.str(info.Name)
+		enc.str(info.Path)
+		enc.uint(uint64(len(info.LabelNumbers)))
+		for _, n := range info.LabelNumbers {
+			enc.int(int64(n))
+		}
+		enc.boolean(info.Snippet)
+		enc.boolean(info.Private)
+		enc.abstractTypes(info.AbstractStructFields)
+		enc.uint(uint64(len(info.AlternateStructFields)))
+		for _, at := range info.AlternateStructFields {
+			enc.altType(at)
+		}
+		enc.boolean(info.IsMI)
+	default:
+		enc.fail(fmt.Errorf("can't make an image of type information of Go type %T", info))
+	}
+}
+
+func (enc *imageEncoder) vm(vm *Vm) {
+	enc.uint(uint64(len(vm.Code)))
+	for _, op := range vm.Code {
+		enc.byte(uint8(op.Opcode))
+		enc.u32s(op.Args)
+	}
+	enc.u32s(vm.CodeTokens)
+	enc.values(vm.Mem)
+	enc.uint(uint64(len(vm.ConcreteTypeInfo)))
+	for _, info := range vm.ConcreteTypeInfo {
+		enc.typeInfo(info)
+	}
+	enc.strs(vm.Labels)
+	enc.bools(vm.LabelIsPrivate)
+	enc.uint(uint64(len(vm.Tokens)))
+	enc.uint(uint64(len(vm.LambdaFactories)))
+	for _, lf := range vm.LambdaFactories {
+		enc.lambda(lf.Model)
+		enc.u32s(lf.CaptureLocations)
+	}
+	enc.uint(uint64(len(vm.SnippetFactories)))
+	for _, sf := range vm.SnippetFactories {
+		enc.u32(uint32(sf.snippetType))
+		enc.str(sf.sourceString)
+		enc.snippetBindle(sf.bindle)
+	}
+	enc.uint(uint64(len(vm.GoFns)))
+	for _, fn := range vm.GoFns {
+		enc.str(fn.Source)
+		enc.str(fn.Symbol)
+	}
+	enc.uint(uint64(len(vm.GoPlugins)))
+	for _, plugin := range vm.GoPlugins {
+		enc.str(plugin.Source)
+		keys := sortedKeys(plugin.Converters)
+		enc.uint(uint64(len(keys)))
+		for _, k := range keys {
+			enc.str(k)
+			enc.u32(uint32(plugin.Converters[k]))
+		}
+	}
+	enc.uint(uint64(len(vm.tracking)))
+	for _, td := range vm.tracking {
+		enc.uint(uint64(td.flavor))
+		enc.token(td.tok)
+		enc.uint(uint64(len(td.args)))
+		for _, arg := range td.args {
+			enc.payload(arg, false)
+		}
+	}
+	enc.uint(uint64(len(vm.AbstractTypes)))
+	for _, info := range vm.AbstractTypes {
+		enc.str(info.Name)
+		enc.str(info.Path)
+		enc.abstractType(info.AT)
+		enc.boolean(info.IsMI)
+	}
+	enc.u32(uint32(vm.TypeNumberOfUnwrappedError))
+	if vm.Stringify == nil {
+		enc.u32(DUMMY)
+	} else {
+		enc.u32(enc.fns[vm.Stringify])
+	}
+	types := make([]values.ValueType, 0, len(vm.CodeGeneratingTypes))
+	for t := range vm.CodeGeneratingTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	enc.uint(uint64(len(types)))
+	for _, t := range types {
+		enc.u32(uint32(t))
+	}
+	enc.altTypeMap(vm.SharedTypenameToTypeList)
+	enc.altType(vm.AnyTypeScheme)
+	enc.altType(vm.AnyTuple)
+	enc.altType(vm.IsRangeable)
+	enc.u32Map(vm.FieldLabelsInMem)
+}
+
+func (enc *imageEncoder) u32Map(m map[string]uint32) {
+	keys := sortedKeys(m)
+	enc.uint(uint64(len(keys)))
+	for _, k := range keys {
+		enc.str(k)
+		enc.u32(m[k])
+	}
+}
+
+func (enc *imageEncoder) function(fn *CpFunc) {
+	enc.u32(fn.CallTo)
+	enc.u32(fn.LoReg)
+	enc.u32(fn.HiReg)
+	enc.u32(fn.OutReg)
+	enc.u32(fn.LocOfTupleAndVarargData)
+	enc.altType(fn.RtnTypes)
+	enc.str(fn.Builtin)
+	enc.boolean(fn.Xcall != nil)
+	if fn.Xcall != nil {
+		enc.u32(fn.Xcall.ExternalServiceOrdinal)
+		enc.str(fn.Xcall.FunctionName)
+		enc.u32(fn.Xcall.Position)
+	}
+	enc.boolean(fn.Private)
+	enc.boolean(fn.Command)
+	enc.strs(fn.Access)
+	enc.u32(fn.GoNumber)
+	enc.boolean(fn.HasGo)
+	enc.str(fn.Name)
+	enc.boolean(fn.Env != nil)
+	if fn.Env != nil {
+		enc.environment(fn.Env)
+	}
+	enc.u32(fn.CodeStart)
+	enc.u32(fn.CodeEnd)
+}
+
+// We only write the variables of the environment itself, not of the environments it extends:
+// the image doesn't need them, since nothing will be compiled in them.
+func (enc *imageEncoder) environment(env *Environment) {
+	keys := sortedKeys(env.Data)
+	enc.uint(uint64(len(keys)))
+	for _, k := range keys {
+		v := env.Data[k]
+		enc.str(k)
+		enc.u32(v.MLoc)
+		enc.uint(uint64(v.access))
+		enc.altType(v.types)
+	}
+}
+
+func (enc *imageEncoder) compiler(cp *Compiler, compilerNumbers map[*Compiler]uint32) {
+	enc.str(cp.ScriptFilepath)
+	enc.str(cp.P.NamespacePath)
+	enc.int(cp.Timestamp)
+	enc.u32(cp.TupleType)
+	keys := sortedKeys(cp.EnumElements)
+	enc.uint(uint64(len(keys)))
+	for _, k := range keys {
+		enc.str(k)
+		enc.value(cp.EnumElements[k])
+	}
+	enc.environment(cp.GlobalConsts)
+	enc.environment(cp.GlobalVars)
+	enc.uint(uint64(len(cp.Fns)))
+	for _, fn := range cp.Fns {
+		enc.u32(enc.fns[fn])
+	}
+	enc.abstractTypeMap(cp.P.TypeMap)
+	enc.cloneGroups(cp.TypeToCloneGroup)
+	enc.parser(cp.P)
+	modules := map[string]uint32{}
+	for name, module := range cp.Modules {
+		modules[name] = compilerNumbers[module]
+	}
+	enc.u32Map(modules)
+}
+
+func (enc *imageEncoder) cloneGroups(m map[values.ValueType]AlternateType) {
+	types := make([]values.ValueType, 0, len(m))
+	for t := range m {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	enc.uint(uint64(len(types)))
+	for _, t := range types {
+		enc.u32(uint32(t))
+		enc.altType(m[t])
+	}
+}
+
+// What the parser knows once it's been initialized. Its types are in the `TypeMap`, which we
+// write with the rest of the compiler, and its namespaces can be found from the modules.
+func (enc *imageEncoder) parser(p *parser.Parser) {
+	for _, set := range []dtypes.Set[string]{p.Functions, p.Prefixes, p.Forefixes, p.Midfixes, p.Endfixes,
+		p.Infixes, p.Suffixes, p.Unfixes, p.Bling, p.AllFunctionIdents, p.Typenames} {
+		names := set.ToSlice()
+		sort.Strings(names)
+		enc.strs(names)
+	}
+	names := sortedKeys(p.FunctionTable)
+	enc.uint(uint64(len(names)))
+	for _, name := range names {
+		enc.str(name)
+		enc.uint(uint64(len(p.FunctionTable[name])))
+		for _, fn := range p.FunctionTable[name] {
+			enc.u32(enc.prsrFns[fn])
+		}
+	}
+	names = sortedKeys(p.FunctionForest)
+	enc.uint(uint64(len(names)))
+	for _, name := range names {
+		enc.str(name)
+		enc.int(int64(p.FunctionForest[name].RefCount))
+		enc.fnTreeNode(p.FunctionForest[name].Tree)
+	}
+	enc.boolean(p.Private)
+}
+
+func (enc *imageEncoder) fnTreeNode(node *ast.FnTreeNode) {
+	if node.Fn == nil {
+		enc.u32(DUMMY)
+	} else {
+		enc.u32(enc.prsrFns[node.Fn])
+	}
+	enc.uint(uint64(len(node.Branch)))
+	for _, branch := range node.Branch {
+		enc.abstractType(branch.Type)
+		enc.boolean(branch.IsVararg)
+		enc.str(branch.Bling)
+		enc.fnTreeNode(branch.Node)
+	}
+}
+
+// We don't write the body or the `given` block, since they're only needed to compile the function,
+// but we do need the token of the body, which says where the function came from.
+func (enc *imageEncoder) prsrFunction(fn *ast.PrsrFunction, compilerNumbers map[*Compiler]uint32) {
+	enc.str(fn.FName)
+	enc.abstractSig(fn.Sig)
+	enc.stringSig(fn.NameSig)
+	enc.abstractSig(fn.RtnSig)
+	enc.stringSig(fn.NameRets)
+	if fn.Body == nil {
+		enc.u32(DUMMY)
+	} else {
+		enc.token(fn.Body.GetToken())
+	}
+	enc.boolean(fn.Cmd)
+	enc.boolean(fn.Private)
+	enc.strs(fn.Access)
+	enc.u32(fn.Number)
+	if fn.Compiler == nil {
+		enc.u32(DUMMY)
+	} else if n, ok := compilerNumbers[fn.Compiler.(*Compiler)]; ok {
+		enc.u32(n)
+	} else {
+		enc.fail(errors.New("can't make an image of a function belonging to another service"))
+	}
+	enc.u32(fn.Position)
+	enc.token(fn.Tok)
+}
+
+// As with lists of types, we distinguish between nil and empty signatures, since a nil return
+// signature means that none was supplied.
+func (enc *imageEncoder) abstractSig(sig ast.AbstractSig) {
+	if sig == nil {
+		enc.uint(0)
+		return
+	}
+	enc.uint(uint64(len(sig)) + 1)
+	for _, pair := range sig {
+		enc.str(pair.VarName)
+		enc.abstractType(pair.VarType)
+	}
+}
+
+func (enc *imageEncoder) stringSig(sig ast.StringSig) {
+	if sig == nil {
+		enc.uint(0)
+		return
+	}
+	enc.uint(uint64(len(sig)) + 1)
+	for _, pair := range sig {
+		enc.str(pair.VarName)
+		enc.str(pair.VarType)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type imageDecoder struct {
+	buf        []byte
+	tokenList  []*token.Token
+	fnList     []*CpFunc
+	prsrFnList []*ast.PrsrFunction
+	stringify  uint32 // The number of the vm's `Stringify` function, which we read before the functions.
+	e          error
+}
+
+func (dec *imageDecoder) fail(message string) {
+	if dec.e == nil {
+		dec.e = errors.New("malformed image: " + message)
+	}
+	dec.buf = nil
+}
+
+func (dec *imageDecoder) uint() uint64 {
+	x, n := binary.Uvarint(dec.buf)
+	if n <= 0 {
+		dec.fail("bad number")
+		return 0
+	}
+	dec.buf = dec.buf[n:]
+	return x
+}
+
+func (dec *imageDecoder) int() int64 {
+	x, n := binary.Varint(dec.buf)
+	if n <= 0 {
+		dec.fail("bad number")
+		return 0
+	}
+	dec.buf = dec.buf[n:]
+	return x
+}
+
+func (dec *imageDecoder) u32() uint32 {
+	x := dec.uint()
+	if x > math.MaxUint32 {
+		dec.fail("number out of range")
+		return 0
+	}
+	return uint32(x)
+}
+
+// Reads the length of a list. Since everything in the list takes up at least a byte, we can
+// reject lengths longer than what's left, so that a corrupt image can't make us allocate a lot.
+func (dec *imageDecoder) length() int {
+	n := dec.uint()
+	if n > uint64(len(dec.buf)) {
+		dec.fail("bad length")
+		return 0
+	}
+	return int(n)
+}
+
+func (dec *imageDecoder) byte() uint8 {
+	if len(dec.buf) == 0 {
+		dec.fail("unexpected end of image")
+		return 0
+	}
+	x := dec.buf[0]
+	dec.buf = dec.buf[1:]
+	return x
+}
+
+func (dec *imageDecoder) boolean() bool {
+	return dec.byte() == 1
+}
+
+func (dec *imageDecoder) str() string {
+	n := dec.length()
+	s := string(dec.buf[:n])
+	dec.buf = dec.buf[n:]
+	return s
+}
+
+func (dec *imageDecoder) strs() []string {
+	result := make([]string, dec.length())
+	for i := range result {
+		result[i] = dec.str()
+	}
+	return result
+}
+
+func (dec *imageDecoder) u32s() []uint32 {
+	result := make([]uint32, dec.length())
+	for i := range result {
+		result[i] = dec.u32()
+	}
+	return result
+}
+
+func (dec *imageDecoder) bools() []bool {
+	result := make([]bool, dec.length())
+	for i := range result {
+		result[i] = dec.boolean()
+	}
+	return result
+}
+
+func (dec *imageDecoder) token() *token.Token {
+	n := dec.u32()
+	if n == DUMMY {
+		return nil
+	}
+	if n >= uint32(len(dec.tokenList)) {
+		dec.fail("bad token number")
+		return nil
+	}
+	return dec.tokenList[n]
+}
+
+func (dec *imageDecoder) abstractType() values.AbstractType {
+	var result values.AbstractType
+	if n := dec.length(); n > 0 {
+		result.Types = make([]values.ValueType, n-1)
+		for i := range result.Types {
+			result.Types[i] = values.ValueType(dec.u32())
+		}
+	}
+	result.Varchar = dec.u32()
+	return result
+}
+
+func (dec *imageDecoder) abstractTypes() []values.AbstractType {
+	n := dec.length()
+	if n == 0 {
+		return nil
+	}
+	result := make([]values.AbstractType, n)
+	for i := range result {
+		result[i] = dec.abstractType()
+	}
+	return result
+}
+
+func (dec *imageDecoder) abstractTypeMap() map[string]values.AbstractType {
+	result := map[string]values.AbstractType{}
+	for i := dec.length(); i > 0; i-- {
+		k := dec.str()
+		result[k] = dec.abstractType()
+	}
+	return result
+}
+
+func (dec *imageDecoder) typeScheme() TypeScheme {
+	switch dec.byte() {
+	case imSIMPLE:
+		return SimpleType(dec.u32())
+	case imALTERNATE:
+		return dec.altType()
+	case imFINITE_TUPLE:
+		return FiniteTupleType(dec.altType())
+	case imTYPED_TUPLE:
+		return TypedTupleType{dec.altType()}
+	case imBLING:
+		return blingType{dec.str()}
+	}
+	dec.fail("bad typescheme")
+	return nil
+}
+
+func (dec *imageDecoder) altType() AlternateType {
+	result := make(AlternateType, dec.length())
+	for i := range result {
+		result[i] = dec.typeScheme()
+	}
+	return result
+}
+
+func (dec *imageDecoder) altTypeMap() map[string]AlternateType {
+	result := map[string]AlternateType{}
+	for i := dec.length(); i > 0; i-- {
+		k := dec.str()
+		result[k] = dec.altType()
+	}
+	return result
+}
+
+func (dec *imageDecoder) values() []values.Value {
+	result := make([]values.Value, dec.length())
+	for i := range result {
+		result[i] = dec.value()
+	}
+	return result
+}
+
+func (dec *imageDecoder) value() values.Value {
+	t := values.ValueType(dec.u32())
+	return values.Value{T: t, V: dec.payload()}
+}
+
+func (dec *imageDecoder) payload() any {
+	switch dec.byte() {
+	case imNIL:
+		return nil
+	case imINT:
+		return int(dec.int())
+	case imBOOL:
+		return dec.boolean()
+	case imSTRING:
+		return dec.str()
+	case imRUNE:
+		return rune(dec.int())
+	case imFLOAT:
+		return math.Float64frombits(dec.uint())
+	case imUINT32:
+		return dec.u32()
+	case imUINT32S:
+		return dec.u32s()
+	case imVALUES:
+		return dec.values()
+	case imABSTRACT_TYPE:
+		return dec.abstractType()
+	case imVECTOR:
+		result := vector.Empty
+		for i := dec.length(); i > 0; i-- {
+			result = result.Conj(dec.value())
+		}
+		return result
+	case imMAP:
+		result := &values.Map{}
+		for i := dec.length(); i > 0; i-- {
+			k := dec.value()
+			result = result.Set(k, dec.value())
+		}
+		return result
+	case imSET:
+		result := values.Set{}
+		for i := dec.length(); i > 0; i-- {
+			result = result.Add(dec.value())
+		}
+		return result
+	case imERROR:
+		result := &err.Error{ErrorId: dec.str(), Message: dec.str()}
+		if n := dec.length(); n > 0 {
+			result.Args = make([]any, n)
+			for i := range result.Args {
+				result.Args[i] = dec.payload()
+			}
+		}
+		if vals := dec.values(); len(vals) > 0 {
+			result.Values = vals
+		}
+		if n := dec.length(); n > 0 {
+			result.Trace = make([]*token.Token, n)
+			for i := range result.Trace {
+				result.Trace[i] = dec.token()
+			}
+		}
+		result.Token = dec.token()
+		return result
+	case imLAMBDA:
+		return *dec.lambda()
+	case imTHUNK:
+		return ThunkValue{dec.u32(), dec.u32()}
+	case imSNIPPET_BINDLE:
+		return dec.snippetBindle()
+	case imVALUE_TYPE:
+		return values.ValueType(dec.u32())
+	case imTOKEN:
+		return dec.token()
+	case imVALUE:
+		return dec.value()
+	}
+	dec.fail("bad value")
+	return nil
+}
+
+func (dec *imageDecoder) lambda() *Lambda {
+	result := &Lambda{capturesStart: dec.u32(), capturesEnd: dec.u32(), parametersEnd: dec.u32(),
+		resultLocation: dec.u32(), addressToCall: dec.u32()}
+	if captures := dec.values(); len(captures) > 0 {
+		result.captures = captures
+	}
+	result.sig = dec.abstractTypes()
+	result.rtnSig = dec.abstractTypes()
+	result.tok = dec.token()
+	return result
+}
+
+func (dec *imageDecoder) snippetBindle() *SnippetBindle {
+	result := &SnippetBindle{compiledSnippetKind: compiledSnippetKind(dec.uint()), codeLoc: dec.u32(), objectStringLoc: dec.u32()}
+	if locs := dec.u32s(); len(locs) > 0 {
+		result.valueLocs = locs
+	}
+	result.database = dec.str()
+	return result
+}
+
+func (dec *imageDecoder) typeInfo() typeInformation {
+	switch dec.byte() {
+	case imBUILTIN_TYPE:
+		return BuiltinType{name: dec.str(), path: dec.str()}
+	case imENUM_TYPE:
+		return EnumType{Name: dec.str(), Path: dec.str(), ElementNames: dec.strs(), Private: dec.boolean(), IsMI: dec.boolean()}
+	case imCLONE_TYPE:
+		return CloneType{Name: dec.str(), Path: dec.str(), Parent: values.ValueType(dec.u32()), Private: dec.boolean(),
+			IsSliceable: dec.boolean(), IsFilterable: dec.boolean(), IsMappable: dec.boolean(), IsMI: dec.boolean()}
+	case imSTRUCT_TYPE:
+		result := StructType{Name: dec.str(), Path: dec.str()}
+		result.LabelNumbers = make([]int, dec.length())
+		for i := range result.LabelNumbers {
+			result.LabelNumbers[i] = int(dec.int())
+		}
+		result.Snippet = dec.boolean()
+		result.Private = dec.boolean()
+		result.AbstractStructFields = dec.abstractTypes()
+		result.AlternateStructFields = make([]AlternateType, dec.length())
+		for i := range result.AlternateStructFields {
+			result.AlternateStructFields[i] = dec.altType()
+		}
+		result.IsMI = dec.boolean()
+		return result.AddLabels(result.LabelNumbers) // Which makes the resolving map.
+	}
+	dec.fail("bad type information")
+	return BuiltinType{}
+}
+
+func (dec *imageDecoder) vm(vm *Vm) {
+	vm.Code = make([]*Operation, dec.length())
+	for i := range vm.Code {
+		vm.Code[i] = &Operation{Opcode: Opcode(dec.byte()), Args: dec.u32s()}
+	}
+	vm.CodeTokens = dec.u32s()
+	vm.Mem = dec.values()
+	vm.ConcreteTypeInfo = make([]typeInformation, dec.length())
+	for i := range vm.ConcreteTypeInfo {
+		vm.ConcreteTypeInfo[i] = dec.typeInfo()
+	}
+	vm.Labels = dec.strs()
+	vm.LabelIsPrivate = dec.bools()
+	if n := dec.length(); n <= len(dec.tokenList) {
+		vm.Tokens = dec.tokenList[:n:n]
+	} else {
+		dec.fail("bad number of tokens")
+	}
+	vm.LambdaFactories = make([]*LambdaFactory, dec.length())
+	for i := range vm.LambdaFactories {
+		vm.LambdaFactories[i] = &LambdaFactory{Model: dec.lambda(), CaptureLocations: dec.u32s()}
+	}
+	vm.SnippetFactories = make([]*SnippetFactory, dec.length())
+	for i := range vm.SnippetFactories {
+		vm.SnippetFactories[i] = &SnippetFactory{snippetType: values.ValueType(dec.u32()), sourceString: dec.str(), bindle: dec.snippetBindle()}
+	}
+	vm.GoFns = make([]GoFn, dec.length())
+	for i := range vm.GoFns {
+		vm.GoFns[i] = GoFn{Source: dec.str(), Symbol: dec.str()}
+	}
+	vm.GoPlugins = make([]GoPlugin, dec.length())
+	for i := range vm.GoPlugins {
+		vm.GoPlugins[i].Source = dec.str()
+		vm.GoPlugins[i].Converters = map[string]values.ValueType{}
+		for j := dec.length(); j > 0; j-- {
+			k := dec.str()
+			vm.GoPlugins[i].Converters[k] = values.ValueType(dec.u32())
+		}
+	}
+	vm.tracking = make([]TrackingData, dec.length())
+	for i := range vm.tracking {
+		vm.tracking[i] = TrackingData{flavor: trackingFlavor(dec.uint()), tok: dec.token()}
+		vm.tracking[i].args = make([]any, dec.length())
+		for j := range vm.tracking[i].args {
+			vm.tracking[i].args[j] = dec.payload()
+		}
+	}
+	vm.AbstractTypes = make([]values.AbstractTypeInfo, dec.length())
+	for i := range vm.AbstractTypes {
+		vm.AbstractTypes[i] = values.AbstractTypeInfo{Name: dec.str(), Path: dec.str(), AT: dec.abstractType(), IsMI: dec.boolean()}
+	}
+	vm.TypeNumberOfUnwrappedError = values.ValueType(dec.u32())
+	dec.stringify = dec.u32() // We can't look it up until we've read the functions.
+	vm.CodeGeneratingTypes = make(dtypes.Set[values.ValueType])
+	for i := dec.length(); i > 0; i-- {
+		vm.CodeGeneratingTypes.Add(values.ValueType(dec.u32()))
+	}
+	vm.SharedTypenameToTypeList = dec.altTypeMap()
+	vm.AnyTypeScheme = dec.altType()
+	vm.AnyTuple = dec.altType()
+	vm.IsRangeable = dec.altType()
+	vm.FieldLabelsInMem = dec.u32Map()
+}
+
+func (dec *imageDecoder) u32Map() map[string]uint32 {
+	result := map[string]uint32{}
+	for i := dec.length(); i > 0; i-- {
+		k := dec.str()
+		result[k] = dec.u32()
+	}
+	return result
+}
+
+func (dec *imageDecoder) function(fn *CpFunc) {
+	fn.CallTo = dec.u32()
+	fn.LoReg = dec.u32()
+	fn.HiReg = dec.u32()
+	fn.OutReg = dec.u32()
+	fn.LocOfTupleAndVarargData = dec.u32()
+	fn.RtnTypes = dec.altType()
+	fn.Builtin = dec.str()
+	if dec.boolean() {
+		fn.Xcall = &XBindle{ExternalServiceOrdinal: dec.u32(), FunctionName: dec.str(), Position: dec.u32()}
+	}
+	fn.Private = dec.boolean()
+	fn.Command = dec.boolean()
+	fn.Access = dec.strs()
+	fn.GoNumber = dec.u32()
+	fn.HasGo = dec.boolean()
+	fn.Name = dec.str()
+	if dec.boolean() {
+		fn.Env = dec.environment()
+	}
+	fn.CodeStart = dec.u32()
+	fn.CodeEnd = dec.u32()
+}
+
+func (dec *imageDecoder) environment() *Environment {
+	result := NewEnvironment()
+	for i := dec.length(); i > 0; i-- {
+		k := dec.str()
+		result.Data[k] = variable{MLoc: dec.u32(), access: VarAccess(dec.uint()), types: dec.altType()}
+	}
+	return result
+}
+
+func (dec *imageDecoder) compiler(vm *Vm, common *parser.CommonParserBindle) *Compiler {
+	scriptFilepath := dec.str()
+	cp := NewCompiler(parser.New(common, scriptFilepath, "", dec.str()))
+	cp.Vm = vm
+	cp.ScriptFilepath = scriptFilepath
+	cp.Timestamp = dec.int()
+	cp.TupleType = dec.u32()
+	for i := dec.length(); i > 0; i-- {
+		k := dec.str()
+		cp.EnumElements[k] = dec.value()
+	}
+	cp.GlobalConsts = dec.environment()
+	cp.GlobalVars = dec.environment()
+	cp.GlobalVars.Ext = cp.GlobalConsts
+	cp.Fns = make([]*CpFunc, dec.length())
+	for i := range cp.Fns {
+		cp.Fns[i] = dec.functionNumbered(dec.u32())
+	}
+	cp.P.TypeMap = dec.abstractTypeMap()
+	cp.TypeNameToTypeScheme = make(map[string]AlternateType) // As made by the initializer from the abstract types.
+	for typename, abType := range cp.P.TypeMap {
+		cp.TypeNameToTypeScheme[typename] = AbstractTypeToAlternateType(abType)
+	}
+	for typename, abType := range common.Types {
+		cp.TypeNameToTypeScheme[typename] = AbstractTypeToAlternateType(abType)
+	}
+	for i := dec.length(); i > 0; i-- {
+		t := values.ValueType(dec.u32())
+		cp.TypeToCloneGroup[t] = dec.altType()
+	}
+	dec.parser(cp.P)
+	return cp
+}
+
+func (dec *imageDecoder) parser(p *parser.Parser) {
+	for _, set := range []*dtypes.Set[string]{&p.Functions, &p.Prefixes, &p.Forefixes, &p.Midfixes, &p.Endfixes,
+		&p.Infixes, &p.Suffixes, &p.Unfixes, &p.Bling, &p.AllFunctionIdents, &p.Typenames} {
+		*set = dtypes.MakeFromSlice(dec.strs())
+	}
+	for i := dec.length(); i > 0; i-- {
+		name := dec.str()
+		fns := make([]*ast.PrsrFunction, dec.length())
+		for j := range fns {
+			fns[j] = dec.prsrFunctionNumbered(dec.u32())
+		}
+		p.FunctionTable[name] = fns
+	}
+	for i := dec.length(); i > 0; i-- {
+		name := dec.str()
+		refCount := int(dec.int())
+		p.FunctionForest[name] = &ast.FunctionTree{Tree: dec.fnTreeNode(), RefCount: refCount}
+	}
+	p.Private = dec.boolean()
+}
+
+func (dec *imageDecoder) fnTreeNode() *ast.FnTreeNode {
+	result := &ast.FnTreeNode{}
+	if n := dec.u32(); n != DUMMY {
+		result.Fn = dec.prsrFunctionNumbered(n)
+	}
+	result.Branch = make([]*ast.TypeNodePair, dec.length())
+	for i := range result.Branch {
+		result.Branch[i] = &ast.TypeNodePair{Type: dec.abstractType(), IsVararg: dec.boolean(), Bling: dec.str()}
+		result.Branch[i].Node = dec.fnTreeNode()
+	}
+	return result
+}
+
+// Reads a function as the parser sees it, returning the number of its compiler, which we can't
+// look up until we've read the compilers.
+func (dec *imageDecoder) prsrFunction(fn *ast.PrsrFunction) uint32 {
+	fn.FName = dec.str()
+	fn.Sig = dec.abstractSig()
+	fn.NameSig = dec.stringSig()
+	fn.RtnSig = dec.abstractSig()
+	fn.NameRets = dec.stringSig()
+	if bodyTok := dec.token(); bodyTok != nil {
+		fn.Body = &ast.Nothing{Token: *bodyTok}
+	}
+	fn.Cmd = dec.boolean()
+	fn.Private = dec.boolean()
+	if access := dec.strs(); len(access) > 0 {
+		fn.Access = access
+	}
+	fn.Number = dec.u32()
+	compilerNumber := dec.u32()
+	fn.Position = dec.u32()
+	fn.Tok = dec.token()
+	return compilerNumber
+}
+
+func (dec *imageDecoder) abstractSig() ast.AbstractSig {
+	n := dec.length()
+	if n == 0 {
+		return nil
+	}
+	result := make(ast.AbstractSig, n-1)
+	for i := range result {
+		result[i] = ast.NameAbstractTypePair{VarName: dec.str(), VarType: dec.abstractType()}
+	}
+	return result
+}
+
+func (dec *imageDecoder) stringSig() ast.StringSig {
+	n := dec.length()
+	if n == 0 {
+		return nil
+	}
+	result := make(ast.StringSig, n-1)
+	for i := range result {
+		result[i] = ast.NameTypenamePair{VarName: dec.str(), VarType: dec.str()}
+	}
+	return result
+}
+
+func (dec *imageDecoder) prsrFunctionNumbered(n uint32) *ast.PrsrFunction {
+	if n >= uint32(len(dec.prsrFnList)) {
+		dec.fail("bad function number")
+		return &ast.PrsrFunction{}
+	}
+	return dec.prsrFnList[n]
+}
+
+func (dec *imageDecoder) functionNumbered(n uint32) *CpFunc {
+	if n >= uint32(len(dec.fnList)) {
+		dec.fail("bad function number")
+		return &CpFunc{}
+	}
+	return dec.fnList[n]
+}
@@ -12,6 +12,13 @@ type InHandler interface {
 	Get() string
 }
 
+// An InHandler which wants the prompt of the `Input` it's getting from, e.g. to pass it on to a
+// user at the other end of a network. The vm calls `GetWithPrompt` rather than `Get`.
+type PromptingInHandler interface {
+	InHandler
+	GetWithPrompt(prompt string) string
+}
+
 type OutHandler interface {
 	Out(v values.Value)
 	Write(s string)
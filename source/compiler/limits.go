@@ -0,0 +1,191 @@
+package compiler
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/err"
+	"github.com/tim-hardcastle/Pipefish/source/token"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+
+	"src.elv.sh/pkg/persistent/vector"
+)
+
+// Limits on what a call to a service may do, so that a runaway function returns an error rather
+// than hanging the service. A zero field means there is no limit of that kind.
+type Limits struct {
+	Instructions   int           // How many instructions of bytecode the call may execute.
+	Time           time.Duration // How long the call may take.
+	RecursionDepth int           // How many recursive calls may be waiting at once, i.e. the height of the recursion stack.
+	Memory         int           // How many values the call may add to memory, as estimated by `memoryInUse`.
+}
+
+// Apart from the instruction count, the limits and the context are only checked this often, so
+// that checking them costs little.
+const LIMIT_CHECK_INTERVAL = 1024
+
+// Finding how much memory is in use means looking through all of it, so we do it less often.
+const MEMORY_CHECK_INTERVAL = 16 * LIMIT_CHECK_INTERVAL
+
+// The state of a run of the vm which is subject to limits or to cancellation.
+type limiter struct {
+	ctx             context.Context
+	limits          Limits
+	start           time.Time
+	instructions    int
+	maxInstructions int
+	recursionHeight int // The height of the recursion stack when the run started.
+	memoryAtStart   int // How much memory was in use when the run started, if there's a limit on it.
+}
+
+// What the limiter panics with when a limit is exceeded, to be recovered by `RunContext`. We do it
+// this way because the run may be nested inside Go code, e.g. a lambda being called by a Go
+// function, which would otherwise carry on with whatever it found in memory.
+type limitExceeded struct {
+	e *err.Error
+}
+
+// Runs the code at the location like `Run`, but subject to the vm's `Limits` and to the
+// context. If a limit is exceeded or the context is done, the vm is returned to the state it
+// was in before the call and we return the error and `false`.
+func (vm *Vm) RunContext(ctx context.Context, loc uint32) (result values.Value, ok bool) {
+	if vm.limiter != nil || ctx.Done() == nil && vm.Limits == (Limits{}) {
+		vm.Run(loc)
+		return values.UNDEF, true
+	}
+	l := &limiter{ctx: ctx, limits: vm.Limits, start: time.Now(), maxInstructions: math.MaxInt,
+		recursionHeight: len(vm.recursionStack)}
+	if vm.Limits.Instructions > 0 {
+		l.maxInstructions = vm.Limits.Instructions
+	}
+	if vm.Limits.Memory > 0 {
+		l.memoryAtStart = vm.memoryInUse(l.recursionHeight)
+	}
+	stackHeight := len(vm.callstack)
+	transactionDepth := vm.transactionDepth
+	vm.limiter = l
+	defer func() {
+		vm.limiter = nil
+		r := recover()
+		if r == nil {
+			return
+		}
+		stop, isLimit := r.(limitExceeded)
+		if !isLimit {
+			panic(r)
+		}
+		vm.callstack = vm.callstack[:stackHeight]
+		vm.abandonTransactions(transactionDepth)
+		for len(vm.recursionStack) > l.recursionHeight {
+			rData := vm.recursionStack[len(vm.recursionStack)-1]
+			vm.recursionStack = vm.recursionStack[:len(vm.recursionStack)-1]
+			copy(vm.Mem[rData.loc:int(rData.loc)+len(rData.mems)], rData.mems)
+		}
+		result, ok = values.Value{T: values.ERROR, V: stop.e}, false
+	}()
+	vm.Run(loc)
+	return values.UNDEF, true
+}
+
+// The context for a call the vm makes to another service on the same hub: that of the run making
+// the call, if any, with the run's time limit as its deadline.
+func (vm *Vm) callContext() (context.Context, context.CancelFunc) {
+	if vm.limiter == nil {
+		return context.WithCancel(vm.foldingContext())
+	}
+	if vm.limiter.limits.Time > 0 {
+		return context.WithDeadline(vm.limiter.ctx, vm.limiter.start.Add(vm.limiter.limits.Time))
+	}
+	return context.WithCancel(vm.limiter.ctx)
+}
+
+// Sets the context which constant folding is subject to while we compile a line for `DoContext`,
+// since folding a constant can run any function of the service. Returns a function to unset it.
+func (vm *Vm) SetFoldingContext(ctx context.Context) func() {
+	vm.folding = ctx
+	return func() { vm.folding = nil }
+}
+
+func (vm *Vm) foldingContext() context.Context {
+	if vm.folding == nil {
+		return context.Background()
+	}
+	return vm.folding
+}
+
+// Called by the vm before each instruction.
+func (l *limiter) check(vm *Vm, loc uint32) {
+	l.instructions++
+	if l.instructions%LIMIT_CHECK_INTERVAL != 0 && l.instructions <= l.maxInstructions {
+		return
+	}
+	if l.instructions > l.maxInstructions {
+		l.stop(vm, loc, "vm/limit/instructions", l.maxInstructions)
+	}
+	if e := l.ctx.Err(); e != nil {
+		if errors.Is(e, context.DeadlineExceeded) {
+			deadline, _ := l.ctx.Deadline()
+			l.stop(vm, loc, "vm/limit/time", deadline.Sub(l.start).Round(time.Millisecond))
+		}
+		l.stop(vm, loc, "vm/limit/cancel")
+	}
+	if l.limits.Time > 0 && time.Since(l.start) > l.limits.Time {
+		l.stop(vm, loc, "vm/limit/time", l.limits.Time)
+	}
+	depth := len(vm.recursionStack) - l.recursionHeight
+	if l.limits.RecursionDepth > 0 && depth > l.limits.RecursionDepth {
+		l.stop(vm, loc, "vm/limit/depth", l.limits.RecursionDepth)
+	}
+	if l.limits.Memory > 0 && l.instructions%MEMORY_CHECK_INTERVAL == 0 &&
+		vm.memoryInUse(l.recursionHeight)-l.memoryAtStart > l.limits.Memory {
+		l.stop(vm, loc, "vm/limit/memory", l.limits.Memory)
+	}
+}
+
+// Estimates how many values the vm is keeping in memory: those in `Mem`, and those which recursive
+// calls above the given height have saved on the recursion stack. The elements of a container
+// count as values, as does each eight bytes of a string; but containers inside other containers
+// count as one value, so that we can do this often without slowing the vm down much.
+func (vm *Vm) memoryInUse(recursionHeight int) int {
+	result := sizeOfValues(vm.Mem)
+	for _, rData := range vm.recursionStack[recursionHeight:] {
+		result += sizeOfValues(rData.mems)
+	}
+	return result
+}
+
+func sizeOfValues(vals []values.Value) int {
+	result := len(vals)
+	for _, v := range vals {
+		switch x := v.V.(type) {
+		case vector.Vector:
+			result += x.Len()
+		case *values.Map:
+			result += x.Len()
+		case values.Set:
+			result += x.Len()
+		case []values.Value:
+			result += len(x)
+		case string:
+			result += len(x) / 8
+		}
+	}
+	return result
+}
+
+// Makes the error, with a trace going back through the callstack, and stops the run.
+func (l *limiter) stop(vm *Vm, loc uint32, errorId string, args ...any) {
+	e := err.CreateErr(errorId, vm.tokenAt(loc), args...)
+	e.Trace = []*token.Token{}
+	if e.Token != nil {
+		e.AddToTrace(e.Token)
+	}
+	for i := len(vm.callstack) - 1; i >= 0; i-- {
+		if tok := vm.tokenAt(vm.callstack[i]); tok != nil {
+			e.AddToTrace(tok)
+		}
+	}
+	panic(limitExceeded{e})
+}
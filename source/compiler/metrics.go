@@ -0,0 +1,40 @@
+package compiler
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/metrics"
+	"github.com/tim-hardcastle/Pipefish/source/token"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+)
+
+// What a vm has done, for monitoring. It's always kept, so it has to be cheap: `Run` counts the
+// instructions it executes in a local variable, and adds them on when it returns. The counters
+// can be read while the vm is running.
+type VmMetrics struct {
+	Instructions  atomic.Uint64      // How many instructions of bytecode the vm has executed.
+	MemSize       atomic.Int64       // How many values were in `Mem` when the vm last finished a run.
+	ExternalCalls *metrics.Histogram // How many seconds calls to external services took, by the name of the service.
+}
+
+func NewVmMetrics() *VmMetrics {
+	return &VmMetrics{ExternalCalls: metrics.NewHistogram(metrics.DEFAULT_BUCKETS)}
+}
+
+// Called by `Run` when it returns.
+func (vm *Vm) countRun(instructions uint64) {
+	vm.Metrics.Instructions.Add(instructions)
+	vm.Metrics.MemSize.Store(int64(len(vm.Mem)))
+}
+
+// The token is where the call was made, for the error if it couldn't be.
+func (vm *Vm) callExternal(externalOrdinal uint32, call *externalCall, tok *token.Token) values.Value {
+	start := time.Now()
+	result, e := vm.ExternalCallHandlers[externalOrdinal].evaluate(vm, call)
+	vm.Metrics.ExternalCalls.Observe(time.Since(start).Seconds(), vm.ExternalServiceNames[externalOrdinal])
+	if e != nil {
+		return values.Value{values.ERROR, externalError(e, vm.ExternalServiceNames[externalOrdinal], tok)}
+	}
+	return result
+}
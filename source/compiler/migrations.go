@@ -0,0 +1,346 @@
+package compiler
+
+// Works out how the tables which a service declares with `CREATE TABLE <name> |<struct type>|` have
+// drifted from the struct types since the tables were created, and what SQL would bring them back
+// into line. The hub uses this to write and apply migration scripts, and keeps track of them.
+
+// We find out about the live table by asking for its columns with a query that returns no rows,
+// since every driver can do that. Not every driver says truly whether a column is nullable, or how
+// long a `VARCHAR` is, so we only compare these when it does. Tables which don't exist yet are left
+// for the service to create.
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tim-hardcastle/Pipefish/source/values"
+)
+
+// How the tables declared by a service differ from their struct types.
+type MigrationPlan struct {
+	Tables []*TableMigration
+}
+
+// How one table differs from the struct type it was declared from.
+type TableMigration struct {
+	Table   string
+	Type    string            // The name of the struct type.
+	Columns []MigrationColumn // The columns the table should have, in the order of the fields of the type.
+	Dropped []string          // The columns of the table which the type doesn't have.
+	Renames []ColumnRename    // Possible renames, each pairing a dropped column with a new one of a compatible type.
+}
+
+type MigrationColumn struct {
+	Name    string
+	Decl    string // As in `CREATE TABLE`, e.g. `VARCHAR(20) NOT NULL`.
+	Default string // An SQL literal to fill the column with in existing rows, or "" for NULL.
+	Was     string // The name of the column in the live table, or "" if it's new.
+	Altered bool   // Whether the type of the column in the live table is different.
+}
+
+// A rename is only acted on if it's been confirmed, since otherwise we can't tell it apart from
+// dropping one column and adding another.
+type ColumnRename struct {
+	From, To  string
+	Confirmed bool
+	altered   bool // Whether the type of the column should change as well as its name.
+}
+
+var createTableRegex = regexp.MustCompile(`(?i)CREATE\s+TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?(\w+)\s*\|\s*([\w.]+)\s*\|`)
+
+// Compares each table declared by the service with its struct type, returning the tables which differ.
+func (vm *Vm) PlanMigration() (*MigrationPlan, error) {
+	if vm.Database == nil {
+		return nil, errors.New("the service has no database")
+	}
+	plan := &MigrationPlan{}
+	for _, table := range vm.sqlTables() {
+		tm, ok, err := vm.planTableMigration(table.name, table.structType)
+		if err != nil {
+			return nil, err
+		}
+		if ok && !tm.IsEmpty() {
+			plan.Tables = append(plan.Tables, tm)
+		}
+	}
+	return plan, nil
+}
+
+type sqlTable struct {
+	name       string
+	structType values.ValueType
+}
+
+// Finds the tables declared in the SQL snippets of the service which go to its own database.
+func (vm *Vm) sqlTables() []sqlTable {
+	result := []sqlTable{}
+	seen := map[string]bool{}
+	for _, snF := range vm.SnippetFactories {
+		if snF.bindle == nil || snF.bindle.compiledSnippetKind != SQL_SNIPPET || snF.bindle.database != "" {
+			continue
+		}
+		for _, match := range createTableRegex.FindAllStringSubmatch(snF.sourceString, -1) {
+			if seen[strings.ToLower(match[1])] {
+				continue
+			}
+			for ty := int(values.FIRST_DEFINED_TYPE); ty < len(vm.ConcreteTypeInfo); ty++ {
+				if structInfo, ok := vm.ConcreteTypeInfo[ty].(StructType); ok && !structInfo.Snippet &&
+					structInfo.GetName(LITERAL) == match[2] {
+					seen[strings.ToLower(match[1])] = true
+					result = append(result, sqlTable{match[1], values.ValueType(ty)})
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Returns false if the table doesn't exist or can't be described in SQL.
+func (vm *Vm) planTableMigration(table string, structType values.ValueType) (*TableMigration, bool, error) {
+	structInfo := vm.ConcreteTypeInfo[structType].(StructType)
+	rows, err := vm.Database.Query("SELECT * FROM " + table + " WHERE 1 = 0")
+	if err != nil {
+		return nil, false, nil
+	}
+	defer rows.Close()
+	liveColumns, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, false, err
+	}
+	tm := &TableMigration{Table: table, Type: structInfo.GetName(LITERAL)}
+	matched := make([]bool, len(liveColumns))
+	for i, fieldType := range structInfo.AbstractStructFields {
+		column := MigrationColumn{Name: vm.Labels[structInfo.LabelNumbers[i]], Decl: vm.getSqlType(fieldType)}
+		if column.Decl == "" {
+			return nil, false, nil
+		}
+		if !fieldType.Contains(values.NULL) {
+			column.Default = vm.sqlDefault(fieldType)
+		}
+		for j, live := range liveColumns {
+			if !matched[j] && strings.EqualFold(live.Name(), column.Name) {
+				matched[j] = true
+				column.Was = live.Name()
+				column.Altered = !sqlColumnFits(live, column.Decl)
+				break
+			}
+		}
+		tm.Columns = append(tm.Columns, column)
+	}
+	for j, live := range liveColumns {
+		if matched[j] {
+			continue
+		}
+		tm.Dropped = append(tm.Dropped, live.Name())
+		for _, column := range tm.Columns {
+			if column.Was == "" && !tm.isRenameTarget(column.Name) &&
+				sqlFamily(live.DatabaseTypeName()) == sqlFamily(column.Decl) {
+				tm.Renames = append(tm.Renames, ColumnRename{From: live.Name(), To: column.Name,
+					altered: !sqlColumnFits(live, column.Decl)})
+				break
+			}
+		}
+	}
+	return tm, true, nil
+}
+
+func (tm *TableMigration) isRenameTarget(name string) bool {
+	for _, rename := range tm.Renames {
+		if rename.To == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the table already has the columns and types of the struct type.
+func (tm *TableMigration) IsEmpty() bool {
+	if len(tm.Dropped) > 0 {
+		return false
+	}
+	for _, column := range tm.Columns {
+		if column.Was == "" || column.Altered {
+			return false
+		}
+	}
+	return true
+}
+
+// The SQL statements which make the table fit the struct type, acting on the confirmed renames. If
+// the type of any column has changed, we rebuild the table, since not every database can alter the
+// type of a column.
+func (tm *TableMigration) Statements() []string {
+	columns, dropped := tm.withRenames()
+	result := []string{}
+	rebuild := false
+	for _, column := range columns {
+		rebuild = rebuild || column.Altered
+	}
+	if rebuild {
+		newTable := tm.Table + "_pipefish_new"
+		decls, names, sources := []string{}, []string{}, []string{}
+		for _, column := range columns {
+			decls = append(decls, column.Name+" "+column.Decl)
+			names = append(names, column.Name)
+			switch {
+			case column.Was == "" && column.Default == "":
+				sources = append(sources, "NULL")
+			case column.Was == "":
+				sources = append(sources, column.Default)
+			case column.Altered && sqlFamily(column.Decl) != "timestamp":
+				sources = append(sources, "CAST("+column.Was+" AS "+strings.TrimSuffix(column.Decl, " NOT NULL")+")")
+			default:
+				sources = append(sources, column.Was)
+			}
+		}
+		return append(result,
+			"CREATE TABLE "+newTable+" ("+strings.Join(decls, ", ")+")",
+			"INSERT INTO "+newTable+" ("+strings.Join(names, ", ")+") SELECT "+strings.Join(sources, ", ")+" FROM "+tm.Table,
+			"DROP TABLE "+tm.Table,
+			"ALTER TABLE "+newTable+" RENAME TO "+tm.Table)
+	}
+	for _, column := range columns {
+		if column.Was != "" && !strings.EqualFold(column.Was, column.Name) {
+			result = append(result, "ALTER TABLE "+tm.Table+" RENAME COLUMN "+column.Was+" TO "+column.Name)
+		}
+	}
+	for _, column := range columns {
+		if column.Was == "" {
+			statement := "ALTER TABLE " + tm.Table + " ADD COLUMN " + column.Name + " " + column.Decl
+			if column.Default != "" {
+				statement = statement + " DEFAULT " + column.Default
+			}
+			result = append(result, statement)
+		}
+	}
+	for _, name := range dropped {
+		result = append(result, "ALTER TABLE "+tm.Table+" DROP COLUMN "+name)
+	}
+	return result
+}
+
+// Describes the changes to the table, one to a line, acting on the confirmed renames.
+func (tm *TableMigration) String() string {
+	columns, dropped := tm.withRenames()
+	lines := []string{}
+	for _, column := range columns {
+		switch {
+		case column.Was == "":
+			lines = append(lines, "add column "+column.Name+" "+column.Decl)
+		case !strings.EqualFold(column.Was, column.Name) && column.Altered:
+			lines = append(lines, "rename column "+column.Was+" to "+column.Name+" and change its type to "+column.Decl)
+		case !strings.EqualFold(column.Was, column.Name):
+			lines = append(lines, "rename column "+column.Was+" to "+column.Name)
+		case column.Altered:
+			lines = append(lines, "change the type of column "+column.Name+" to "+column.Decl)
+		}
+	}
+	for _, name := range dropped {
+		lines = append(lines, "drop column "+name)
+	}
+	return tm.Table + ": " + strings.Join(lines, "; ")
+}
+
+// Returns the columns and the dropped columns as they are once the confirmed renames are made.
+func (tm *TableMigration) withRenames() ([]MigrationColumn, []string) {
+	columns := append([]MigrationColumn{}, tm.Columns...)
+	dropped := []string{}
+	for _, name := range tm.Dropped {
+		renamed := false
+		for _, rename := range tm.Renames {
+			if rename.Confirmed && rename.From == name {
+				for i := range columns {
+					if columns[i].Name == rename.To {
+						columns[i].Was = name
+						columns[i].Altered = rename.altered
+					}
+				}
+				renamed = true
+			}
+		}
+		if !renamed {
+			dropped = append(dropped, name)
+		}
+	}
+	return columns, dropped
+}
+
+// What we fill in a new column with when it can't be NULL.
+func (vm *Vm) sqlDefault(pfType values.AbstractType) string {
+	ty := pfType.Types[0]
+	if cloneInfo, ok := vm.ConcreteTypeInfo[ty].(CloneType); ok {
+		ty = cloneInfo.Parent
+	}
+	if enumInfo, ok := vm.ConcreteTypeInfo[ty].(EnumType); ok {
+		return "'" + enumInfo.ElementNames[0] + "'"
+	}
+	if vm.isTimeType(ty) {
+		return "'1970-01-01 00:00:00'"
+	}
+	switch ty {
+	case values.INT, values.FLOAT:
+		return "0"
+	case values.BOOL:
+		return "FALSE"
+	}
+	return "''"
+}
+
+// Whether the column of the live table fits the declaration, so far as the driver can tell us.
+func sqlColumnFits(live *sql.ColumnType, decl string) bool {
+	if sqlFamily(live.DatabaseTypeName()) != sqlFamily(decl) &&
+		!(sqlFamily(decl) == "bool" && sqlFamily(live.DatabaseTypeName()) == "integer") {
+		return false
+	}
+	// Some drivers say that every column is nullable, so we can only trust them when they say it isn't.
+	if nullable, ok := live.Nullable(); ok && !nullable && !strings.HasSuffix(decl, " NOT NULL") {
+		return false
+	}
+	wantedLength, ok := sqlLength(decl)
+	if !ok {
+		return true
+	}
+	liveLength, ok := live.Length()
+	if !ok || liveLength <= 0 {
+		if parsedLength, parsed := sqlLength(live.DatabaseTypeName()); parsed {
+			return parsedLength == wantedLength
+		}
+		return true
+	}
+	return liveLength == wantedLength
+}
+
+// Sorts the names databases give their types into the kinds of value they hold.
+func sqlFamily(typeName string) string {
+	typeName = strings.ToUpper(typeName)
+	switch {
+	case strings.Contains(typeName, "BOOL"):
+		return "bool"
+	case strings.Contains(typeName, "INT"):
+		return "integer"
+	case strings.Contains(typeName, "DOUBLE"), strings.Contains(typeName, "FLOAT"), strings.Contains(typeName, "REAL"),
+		strings.Contains(typeName, "NUMERIC"), strings.Contains(typeName, "DECIMAL"):
+		return "float"
+	case strings.Contains(typeName, "TIME"), strings.Contains(typeName, "DATE"):
+		return "timestamp"
+	case strings.Contains(typeName, "CHAR"), strings.Contains(typeName, "TEXT"), strings.Contains(typeName, "STRING"),
+		strings.Contains(typeName, "CLOB"):
+		return "text"
+	}
+	return typeName
+}
+
+var sqlLengthRegex = regexp.MustCompile(`CHAR\s*\(\s*(\d+)\s*\)`)
+
+func sqlLength(typeName string) (int64, bool) {
+	match := sqlLengthRegex.FindStringSubmatch(strings.ToUpper(typeName))
+	if match == nil {
+		return 0, false
+	}
+	length, err := strconv.ParseInt(match[1], 10, 64)
+	return length, err == nil
+}
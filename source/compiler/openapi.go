@@ -0,0 +1,280 @@
+package compiler
+
+// Generates an OpenAPI 3.1 document describing how to call the public functions and commands of a
+// service over HTTP, as the hub lets you do at `/services/{name}/call/{function}`. This covers the
+// same ground as `SerializeApi`, but the types are described by JSON Schemas, according to the
+// scheme for converting Pipefish values to JSON described in `vmjson.go`. The enums, structs and
+// clones have schemas of their own in the components of the document; abstract types are written
+// out as the `oneOf` of their concrete types.
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/tim-hardcastle/Pipefish/source/ast"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+)
+
+type openApiGenerator struct {
+	cp      *Compiler
+	schemas map[string]any // The schemas of the enums, structs, and clones, by name.
+}
+
+// Returns the document as something which can be passed to `json.Marshal`. The service name is
+// needed for the paths, and `basicAuth` says whether the caller must supply a username and password,
+// or else a bearer token from the hub's login endpoint.
+func (cp *Compiler) OpenApi(serviceName string, basicAuth bool) map[string]any {
+	g := &openApiGenerator{cp: cp, schemas: map[string]any{}}
+	g.schemas["call-error"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"errorId": map[string]any{"type": "string"},
+			"message": map[string]any{"type": "string"},
+		},
+		"required": []string{"message"},
+	}
+	g.schemas["call-error-response"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"error":  map[string]any{"$ref": "#/components/schemas/call-error"},
+			"output": map[string]any{"type": "string"},
+		},
+		"required": []string{"error"},
+	}
+	for ty := int(values.FIRST_DEFINED_TYPE); ty < len(cp.Vm.ConcreteTypeInfo); ty++ {
+		typeInfo := cp.Vm.ConcreteTypeInfo[ty]
+		if typeInfo.IsPrivate() || typeInfo.isMandatoryImport() {
+			continue
+		}
+		if structInfo, ok := typeInfo.(StructType); ok && structInfo.Snippet {
+			continue
+		}
+		g.concreteTypeSchema(values.ValueType(ty))
+	}
+	paths := map[string]any{}
+	for name, fns := range cp.P.FunctionTable {
+		if operation, ok := g.operation(name, fns); ok {
+			paths["/services/"+url.PathEscape(serviceName)+"/call/"+url.PathEscape(name)] = map[string]any{"post": operation}
+		}
+	}
+	components := map[string]any{"schemas": g.schemas}
+	doc := map[string]any{
+		"openapi":    "3.1.0",
+		"info":       map[string]any{"title": serviceName, "version": "1.0"},
+		"paths":      paths,
+		"components": components,
+	}
+	if basicAuth {
+		components["securitySchemes"] = map[string]any{
+			"basicAuth":  map[string]any{"type": "http", "scheme": "basic"},
+			"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+		}
+		doc["security"] = []any{map[string]any{"basicAuth": []string{}}, map[string]any{"bearerAuth": []string{}}}
+	}
+	return doc
+}
+
+func (g *openApiGenerator) operation(name string, fns []*ast.PrsrFunction) (map[string]any, bool) {
+	argSchemas := []any{}
+	rtnTypes := AlternateType{}
+	sigs := []string{}
+	isCommand := false
+	for _, fn := range fns {
+		if !isApiFunction(fn) {
+			continue
+		}
+		argSchema, ok := g.argumentsSchema(fn)
+		if !ok {
+			continue
+		}
+		argSchemas = append(argSchemas, argSchema)
+		rtnTypes = rtnTypes.Union(g.cp.Fns[fn.Number].RtnTypes)
+		sigs = append(sigs, name+" "+fn.NameSig.String())
+		isCommand = isCommand || fn.Cmd
+	}
+	if len(argSchemas) == 0 {
+		return nil, false
+	}
+	summary := "Calls the function " + name + "."
+	if isCommand {
+		summary = "Calls the command " + name + "."
+	}
+	errorResponse := func(description string) map[string]any {
+		return map[string]any{
+			"description": description,
+			"content": map[string]any{"application/json": map[string]any{
+				"schema": map[string]any{"$ref": "#/components/schemas/call-error-response"}}},
+		}
+	}
+	result := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"result": g.typeSchemeSchema(rtnTypes),
+			"output": map[string]any{"type": "string"},
+		},
+		"required": []string{"result"},
+	}
+	return map[string]any{
+		"operationId": name,
+		"summary":     summary,
+		"description": "Signatures:\n\n" + strings.Join(sigs, "\n\n"),
+		"requestBody": map[string]any{
+			"description": "The arguments, as an array.",
+			"content":     map[string]any{"application/json": map[string]any{"schema": oneOf(argSchemas)}},
+		},
+		"responses": map[string]any{
+			"200": map[string]any{
+				"description": "The value returned, or the runtime error.",
+				"content": map[string]any{"application/json": map[string]any{
+					"schema": oneOf([]any{result, map[string]any{"$ref": "#/components/schemas/call-error-response"}})}},
+			},
+			"400": errorResponse("The arguments don't fit any signature of the function."),
+			"404": errorResponse("There is no such service or function."),
+		},
+	}, true
+}
+
+// Describes the JSON array of arguments which fits the function's signature, on the same
+// principles as `MatchJsonArguments`.
+func (g *openApiGenerator) argumentsSchema(fn *ast.PrsrFunction) (map[string]any, bool) {
+	items := []any{}
+	var varargs any
+	for i, pair := range fn.NameSig {
+		switch {
+		case pair.VarType == "bling":
+		case pair.VarType == "ref":
+			return nil, false
+		case strings.HasPrefix(pair.VarType, "..."):
+			if i != len(fn.NameSig)-1 {
+				return nil, false
+			}
+			varargs = g.abstractTypeSchema(fn.Sig[i].VarType)
+		default:
+			items = append(items, g.abstractTypeSchema(fn.Sig[i].VarType))
+		}
+	}
+	result := map[string]any{"type": "array", "minItems": len(items)}
+	if len(items) > 0 {
+		result["prefixItems"] = items
+	}
+	if varargs == nil {
+		result["maxItems"] = len(items)
+	} else {
+		result["items"] = varargs
+	}
+	return result, true
+}
+
+func (g *openApiGenerator) abstractTypeSchema(aT values.AbstractType) any {
+	if g.cp.P.GetAbstractType("any").IsSubtypeOf(aT) { // Then it's 'any' or 'any?'.
+		return map[string]any{}
+	}
+	schemas := []any{}
+	for _, t := range aT.Types {
+		schema := g.concreteTypeSchema(t)
+		if t == values.STRING && aT.Varchar < DUMMY {
+			schema = map[string]any{"type": "string", "maxLength": aT.Varchar}
+		}
+		schemas = append(schemas, schema)
+	}
+	return oneOf(schemas)
+}
+
+func (g *openApiGenerator) typeSchemeSchema(t TypeScheme) any {
+	switch t := t.(type) {
+	case SimpleType:
+		if values.ValueType(t) == values.ERROR { // Errors are returned as a `call-error-response`.
+			return nil
+		}
+		return g.concreteTypeSchema(values.ValueType(t))
+	case AlternateType:
+		schemas := []any{}
+		for _, u := range t {
+			if schema := g.typeSchemeSchema(u); schema != nil {
+				schemas = append(schemas, schema)
+			}
+		}
+		return oneOf(schemas)
+	case FiniteTupleType:
+		items := []any{}
+		for _, u := range t {
+			schema := g.typeSchemeSchema(u)
+			if schema == nil {
+				schema = map[string]any{}
+			}
+			items = append(items, schema)
+		}
+		return map[string]any{"type": "array", "prefixItems": items, "minItems": len(items), "maxItems": len(items)}
+	case TypedTupleType:
+		return map[string]any{"type": "array", "items": g.typeSchemeSchema(t.T)}
+	}
+	return map[string]any{}
+}
+
+// Returns the schema of a concrete type, or a reference to it in the components if it's a
+// user-defined type, in which case we make sure it's there.
+func (g *openApiGenerator) concreteTypeSchema(ty values.ValueType) any {
+	typeInfo := g.cp.Vm.ConcreteTypeInfo[ty]
+	if _, ok := typeInfo.(BuiltinType); !ok {
+		name := typeInfo.GetName(DEFAULT)
+		ref := map[string]any{"$ref": "#/components/schemas/" + name}
+		if _, ok := g.schemas[name]; ok {
+			return ref
+		}
+		g.schemas[name] = map[string]any{} // So that recursive types don't recurse forever.
+		switch typeInfo := typeInfo.(type) {
+		case EnumType:
+			g.schemas[name] = map[string]any{"type": "string", "enum": typeInfo.ElementNames}
+		case StructType:
+			properties := map[string]any{}
+			required := []string{}
+			for i, lb := range typeInfo.LabelNumbers {
+				properties[g.cp.Vm.Labels[lb]] = g.abstractTypeSchema(typeInfo.AbstractStructFields[i])
+				if !typeInfo.AbstractStructFields[i].Contains(values.NULL) {
+					required = append(required, g.cp.Vm.Labels[lb])
+				}
+			}
+			g.schemas[name] = map[string]any{"type": "object", "properties": properties,
+				"required": required, "additionalProperties": false}
+		case CloneType:
+			g.schemas[name] = g.concreteTypeSchema(typeInfo.Parent)
+		}
+		return ref
+	}
+	switch ty {
+	case values.NULL:
+		return map[string]any{"type": "null"}
+	case values.BOOL:
+		return map[string]any{"type": "boolean"}
+	case values.INT:
+		return map[string]any{"type": "integer"}
+	case values.FLOAT:
+		return map[string]any{"type": "number"}
+	case values.STRING, values.TYPE:
+		return map[string]any{"type": "string"}
+	case values.RUNE:
+		return map[string]any{"type": "string", "minLength": 1, "maxLength": 1}
+	case values.SUCCESSFUL_VALUE:
+		return map[string]any{"const": "OK"}
+	case values.LIST, values.SET, values.TUPLE:
+		return map[string]any{"type": "array"}
+	case values.PAIR:
+		return map[string]any{"type": "array", "minItems": 2, "maxItems": 2}
+	case values.MAP:
+		return oneOf([]any{
+			map[string]any{"type": "object"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "array", "minItems": 2, "maxItems": 2}},
+		})
+	}
+	return map[string]any{}
+}
+
+func oneOf(schemas []any) any {
+	switch len(schemas) {
+	case 0:
+		return map[string]any{}
+	case 1:
+		return schemas[0]
+	}
+	return map[string]any{"oneOf": schemas}
+}
@@ -126,10 +126,11 @@ var OPERANDS = map[Opcode]opDescriptor{
 	Equs: {"equs", operands{dst, mem, mem}},
 	Equt: {"equt", operands{dst, mem, mem}},
 	Eqxx: {"eqxx", operands{dst, mem, mem, tok}},
-	Extn: {"extn", operands{dst, mem, mem, mem, mem, tup}}, // Operands are: the external service to call; whether the function is PREFIX, INFIX, or POSTFIX; the remainder of the namespace of the function as a string; the name of the function as a string; the locations of the arguments.
+	Extn: {"extn", operands{dst, mem, mem, mem, mem, num, tok, tup}}, // Operands are: the external service to call; whether the function is PREFIX, INFIX, or POSTFIX; the remainder of the namespace of the function as a string; the name of the function as a string; 1 if it's a command, else 0; the token of the call; the locations of the arguments.
 	Flti: {"flti", operands{dst, mem}},
 	Flts: {"flts", operands{dst, mem}},
 	Gsnp: {"gsnp", operands{dst, mem}},
+	Gsql: {"gsql", operands{dst, mem, mem, tok}},
 	Gofn: {"gofn", operands{dst, mem, gfn, tup}}, // Mem contains the location of a *mutable* error, i.e. we will copy its token but change its contents when returning it. 
 	Gtef: {"gtef", operands{dst, mem, mem}},
 	Gtei: {"gtei", operands{dst, mem, mem}},
@@ -157,6 +158,8 @@ var OPERANDS = map[Opcode]opDescriptor{
 	Itor: {"itor", operands{dst, mem}},
 	IxXx: {"ixXx", operands{dst, mem, mem, tok}},
 	Jmp:  {"jmp", operands{loc}},
+	Jsnd: {"jsnd", operands{dst, mem, mem, tok}},
+	Jsne: {"jsne", operands{dst, mem, tok}},
 	Jsr:  {"jsr", operands{loc}},
 	KeyM: {"keyM", operands{dst, mem}},
 	KeyZ: {"keyZ", operands{dst, mem}},
@@ -187,7 +190,7 @@ var OPERANDS = map[Opcode]opDescriptor{
 	Orb:  {"orb", operands{dst, mem, mem}},
 	Outp: {"outp", operands{mem}},
 	Outt: {"outt", operands{mem}},
-	Psnp: {"psnp", operands{dst, mem}},
+	Psnp: {"psnp", operands{dst, mem, tok}},
 	Qabt: {"qabt", operands{mem, tup, loc}},
 	Qfls: {"qfls", operands{mem, loc}},
 	Qitr: {"qitr", operands{mem, loc}},
@@ -221,6 +224,8 @@ var OPERANDS = map[Opcode]opDescriptor{
 	Strx: {"strx", operands{dst, mem}},
 	Subf: {"subf", operands{dst, mem, mem}},
 	Subi: {"subi", operands{dst, mem, mem}},
+	Tbeg: {"tbeg", operands{dst, tok}},
+	Tend: {"tend", operands{dst, mem, tok}},
 	Thnk: {"thnk", operands{dst, mem, loc}},
 	Tplf: {"tupf", operands{dst, mem, tok}},
 	Tpll: {"tupl", operands{dst, mem, tok}},
@@ -298,6 +303,7 @@ const (
 	Flts
 	Gofn
 	Gsnp
+	Gsql
 	Gtef
 	Gtei
 	Gthf
@@ -325,6 +331,8 @@ const (
 	IxZl
 	IxZn
 	Jmp
+	Jsnd
+	Jsne
 	Jsr
 	KeyM
 	KeyZ
@@ -390,6 +398,8 @@ const (
 	Strx
 	Subf
 	Subi
+	Tbeg
+	Tend
 	Thnk
 	Tplf
 	Tpll
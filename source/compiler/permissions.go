@@ -0,0 +1,100 @@
+package compiler
+
+// Access control on the functions and commands of a service. Whether a user of an administered hub
+// may use a service at all is up to the hub, but the service can say which groups of users may call
+// which of its public functions and commands, by declaring them under a `for` line, e.g.
+//
+//	cmd
+//
+//	listUsers :
+//	    ...
+//
+//	for Admins
+//
+//	deleteUser(name string) :
+//	    ...
+//
+//	for Admins, Readers
+//
+//	showUser(name string) :
+//	    ...
+//
+// A `for` line applies to everything declared after it, up to the next one or the end of the section,
+// and anything not declared under one may be called by anyone who can use the service.
+//
+// The permissions are checked when a function or command is called by something the user typed into
+// the REPL, including the lambdas in it and the functions of the modules it calls, or by an HTTP
+// client. They're not checked when a function is called by another function, so that a function
+// anyone may call can make use of one that they can't.
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/tim-hardcastle/Pipefish/source/ast"
+)
+
+// Who is calling the service, as far as the permissions are concerned. A nil `*Caller` is someone
+// who may call anything, e.g. the user of an unadministered hub or an admin of an administered one.
+type Caller struct {
+	Name   string
+	Groups []string // The groups the caller belongs to.
+}
+
+// Returned when the caller of a function or command by name isn't permitted to call it.
+var ErrAccessDenied = errors.New("not permitted to call that function or command")
+
+// Returns the permissions declared on the public functions and commands of the service, as a map
+// from the names of the restricted ones to the groups which may call them.
+func (cp *Compiler) Permissions() map[string][]string {
+	result := map[string][]string{}
+	for name, fns := range cp.P.FunctionTable {
+		for _, fn := range fns {
+			if isApiFunction(fn) && len(fn.Access) > 0 {
+				result[name] = fn.Access
+			}
+		}
+	}
+	return result
+}
+
+// Says whether the caller may call a function or command declared for the given groups.
+func MayCall(caller *Caller, access []string) bool {
+	if caller == nil || len(access) == 0 {
+		return true
+	}
+	for _, group := range access {
+		for _, callersGroup := range caller.Groups {
+			if group == callersGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks that the overloads of each public function or command are all declared for the same groups,
+// so that we can say who may call it by name.
+func (cp *Compiler) CheckPermissions() {
+	names := []string{}
+	for name := range cp.P.FunctionTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var first *ast.PrsrFunction
+		for _, fn := range cp.P.FunctionTable[name] {
+			if !isApiFunction(fn) {
+				continue
+			}
+			if first == nil {
+				first = fn
+				continue
+			}
+			if strings.Join(fn.Access, ", ") != strings.Join(first.Access, ", ") {
+				cp.P.Throw("init/access/overload", fn.Tok, name, first.Tok.Line)
+			}
+		}
+	}
+}
@@ -1,16 +1,22 @@
 package compiler_test
 
 import (
+	"bytes"
 	"errors"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/tim-hardcastle/Pipefish/source/compiler"
+	"github.com/tim-hardcastle/Pipefish/source/err"
+	"github.com/tim-hardcastle/Pipefish/source/initializer"
 	"github.com/tim-hardcastle/Pipefish/source/test_helper"
 	"github.com/tim-hardcastle/Pipefish/source/text"
+	"github.com/tim-hardcastle/Pipefish/source/values"
 )
 
 func TestLiterals(t *testing.T) {
@@ -253,6 +259,8 @@ func TestOverloading(t *testing.T) {
 		{`foo 42, true`, `"any?, bool"`},
 		{`foo 42.0, true`, `"any?, bool"`},
 		{`foo true, true`, `"bool, bool"`},
+		{`bar 42 on`, `"on"`},
+		{`bar 42 off`, `"off"`},
 	}
 	test_helper.RunTest(t, "overloading_test.pf", tests, testValues)
 }
@@ -439,6 +447,140 @@ func TestGocode(t *testing.T) {
 	os.WriteFile(locationOfGoTimes, temp, 0644)
 }
 
+func TestImage(t *testing.T) {
+	tests := []test_helper.TestItem{
+		{`DARK_BLUE`, `Tone with (shade::DARK, color::BLUE)`},
+		{`keys DARK_BLUE`, `[shade, color]`},
+		{`type RED`, `Color`},
+		{`Tone(LIGHT, GREEN)`, `Tone with (shade::LIGHT, color::GREEN)`},
+	}
+	test_helper.RunTest(t, "user_types_test.pf", tests, testImage)
+	tests = []test_helper.TestItem{
+		{`foo 42`, `"int"`},
+		{`foo 42, true`, `"any?, bool"`},
+		{`bar 42 off`, `"off"`},
+	}
+	test_helper.RunTest(t, "overloading_test.pf", tests, testImage)
+	test_helper.RunTest(t, "overloading_test.pf", tests, testImageDo)
+	tests = []test_helper.TestItem{
+		{`qux.RED in qux.Color`, `true`},
+		{`qux.Tone LIGHT, BLUE`, `qux.Tone with (shade::qux.LIGHT, color::qux.BLUE)`},
+		{`troz.sumOfSquares 3, 4`, `25`},
+		{`[1, 2] >> troz.sumOfSquares that, that`, `[2, 8]`},
+	}
+	test_helper.RunTest(t, "import_test.pf", tests, testImageDo)
+}
+
+func TestLimits(t *testing.T) {
+	tests := []test_helper.TestItem{
+		{`forever 1`, `vm/limit/depth`},
+		{`spin 1`, `vm/limit/instructions`},
+		{`fact 5`, `120`},
+		{`grow 5000`, `vm/limit/memory`},
+		{`len grow 100`, `1000`},
+	}
+	test_helper.RunTest(t, "limits_test.pf", tests, testLimits)
+}
+
+// Each test sets a breakpoint, runs a line and then tells the debugger what to do each time it
+// stops, as "<line of breakpoint>: <actions> | <line to run>". We get back where it stopped and
+// the local variables of each frame of the callstack, followed by the result.
+func TestDebugger(t *testing.T) {
+	tests := []test_helper.TestItem{
+		{`2: | quadruple 3`, `no code on line 2`},
+		{`4: | quadruple 3`, `breakpoint at double:4 (n=3) < quadruple:9 (m=not yet evaluated, n=3) < REPL:1; ` +
+			`breakpoint at double:4 (n=6) < quadruple:7 (m=6, n=3) < REPL:1; 12`},
+		{`4: detach | quadruple 3`, `breakpoint at double:4 (n=3) < quadruple:9 (m=not yet evaluated, n=3) < REPL:1; 12`},
+		{`4: in in in in | quadruple 3`, `breakpoint at double:4 (n=3) < quadruple:9 (m=not yet evaluated, n=3) < REPL:1; ` +
+			`step at quadruple:9 (m=not yet evaluated, n=3) < REPL:1; ` +
+			`step at quadruple:7 (m=6, n=3) < REPL:1; ` +
+			`step at double:4 (n=6) < quadruple:7 (m=6, n=3) < REPL:1; ` +
+			`step at quadruple:7 (m=6, n=3) < REPL:1; 12`},
+		{`4: over over over | quadruple 3`, `breakpoint at double:4 (n=3) < quadruple:9 (m=not yet evaluated, n=3) < REPL:1; ` +
+			`step at quadruple:9 (m=not yet evaluated, n=3) < REPL:1; ` +
+			`step at quadruple:7 (m=6, n=3) < REPL:1; ` +
+			`breakpoint at double:4 (n=6) < quadruple:7 (m=6, n=3) < REPL:1; 12`},
+		{`4: out out | quadruple 3`, `breakpoint at double:4 (n=3) < quadruple:9 (m=not yet evaluated, n=3) < REPL:1; ` +
+			`step at quadruple:9 (m=not yet evaluated, n=3) < REPL:1; ` +
+			`breakpoint at double:4 (n=6) < quadruple:7 (m=6, n=3) < REPL:1; 12`},
+		{`12: | fac 2`, `breakpoint at fac:12 (i=2) < REPL:1; ` +
+			`breakpoint at fac:12 (i=1) < fac:15 (i=1) < REPL:1; ` +
+			`breakpoint at fac:12 (i=0) < fac:15 (i=0) < fac:15 (i=0) < REPL:1; 2`},
+	}
+	test_helper.RunTest(t, "debugger_test.pf", tests, testDebugger)
+}
+
+var debugActions = map[string]compiler.DebugAction{"resume": compiler.DEBUG_RESUME, "in": compiler.DEBUG_STEP_IN,
+	"over": compiler.DEBUG_STEP_OVER, "out": compiler.DEBUG_STEP_OUT, "detach": compiler.DEBUG_DETACH}
+
+// Does what it's told each time the vm stops, and writes down where it stopped.
+type scriptedDebugHandler struct {
+	actions []string
+	stops   []string
+}
+
+func (h *scriptedDebugHandler) Stopped(d *compiler.Debugger, reason string) compiler.DebugAction {
+	frames := []string{}
+	for i, frame := range d.Stack() {
+		name := frame.Name
+		if name == "" {
+			name = "REPL"
+		}
+		description := name + ":" + strconv.Itoa(frame.Token.Line)
+		locals := []string{}
+		for _, v := range d.Locals(i) {
+			locals = append(locals, v.Name+"="+v.Value)
+		}
+		if len(locals) > 0 {
+			description = description + " (" + strings.Join(locals, ", ") + ")"
+		}
+		frames = append(frames, description)
+	}
+	h.stops = append(h.stops, reason+" at "+strings.Join(frames, " < "))
+	if len(h.actions) == 0 {
+		return compiler.DEBUG_RESUME
+	}
+	action := debugActions[h.actions[0]]
+	h.actions = h.actions[1:]
+	return action
+}
+
+func testDebugger(cp *compiler.Compiler, s string) (string, error) {
+	lineNo, rest, _ := strings.Cut(s, ":")
+	actions, line, _ := strings.Cut(rest, "|")
+	handler := &scriptedDebugHandler{actions: strings.Fields(actions)}
+	d := cp.StartDebugging(handler)
+	n, _ := strconv.Atoi(lineNo)
+	if !d.SetBreakpoint(cp.ScriptFilepath, n) {
+		return "no code on line " + lineNo, nil
+	}
+	v := cp.Do(strings.TrimSpace(line))
+	if cp.ErrorsExist() {
+		return "", errors.New("failed to compile with code " + cp.P.Common.Errors[0].ErrorId)
+	}
+	return strings.Join(append(handler.stops, cp.Vm.Literal(v)), "; "), nil
+}
+
+func TestJson(t *testing.T) {
+	tests := []test_helper.TestItem{
+		{`json.encode bob`, `"{\"age\":42,\"favorite\":\"GREEN\",\"name\":\"Bob\",\"nickname\":null,\"savings\":7}"`},
+		{`json.encode [1, 2.5, "x", true, NULL]`, `"[1,2.5,\"x\",true,null]"`},
+		{`json.encode map("a"::1)`, `"{\"a\":1}"`},
+		{`json.decode(json.encode(bob), Person) == bob`, `true`},
+		{`json.decode("{\"name\": \"Ann\", \"age\": 7, \"favorite\": \"RED\", \"savings\": 99}", Person)`, `Person with (name::"Ann", age::7, nickname::NULL, favorite::RED, savings::Money(99))`},
+		{`json.decode("null", Person?)`, `NULL`},
+		{`json.decode("\"BLUE\"", Color)`, `BLUE`},
+		{`json.decode("[1, \"two\"]", list)`, `[1, "two"]`},
+		{`json.decode("{\"name\": \"Annabel\", \"age\": 7, \"favorite\": \"RED\", \"savings\": 0}", Person)`, `can't decode JSON: at $.name: string is longer than varchar(5)`},
+		{`json.decode("{\"name\": \"Ann\", \"age\": 7, \"favorite\": \"PINK\", \"savings\": 0}", Person)`, `can't decode JSON: at $.favorite: can't convert JSON string "PINK" to Color`},
+		{`json.decode("{\"name\": \"Ann\", \"age\": 7, \"favorite\": \"RED\", \"savings\": 0.5}", Person)`, `can't decode JSON: at $.savings: can't convert JSON number 0.5 to Money`},
+		{`json.decode("{\"name\": \"Ann\", \"favorite\": \"RED\", \"savings\": 0}", Person)`, `can't decode JSON: at $: missing field "age" of struct type Person`},
+		{`json.decode("[1, 2", list)`, `can't decode JSON: unexpected EOF`},
+		{`json.encode [func(x) : x]`, `can't encode value as JSON: can't convert value of type func to JSON`},
+	}
+	test_helper.RunTest(t, "json_test.pf", tests, testErrorMessages)
+}
+
 func testValues(cp *compiler.Compiler, s string) (string, error) {
 	v := cp.Do(s)
 	if cp.ErrorsExist() {
@@ -447,6 +589,19 @@ func testValues(cp *compiler.Compiler, s string) (string, error) {
 	return cp.Vm.Literal(v), nil
 }
 
+// Like `testValues`, except that for runtime errors it returns the message.
+func testErrorMessages(cp *compiler.Compiler, s string) (string, error) {
+	v := cp.Do(s)
+	if cp.ErrorsExist() {
+		return "", errors.New("failed to compile with code " + cp.P.Common.Errors[0].ErrorId)
+	}
+	if v.T == values.ERROR {
+		e := v.V.(*err.Error)
+		return err.CreateErr(e.ErrorId, e.Token, e.Args...).Message, nil
+	}
+	return cp.Vm.Literal(v), nil
+}
+
 func testCompilerErrors(cp *compiler.Compiler, s string) (string, error) {
 	v := cp.Do(s)
 	if !cp.ErrorsExist() {
@@ -455,3 +610,250 @@ func testCompilerErrors(cp *compiler.Compiler, s string) (string, error) {
 		return cp.P.Common.Errors[0].ErrorId, nil
 	}
 }
+
+// Compiles the line, makes an image of the result, and then runs the line from a
+// compiler loaded from the image.
+func testImage(cp *compiler.Compiler, s string) (string, error) {
+	cT := cp.CodeTop()
+	node := cp.P.ParseLine("REPL input", s)
+	if cp.ErrorsExist() {
+		return "", errors.New("failed to parse with code " + cp.P.Common.Errors[0].ErrorId)
+	}
+	cp.CompileNode(node, compiler.Context{Env: cp.GlobalVars, Access: compiler.REPL, LowMem: compiler.DUMMY, LogFlavor: compiler.LF_NONE})
+	if cp.ErrorsExist() {
+		return "", errors.New("failed to compile with code " + cp.P.Common.Errors[0].ErrorId)
+	}
+	cp.Emit(compiler.Ret)
+	result := cp.That()
+	var buf bytes.Buffer
+	if e := cp.WriteImage(&buf); e != nil {
+		return "", e
+	}
+	loadedCp, e := initializer.StartCompilerFromImage(&buf, nil, map[string]*compiler.Compiler{})
+	if e != nil {
+		return "", e
+	}
+	loadedCp.Vm.Run(cT)
+	return loadedCp.Vm.Literal(loadedCp.Vm.Mem[result]), nil
+}
+
+// Makes an image of the compiler, and then compiles and runs the line with a compiler loaded
+// from the image.
+func testImageDo(cp *compiler.Compiler, s string) (string, error) {
+	var buf bytes.Buffer
+	if e := cp.WriteImage(&buf); e != nil {
+		return "", e
+	}
+	loadedCp, e := initializer.StartCompilerFromImage(&buf, nil, map[string]*compiler.Compiler{})
+	if e != nil {
+		return "", e
+	}
+	v := loadedCp.Do(s)
+	if loadedCp.ErrorsExist() {
+		return "", errors.New("failed to compile with code " + loadedCp.P.Common.Errors[0].ErrorId)
+	}
+	return loadedCp.Vm.Literal(v), nil
+}
+
+func testLimits(cp *compiler.Compiler, s string) (string, error) {
+	cp.Vm.Limits = compiler.Limits{Instructions: 100000, RecursionDepth: 1000, Memory: 10000}
+	v := cp.Do(s)
+	if cp.ErrorsExist() {
+		return "", errors.New("failed to compile with code " + cp.P.Common.Errors[0].ErrorId)
+	}
+	if v.T == values.ERROR {
+		return v.V.(*err.Error).ErrorId, nil
+	}
+	return cp.Vm.Literal(v), nil
+}
+func TestExternalOnSameHub(t *testing.T) {
+	tests := []test_helper.TestItem{
+		{`external_server.double 21`, `42`},
+		{`external_server.half(1.0 / 3.0) * 2.0 == 1.0 / 3.0`, `true`},
+		{`external_server.move(external_server.Point(1.5, 2.5), external_server.GREEN)`, `(external_server.Point with (left::2.50000000, top::3.50000000), external_server.GREEN)`},
+		{`external_server.colors [external_server.RED, external_server.BLUE]`, `set(external_server.RED, external_server.BLUE)`},
+		{`external_server.double 1 + external_server.double 2`, `10`},
+	}
+	test_helper.RunTest(t, "external_test.pf", tests, testValues)
+}
+
+// Compares calls to an external service on the same hub which convert the values directly with
+// calls which go by way of literals, as to another hub.
+func BenchmarkExternalOnSameHub(b *testing.B) {
+	for _, useLiterals := range []bool{true, false} {
+		b.Run("useLiterals="+strconv.FormatBool(useLiterals), func(b *testing.B) {
+			cp, _ := initializer.StartCompilerFromFilepath("test-files/external_test.pf", nil, map[string]*compiler.Compiler{})
+			if cp.P.Common.IsBroken {
+				b.Fatal(cp.P.ReturnErrors())
+			}
+			handler := cp.Vm.ExternalCallHandlers[0].(compiler.ExternalCallToHubHandler)
+			handler.UseLiterals = useLiterals
+			cp.Vm.ExternalCallHandlers[0] = handler
+			for _, line := range []string{`external_server.half 3.5`, `external_server.move(external_server.Point(1.5, 2.5), external_server.GREEN)`} {
+				b.Run(line, func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						cp.Do(line)
+					}
+				})
+			}
+		})
+	}
+}
+
+// Encodes random values in the wire format and decodes them again, checking that we get the same
+// value, and the same bytes when we encode it a second time.
+func TestWireFormatRoundTrip(t *testing.T) {
+	cp := wireTestCompiler(t, "wire_test.pf")
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 300; i++ {
+		source := randomValueSource(r, 3)
+		if r.Intn(5) == 0 {
+			source = "tuple(" + source + ", " + randomValueSource(r, 2) + ", " + []string{"int", "Color", "string?", "FloatClone"}[r.Intn(4)] + ")"
+		}
+		v := cp.Do(source)
+		if v.T == values.ERROR || cp.ErrorsExist() {
+			t.Fatalf("can't evaluate %s", source)
+		}
+		data, e := cp.Vm.EncodeValue(v)
+		if e != nil {
+			t.Fatalf("can't encode %s: %v", source, e)
+		}
+		decoded, e := cp.Vm.DecodeValue(data, "")
+		if e != nil {
+			t.Fatalf("can't decode %s: %v", source, e)
+		}
+		if cp.Vm.Literal(decoded) != cp.Vm.Literal(v) {
+			t.Fatalf("encoded %s, decoded %s", cp.Vm.Literal(v), cp.Vm.Literal(decoded))
+		}
+		again, _ := cp.Vm.EncodeValue(decoded)
+		if !bytes.Equal(data, again) {
+			t.Fatalf("encoding %s again gave different bytes", source)
+		}
+		for n := 0; n < len(data); n++ { // Every truncation of the data should be rejected.
+			if _, e := cp.Vm.DecodeValue(data[:n], ""); e == nil {
+				t.Fatalf("decoded %d bytes of the %d of %s", n, len(data), source)
+			}
+		}
+	}
+}
+
+func TestWireFormatErrors(t *testing.T) {
+	cp := wireTestCompiler(t, "wire_test.pf")
+	blank := wireTestCompiler(t, "")
+	person, _ := cp.Vm.EncodeValue(cp.Do(`Person("Ann", 7, RED, [])`))
+	if _, e := blank.Vm.DecodeValue(person, ""); e == nil || !strings.Contains(e.Error(), "there is no type 'Person'") {
+		t.Errorf("decoded a type which doesn't exist: %v", e)
+	}
+	if _, e := cp.Vm.DecodeValue([]byte(`"foo"`), ""); e == nil {
+		t.Errorf("decoded a literal")
+	}
+	future := append([]byte(compiler.WIRE_MAGIC), compiler.WIRE_VERSION+1)
+	if _, e := cp.Vm.DecodeValue(future, ""); e == nil || !strings.Contains(e.Error(), "version") {
+		t.Errorf("decoded a later version: %v", e)
+	}
+	if _, e := cp.Vm.EncodeValue(cp.Do(`[func(i) : i]`)); e == nil {
+		t.Errorf("encoded a lambda")
+	}
+	// A map of two pairs keyed by empty lists, and a set of two empty lists, which the vm couldn't
+	// make.
+	message := func(value ...byte) []byte {
+		header := append([]byte(compiler.WIRE_MAGIC), compiler.WIRE_VERSION, 3, 3, 'm', 'a', 'p', 4, 'l', 'i', 's', 't', 3, 's', 'e', 't', 0)
+		return append(header, value...)
+	}
+	unhashable := map[string][]byte{
+		"a map can't have a key of type 'list'":      message(0, 2, 1, 0, 1, 0, 1, 0, 1, 0),
+		"a set can't contain a value of type 'list'": message(2, 2, 1, 0, 1, 0),
+	}
+	for want, data := range unhashable {
+		if _, e := cp.Vm.DecodeValue(data, ""); e == nil || !strings.Contains(e.Error(), want) {
+			t.Errorf("wanted %q | got %v", want, e)
+		}
+	}
+	tag, _ := cp.Vm.EncodeValue(cp.Do(`Tag("abc")`))
+	if _, e := cp.Vm.DecodeValue(tag, ""); e != nil {
+		t.Errorf("couldn't decode a varchar: %v", e)
+	}
+	tooLong := bytes.Replace(tag, []byte{3, 'a', 'b', 'c'}, []byte{4, 'a', 'b', 'c', 'd'}, 1)
+	if _, e := cp.Vm.DecodeValue(tooLong, ""); e == nil || !strings.Contains(e.Error(), "longer than varchar(3)") {
+		t.Errorf("decoded a string too long for its varchar: %v", e)
+	}
+}
+
+func TestWireFormatBetweenServices(t *testing.T) {
+	cp := wireTestCompiler(t, "external_test.pf")
+	server := cp.Vm.ExternalCallHandlers[0].(compiler.ExternalCallToHubHandler).ExternalServiceCp
+	data, e := server.Vm.EncodeValue(server.Do(`Point(1.0 / 3.0, 2.5), [GREEN]`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	v, e := cp.Vm.DecodeValue(data, "external_server.")
+	if e != nil {
+		t.Fatal(e)
+	}
+	want := `(external_server.Point with (left::0.33333333, top::2.50000000), [external_server.GREEN])`
+	if cp.Vm.Literal(v) != want {
+		t.Errorf("got %s", cp.Vm.Literal(v))
+	}
+	if v.V.([]values.Value)[0].V.([]values.Value)[0].V.(float64) != 1.0/3.0 {
+		t.Errorf("the float wasn't decoded exactly")
+	}
+}
+
+func wireTestCompiler(t *testing.T, filename string) *compiler.Compiler {
+	if filename != "" {
+		filename = "test-files/" + filename
+	}
+	cp, _ := initializer.StartCompilerFromFilepath(filename, nil, map[string]*compiler.Compiler{})
+	if cp.P.Common.IsBroken {
+		t.Fatal(cp.P.ReturnErrors())
+	}
+	return cp
+}
+
+// Makes the source of a random value of the types of wire_test.pf, containing other values to
+// the depth given.
+func randomValueSource(r *rand.Rand, depth int) string {
+	scalars := []func() string{
+		func() string { return strconv.Itoa(r.Intn(2000001) - 1000000) },
+		func() string { return strconv.FormatFloat(r.NormFloat64()*1000, 'f', -1, 64) },
+		func() string { return strconv.Quote(string([]rune("abcdéπ🐟 ")[r.Intn(9):])) },
+		func() string { return "'" + string("xyz"[r.Intn(3)]) + "'" },
+		func() string { return []string{"true", "false", "NULL"}[r.Intn(3)] },
+		func() string { return []string{"RED", "GREEN", "BLUE"}[r.Intn(3)] },
+		func() string { return "FloatClone(" + strconv.FormatFloat(r.Float64(), 'f', -1, 64) + ")" },
+	}
+	scalar := func() string { return scalars[r.Intn(len(scalars))]() }
+	key := func() string { return scalars[r.Intn(3)]() } // What can go in a set or be the key of a map.
+	if depth == 0 || r.Intn(3) == 0 {
+		return scalar()
+	}
+	elements := func(f func() string) string { // At least one, since there are no empty literals of sets and maps.
+		els := make([]string, 1+r.Intn(3))
+		for i := range els {
+			els[i] = f()
+		}
+		return strings.Join(els, ", ")
+	}
+	inner := func() string { return randomValueSource(r, depth-1) }
+	entry := func() string { return key() + "::" + inner() }
+	switch r.Intn(9) {
+	case 0:
+		return "[" + elements(inner) + "]"
+	case 1:
+		return "set(" + elements(key) + ")"
+	case 2:
+		return "map(" + elements(entry) + ")"
+	case 3:
+		return "(" + scalar() + "::" + inner() + ")"
+	case 4:
+		return "Person(" + scalars[2]() + ", " + scalars[0]() + ", " + scalars[5]() + ", [" + elements(inner) + "])"
+	case 5:
+		return "(keys Person(\"Bob\", 42, RED, []))"
+	case 6:
+		return "ListClone([" + elements(inner) + "])"
+	case 7:
+		return "MapClone(map(" + elements(entry) + "))"
+	default:
+		return "SetClone(set(" + elements(key) + "))"
+	}
+}
@@ -0,0 +1,806 @@
+package compiler
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tim-hardcastle/Pipefish/source/token"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+)
+
+// Checks the SQL snippets of a module against the schemas of its databases, so that unknown tables
+// and columns, the wrong number of values for a table, and values or rows which don't fit their
+// columns are found when the service is compiled, rather than being returned by the database as
+// errors at runtime.
+
+// The checks are opt-in. A database is only checked if the module imports a schema for it, by
+// putting the path of a '.sql' file in the 'import' section: a plain path for the service's own
+// database, and 'analytics::"analytics.sql"' for a named one. The CREATE TABLE statements of the
+// schema declare the tables of the database, as do the CREATE TABLE snippets of the module.
+
+// Since every database has its own dialect, we don't parse SQL in full. We tokenize the snippet and
+// look for the tables and columns it names, and we don't check the columns of statements with
+// subqueries and the like, whose scopes we'd have to understand. The principle is that we should
+// never reject a statement which the database would accept.
+
+type sqlSchema struct {
+	tables map[string]*sqlSchemaTable // By the name of the table in lower case, since SQL names are case-insensitive.
+}
+
+type sqlSchemaTable struct {
+	name    string
+	columns []sqlSchemaColumn
+}
+
+type sqlSchemaColumn struct {
+	name string
+	decl string // The declared type of the column, e.g. "VARCHAR(32) NOT NULL".
+}
+
+func (table *sqlSchemaTable) column(name string) (sqlSchemaColumn, bool) {
+	for _, column := range table.columns {
+		if strings.EqualFold(column.name, name) {
+			return column, true
+		}
+	}
+	return sqlSchemaColumn{}, false
+}
+
+// What the compiler records about an SQL snippet so that it can be checked once the module has been
+// compiled, by which time we know all the tables it declares.
+type sqlSnippet struct {
+	tok      *token.Token
+	database string
+	query    string             // The query with the injection sites replaced by '$1', '$2' ...
+	params   []values.ValueType // The types of the values injected into the query, or UNDEFINED_TYPE if we can't tell at compile time.
+	readAs   values.ValueType   // The struct type 'get ... as' reads the rows into, or UNDEFINED_TYPE.
+}
+
+// Adds the tables declared in the given SQL to the schema of the database.
+func (cp *Compiler) AddSqlSchema(database, source, code string) {
+	schema := cp.sqlSchema(database)
+	for _, statement := range splitSqlStatements(tokenizeSql(code)) {
+		if !isCreateTable(statement) {
+			continue
+		}
+		if table, ok := parseCreateTable(statement); ok {
+			schema.tables[strings.ToLower(table.name)] = table
+			continue
+		}
+		first := statement[0]
+		cp.P.Throw("init/sql/schema", &token.Token{Type: token.STRING, Literal: first.text, Source: source,
+			Line: first.line, ChStart: first.ch, ChEnd: first.ch + len(first.text)})
+	}
+}
+
+func (cp *Compiler) sqlSchema(database string) *sqlSchema {
+	if cp.sqlSchemas == nil {
+		cp.sqlSchemas = map[string]*sqlSchema{}
+	}
+	if _, ok := cp.sqlSchemas[database]; !ok {
+		cp.sqlSchemas[database] = &sqlSchema{tables: map[string]*sqlSchemaTable{}}
+	}
+	return cp.sqlSchemas[database]
+}
+
+// Called by reserveSnippetFactory.
+func (cp *Compiler) recordSqlSnippet(snF uint32, tok *token.Token, database, query string, params []values.ValueType) {
+	if cp.sqlSnippets == nil {
+		cp.sqlSnippets = map[uint32]*sqlSnippet{}
+	}
+	cp.sqlSnippets[snF] = &sqlSnippet{tok: tok, database: database, query: query, params: params}
+}
+
+// Called after the compiler puts the snippet made by the factory into memory.
+func (cp *Compiler) noteSnippetLoc(snF uint32) {
+	if _, ok := cp.sqlSnippets[snF]; !ok {
+		return
+	}
+	if cp.snippetLocs == nil {
+		cp.snippetLocs = map[uint32]uint32{}
+	}
+	cp.snippetLocs[cp.That()] = snF
+}
+
+// Called by btGetFromSQLAs, so that we can check that the rows of the snippet fit the type.
+func (cp *Compiler) recordSqlReadAs(snippetLoc, typeLoc uint32) {
+	snF, ok := cp.snippetLocs[snippetLoc]
+	if !ok || cp.Vm.Mem[typeLoc].T != values.TYPE {
+		return
+	}
+	sn, ok := cp.sqlSnippets[snF]
+	types := cp.Vm.Mem[typeLoc].V.(values.AbstractType).Types
+	if ok && len(types) == 1 && cp.Vm.ConcreteTypeInfo[types[0]].IsStruct() {
+		sn.readAs = types[0]
+	}
+}
+
+// Checks the SQL snippets of the module against the schemas it imported, once it's been compiled.
+func (cp *Compiler) CheckSqlSnippets() {
+	if len(cp.sqlSchemas) == 0 {
+		return
+	}
+	// The schema of a database includes the tables the module's own snippets create.
+	for _, sn := range cp.sqlSnippets {
+		if schema, ok := cp.sqlSchemas[sn.database]; ok {
+			for _, statement := range splitSqlStatements(tokenizeSql(sn.query)) {
+				if !isCreateTable(statement) {
+					continue
+				}
+				if table, ok := parseCreateTable(statement); ok {
+					schema.tables[strings.ToLower(table.name)] = table
+				}
+			}
+		}
+	}
+	// A snippet may have been compiled more than once, e.g. if the compiler rolled back, so we check
+	// each place in the code only once, and in the order they were compiled so the errors are too.
+	snippets := []*sqlSnippet{}
+	seen := map[token.Token]bool{}
+	for snF := uint32(0); snF < uint32(len(cp.Vm.SnippetFactories)); snF++ {
+		sn, ok := cp.sqlSnippets[snF]
+		if !ok || seen[*sn.tok] {
+			continue
+		}
+		seen[*sn.tok] = true
+		snippets = append(snippets, sn)
+	}
+	for _, sn := range snippets {
+		schema, ok := cp.sqlSchemas[sn.database]
+		if !ok {
+			continue
+		}
+		for _, statement := range splitSqlStatements(tokenizeSql(sn.query)) {
+			ch := &sqlChecker{cp: cp, sn: sn, schema: schema, toks: statement, scope: map[string]*sqlSchemaTable{},
+				notColumns: map[int]bool{}, aliases: map[string]bool{}, reported: map[string]bool{}, ok: true}
+			ch.check()
+		}
+	}
+}
+
+type sqlTokenKind int
+
+const (
+	sqlWord   sqlTokenKind = iota // An unquoted name or keyword.
+	sqlName                       // A quoted name.
+	sqlString                     // A string literal.
+	sqlNumber                     // A numeric literal.
+	sqlParam                      // An injection site, '$1', '$2' ...
+	sqlPunct                      // Anything else.
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string // For a param, the number; for a quoted name, the name without the quotes.
+	line int
+	ch   int
+}
+
+func (t sqlToken) is(s string) bool {
+	return t.kind == sqlPunct && t.text == s
+}
+
+func (t sqlToken) isWord(words ...string) bool {
+	if t.kind != sqlWord {
+		return false
+	}
+	for _, word := range words {
+		if strings.EqualFold(t.text, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the token is something which could be the name of a table, column or alias.
+func (t sqlToken) isName() bool {
+	return t.kind == sqlName || t.kind == sqlWord && !sqlKeywords[strings.ToUpper(t.text)]
+}
+
+// Whether the token can be the end of an operand, so that a name after it must be an alias.
+func (t sqlToken) endsOperand() bool {
+	return t.isName() || t.kind == sqlString || t.kind == sqlNumber || t.kind == sqlParam || t.is(")")
+}
+
+var sqlOperators = []string{"<=", ">=", "<>", "!=", "||", "::", "=="}
+
+func tokenizeSql(code string) []sqlToken {
+	result := []sqlToken{}
+	runes := []rune(code)
+	line, lineStart := 1, 0
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case r == '\n':
+			i++
+			line, lineStart = line+1, i
+			continue
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			continue
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			for i = i + 3; i < len(runes) && !(runes[i-1] == '*' && runes[i] == '/'); i++ {
+				if runes[i] == '\n' {
+					line, lineStart = line+1, i+1
+				}
+			}
+			i++
+			continue
+		case r == '\'':
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			i++
+			result = append(result, sqlToken{sqlString, string(runes[start:min(i, len(runes))]), line, start - lineStart})
+		case r == '"' || r == '`':
+			for i++; i < len(runes) && runes[i] != r; i++ {
+			}
+			result = append(result, sqlToken{sqlName, string(runes[start+1 : min(i, len(runes))]), line, start - lineStart})
+			i++
+		case r == '$' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			for i++; i < len(runes) && unicode.IsDigit(runes[i]); i++ {
+			}
+			result = append(result, sqlToken{sqlParam, string(runes[start+1 : i]), line, start - lineStart})
+		case unicode.IsLetter(r) || r == '_':
+			for ; i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '$'); i++ {
+			}
+			result = append(result, sqlToken{sqlWord, string(runes[start:i]), line, start - lineStart})
+		case unicode.IsDigit(r):
+			for ; i < len(runes) && (unicode.IsDigit(runes[i]) || unicode.IsLetter(runes[i]) || runes[i] == '.'); i++ {
+			}
+			result = append(result, sqlToken{sqlNumber, string(runes[start:i]), line, start - lineStart})
+		default:
+			i++
+			for _, op := range sqlOperators {
+				if string(runes[start:min(start+2, len(runes))]) == op {
+					i++
+					break
+				}
+			}
+			result = append(result, sqlToken{sqlPunct, string(runes[start:i]), line, start - lineStart})
+		}
+	}
+	return result
+}
+
+func splitSqlStatements(toks []sqlToken) [][]sqlToken {
+	result := [][]sqlToken{}
+	start, depth := 0, 0
+	for i, tok := range toks {
+		switch {
+		case tok.is("("):
+			depth++
+		case tok.is(")"):
+			depth--
+		case tok.is(";") && depth == 0:
+			if i > start {
+				result = append(result, toks[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(toks) {
+		result = append(result, toks[start:])
+	}
+	return result
+}
+
+// Splits the tokens at the top-level commas.
+func splitSqlList(toks []sqlToken) [][]sqlToken {
+	result := [][]sqlToken{}
+	start, depth := 0, 0
+	for i, tok := range toks {
+		switch {
+		case tok.is("("):
+			depth++
+		case tok.is(")"):
+			depth--
+		case tok.is(",") && depth == 0:
+			result = append(result, toks[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, toks[start:])
+}
+
+// Returns the index of the parenthesis closing the one at i, or -1.
+func closingSqlParen(toks []sqlToken, i int) int {
+	depth := 0
+	for ; i < len(toks); i++ {
+		switch {
+		case toks[i].is("("):
+			depth++
+		case toks[i].is(")"):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isCreateTable(statement []sqlToken) bool {
+	return len(statement) > 2 && statement[0].isWord("CREATE") && statement[1].isWord("TABLE")
+}
+
+func parseCreateTable(statement []sqlToken) (*sqlSchemaTable, bool) {
+	i := 2
+	if len(statement) > 5 && statement[2].isWord("IF") && statement[3].isWord("NOT") && statement[4].isWord("EXISTS") {
+		i = 5
+	}
+	if i+1 >= len(statement) || !(statement[i].kind == sqlWord || statement[i].kind == sqlName) {
+		return nil, false
+	}
+	table := &sqlSchemaTable{name: statement[i].text}
+	for i+2 < len(statement) && statement[i+1].is(".") { // Then the name was qualified by the name of a schema.
+		i = i + 2
+		table.name = statement[i].text
+	}
+	i++
+	end := closingSqlParen(statement, i)
+	if !statement[i].is("(") || end == -1 {
+		return nil, false
+	}
+	for _, definition := range splitSqlList(statement[i+1 : end]) {
+		if len(definition) == 0 {
+			return nil, false
+		}
+		if definition[0].isWord("PRIMARY", "FOREIGN", "UNIQUE", "CHECK", "CONSTRAINT", "KEY", "INDEX", "EXCLUDE") {
+			continue // ... since it's a constraint on the table rather than a column.
+		}
+		if !(definition[0].kind == sqlWord || definition[0].kind == sqlName) {
+			return nil, false
+		}
+		decl := []string{}
+		for _, tok := range definition[1:] {
+			decl = append(decl, tok.text)
+		}
+		table.columns = append(table.columns, sqlSchemaColumn{definition[0].text, strings.Join(decl, " ")})
+	}
+	return table, true
+}
+
+// Checks one statement of a snippet.
+type sqlChecker struct {
+	cp          *Compiler
+	sn          *sqlSnippet
+	schema      *sqlSchema
+	toks        []sqlToken
+	scope       map[string]*sqlSchemaTable // The tables named by the statement, by their names and aliases in lower case.
+	tables      []*sqlSchemaTable          // The same, in order, so we know what '*' means.
+	target      *sqlSchemaTable            // The table inserted into.
+	afterTarget int                        // The index of the token after its name.
+	notColumns  map[int]bool               // The indices of the tokens which name tables rather than columns.
+	aliases     map[string]bool            // The aliases given to columns, which can be used in e.g. ORDER BY.
+	reported    map[string]bool            // So that we don't report the same unknown name twice.
+	ok          bool                       // Whether all the tables are known, so that it's worth checking the columns.
+}
+
+func (ch *sqlChecker) check() {
+	if len(ch.toks) == 0 || !ch.toks[0].isWord("SELECT", "INSERT", "REPLACE", "UPDATE", "DELETE") {
+		return // Either it declares rather than uses tables, or it's a WITH clause with tables of its own, or we don't check it.
+	}
+	ch.findTables()
+	if !ch.ok || ch.isCompound() {
+		return
+	}
+	ch.findAliases()
+	ch.checkColumns()
+	ch.checkComparisons()
+	switch {
+	case ch.target != nil:
+		ch.checkInsert()
+	case ch.toks[0].isWord("SELECT") && ch.sn.readAs != values.UNDEFINED_TYPE:
+		ch.checkRows()
+	}
+}
+
+func (ch *sqlChecker) throw(errorID string, args ...any) {
+	ch.cp.P.Throw(errorID, ch.sn.tok, args...)
+}
+
+// Finds the tables the statement names after FROM, JOIN, INTO and UPDATE, and their aliases.
+func (ch *sqlChecker) findTables() {
+	depth := 0
+	scopes := []int{} // The depths of the parentheses of the queries we're in, since e.g. EXTRACT(YEAR FROM x) doesn't name a table.
+	for i := 0; i < len(ch.toks); i++ {
+		tok := ch.toks[i]
+		switch {
+		case tok.is("("):
+			depth++
+		case tok.is(")"):
+			depth--
+			for len(scopes) > 0 && scopes[len(scopes)-1] > depth {
+				scopes = scopes[:len(scopes)-1]
+			}
+		case tok.isWord("SELECT", "DELETE"):
+			if len(scopes) == 0 || scopes[len(scopes)-1] != depth {
+				scopes = append(scopes, depth)
+			}
+		case tok.isWord("FROM", "JOIN") && len(scopes) > 0 && scopes[len(scopes)-1] == depth:
+			i = ch.readTable(i+1, false)
+			for tok.isWord("FROM") && i < len(ch.toks) && ch.toks[i].is(",") {
+				i = ch.readTable(i+1, false)
+			}
+			i--
+		case tok.isWord("INTO") && ch.toks[0].isWord("INSERT", "REPLACE") && ch.target == nil:
+			i = ch.readTable(i+1, true)
+			if len(ch.tables) > 0 {
+				ch.target, ch.afterTarget = ch.tables[len(ch.tables)-1], i
+			}
+			i--
+		case tok.isWord("UPDATE") && i == 0:
+			i = ch.readTable(i+1, true) - 1
+		}
+	}
+}
+
+var sqlTableModifiers = map[string]bool{"ONLY": true, "OR": true, "ROLLBACK": true, "ABORT": true, "REPLACE": true,
+	"FAIL": true, "IGNORE": true, "LOW_PRIORITY": true, "HIGH_PRIORITY": true, "DELAYED": true, "QUICK": true}
+
+// Reads the name of a table starting at i, and its alias if it has one, returning the index of the
+// token after them.
+func (ch *sqlChecker) readTable(i int, isTarget bool) int {
+	for i < len(ch.toks) && ch.toks[i].kind == sqlWord && sqlTableModifiers[strings.ToUpper(ch.toks[i].text)] {
+		i++
+	}
+	if i >= len(ch.toks) || !ch.toks[i].isName() {
+		return i // E.g. it's a subquery.
+	}
+	name := ch.toks[i].text
+	ch.notColumns[i] = true
+	for i++; i+1 < len(ch.toks) && ch.toks[i].is(".") && ch.toks[i+1].isName(); i = i + 2 { // Then it was qualified by the name of a schema.
+		name = ch.toks[i+1].text
+		ch.notColumns[i+1] = true
+	}
+	if i < len(ch.toks) && ch.toks[i].is("(") && !isTarget {
+		return i // Then it's a table-valued function.
+	}
+	table, ok := ch.schema.tables[strings.ToLower(name)]
+	if !ok {
+		ch.ok = false
+		if !ch.reported["table "+strings.ToLower(name)] {
+			ch.reported["table "+strings.ToLower(name)] = true
+			ch.throw("comp/sql/table", name, ch.describeDatabase())
+		}
+	} else {
+		ch.scope[strings.ToLower(name)] = table
+		ch.tables = append(ch.tables, table)
+	}
+	if i < len(ch.toks) && ch.toks[i].isWord("AS") {
+		i++
+	}
+	if i < len(ch.toks) && ch.toks[i].isName() {
+		ch.notColumns[i] = true
+		if ok {
+			ch.scope[strings.ToLower(ch.toks[i].text)] = table
+		}
+		i++
+	}
+	return i
+}
+
+func (ch *sqlChecker) describeDatabase() string {
+	if ch.sn.database == "" {
+		return "the service's database"
+	}
+	return "the database " + ch.sn.database
+}
+
+// Whether the statement has a subquery or a compound SELECT, which have scopes we don't try to
+// understand.
+func (ch *sqlChecker) isCompound() bool {
+	for i, tok := range ch.toks {
+		if tok.isWord("UNION", "INTERSECT", "EXCEPT", "WITH") || i > 0 && tok.isWord("SELECT") {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the names given to columns by AS, or by following an expression directly, as in
+// 'SELECT count(*) n FROM ...'.
+func (ch *sqlChecker) findAliases() {
+	for i := 1; i < len(ch.toks); i++ {
+		if ch.notColumns[i] || !ch.toks[i].isName() {
+			continue
+		}
+		if ch.toks[i-1].isWord("AS") || ch.toks[i-1].endsOperand() {
+			ch.aliases[strings.ToLower(ch.toks[i].text)] = true
+			ch.notColumns[i] = true
+		}
+	}
+}
+
+func (ch *sqlChecker) checkColumns() {
+	if len(ch.tables) == 0 {
+		return
+	}
+	for i := 0; i < len(ch.toks); i++ {
+		tok := ch.toks[i]
+		if ch.notColumns[i] || !tok.isName() {
+			continue
+		}
+		if i+1 < len(ch.toks) && ch.toks[i+1].is("(") {
+			continue // ... because it's a function.
+		}
+		if i > 0 && (ch.toks[i-1].is("::") || ch.toks[i-1].is(".")) {
+			continue // ... because it's a type, or something we've already looked at.
+		}
+		if i+2 < len(ch.toks) && ch.toks[i+1].is(".") {
+			table, ok := ch.scope[strings.ToLower(tok.text)]
+			if ok && ch.toks[i+2].isName() {
+				if _, ok := table.column(ch.toks[i+2].text); !ok {
+					ch.reportColumn(ch.toks[i+2].text, []*sqlSchemaTable{table})
+				}
+			}
+			i = i + 2
+			continue
+		}
+		if _, ok := ch.findColumn(tok.text); !ok && !ch.aliases[strings.ToLower(tok.text)] {
+			ch.reportColumn(tok.text, ch.tables)
+		}
+	}
+}
+
+func (ch *sqlChecker) reportColumn(name string, tables []*sqlSchemaTable) {
+	if ch.reported["column "+strings.ToLower(name)] {
+		return
+	}
+	ch.reported["column "+strings.ToLower(name)] = true
+	names := []string{}
+	for _, table := range tables {
+		names = append(names, "'"+table.name+"'")
+	}
+	ch.throw("comp/sql/column", name, strings.Join(names, ", "))
+}
+
+// Finds a column by its unqualified name in the tables of the statement.
+func (ch *sqlChecker) findColumn(name string) (sqlSchemaColumn, bool) {
+	for _, table := range ch.tables {
+		if column, ok := table.column(name); ok {
+			return column, true
+		}
+	}
+	return sqlSchemaColumn{}, false
+}
+
+// Finds the column named at i, qualified or not, returning the column and the index of the token
+// it starts at.
+func (ch *sqlChecker) columnEndingAt(i int) (sqlSchemaColumn, int, bool) {
+	if i < 0 || !ch.toks[i].isName() || ch.notColumns[i] {
+		return sqlSchemaColumn{}, 0, false
+	}
+	if i >= 2 && ch.toks[i-1].is(".") {
+		table, ok := ch.scope[strings.ToLower(ch.toks[i-2].text)]
+		if !ok {
+			return sqlSchemaColumn{}, 0, false
+		}
+		column, ok := table.column(ch.toks[i].text)
+		return column, i - 2, ok
+	}
+	column, ok := ch.findColumn(ch.toks[i].text)
+	return column, i, ok
+}
+
+func (ch *sqlChecker) columnStartingAt(i int) (sqlSchemaColumn, int, bool) {
+	if i+2 < len(ch.toks) && ch.toks[i+1].is(".") {
+		column, _, ok := ch.columnEndingAt(i + 2)
+		return column, i + 2, ok
+	}
+	if i >= len(ch.toks) {
+		return sqlSchemaColumn{}, 0, false
+	}
+	column, _, ok := ch.columnEndingAt(i)
+	return column, i, ok
+}
+
+var sqlComparisons = map[string]bool{"=": true, "==": true, "<>": true, "!=": true, "<": true, ">": true, "<=": true, ">=": true}
+
+var sqlArithmetic = map[string]bool{"+": true, "-": true, "*": true, "/": true, "%": true, "||": true, "::": true, "^": true, "&": true, "|": true}
+
+// Checks the types of the values injected into comparisons with columns, and assignments to them,
+// e.g. 'WHERE name = |x|' and 'SET count = |y|'.
+func (ch *sqlChecker) checkComparisons() {
+	for i := 1; i+1 < len(ch.toks); i++ {
+		if ch.toks[i].kind != sqlPunct || !sqlComparisons[ch.toks[i].text] {
+			continue
+		}
+		if ch.toks[i+1].kind == sqlParam && (i+2 == len(ch.toks) || !sqlArithmetic[ch.toks[i+2].text]) {
+			if column, start, ok := ch.columnEndingAt(i - 1); ok && (start == 0 || !sqlArithmetic[ch.toks[start-1].text]) {
+				ch.checkParam(ch.toks[i+1], column)
+			}
+		}
+		if ch.toks[i-1].kind == sqlParam && (i < 2 || !sqlArithmetic[ch.toks[i-2].text]) {
+			if column, end, ok := ch.columnStartingAt(i + 1); ok && (end+1 == len(ch.toks) || !sqlArithmetic[ch.toks[end+1].text]) {
+				ch.checkParam(ch.toks[i-1], column)
+			}
+		}
+	}
+}
+
+// Checks that the number of values inserted into the table fits the number of its columns, and
+// that their types fit too.
+func (ch *sqlChecker) checkInsert() {
+	i := ch.afterTarget
+	columns := ch.target.columns
+	if i < len(ch.toks) && ch.toks[i].is("(") {
+		end := closingSqlParen(ch.toks, i)
+		if end == -1 {
+			return
+		}
+		columns = []sqlSchemaColumn{}
+		for _, name := range splitSqlList(ch.toks[i+1 : end]) {
+			if len(name) != 1 {
+				return
+			}
+			column, ok := ch.target.column(name[0].text)
+			if !ok {
+				return // We've already said so.
+			}
+			columns = append(columns, column)
+		}
+		i = end + 1
+	}
+	if i >= len(ch.toks) || !ch.toks[i].isWord("VALUES") {
+		return
+	}
+	for i++; i < len(ch.toks) && ch.toks[i].is("("); i++ {
+		end := closingSqlParen(ch.toks, i)
+		if end == -1 {
+			return
+		}
+		row := splitSqlList(ch.toks[i+1 : end])
+		if len(row) != len(columns) {
+			ch.throw("comp/sql/params", ch.target.name, len(columns), len(row))
+			return
+		}
+		for j, value := range row {
+			if len(value) == 1 && value[0].kind == sqlParam {
+				ch.checkParam(value[0], columns[j])
+			}
+		}
+		i = end + 1
+		if i >= len(ch.toks) || !ch.toks[i].is(",") {
+			return
+		}
+	}
+}
+
+// Checks that the type of an injected value fits the column it goes into or is compared with.
+func (ch *sqlChecker) checkParam(param sqlToken, column sqlSchemaColumn) {
+	n, err := strconv.Atoi(param.text)
+	if err != nil || n < 1 || n > len(ch.sn.params) || ch.sn.params[n-1] == values.UNDEFINED_TYPE {
+		return
+	}
+	ty := ch.sn.params[n-1]
+	sqlType := ch.cp.Vm.getSqlType(values.AbstractType{[]values.ValueType{ty}, DUMMY})
+	if sqlType != "" && !sqlTypesFit(sqlType, column.decl) {
+		ch.throw("comp/sql/type", column.name, column.decl, ch.cp.Vm.DescribeType(ty, LITERAL))
+	}
+}
+
+// Checks that the columns returned by a SELECT fit the fields of the struct type 'get ... as' reads
+// them into.
+func (ch *sqlChecker) checkRows() {
+	end := len(ch.toks)
+	depth := 0
+	for i, tok := range ch.toks {
+		if tok.is("(") {
+			depth++
+		}
+		if tok.is(")") {
+			depth--
+		}
+		if tok.isWord("FROM") && depth == 0 {
+			end = i
+			break
+		}
+	}
+	start := 1
+	for start < end && ch.toks[start].isWord("DISTINCT", "ALL") {
+		start++
+	}
+	columns := []*sqlSchemaColumn{} // With nil for an expression whose type we don't know.
+	for _, item := range splitSqlList(ch.toks[start:end]) {
+		switch {
+		case len(item) == 1 && item[0].is("*"):
+			for _, table := range ch.tables {
+				for j := range table.columns {
+					columns = append(columns, &table.columns[j])
+				}
+			}
+		case len(item) == 3 && item[1].is(".") && item[2].is("*"):
+			table, ok := ch.scope[strings.ToLower(item[0].text)]
+			if !ok {
+				return
+			}
+			for j := range table.columns {
+				columns = append(columns, &table.columns[j])
+			}
+		default:
+			if len(item) >= 2 && item[len(item)-1].isName() && (item[len(item)-2].isWord("AS") || item[len(item)-2].endsOperand()) {
+				item = item[:len(item)-1] // ... to remove the alias.
+				if item[len(item)-1].isWord("AS") {
+					item = item[:len(item)-1]
+				}
+			}
+			var column sqlSchemaColumn
+			var ok bool
+			switch {
+			case len(item) == 1 && item[0].isName():
+				column, ok = ch.findColumn(item[0].text)
+			case len(item) == 3 && item[1].is(".") && item[2].isName():
+				var table *sqlSchemaTable
+				if table, ok = ch.scope[strings.ToLower(item[0].text)]; ok {
+					column, ok = table.column(item[2].text)
+				}
+			}
+			if ok {
+				columns = append(columns, &column)
+			} else {
+				columns = append(columns, nil)
+			}
+		}
+	}
+	structInfo := ch.cp.Vm.ConcreteTypeInfo[ch.sn.readAs].(StructType)
+	typeName := ch.cp.Vm.DescribeType(ch.sn.readAs, LITERAL)
+	if len(columns) != len(structInfo.AbstractStructFields) {
+		ch.throw("comp/sql/columns", len(columns), typeName, len(structInfo.AbstractStructFields))
+		return
+	}
+	for j, column := range columns {
+		if column == nil {
+			continue
+		}
+		sqlType := ch.cp.Vm.getSqlType(structInfo.AbstractStructFields[j])
+		if sqlType != "" && !sqlTypesFit(column.decl, sqlType) {
+			ch.throw("comp/sql/field", column.name, column.decl, ch.cp.Vm.Labels[structInfo.LabelNumbers[j]], typeName)
+		}
+	}
+}
+
+// Whether a value of the first SQL type can go into something of the second. We only know about the
+// families sqlFamily sorts the types into, so any other type fits anything.
+func sqlTypesFit(from, to string) bool {
+	fromFamily, toFamily := sqlFamily(from), sqlFamily(to)
+	if fromFamily == toFamily || fromFamily == "integer" && toFamily == "float" {
+		return true
+	}
+	return !sqlKnownFamilies[fromFamily] || !sqlKnownFamilies[toFamily]
+}
+
+var sqlKnownFamilies = map[string]bool{"bool": true, "integer": true, "float": true, "timestamp": true, "text": true}
+
+// Words which can't be the names of columns, or at least which we shouldn't check as though they
+// were. It does no harm to have too many.
+var sqlKeywords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`SELECT FROM WHERE AND OR NOT NULL IS ISNULL NOTNULL IN LIKE ILIKE GLOB
+		REGEXP MATCH SIMILAR ESCAPE BETWEEN EXISTS AS ON USING JOIN INNER LEFT RIGHT FULL OUTER CROSS NATURAL
+		LATERAL GROUP BY ORDER HAVING LIMIT OFFSET FETCH FIRST NEXT ROWS ROW ONLY ASC DESC NULLS LAST DISTINCT
+		ALL ANY SOME UNION INTERSECT EXCEPT INSERT INTO VALUES DEFAULT UPDATE SET DELETE RETURNING CONFLICT DO
+		NOTHING REPLACE IGNORE ABORT FAIL ROLLBACK LOW_PRIORITY HIGH_PRIORITY DELAYED QUICK DUPLICATE KEY CASE
+		WHEN THEN ELSE END CAST TRUE FALSE UNKNOWN CURRENT_DATE CURRENT_TIME CURRENT_TIMESTAMP CURRENT_USER
+		SESSION_USER LOCALTIME LOCALTIMESTAMP INTERVAL COLLATE NOCASE BINARY RTRIM WITH RECURSIVE OVER PARTITION
+		WINDOW RANGE GROUPS PRECEDING FOLLOWING UNBOUNDED CURRENT FILTER WITHIN TIES PERCENT TOP FOR SHARE NOWAIT
+		SKIP LOCKED BOTH LEADING TRAILING YEAR MONTH DAY HOUR MINUTE SECOND EPOCH DOW DOY WEEK QUARTER ZONE AT
+		TIME DATE TIMESTAMP ARRAY TO OF CREATE TABLE DROP ALTER`) {
+		sqlKeywords[word] = true
+	}
+}
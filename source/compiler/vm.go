@@ -1,6 +1,7 @@
 package compiler
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"html/template"
@@ -27,24 +28,36 @@ type Vm struct {
 	callstack      []uint32
 	recursionStack []recursionData
 	logging        bool
-	LiveTracking   []TrackingData // "Live" tracking data in which the uint32s in the permanent tracking data have been replaced by the corresponding memory registers.
+	LiveTracking   []TrackingData  // "Live" tracking data in which the uint32s in the permanent tracking data have been replaced by the corresponding memory registers.
+	Debugger       *Debugger       // Non-nil when a debugger is attached to the vm.
+	Limits         Limits          // What a call to the service may do before it's stopped.
+	limiter        *limiter        // Non-nil during a run which is subject to limits or cancellation.
+	folding        context.Context // The context of the line being compiled, if any, for constant folding.
+	Metrics        *VmMetrics      // What the vm has done, for monitoring. (See metrics.go.)
+	Lock           func() func()   // Set by the service which owns the vm, to take turns with it. (See ExternalCallToHubHandler.)
 
 	// Permanent state: things established at compile time.
 
 	ConcreteTypeInfo           []typeInformation
 	Labels                     []string // Array from the number of a field label to its name.
 	Tokens                     []*token.Token
+	CodeTokens                 []uint32 // For each operation in Code, the number in Tokens of the token of the node it was compiled from, or DUMMY.
 	LambdaFactories            []*LambdaFactory
 	SnippetFactories           []*SnippetFactory
 	GoFns                      []GoFn
+	GoPlugins                  []GoPlugin     // The plugins the Go functions came from, so that we can reopen them when we load an image.
 	tracking                   []TrackingData // Data needed by the 'trak' opcode to produce the live tracking data.
 	InHandle                   InHandler
 	OutHandle                  OutHandler
 	Database                   *sql.DB
+	NamedDatabases             map[string]*sql.DB // The databases which SQL snippets can go to by name, as in `SQL(analytics) ---`.
+	transaction                *sql.Tx            // The transaction of the outermost `transaction` block being run, if any.
+	transactionDepth           int                // How many `transaction` blocks are being run. The inner ones are savepoints of the outer one.
 	AbstractTypes              []values.AbstractTypeInfo
 	OwningCompiler             *Compiler             // The compiler at the root of the dependency tree.
 	HubServices                map[string]*Compiler  // Like the map that the hub has, but with the exposed compilers rather than wrapped in a Service.
 	ExternalCallHandlers       []ExternalCallHandler // The services declared external, whether on the same hub or a different one.
+	ExternalServiceNames       []string              // Their names, in the same order.
 	TypeNumberOfUnwrappedError values.ValueType      // What it says. When we unwrap an 'error' to an 'Error' struct, the vm needs to know the number of the struct.
 	Stringify                  *CpFunc
 	GoToPipefishTypes          map[reflect.Type]values.ValueType
@@ -70,9 +83,19 @@ type vmState struct {
 	snippetFactories int
 }
 
-// Contains a Go function in the form of a reflect.Value, and, currently, nothing else.
+// Contains a Go function in the form of a reflect.Value, and where it came from, so that we
+// can find it again when we load a bytecode image.
 type GoFn struct {
-	Code reflect.Value
+	Code   reflect.Value
+	Source string // The Pipefish source file containing the Go code.
+	Symbol string // The name of the function in the plugin compiled from it.
+}
+
+// A plugin compiled from the Go code in a Pipefish source file, and the numbers of the types
+// named by its converters.
+type GoPlugin struct {
+	Source     string
+	Converters map[string]values.ValueType
 }
 
 // Contains the information to execute a lambda at runtime; i.e. it is the payload of a FUNC type value.
@@ -108,6 +131,7 @@ type SnippetBindle struct {
 	codeLoc             uint32              // Where to find the code to compute the object string and the values.
 	objectStringLoc     uint32              // Where to find the object string.
 	valueLocs           []uint32            // The locations where we put the computed values to inject into SQL or HTML snippets.
+	database            string              // The name of the database an SQL snippet goes to, or "" for the service's own.
 }
 
 // Container for the data we push when a function might be about to do recursion.
@@ -132,7 +156,7 @@ var nativeTypeNames = []string{"UNDEFINED VALUE", "INT ARRAY", "SNIPPET DATA", "
 
 func BlankVm(db *sql.DB, hubServiceCompilers map[string]*Compiler) *Vm {
 	vm := &Vm{Mem: make([]values.Value, len(CONSTANTS)), Database: db, HubServices: hubServiceCompilers,
-		logging: true, InHandle: &StandardInHandler{"→ "},
+		logging: true, InHandle: &StandardInHandler{"→ "}, Metrics: NewVmMetrics(),
 		CodeGeneratingTypes: (make(dtypes.Set[values.ValueType])).Add(values.FUNC),
 		SharedTypenameToTypeList: map[string]AlternateType{
 			"any":  AltType(values.INT, values.BOOL, values.STRING, values.RUNE, values.TYPE, values.FUNC, values.PAIR, values.LIST, values.MAP, values.SET, values.LABEL),
@@ -168,6 +192,14 @@ func BlankVm(db *sql.DB, hubServiceCompilers map[string]*Compiler) *Vm {
 	return vm
 }
 
+// The token of the node the operation at the location was compiled from, if there is one.
+func (vm *Vm) tokenAt(loc uint32) *token.Token {
+	if loc >= uint32(len(vm.CodeTokens)) || vm.CodeTokens[loc] == DUMMY {
+		return nil
+	}
+	return vm.Tokens[vm.CodeTokens[loc]]
+}
+
 // The heart of the VM. A big loop around a switch. It will keep going until it hits a `ret`
 // and the callstack is empty.
 func (vm *Vm) Run(loc uint32) {
@@ -175,11 +207,24 @@ func (vm *Vm) Run(loc uint32) {
 		println()
 	}
 	stackHeight := len(vm.callstack)
+	if vm.Debugger != nil {
+		vm.Debugger.enter()
+		defer vm.Debugger.exit()
+	}
+	var instructions uint64
+	defer func() { vm.countRun(instructions) }()
 loop:
 	for {
+		instructions++
 		if settings.SHOW_RUNTIME {
 			println(text.GREEN + vm.DescribeCode(loc) + text.RESET)
 		}
+		if vm.Debugger != nil {
+			vm.Debugger.check(loc)
+		}
+		if vm.limiter != nil {
+			vm.limiter.check(vm, loc)
+		}
 		if settings.SHOW_RUNTIME_VALUES {
 			print(vm.DescribeOperandValues(loc))
 		}
@@ -473,39 +518,12 @@ loop:
 				vm.Mem[args[0]] = values.Value{values.BOOL, vm.equals(vm.Mem[args[1]], vm.Mem[args[2]])}
 			}
 		case Extn:
-			externalOrdinal := args[1]
-			operatorType := args[2]
-			remainingNamespace := vm.Mem[args[3]].V.(string)
-			name := vm.Mem[args[4]].V.(string)
-			argLocs := args[5:]
-			var buf strings.Builder
-			if operatorType == PREFIX {
-				buf.WriteString(remainingNamespace)
-				buf.WriteString(name)
-			}
-			buf.WriteString("(")
-			for i, loc := range argLocs {
-				serialize := vm.Literal(vm.Mem[loc])
-				if vm.Mem[loc].T == values.BLING && serialize == name {
-					buf.WriteString(") ")
-					buf.WriteString(remainingNamespace)
-					buf.WriteString(serialize)
-					buf.WriteString(" (")
-					continue
-				}
-				buf.WriteString(serialize)
-				if vm.Mem[loc].T == values.BLING || i+1 == len(argLocs) || vm.Mem[argLocs[i+1]].T == values.BLING {
-					buf.WriteString(" ")
-				} else {
-					buf.WriteString(", ")
-				}
-			}
-			buf.WriteString(")")
-			if operatorType == SUFFIX {
-				buf.WriteString(remainingNamespace)
-				buf.WriteString(name)
+			call := &externalCall{namespace: vm.Mem[args[3]].V.(string), name: vm.Mem[args[4]].V.(string),
+				position: args[2], isCommand: args[5] == 1, args: make([]values.Value, 0, len(args)-7)}
+			for _, loc := range args[7:] {
+				call.args = append(call.args, vm.Mem[loc])
 			}
-			vm.Mem[args[0]] = vm.ExternalCallHandlers[externalOrdinal].evaluate(vm, buf.String())
+			vm.Mem[args[0]] = vm.callExternal(args[1], call, vm.Tokens[args[6]])
 		case Flti:
 			vm.Mem[args[0]] = values.Value{values.FLOAT, float64(vm.Mem[args[1]].V.(int))}
 		case Flts:
@@ -553,6 +571,10 @@ loop:
 			vm.Mem[args[0]] = values.Value{values.BOOL, vm.Mem[args[1]].V.(float64) >= vm.Mem[args[2]].V.(float64)}
 		case Gtei:
 			vm.Mem[args[0]] = values.Value{values.BOOL, vm.Mem[args[1]].V.(int) >= vm.Mem[args[2]].V.(int)}
+		case Gsql:
+			bindle := vm.Mem[args[2]].V.([]values.Value)[2].V.(*SnippetBindle)
+			objectString := vm.Mem[bindle.objectStringLoc].V.(string)
+			vm.Mem[args[0]] = vm.evalGetSQL(vm.Mem[args[1]].V.(values.AbstractType), bindle.database, objectString, vm.sqlInjections(bindle), args[3])
 		case Gthf:
 			vm.Mem[args[0]] = values.Value{values.BOOL, vm.Mem[args[1]].V.(float64) > vm.Mem[args[2]].V.(float64)}
 		case Gthi:
@@ -608,10 +630,15 @@ loop:
 				vm.Mem[args[0]] = vm.makeError("vm/index/tuple", args[3], ix, len(tuple), args[1], args[2])
 			}
 		case Inpt:
+			prompt := vm.Mem[args[1]].V.([]values.Value)[0].V.(string)
 			if _, ok := vm.InHandle.(*StandardInHandler); ok {
-				vm.InHandle = &StandardInHandler{vm.Mem[args[1]].V.([]values.Value)[0].V.(string)}
+				vm.InHandle = &StandardInHandler{prompt}
+			}
+			if in, ok := vm.InHandle.(PromptingInHandler); ok {
+				vm.Mem[args[0]] = values.Value{values.STRING, in.GetWithPrompt(prompt)}
+			} else {
+				vm.Mem[args[0]] = values.Value{values.STRING, vm.InHandle.Get()}
 			}
-			vm.Mem[args[0]] = values.Value{values.STRING, vm.InHandle.Get()}
 		case Inte:
 			vm.Mem[args[0]] = values.Value{values.INT, vm.Mem[args[1]].V.(int)}
 		case Intf:
@@ -838,6 +865,20 @@ loop:
 		case Jmp:
 			loc = args[0]
 			continue
+		case Jsnd:
+			result, e := vm.DecodeJson(vm.Mem[args[1]].V.(string), vm.Mem[args[2]].V.(values.AbstractType))
+			if e != nil {
+				vm.Mem[args[0]] = vm.makeError("vm/json/decode", args[3], e.Error())
+				break Switch
+			}
+			vm.Mem[args[0]] = result
+		case Jsne:
+			result, e := vm.EncodeJson(vm.Mem[args[1]])
+			if e != nil {
+				vm.Mem[args[0]] = vm.makeError("vm/json/encode", args[2], e.Error())
+				break Switch
+			}
+			vm.Mem[args[0]] = values.Value{values.STRING, result}
 		case Jsr:
 			vm.callstack = append(vm.callstack, loc)
 			loc = args[0]
@@ -912,7 +953,7 @@ loop:
 				}
 				k := p.V.([]values.Value)[0]
 				v := p.V.([]values.Value)[1]
-				if !((values.NULL <= k.T && k.T < values.PAIR) || vm.ConcreteTypeInfo[v.T].IsEnum()) {
+				if !vm.isHashable(k) {
 					vm.Mem[args[0]] = vm.makeError("vm/map/key", args[2], k, vm.DescribeType(k.T, LITERAL))
 					break Switch
 				}
@@ -924,7 +965,7 @@ loop:
 		case Mkst:
 			result := values.Set{}
 			for _, v := range vm.Mem[args[1]].V.([]values.Value) {
-				if !((values.NULL <= v.T && v.T < values.PAIR) || vm.ConcreteTypeInfo[v.T].IsEnum()) {
+				if !vm.isHashable(v) {
 					vm.Mem[args[0]] = vm.makeError("vm/set", args[2], v, vm.DescribeType(v.T, LITERAL))
 					break Switch
 				}
@@ -1000,12 +1041,7 @@ loop:
 				vm.OutHandle.Out(values.Value{values.STRING, buf.String()})
 				vm.Mem[args[0]] = values.Value{values.SUCCESSFUL_VALUE, nil}
 			case SQL_SNIPPET:
-				injector := make([]values.Value, 0, len(bindle.valueLocs))
-				for i := 1; i < len(bindle.valueLocs); i = i + 2 {
-					mLoc := bindle.valueLocs[i]
-					injector = append(injector, vm.Mem[mLoc])
-				}
-				vm.Mem[args[0]] = vm.evalPostSQL(objectString, injector)
+				vm.Mem[args[0]] = vm.evalPostSQL(bindle.database, objectString, vm.sqlInjections(bindle), args[2])
 			}
 		case Qabt:
 			varcharLimit := args[1]
@@ -1288,6 +1324,10 @@ loop:
 			vm.Mem[args[0]] = values.Value{vm.Mem[args[1]].T, vm.Mem[args[1]].V.(float64) - vm.Mem[args[2]].V.(float64)}
 		case Subi:
 			vm.Mem[args[0]] = values.Value{vm.Mem[args[1]].T, vm.Mem[args[1]].V.(int) - vm.Mem[args[2]].V.(int)}
+		case Tbeg:
+			vm.Mem[args[0]] = vm.beginTransaction(args[1])
+		case Tend:
+			vm.Mem[args[0]] = vm.endTransaction(vm.Mem[args[1]], args[2])
 		case Thnk:
 			vm.Mem[args[0]] = values.Value{values.THUNK, ThunkValue{args[1], args[2]}}
 		case Tplf:
@@ -1716,6 +1756,11 @@ func (vm *Vm) setsAreEqual(v, w values.Value) bool {
 	return true
 }
 
+// Whether the value can be a key of a map or an element of a set.
+func (vm *Vm) isHashable(v values.Value) bool {
+	return (values.NULL <= v.T && v.T < values.PAIR) || vm.ConcreteTypeInfo[v.T].IsEnum()
+}
+
 // Implements `with`, which needs to be done separately because it may be recursive.
 func (vm *Vm) with(container values.Value, keys []values.Value, val values.Value, errTok uint32) values.Value {
 	key := keys[0]
@@ -0,0 +1,389 @@
+package compiler
+
+// Converts values from JSON to Pipefish and back, for calling the functions of a service over HTTP.
+//
+// The correspondence is as follows. `NULL`, booleans, numbers and strings are what you'd expect;
+// a rune is a string of length one. Lists, sets, tuples and pairs are arrays. A map is an object
+// if all its keys are strings, and otherwise an array of [key, value] arrays. A struct is an
+// object whose keys are its labels, an enum element is its name as a string, and a clone is
+// represented the same way as its parent type.
+//
+// JSON can't say which of these it means, and so when we convert JSON into Pipefish we need to be
+// told what type to expect: where the type could be any of several, as with the elements of a
+// `list`, we give the JSON the type it would most naturally have.
+//
+// The same scheme is used by the `encode` and `decode` functions of the `json` standard library.
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tim-hardcastle/Pipefish/source/values"
+
+	"src.elv.sh/pkg/persistent/vector"
+)
+
+// Converts JSON, as decoded by a `json.Decoder` with `UseNumber` set, into a value of one of the
+// types of the abstract type. The path is the path to the data from the top of the JSON, and is
+// used to say where the conversion failed.
+func (vm *Vm) JsonToPipefish(data any, aT values.AbstractType, path string) (values.Value, error) {
+	natural := naturalJsonType(data)
+	if aT.Contains(natural) {
+		return vm.jsonToConcreteType(data, natural, aT.Varchar, path)
+	}
+	var problem error
+	for _, ty := range aT.Types {
+		result, e := vm.jsonToConcreteType(data, ty, aT.Varchar, path)
+		if e == nil {
+			return result, nil
+		}
+		problem = e
+	}
+	if len(aT.Types) == 1 && problem != nil {
+		return values.UNDEF, problem
+	}
+	return values.UNDEF, errors.New("at " + path + ": can't convert JSON " + describeJson(data) + " to " + vm.DescribeAbstractType(aT, LITERAL))
+}
+
+// Parses a string of JSON and converts it into a value of one of the types of the abstract type,
+// for the `decode` function of the `json` library.
+func (vm *Vm) DecodeJson(s string, aT values.AbstractType) (values.Value, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var data any
+	if e := dec.Decode(&data); e != nil {
+		return values.UNDEF, e
+	}
+	if _, e := dec.Token(); e != io.EOF {
+		return values.UNDEF, errors.New("unexpected data after the end of the JSON")
+	}
+	return vm.JsonToPipefish(data, aT, "$")
+}
+
+// Renders a Pipefish value as a string of JSON, for the `encode` function of the `json` library.
+func (vm *Vm) EncodeJson(v values.Value) (string, error) {
+	data, e := vm.PipefishToJson(v)
+	if e != nil {
+		return "", e
+	}
+	result, e := json.Marshal(data)
+	if e != nil {
+		return "", e
+	}
+	return string(result), nil
+}
+
+// Converts a JSON array into the elements of a list, set, or tuple, without regard to their types.
+func (vm *Vm) jsonToElements(data any, path string) ([]values.Value, error) {
+	arr, ok := data.([]any)
+	if !ok {
+		return nil, errors.New("at " + path + ": expected array, got " + describeJson(data))
+	}
+	result := make([]values.Value, 0, len(arr))
+	for i, el := range arr {
+		pfEl, e := vm.jsonToNaturalType(el, path+"["+strconv.Itoa(i)+"]")
+		if e != nil {
+			return nil, e
+		}
+		result = append(result, pfEl)
+	}
+	return result, nil
+}
+
+func (vm *Vm) jsonToNaturalType(data any, path string) (values.Value, error) {
+	return vm.jsonToConcreteType(data, naturalJsonType(data), DUMMY, path)
+}
+
+func (vm *Vm) jsonToConcreteType(data any, ty values.ValueType, varchar uint32, path string) (values.Value, error) {
+	problem := errors.New("at " + path + ": can't convert JSON " + describeJson(data) + " to " + vm.DescribeType(ty, LITERAL))
+	switch typeInfo := vm.ConcreteTypeInfo[ty].(type) {
+	case EnumType:
+		if s, ok := data.(string); ok {
+			for i, el := range typeInfo.ElementNames {
+				if el == s {
+					return values.Value{T: ty, V: i}, nil
+				}
+			}
+		}
+		return values.UNDEF, problem
+	case StructType:
+		obj, ok := data.(map[string]any)
+		if !ok || typeInfo.Snippet {
+			return values.UNDEF, problem
+		}
+		for key := range obj {
+			if _, ok := vm.fieldNumber(typeInfo, key); !ok {
+				return values.UNDEF, errors.New("at " + path + ": struct type " + vm.DescribeType(ty, LITERAL) + " has no field " + strconv.Quote(key))
+			}
+		}
+		fields := make([]values.Value, len(typeInfo.LabelNumbers))
+		for i, lb := range typeInfo.LabelNumbers {
+			fieldData, ok := obj[vm.Labels[lb]]
+			if !ok {
+				if !typeInfo.AbstractStructFields[i].Contains(values.NULL) {
+					return values.UNDEF, errors.New("at " + path + ": missing field " + strconv.Quote(vm.Labels[lb]) + " of struct type " + vm.DescribeType(ty, LITERAL))
+				}
+				fields[i] = values.Value{T: values.NULL, V: nil}
+				continue
+			}
+			field, e := vm.JsonToPipefish(fieldData, typeInfo.AbstractStructFields[i], path+"."+vm.Labels[lb])
+			if e != nil {
+				return values.UNDEF, e
+			}
+			fields[i] = field
+		}
+		return values.Value{T: ty, V: fields}, nil
+	case CloneType:
+		result, e := vm.jsonToConcreteType(data, typeInfo.Parent, DUMMY, path)
+		if e != nil {
+			return values.UNDEF, problem
+		}
+		result.T = ty
+		return result, nil
+	}
+	switch ty {
+	case values.NULL:
+		if data == nil {
+			return values.Value{T: values.NULL, V: nil}, nil
+		}
+	case values.BOOL:
+		if b, ok := data.(bool); ok {
+			return values.Value{T: values.BOOL, V: b}, nil
+		}
+	case values.INT:
+		if n, ok := data.(json.Number); ok {
+			if i, e := strconv.Atoi(string(n)); e == nil {
+				return values.Value{T: values.INT, V: i}, nil
+			}
+		}
+	case values.FLOAT:
+		if n, ok := data.(json.Number); ok {
+			if f, e := n.Float64(); e == nil {
+				return values.Value{T: values.FLOAT, V: f}, nil
+			}
+		}
+	case values.STRING:
+		if s, ok := data.(string); ok {
+			if varchar < DUMMY && utf8.RuneCountInString(s) > int(varchar) {
+				return values.UNDEF, errors.New("at " + path + ": string is longer than varchar(" + strconv.Itoa(int(varchar)) + ")")
+			}
+			return values.Value{T: values.STRING, V: s}, nil
+		}
+	case values.RUNE:
+		if s, ok := data.(string); ok && utf8.RuneCountInString(s) == 1 {
+			r, _ := utf8.DecodeRuneInString(s)
+			return values.Value{T: values.RUNE, V: r}, nil
+		}
+	case values.LIST:
+		if _, ok := data.([]any); ok {
+			els, e := vm.jsonToElements(data, path)
+			if e != nil {
+				return values.UNDEF, e
+			}
+			vec := vector.Empty
+			for _, el := range els {
+				vec = vec.Conj(el)
+			}
+			return values.Value{T: values.LIST, V: vec}, nil
+		}
+	case values.SET:
+		if _, ok := data.([]any); ok {
+			els, e := vm.jsonToElements(data, path)
+			if e != nil {
+				return values.UNDEF, e
+			}
+			set := values.Set{}
+			for _, el := range els {
+				set = set.Add(el)
+			}
+			return values.Value{T: values.SET, V: set}, nil
+		}
+	case values.TUPLE:
+		if _, ok := data.([]any); ok {
+			els, e := vm.jsonToElements(data, path)
+			if e != nil {
+				return values.UNDEF, e
+			}
+			return values.Value{T: values.TUPLE, V: els}, nil
+		}
+	case values.PAIR:
+		if arr, ok := data.([]any); ok && len(arr) == 2 {
+			els, e := vm.jsonToElements(data, path)
+			if e != nil {
+				return values.UNDEF, e
+			}
+			return values.Value{T: values.PAIR, V: els}, nil
+		}
+	case values.MAP:
+		switch data := data.(type) {
+		case map[string]any:
+			result := &values.Map{}
+			for k, el := range data {
+				pfEl, e := vm.jsonToNaturalType(el, path+"."+k)
+				if e != nil {
+					return values.UNDEF, e
+				}
+				result = result.Set(values.Value{T: values.STRING, V: k}, pfEl)
+			}
+			return values.Value{T: values.MAP, V: result}, nil
+		case []any:
+			result := &values.Map{}
+			for i, el := range data {
+				elPath := path + "[" + strconv.Itoa(i) + "]"
+				pair, ok := el.([]any)
+				if !ok || len(pair) != 2 {
+					return values.UNDEF, errors.New("at " + elPath + ": expected [key, value] array, got " + describeJson(el))
+				}
+				kv, e := vm.jsonToElements(pair, elPath)
+				if e != nil {
+					return values.UNDEF, e
+				}
+				result = result.Set(kv[0], kv[1])
+			}
+			return values.Value{T: values.MAP, V: result}, nil
+		}
+	}
+	return values.UNDEF, problem
+}
+
+// The type we give to a piece of JSON when we're not told what type it should be.
+func naturalJsonType(data any) values.ValueType {
+	switch data := data.(type) {
+	case nil:
+		return values.NULL
+	case bool:
+		return values.BOOL
+	case json.Number:
+		if _, e := strconv.Atoi(string(data)); e == nil {
+			return values.INT
+		}
+		return values.FLOAT
+	case string:
+		return values.STRING
+	case []any:
+		return values.LIST
+	case map[string]any:
+		return values.MAP
+	}
+	return values.UNDEFINED_TYPE
+}
+
+func describeJson(data any) string {
+	switch data := data.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number " + string(data)
+	case string:
+		return "string " + strconv.Quote(data)
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "value"
+}
+
+func (vm *Vm) fieldNumber(structInfo StructType, label string) (int, bool) {
+	for i, lb := range structInfo.LabelNumbers {
+		if vm.Labels[lb] == label {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Converts a Pipefish value into something which `json.Marshal` will render according to the
+// scheme described at the top of this file. Errors, lambdas, and other such values have no JSON
+// representation and so we return an error.
+func (vm *Vm) PipefishToJson(v values.Value) (any, error) {
+	switch typeInfo := vm.ConcreteTypeInfo[v.T].(type) {
+	case EnumType:
+		return typeInfo.ElementNames[v.V.(int)], nil
+	case StructType:
+		result := map[string]any{}
+		for i, lb := range typeInfo.LabelNumbers {
+			field, e := vm.PipefishToJson(v.V.([]values.Value)[i])
+			if e != nil {
+				return nil, e
+			}
+			result[vm.Labels[lb]] = field
+		}
+		return result, nil
+	case CloneType:
+		return vm.PipefishToJson(values.Value{T: typeInfo.Parent, V: v.V})
+	}
+	switch v.T {
+	case values.NULL:
+		return nil, nil
+	case values.BOOL, values.INT, values.STRING:
+		return v.V, nil
+	case values.FLOAT:
+		if math.IsNaN(v.V.(float64)) || math.IsInf(v.V.(float64), 0) {
+			return nil, errors.New("can't convert " + vm.Literal(v) + " to JSON")
+		}
+		return v.V, nil
+	case values.RUNE:
+		return string(v.V.(rune)), nil
+	case values.SUCCESSFUL_VALUE:
+		return "OK", nil
+	case values.TYPE:
+		return vm.DescribeAbstractType(v.V.(values.AbstractType), LITERAL), nil
+	case values.LIST:
+		result := []any{}
+		for it := v.V.(vector.Vector).Iterator(); it.HasElem(); it.Next() {
+			el, e := vm.PipefishToJson(it.Elem().(values.Value))
+			if e != nil {
+				return nil, e
+			}
+			result = append(result, el)
+		}
+		return result, nil
+	case values.SET:
+		return vm.elementsToJson(v.V.(values.Set).AsSlice())
+	case values.TUPLE, values.PAIR:
+		return vm.elementsToJson(v.V.([]values.Value))
+	case values.MAP:
+		mapAsSlice := v.V.(*values.Map).AsSlice()
+		stringKeyed := map[string]any{}
+		pairs := make([]any, 0, len(mapAsSlice))
+		for _, pair := range mapAsSlice {
+			key, e := vm.PipefishToJson(pair.Key)
+			if e != nil {
+				return nil, e
+			}
+			el, e := vm.PipefishToJson(pair.Val)
+			if e != nil {
+				return nil, e
+			}
+			if pair.Key.T == values.STRING {
+				stringKeyed[pair.Key.V.(string)] = el
+			}
+			pairs = append(pairs, []any{key, el})
+		}
+		if len(stringKeyed) == len(pairs) {
+			return stringKeyed, nil
+		}
+		return pairs, nil
+	}
+	return nil, errors.New("can't convert value of type " + vm.DescribeType(v.T, LITERAL) + " to JSON")
+}
+
+func (vm *Vm) elementsToJson(els []values.Value) (any, error) {
+	result := make([]any, 0, len(els))
+	for _, pfEl := range els {
+		el, e := vm.PipefishToJson(pfEl)
+		if e != nil {
+			return nil, e
+		}
+		result = append(result, el)
+	}
+	return result, nil
+}
@@ -0,0 +1,484 @@
+package compiler
+
+// The binary wire format for values, for sending them between services and hubs, and for keeping
+// them, without the cost of rendering them as Pipefish literals and then parsing and compiling the
+// literals at the other end, and without losing the precision of floats.
+//
+// The format is self-describing: a message consists of `WIRE_MAGIC` and `WIRE_VERSION`; the names
+// of the types, and then of the labels, which the value contains; and then the value. A value is
+// written as the number of its type in the message's list of names, followed by its payload, which
+// depends on what kind of type it is: the elements of a tuple, list, set or pair, preceded by their
+// number; the keys and values of a map likewise; the name of an element of an enum; the fields of
+// a struct, each preceded by the number of its label, so that they can be matched up if the struct
+// type at the other end has its fields in a different order; the payload of the parent type for a
+// clone; and so on. Numbers are written as varints, except for floats, which are written as their
+// eight bytes.
+//
+// Since the types are identified by name, the two ends needn't number them the same way, but they
+// do need to have types of the same names and shapes. A value which can't be reconstructed from its
+// description, such as a lambda or an iterator, can't be encoded.
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"src.elv.sh/pkg/persistent/vector"
+
+	"github.com/tim-hardcastle/Pipefish/source/text"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+)
+
+const WIRE_MAGIC = "PFV"
+
+// This should be incremented whenever the format changes.
+const WIRE_VERSION = 1
+
+// How deeply containers can be nested in a message we decode.
+const WIRE_MAX_DEPTH = 1000
+
+// Encodes a value in the wire format.
+func (vm *Vm) EncodeValue(v values.Value) ([]byte, error) {
+	enc := &wireEncoder{vm: vm, types: map[values.ValueType]uint32{}, labels: map[int]uint32{}}
+	enc.value(v)
+	if enc.e != nil {
+		return nil, enc.e
+	}
+	body := enc.buf
+	enc.buf = []byte(WIRE_MAGIC)
+	enc.uint(WIRE_VERSION)
+	enc.uint(uint64(len(enc.typeList)))
+	for _, t := range enc.typeList {
+		enc.str(vm.ConcreteTypeInfo[t].GetName(LITERAL))
+	}
+	enc.strs(enc.labelList)
+	return append(enc.buf, body...), nil
+}
+
+// Decodes a value in the wire format. If the namespace isn't empty, then the types named in the
+// message are looked for in that namespace first, e.g. when the value comes from an external service
+// whose types are in the namespace of its stub.
+func (vm *Vm) DecodeValue(data []byte, namespace string) (values.Value, error) {
+	if len(data) < len(WIRE_MAGIC) || string(data[:len(WIRE_MAGIC)]) != WIRE_MAGIC {
+		return values.Value{}, errors.New("not a Pipefish value")
+	}
+	dec := &wireDecoder{vm: vm, buf: data[len(WIRE_MAGIC):]}
+	if version := dec.uint(); dec.e == nil && version != WIRE_VERSION {
+		return values.Value{}, errors.New("can't decode version " + text.Emph(strconv.FormatUint(version, 10)) + " of the wire format")
+	}
+	typeNumbers := map[string]values.ValueType{}
+	for i := range vm.ConcreteTypeInfo {
+		typeNumbers[vm.ConcreteTypeInfo[i].GetName(LITERAL)] = values.ValueType(i)
+	}
+	names := dec.strs()
+	dec.types = make([]values.ValueType, len(names))
+	for i, name := range names {
+		t, ok := typeNumbers[namespace+name]
+		if !ok {
+			t, ok = typeNumbers[name]
+		}
+		if !ok {
+			dec.fail("there is no type " + text.Emph(name))
+			break
+		}
+		dec.types[i] = t
+	}
+	labelNumbers := map[string]int{}
+	for i, label := range vm.Labels {
+		labelNumbers[label] = i
+	}
+	names = dec.strs()
+	dec.labels = make([]int, len(names))
+	for i, name := range names {
+		label, ok := labelNumbers[name]
+		if !ok {
+			dec.fail("there is no label " + text.Emph(name))
+			break
+		}
+		dec.labels[i] = label
+	}
+	result := dec.value(0)
+	if dec.e == nil && len(dec.buf) > 0 {
+		dec.fail("data after the end of the value")
+	}
+	if dec.e != nil {
+		return values.Value{}, dec.e
+	}
+	return result, nil
+}
+
+type wireEncoder struct {
+	imageEncoder
+	vm        *Vm
+	types     map[values.ValueType]uint32
+	typeList  []values.ValueType
+	labels    map[int]uint32
+	labelList []string
+}
+
+func (enc *wireEncoder) typeNumber(t values.ValueType) {
+	n, ok := enc.types[t]
+	if !ok {
+		n = uint32(len(enc.typeList))
+		enc.types[t] = n
+		enc.typeList = append(enc.typeList, t)
+	}
+	enc.u32(n)
+}
+
+func (enc *wireEncoder) label(label int) {
+	n, ok := enc.labels[label]
+	if !ok {
+		n = uint32(len(enc.labelList))
+		enc.labels[label] = n
+		enc.labelList = append(enc.labelList, enc.vm.Labels[label])
+	}
+	enc.u32(n)
+}
+
+func (enc *wireEncoder) float(f float64) {
+	enc.buf = binary.LittleEndian.AppendUint64(enc.buf, math.Float64bits(f))
+}
+
+func (enc *wireEncoder) value(v values.Value) {
+	enc.typeNumber(v.T)
+	enc.payload(v)
+}
+
+func (enc *wireEncoder) values(vals []values.Value) {
+	enc.uint(uint64(len(vals)))
+	for _, el := range vals {
+		enc.value(el)
+	}
+}
+
+func (enc *wireEncoder) payload(v values.Value) {
+	if int(v.T) >= len(enc.vm.ConcreteTypeInfo) {
+		enc.fail(errors.New("can't encode a value of unknown type"))
+		return
+	}
+	info := enc.vm.ConcreteTypeInfo[v.T]
+	switch {
+	case info.IsEnum():
+		enc.str(info.(EnumType).ElementNames[v.V.(int)])
+		return
+	case info.IsClone():
+		enc.payload(values.Value{info.(CloneType).Parent, v.V})
+		return
+	case info.IsStruct():
+		structInfo := info.(StructType)
+		if structInfo.Snippet {
+			enc.fail(errors.New("can't encode a snippet"))
+			return
+		}
+		enc.uint(uint64(len(structInfo.LabelNumbers)))
+		for i, label := range structInfo.LabelNumbers {
+			enc.label(label)
+			enc.value(v.V.([]values.Value)[i])
+		}
+		return
+	}
+	switch v.T {
+	case values.NULL, values.SUCCESSFUL_VALUE:
+	case values.INT:
+		enc.int(int64(v.V.(int)))
+	case values.BOOL:
+		enc.boolean(v.V.(bool))
+	case values.STRING:
+		enc.str(v.V.(string))
+	case values.RUNE:
+		enc.int(int64(v.V.(rune)))
+	case values.FLOAT:
+		enc.float(v.V.(float64))
+	case values.LABEL:
+		enc.label(v.V.(int))
+	case values.TYPE:
+		abType := v.V.(values.AbstractType)
+		enc.uint(uint64(len(abType.Types)))
+		for _, t := range abType.Types {
+			enc.typeNumber(t)
+		}
+		enc.u32(abType.Varchar)
+	case values.TUPLE, values.PAIR:
+		enc.values(v.V.([]values.Value))
+	case values.LIST:
+		vec := v.V.(vector.Vector)
+		enc.uint(uint64(vec.Len()))
+		for i := 0; i < vec.Len(); i++ {
+			el, _ := vec.Index(i)
+			enc.value(el.(values.Value))
+		}
+	case values.SET:
+		enc.uint(uint64(v.V.(values.Set).Len()))
+		v.V.(values.Set).Range(func(el values.Value) {
+			enc.value(el)
+		})
+	case values.MAP:
+		enc.uint(uint64(v.V.(*values.Map).Len()))
+		v.V.(*values.Map).Range(func(k, el values.Value) {
+			enc.value(k)
+			enc.value(el)
+		})
+	default:
+		enc.fail(errors.New("can't encode a value of type " + text.Emph(enc.vm.DescribeType(v.T, LITERAL))))
+	}
+}
+
+type wireDecoder struct {
+	vm     *Vm
+	buf    []byte
+	types  []values.ValueType // The types named in the message, as numbered in the vm.
+	labels []int              // Likewise the labels.
+	e      error
+}
+
+func (dec *wireDecoder) fail(message string) {
+	if dec.e == nil {
+		dec.e = errors.New("malformed value: " + message)
+	}
+	dec.buf = nil
+}
+
+func (dec *wireDecoder) uint() uint64 {
+	x, n := binary.Uvarint(dec.buf)
+	if n <= 0 {
+		dec.fail("bad number")
+		return 0
+	}
+	dec.buf = dec.buf[n:]
+	return x
+}
+
+func (dec *wireDecoder) int() int64 {
+	x, n := binary.Varint(dec.buf)
+	if n <= 0 {
+		dec.fail("bad number")
+		return 0
+	}
+	dec.buf = dec.buf[n:]
+	return x
+}
+
+// Reads a number which should index one of the lists.
+func (dec *wireDecoder) index(length int) int {
+	x := dec.uint()
+	if x >= uint64(length) {
+		dec.fail("number out of range")
+		return 0
+	}
+	return int(x)
+}
+
+// As with images, everything in a list takes up at least a byte, so we can reject lengths longer
+// than what's left.
+func (dec *wireDecoder) length() int {
+	n := dec.uint()
+	if n > uint64(len(dec.buf)) {
+		dec.fail("bad length")
+		return 0
+	}
+	return int(n)
+}
+
+func (dec *wireDecoder) str() string {
+	n := dec.length()
+	s := string(dec.buf[:n])
+	dec.buf = dec.buf[n:]
+	return s
+}
+
+func (dec *wireDecoder) strs() []string {
+	result := make([]string, dec.length())
+	for i := range result {
+		result[i] = dec.str()
+	}
+	return result
+}
+
+func (dec *wireDecoder) float() float64 {
+	if len(dec.buf) < 8 {
+		dec.fail("unexpected end of value")
+		return 0
+	}
+	f := math.Float64frombits(binary.LittleEndian.Uint64(dec.buf))
+	dec.buf = dec.buf[8:]
+	return f
+}
+
+func (dec *wireDecoder) typeNumber() values.ValueType {
+	i := dec.index(len(dec.types))
+	if dec.e != nil {
+		return values.UNDEFINED_TYPE
+	}
+	return dec.types[i]
+}
+
+func (dec *wireDecoder) label() int {
+	i := dec.index(len(dec.labels))
+	if dec.e != nil {
+		return 0
+	}
+	return dec.labels[i]
+}
+
+func (dec *wireDecoder) value(depth int) values.Value {
+	if depth > WIRE_MAX_DEPTH {
+		dec.fail("too deeply nested")
+		return values.Value{}
+	}
+	t := dec.typeNumber()
+	if dec.e != nil {
+		return values.Value{}
+	}
+	return values.Value{t, dec.payload(t, depth)}
+}
+
+func (dec *wireDecoder) values(depth int) []values.Value {
+	result := make([]values.Value, dec.length())
+	for i := range result {
+		result[i] = dec.value(depth + 1)
+	}
+	return result
+}
+
+func (dec *wireDecoder) payload(t values.ValueType, depth int) any {
+	info := dec.vm.ConcreteTypeInfo[t]
+	switch {
+	case info.IsEnum():
+		name := dec.str()
+		for i, el := range info.(EnumType).ElementNames {
+			if el == name {
+				return i
+			}
+		}
+		dec.fail("type " + text.Emph(info.GetName(LITERAL)) + " has no element " + text.Emph(name))
+		return nil
+	case info.IsClone():
+		return dec.payload(info.(CloneType).Parent, depth)
+	case info.IsStruct():
+		return dec.structFields(info.(StructType), depth)
+	}
+	switch t {
+	case values.NULL, values.SUCCESSFUL_VALUE:
+		return nil
+	case values.INT:
+		return int(dec.int())
+	case values.BOOL:
+		if len(dec.buf) == 0 || dec.buf[0] > 1 {
+			dec.fail("bad boolean")
+			return false
+		}
+		b := dec.buf[0] == 1
+		dec.buf = dec.buf[1:]
+		return b
+	case values.STRING:
+		return dec.str()
+	case values.RUNE:
+		return rune(dec.int())
+	case values.FLOAT:
+		return dec.float()
+	case values.LABEL:
+		return dec.label()
+	case values.TYPE:
+		abType := values.AbstractType{Types: make([]values.ValueType, dec.length())}
+		for i := range abType.Types {
+			abType.Types[i] = dec.typeNumber()
+		}
+		abType.Varchar = uint32(dec.uint())
+		return abType
+	case values.TUPLE:
+		return dec.values(depth)
+	case values.PAIR:
+		vals := dec.values(depth)
+		if dec.e == nil && len(vals) != 2 {
+			dec.fail("a pair should have two elements")
+		}
+		return vals
+	case values.LIST:
+		vals := dec.values(depth)
+		if dec.e != nil {
+			return nil
+		}
+		vec := vector.Empty
+		for _, el := range vals {
+			vec = vec.Conj(el)
+		}
+		return vec
+	case values.SET:
+		vals := dec.values(depth)
+		if dec.e != nil {
+			return nil
+		}
+		set := values.Set{}
+		for _, el := range vals {
+			if !dec.vm.isHashable(el) {
+				dec.fail("a set can't contain a value of type " + text.Emph(dec.vm.DescribeType(el.T, LITERAL)))
+				return nil
+			}
+			set = set.Add(el)
+		}
+		return set
+	case values.MAP:
+		m := &values.Map{}
+		n := dec.length()
+		for i := 0; i < n; i++ {
+			k := dec.value(depth + 1)
+			el := dec.value(depth + 1)
+			if dec.e != nil {
+				return nil
+			}
+			if !dec.vm.isHashable(k) {
+				dec.fail("a map can't have a key of type " + text.Emph(dec.vm.DescribeType(k.T, LITERAL)))
+				return nil
+			}
+			m = m.Set(k, el)
+		}
+		return m
+	}
+	dec.fail("can't decode a value of type " + text.Emph(dec.vm.DescribeType(t, LITERAL)))
+	return nil
+}
+
+// The fields are matched to those of the struct type by their labels, and must be of the types it
+// says.
+func (dec *wireDecoder) structFields(structInfo StructType, depth int) []values.Value {
+	if structInfo.Snippet {
+		dec.fail("can't decode a snippet")
+		return nil
+	}
+	n := dec.length()
+	if dec.e == nil && n != len(structInfo.LabelNumbers) {
+		dec.fail("type " + text.Emph(structInfo.GetName(LITERAL)) + " should have " + text.Emph(strconv.Itoa(len(structInfo.LabelNumbers))) + " fields")
+		return nil
+	}
+	fields := make([]values.Value, n)
+	for i := 0; i < n && dec.e == nil; i++ {
+		label := dec.label()
+		if dec.e != nil {
+			return nil
+		}
+		field := structInfo.resolve(label)
+		if field == -1 || fields[field].T != values.UNDEFINED_TYPE {
+			dec.fail("type " + text.Emph(structInfo.GetName(LITERAL)) + " has no field " + text.Emph(dec.vm.Labels[label]) + ", or it was given twice")
+			return nil
+		}
+		fields[field] = dec.value(depth + 1)
+		if dec.e != nil {
+			return nil
+		}
+		fieldType := structInfo.AbstractStructFields[field]
+		if !fieldType.Contains(fields[field].T) {
+			dec.fail("field " + text.Emph(dec.vm.Labels[label]) + " of type " + text.Emph(structInfo.GetName(LITERAL)) +
+				" can't have a value of type " + text.Emph(dec.vm.DescribeType(fields[field].T, LITERAL)))
+			return nil
+		}
+		if fields[field].T == values.STRING && fieldType.Varchar < DUMMY && utf8.RuneCountInString(fields[field].V.(string)) > int(fieldType.Varchar) {
+			dec.fail("field " + text.Emph(dec.vm.Labels[label]) + " of type " + text.Emph(structInfo.GetName(LITERAL)) +
+				" is longer than varchar(" + strconv.Itoa(int(fieldType.Varchar)) + ")")
+			return nil
+		}
+	}
+	return fields
+}
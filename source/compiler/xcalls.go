@@ -0,0 +1,313 @@
+package compiler
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/tim-hardcastle/Pipefish/source/token"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+
+	"src.elv.sh/pkg/persistent/vector"
+)
+
+// A call to a function or command of an external service, as made by the `extn` operation.
+type externalCall struct {
+	namespace string         // The remainder of the namespace of the function.
+	name      string         // The name of the function.
+	position  uint32         // Whether it's PREFIX, INFIX, SUFFIX, or UNFIX.
+	args      []values.Value // The arguments, including the bling.
+	isCommand bool
+}
+
+// Writes the call as a line of Pipefish, with each argument other than bling written as the
+// function supplied says.
+func (call *externalCall) line(argText func(i int, v values.Value) string) string {
+	var buf strings.Builder
+	if call.position == UNFIX {
+		return call.namespace + call.name
+	}
+	if call.position == PREFIX {
+		buf.WriteString(call.namespace)
+		buf.WriteString(call.name)
+	}
+	buf.WriteString("(")
+	for i, v := range call.args {
+		if v.T == values.BLING && v.V.(string) == call.name {
+			buf.WriteString(") ")
+			buf.WriteString(call.namespace)
+			buf.WriteString(v.V.(string))
+			buf.WriteString(" (")
+			continue
+		}
+		if v.T == values.BLING {
+			buf.WriteString(v.V.(string))
+		} else {
+			buf.WriteString(argText(i, v))
+		}
+		if v.T == values.BLING || i+1 == len(call.args) || call.args[i+1].T == values.BLING {
+			buf.WriteString(" ")
+		} else {
+			buf.WriteString(", ")
+		}
+	}
+	buf.WriteString(")")
+	if call.position == SUFFIX {
+		buf.WriteString(call.namespace)
+		buf.WriteString(call.name)
+	}
+	return buf.String()
+}
+
+// The call as Pipefish source, with the arguments as literals, as it's sent to a service on
+// another hub.
+func (vm *Vm) literalCall(call *externalCall) string {
+	return call.line(func(i int, v values.Value) string { return vm.Literal(v) })
+}
+
+// Calls to an external service on the same hub needn't go through Pipefish source, since we can
+// give the values to the other vm directly, once we've changed the numbers of their types and
+// labels from the ones the calling vm gives them to the ones the external vm does. A `hubLink`
+// keeps the tables for doing this, which are made the first time they're needed, since the
+// calling service's types aren't all made until it's been initialized. It also keeps the code
+// it's compiled in the external service for each call it's made, by the shape of the call and
+// the types of the arguments, so that after the first time we just have to put the arguments in
+// the external vm's memory and run the code.
+//
+// Values which can't be converted, such as lambdas, or values of types which the other service
+// doesn't know about, are sent as literals, as they would be to another hub.
+type hubLink struct {
+	made               bool
+	typesToExternal    []values.ValueType // By the type number in the calling vm; DUMMY if the external vm has no such type.
+	typesFromExternal  []values.ValueType // Likewise the other way.
+	labelsToExternal   []int              // By the label number in the calling vm; -1 if the external vm has no such label.
+	labelsFromExternal []int
+	calls              map[string]*compiledCall
+}
+
+type compiledCall struct {
+	argLocs []uint32 // Where to put the arguments, other than bling, in the external vm's memory.
+	callTo  uint32   // The address of the code.
+	outLoc  uint32   // Where the result ends up.
+}
+
+// Makes the tables. The types of the stub of the external service have the namespace of the stub
+// prefixed to the path they have in the external service; the types from the mandatory imports,
+// and the builtin types, are the same in both.
+func (link *hubLink) make(vm *Vm, ext *Compiler, namespace string) {
+	extTypes := map[string]values.ValueType{}
+	for i := int(values.FIRST_DEFINED_TYPE); i < len(ext.Vm.ConcreteTypeInfo); i++ {
+		extTypes[ext.Vm.ConcreteTypeInfo[i].GetName(LITERAL)] = values.ValueType(i)
+	}
+	link.typesToExternal = make([]values.ValueType, len(vm.ConcreteTypeInfo))
+	link.typesFromExternal = make([]values.ValueType, len(ext.Vm.ConcreteTypeInfo))
+	for i := range link.typesFromExternal {
+		link.typesFromExternal[i] = DUMMY
+	}
+	for i, info := range vm.ConcreteTypeInfo {
+		link.typesToExternal[i] = DUMMY
+		if i < int(values.FIRST_DEFINED_TYPE) {
+			link.typesToExternal[i] = values.ValueType(i)
+			if i < len(link.typesFromExternal) {
+				link.typesFromExternal[i] = values.ValueType(i)
+			}
+			continue
+		}
+		name := info.GetName(LITERAL)
+		switch {
+		case strings.HasPrefix(name, namespace):
+			name = name[len(namespace):]
+		case !info.isMandatoryImport():
+			continue
+		}
+		if extType, ok := extTypes[name]; ok {
+			link.typesToExternal[i] = extType
+			link.typesFromExternal[extType] = values.ValueType(i)
+		}
+	}
+	extLabels := map[string]int{}
+	for i, label := range ext.Vm.Labels {
+		extLabels[label] = i
+	}
+	link.labelsToExternal = make([]int, len(vm.Labels))
+	link.labelsFromExternal = make([]int, len(ext.Vm.Labels))
+	for i := range link.labelsFromExternal {
+		link.labelsFromExternal[i] = -1
+	}
+	for i, label := range vm.Labels {
+		link.labelsToExternal[i] = -1
+		if extLabel, ok := extLabels[label]; ok {
+			link.labelsToExternal[i] = extLabel
+			link.labelsFromExternal[extLabel] = i
+		}
+	}
+	link.calls = map[string]*compiledCall{}
+	link.made = true
+}
+
+// Makes the call in the external service, returning false if it can't be done without literals.
+func (link *hubLink) call(ctx context.Context, vm *Vm, ext *Compiler, namespace string, call *externalCall) (values.Value, bool) {
+	if !link.made {
+		link.make(vm, ext, namespace)
+	}
+	args := make([]values.Value, 0, len(call.args))
+	var key strings.Builder
+	for _, v := range call.args {
+		if v.T == values.BLING {
+			continue
+		}
+		extV, ok := convert(v, link.typesToExternal, link.labelsToExternal, vm, ext.Vm)
+		if !ok {
+			return values.Value{}, false
+		}
+		args = append(args, extV)
+		key.WriteString(strconv.Itoa(int(extV.T)))
+		key.WriteString(" ")
+	}
+	line := call.line(func(i int, v values.Value) string { return "externalArgument" + strconv.Itoa(i) })
+	key.WriteString(line)
+	compiled, ok := link.calls[key.String()]
+	if !ok {
+		compiled, ok = compileExternalCall(ext, line, call, args)
+		if !ok {
+			return values.Value{}, false
+		}
+		link.calls[key.String()] = compiled
+	}
+	for i, loc := range compiled.argLocs {
+		ext.Vm.Mem[loc] = args[i]
+	}
+	result, ok := ext.Vm.RunContext(ctx, compiled.callTo)
+	if ok {
+		result = ext.Vm.Mem[compiled.outLoc]
+	}
+	return convert(result, link.typesFromExternal, link.labelsFromExternal, ext.Vm, vm)
+}
+
+// Compiles the line in the external service, with the arguments other than bling as variables
+// of the types of the values supplied. The code is kept: the external service rolls its vm back
+// after each line it's given, but only to where it was before the line.
+func compileExternalCall(ext *Compiler, line string, call *externalCall, args []values.Value) (*compiledCall, bool) {
+	tok := &token.Token{Source: "external call"}
+	state := ext.GetState()
+	env := NewEnvironment()
+	env.Ext = ext.GlobalVars
+	compiled := &compiledCall{}
+	arg := 0
+	for i, v := range call.args {
+		if v.T == values.BLING {
+			continue
+		}
+		compiled.argLocs = append(compiled.argLocs, ext.Reserve(values.UNDEFINED_TYPE, nil, tok))
+		ext.AddVariable(env, "externalArgument"+strconv.Itoa(i), LOCAL_VARIABLE, AltType(args[arg].T), tok)
+		arg++
+	}
+	compiled.callTo = ext.CodeTop()
+	node := ext.P.ParseLine("external call", line)
+	if !ext.P.ErrorsExist() {
+		ext.CompileNode(node, Context{Env: env, Access: REPL, LowMem: DUMMY, LogFlavor: LF_NONE})
+	}
+	if ext.P.ErrorsExist() {
+		ext.P.ResetAfterError()
+		ext.Rollback(state, tok)
+		return nil, false
+	}
+	ext.Emit(Ret)
+	compiled.outLoc = ext.That()
+	return compiled, true
+}
+
+// Converts a value from one vm to the other, given the tables for doing so.
+func convert(v values.Value, types []values.ValueType, labels []int, from, to *Vm) (values.Value, bool) {
+	if int(v.T) >= len(types) || types[v.T] == DUMMY {
+		return values.Value{}, false
+	}
+	result := values.Value{T: types[v.T], V: v.V}
+	info := from.ConcreteTypeInfo[v.T]
+	switch {
+	case info.IsEnum():
+		return result, true
+	case info.IsClone():
+		parent, ok := convert(values.Value{info.(CloneType).Parent, v.V}, types, labels, from, to)
+		result.V = parent.V
+		return result, ok
+	case info.IsStruct():
+		if info.(StructType).Snippet {
+			return values.Value{}, false
+		}
+		fields, ok := convertAll(v.V.([]values.Value), types, labels, from, to)
+		result.V = fields
+		return result, ok
+	}
+	switch v.T {
+	case values.NULL, values.INT, values.BOOL, values.STRING, values.RUNE, values.FLOAT, values.ERROR, values.SUCCESSFUL_VALUE:
+		return result, true
+	case values.LABEL:
+		if labels[v.V.(int)] == -1 {
+			return values.Value{}, false
+		}
+		result.V = labels[v.V.(int)]
+		return result, true
+	case values.TYPE:
+		abType := v.V.(values.AbstractType)
+		converted := values.AbstractType{Types: make([]values.ValueType, len(abType.Types)), Varchar: abType.Varchar}
+		for i, t := range abType.Types {
+			if int(t) >= len(types) || types[t] == DUMMY {
+				return values.Value{}, false
+			}
+			converted.Types[i] = types[t]
+		}
+		result.V = converted
+		return result, true
+	case values.TUPLE, values.PAIR:
+		elements, ok := convertAll(v.V.([]values.Value), types, labels, from, to)
+		result.V = elements
+		return result, ok
+	case values.LIST:
+		vec := vector.Empty
+		for i := 0; i < v.V.(vector.Vector).Len(); i++ {
+			el, _ := v.V.(vector.Vector).Index(i)
+			converted, ok := convert(el.(values.Value), types, labels, from, to)
+			if !ok {
+				return values.Value{}, false
+			}
+			vec = vec.Conj(converted)
+		}
+		result.V = vec
+		return result, true
+	case values.SET: // The elements are ordered by their types, so we have to make the set again.
+		set := values.Set{}
+		ok := true
+		v.V.(values.Set).Range(func(el values.Value) {
+			converted, elOk := convert(el, types, labels, from, to)
+			ok = ok && elOk
+			set = set.Add(converted)
+		})
+		result.V = set
+		return result, ok
+	case values.MAP: // Likewise.
+		m := &values.Map{}
+		ok := true
+		v.V.(*values.Map).Range(func(k, el values.Value) {
+			convertedKey, keyOk := convert(k, types, labels, from, to)
+			convertedEl, elOk := convert(el, types, labels, from, to)
+			ok = ok && keyOk && elOk
+			m = m.Set(convertedKey, convertedEl)
+		})
+		result.V = m
+		return result, ok
+	}
+	return values.Value{}, false // E.g. a lambda, which belongs to the vm that made it.
+}
+
+func convertAll(vals []values.Value, types []values.ValueType, labels []int, from, to *Vm) ([]values.Value, bool) {
+	result := make([]values.Value, len(vals))
+	for i, v := range vals {
+		converted, ok := convert(v, types, labels, from, to)
+		if !ok {
+			return nil, false
+		}
+		result[i] = converted
+	}
+	return result, true
+}
@@ -0,0 +1,144 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// This file contains the wire format of the Debug Adapter Protocol, which like the Language Server
+// Protocol consists of JSON messages each preceded by a `Content-Length` header, plus the structures
+// we use. We only implement the subset of the protocol that the server in `server.go` needs.
+
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type response struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+// Reads one message from the client.
+func readMessage(r *bufio.Reader) (*request, error) {
+	header, e := textproto.NewReader(r).ReadMIMEHeader()
+	if e != nil {
+		return nil, e
+	}
+	length, e := strconv.Atoi(strings.TrimSpace(header.Get("Content-Length")))
+	if e != nil {
+		return nil, errors.New("missing or malformed Content-Length header")
+	}
+	body := make([]byte, length)
+	if _, e := io.ReadFull(r, body); e != nil {
+		return nil, e
+	}
+	var req request
+	if e := json.Unmarshal(body, &req); e != nil {
+		return nil, e
+	}
+	return &req, nil
+}
+
+// Writes one message to the client.
+func writeMessage(w io.Writer, v any) error {
+	body, e := json.Marshal(v)
+	if e != nil {
+		return e
+	}
+	if _, e := io.WriteString(w, "Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"); e != nil {
+		return e
+	}
+	_, e = w.Write(body)
+	return e
+}
+
+// The arguments of the requests.
+
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type setBreakpointsArguments struct {
+	Source      source `json:"source"`
+	Breakpoints []struct {
+		Line int `json:"line"`
+	} `json:"breakpoints"`
+}
+
+type stackTraceArguments struct {
+	StartFrame int `json:"startFrame"`
+	Levels     int `json:"levels"`
+}
+
+type scopesArguments struct {
+	FrameId int `json:"frameId"`
+}
+
+type variablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+}
+
+type evaluateArguments struct {
+	Expression string `json:"expression"`
+	FrameId    *int   `json:"frameId,omitempty"`
+}
+
+// The bodies of the responses and events.
+
+type breakpoint struct {
+	Verified bool `json:"verified"`
+	Line     int  `json:"line"`
+}
+
+type thread struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type stackFrame struct {
+	Id     int     `json:"id"`
+	Name   string  `json:"name"`
+	Source *source `json:"source,omitempty"`
+	Line   int     `json:"line"`
+	Column int     `json:"column"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type stoppedEvent struct {
+	Reason            string `json:"reason"`
+	ThreadId          int    `json:"threadId"`
+	AllThreadsStopped bool   `json:"allThreadsStopped"`
+}
@@ -0,0 +1,293 @@
+package dap
+
+// A Debug Adapter Protocol endpoint for the VM debugger, started by `hub debug dap`. An editor
+// attaches to it over TCP to set breakpoints in the current service, and when the service stops
+// the editor can inspect the callstack and the variables and tell it to resume or to step.
+//
+// The server is itself the `DebugHandler` of the debugger. The vm runs on whatever goroutine
+// called the service, while the server talks to the client on its own goroutine: when the
+// vm stops, `Stopped` tells the client so and then waits for the client to say what to do next.
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// Variable references. The locals of the nth frame have reference LOCALS + n.
+const (
+	GLOBALS = 1
+	LOCALS  = 2
+)
+
+// The vm has only the one thread.
+const THREAD_ID = 1
+
+type Server struct {
+	listener net.Listener
+	resume   chan pf.DebugAction
+
+	mu      sync.Mutex // Guards everything below.
+	dbg     *pf.Debugger
+	conn    net.Conn
+	seq     int
+	stopped bool
+}
+
+// Starts listening on the given address, e.g. "localhost:4711". The server does nothing until
+// `Serve` is called.
+func Listen(addr string) (*Server, error) {
+	listener, e := net.Listen("tcp", addr)
+	if e != nil {
+		return nil, e
+	}
+	return &Server{listener: listener, resume: make(chan pf.DebugAction)}, nil
+}
+
+// The address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Accepts clients one at a time and serves them until the server is closed.
+func (s *Server) Serve(dbg *pf.Debugger) {
+	s.mu.Lock()
+	s.dbg = dbg
+	s.mu.Unlock()
+	for {
+		conn, e := s.listener.Accept()
+		if e != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conn = conn
+		s.mu.Unlock()
+		s.serveClient(conn)
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		s.doResume(pf.DEBUG_RESUME)
+		dbg.ClearBreakpoints("")
+		conn.Close()
+	}
+}
+
+// Stops listening, disconnects the client if any, and lets the vm carry on if it's stopped.
+func (s *Server) Close() error {
+	e := s.listener.Close()
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	s.doResume(pf.DEBUG_RESUME)
+	return e
+}
+
+// Implements `DebugHandler`. If no client is attached we just carry on.
+func (s *Server) Stopped(d *pf.Debugger, reason string) pf.DebugAction {
+	s.mu.Lock()
+	if s.conn == nil {
+		s.mu.Unlock()
+		return pf.DEBUG_RESUME
+	}
+	s.stopped = true
+	s.sendEvent("stopped", stoppedEvent{Reason: reason, ThreadId: THREAD_ID, AllThreadsStopped: true})
+	s.mu.Unlock()
+	return <-s.resume
+}
+
+func (s *Server) serveClient(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		req, e := readMessage(r)
+		if e != nil {
+			return
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if !s.handle(req) {
+			return
+		}
+	}
+}
+
+// Handles a request, returning false if the client has disconnected.
+func (s *Server) handle(req *request) bool {
+	switch req.Command {
+	case "initialize":
+		s.reply(req, map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		})
+		s.mu.Lock()
+		s.sendEvent("initialized", nil)
+		s.mu.Unlock()
+	case "attach", "launch", "configurationDone":
+		s.reply(req, nil) // The service is already running in the hub, so there's nothing to launch.
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		if e := json.Unmarshal(req.Arguments, &args); e != nil {
+			s.fail(req, e.Error())
+			return true
+		}
+		s.dbg.ClearBreakpoints(args.Source.Path)
+		result := []breakpoint{}
+		for _, bp := range args.Breakpoints {
+			result = append(result, breakpoint{Verified: s.dbg.SetBreakpoint(args.Source.Path, bp.Line), Line: bp.Line})
+		}
+		s.reply(req, map[string]any{"breakpoints": result})
+	case "threads":
+		s.reply(req, map[string]any{"threads": []thread{{Id: THREAD_ID, Name: "main"}}})
+	case "stackTrace":
+		var args stackTraceArguments
+		json.Unmarshal(req.Arguments, &args)
+		if !s.isStopped() {
+			s.reply(req, map[string]any{"stackFrames": []stackFrame{}, "totalFrames": 0})
+			return true
+		}
+		frames := []stackFrame{}
+		stack := s.dbg.Stack()
+		for i, frame := range stack {
+			if i < args.StartFrame || args.Levels > 0 && i >= args.StartFrame+args.Levels {
+				continue
+			}
+			sf := stackFrame{Id: i, Name: frame.Name}
+			if sf.Name == "" {
+				sf.Name = "<top level>"
+			}
+			if frame.Token != nil {
+				sf.Line, sf.Column = frame.Token.Line, frame.Token.ChStart+1
+				if frame.Path != "" && frame.Path != "REPL input" {
+					sf.Source = &source{Name: filepath.Base(frame.Path), Path: frame.Path}
+				}
+			}
+			frames = append(frames, sf)
+		}
+		s.reply(req, map[string]any{"stackFrames": frames, "totalFrames": len(stack)})
+	case "scopes":
+		var args scopesArguments
+		if e := json.Unmarshal(req.Arguments, &args); e != nil {
+			s.fail(req, e.Error())
+			return true
+		}
+		s.reply(req, map[string]any{"scopes": []scope{
+			{Name: "Locals", VariablesReference: LOCALS + args.FrameId},
+			{Name: "Globals", VariablesReference: GLOBALS, Expensive: true},
+		}})
+	case "variables":
+		var args variablesArguments
+		if e := json.Unmarshal(req.Arguments, &args); e != nil {
+			s.fail(req, e.Error())
+			return true
+		}
+		vars := []variable{}
+		if s.isStopped() {
+			var dvs []pf.DebugVariable
+			if args.VariablesReference == GLOBALS {
+				dvs = s.dbg.Globals()
+			} else {
+				dvs = s.dbg.Locals(args.VariablesReference - LOCALS)
+			}
+			for _, dv := range dvs {
+				vars = append(vars, variable{Name: dv.Name, Value: dv.Value, Type: dv.Type})
+			}
+		}
+		s.reply(req, map[string]any{"variables": vars})
+	case "evaluate": // We can only evaluate the names of variables, since evaluating code would need the vm, which is busy being stopped.
+		var args evaluateArguments
+		if e := json.Unmarshal(req.Arguments, &args); e != nil {
+			s.fail(req, e.Error())
+			return true
+		}
+		frame := 0
+		if args.FrameId != nil {
+			frame = *args.FrameId
+		}
+		if !s.isStopped() {
+			s.fail(req, "the service isn't stopped")
+			return true
+		}
+		if dv, ok := s.dbg.Variable(frame, args.Expression); ok {
+			s.reply(req, map[string]any{"result": dv.Value, "type": dv.Type, "variablesReference": 0})
+		} else {
+			s.fail(req, "'"+args.Expression+"' isn't the name of a variable")
+		}
+	case "continue":
+		s.reply(req, map[string]any{"allThreadsContinued": true})
+		s.doResume(pf.DEBUG_RESUME)
+	case "next":
+		s.reply(req, nil)
+		s.doResume(pf.DEBUG_STEP_OVER)
+	case "stepIn":
+		s.reply(req, nil)
+		s.doResume(pf.DEBUG_STEP_IN)
+	case "stepOut":
+		s.reply(req, nil)
+		s.doResume(pf.DEBUG_STEP_OUT)
+	case "pause":
+		s.dbg.RequestPause()
+		s.reply(req, nil)
+	case "disconnect", "terminate":
+		s.reply(req, nil)
+		return false
+	default:
+		s.fail(req, "unsupported request '"+req.Command+"'")
+	}
+	return true
+}
+
+func (s *Server) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// Lets the vm carry on, if it's stopped.
+func (s *Server) doResume(action pf.DebugAction) {
+	s.mu.Lock()
+	wasStopped := s.stopped
+	s.stopped = false
+	s.mu.Unlock()
+	if wasStopped {
+		s.resume <- action
+	}
+}
+
+func (s *Server) reply(req *request, body any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send(response{Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body})
+}
+
+func (s *Server) fail(req *request, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send(response{Type: "response", RequestSeq: req.Seq, Success: false, Command: req.Command, Message: message})
+}
+
+// Must be called with the mutex held.
+func (s *Server) sendEvent(name string, body any) {
+	s.send(event{Type: "event", Event: name, Body: body})
+}
+
+// Must be called with the mutex held.
+func (s *Server) send(msg any) {
+	if s.conn == nil {
+		return
+	}
+	s.seq++
+	switch msg := msg.(type) {
+	case response:
+		msg.Seq = s.seq
+		writeMessage(s.conn, msg)
+	case event:
+		msg.Seq = s.seq
+		writeMessage(s.conn, msg)
+	}
+}
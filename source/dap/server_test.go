@@ -0,0 +1,182 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+const dapTestCode = `def
+
+double(n int) :
+    n + n
+
+quadruple(n int) :
+    double m
+given :
+    m = double n
+`
+
+// A client which talks to the server over TCP, as an editor would.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	seq  int
+}
+
+type testMessage struct {
+	Type       string          `json:"type"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func (c *testClient) readMessage() testMessage {
+	header, e := textproto.NewReader(c.r).ReadMIMEHeader()
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	length, _ := strconv.Atoi(header.Get("Content-Length"))
+	body := make([]byte, length)
+	if _, e := io.ReadFull(c.r, body); e != nil {
+		c.t.Fatal(e)
+	}
+	var msg testMessage
+	if e := json.Unmarshal(body, &msg); e != nil {
+		c.t.Fatal(e)
+	}
+	return msg
+}
+
+// Sends a request and returns the body of the response, skipping any events on the way.
+func (c *testClient) request(command string, arguments any, body any) {
+	c.seq++
+	args, _ := json.Marshal(arguments)
+	if e := writeMessage(c.conn, request{Seq: c.seq, Type: "request", Command: command, Arguments: args}); e != nil {
+		c.t.Fatal(e)
+	}
+	for {
+		msg := c.readMessage()
+		if msg.Type != "response" || msg.RequestSeq != c.seq {
+			continue
+		}
+		if !msg.Success {
+			c.t.Fatalf("%s: %s", command, msg.Message)
+		}
+		if body != nil {
+			if e := json.Unmarshal(msg.Body, body); e != nil {
+				c.t.Fatalf("%s: %v", command, e)
+			}
+		}
+		return
+	}
+}
+
+// Reads until the given event arrives.
+func (c *testClient) waitFor(event string) testMessage {
+	for {
+		if msg := c.readMessage(); msg.Type == "event" && msg.Event == event {
+			return msg
+		}
+	}
+}
+
+func TestDap(t *testing.T) {
+	scriptFilepath := filepath.Join(t.TempDir(), "dap_test.pf")
+	if e := os.WriteFile(scriptFilepath, []byte(dapTestCode), 0644); e != nil {
+		t.Fatal(e)
+	}
+	sv := pf.NewService()
+	if e := sv.InitializeFromFilepath(scriptFilepath); e != nil {
+		t.Fatal(e)
+	}
+	server, e := Listen("localhost:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer server.Close()
+	dbg, e := sv.StartDebugging(server)
+	if e != nil {
+		t.Fatal(e)
+	}
+	go server.Serve(dbg)
+	conn, e := net.Dial("tcp", server.Addr())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.request("initialize", map[string]any{}, nil)
+	c.waitFor("initialized")
+	var bps struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	c.request("setBreakpoints", map[string]any{"source": source{Path: scriptFilepath},
+		"breakpoints": []map[string]int{{"line": 4}, {"line": 2}}}, &bps)
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[1].Verified {
+		t.Fatalf("wanted line 4 but not line 2 to be verified | got %v", bps.Breakpoints)
+	}
+	c.request("configurationDone", nil, nil)
+
+	result := make(chan string)
+	go func() {
+		v, e := sv.Do("quadruple 5")
+		if e != nil {
+			result <- e.Error()
+			return
+		}
+		result <- sv.ToLiteral(v)
+	}()
+
+	stopped := c.waitFor("stopped")
+	var stop stoppedEvent
+	json.Unmarshal(stopped.Body, &stop)
+	if stop.Reason != "breakpoint" {
+		t.Errorf("wanted to stop at a breakpoint | got %q", stop.Reason)
+	}
+	var trace struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+	}
+	c.request("stackTrace", stackTraceArguments{}, &trace)
+	if len(trace.StackFrames) < 2 || trace.StackFrames[0].Name != "double" || trace.StackFrames[0].Line != 4 ||
+		trace.StackFrames[0].Source == nil || trace.StackFrames[0].Source.Path != scriptFilepath {
+		t.Fatalf("wanted to be in double on line 4 | got %v", trace.StackFrames)
+	}
+	var scopes struct {
+		Scopes []scope `json:"scopes"`
+	}
+	c.request("scopes", scopesArguments{FrameId: 0}, &scopes)
+	if len(scopes.Scopes) == 0 || scopes.Scopes[0].Name != "Locals" {
+		t.Fatalf("wanted the locals | got %v", scopes.Scopes)
+	}
+	var vars struct {
+		Variables []variable `json:"variables"`
+	}
+	c.request("variables", variablesArguments{VariablesReference: scopes.Scopes[0].VariablesReference}, &vars)
+	if len(vars.Variables) != 1 || vars.Variables[0].Name != "n" || vars.Variables[0].Value != "5" {
+		t.Errorf("wanted n = 5 | got %v", vars.Variables)
+	}
+
+	// The breakpoint is hit once for the given and once for the body.
+	c.request("continue", nil, nil)
+	c.waitFor("stopped")
+	c.request("variables", variablesArguments{VariablesReference: LOCALS}, &vars)
+	if len(vars.Variables) != 1 || vars.Variables[0].Value != "10" {
+		t.Errorf("wanted n = 10 | got %v", vars.Variables)
+	}
+	c.request("continue", nil, nil)
+	if got := <-result; got != "20" {
+		t.Errorf("wanted 20 | got %s", got)
+	}
+}
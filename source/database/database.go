@@ -6,11 +6,16 @@ package database
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -19,11 +24,11 @@ import (
 	// SQL drivers
 
 	_ "github.com/databricks/databricks-sql-go" // Databricks
-	_ "github.com/go-sql-driver/mysql"          // MariaDB, MySQL, TiDB
+	"github.com/go-sql-driver/mysql"            // MariaDB, MySQL, TiDB
 	_ "github.com/lib/pq"                       // PostgreSQL, CockroachDB
 	_ "github.com/microsoft/go-mssqldb"         // Microsoft SQL Server
 	_ "github.com/nakagami/firebirdsql"         // Firebird
-	_ "github.com/sijms/go-ora"                 // Oracle
+	go_ora "github.com/sijms/go-ora"            // Oracle
 	_ "modernc.org/sqlite"                      // SQLite
 )
 
@@ -32,25 +37,89 @@ import (
 var driversFromPipefishEnum = map[string]string{"COCKROACHDB": "postgres", "FIREBIRD_SQL": "firebirdsql", "MARIADB": "mysql", "MICROSOFT_SQL_SERVER": "sqlserver", "MYSQL": "mysql",
 	"ORACLE": "oracle", "POSTGRESQL": "postgres", "SNOWFLAKE": "snowflake", "SQLITE": "sqlite", "TIDB": "mysql"}
 
-func GetdB(driverAsPipefishEnum, name, host string, port int, user, password string) (*sql.DB, error) {
+// How many connections to the database the pool may hold open, how many it keeps idle, and how
+// long it may keep any one of them. A zero leaves the setting as the driver has it.
+type PoolSettings struct {
+	MaxOpen     int
+	MaxIdle     int
+	MaxLifetime time.Duration
+}
+
+func GetdB(driverAsPipefishEnum, name, host string, port int, user, password string, pool PoolSettings) (*sql.DB, error) {
 
-	connectionString := fmt.Sprintf("host=%v port=%v dbname=%v user=%v password=%v sslmode=disable",
-		host, port, name, user, password)
+	driver, ok := driversFromPipefishEnum[driverAsPipefishEnum]
+	if !ok {
+		return nil, errors.New("unknown SQL driver " + driverAsPipefishEnum)
+	}
+	connectionString := getConnectionString(driverAsPipefishEnum, name, host, port, user, password)
 
-	sqlObj, connectionError := sql.Open(driversFromPipefishEnum[driverAsPipefishEnum], connectionString)
+	sqlObj, connectionError := sql.Open(driver, connectionString)
 	if connectionError != nil {
 		return nil, connectionError
 	}
 
+	// Each connection to an in-memory SQLite database has a database of its own, so there can only
+	// be one, and it mustn't be closed.
+	if driverAsPipefishEnum == "SQLITE" && isInMemory(name) {
+		pool = PoolSettings{MaxOpen: 1, MaxIdle: 1}
+	}
+	if pool.MaxOpen > 0 {
+		sqlObj.SetMaxOpenConns(pool.MaxOpen)
+	}
+	if pool.MaxIdle > 0 {
+		sqlObj.SetMaxIdleConns(pool.MaxIdle)
+	}
+	if pool.MaxLifetime > 0 {
+		sqlObj.SetConnMaxLifetime(pool.MaxLifetime)
+	}
+
 	err := sqlObj.Ping()
 
 	if err != nil {
+		sqlObj.Close()
 		return nil, err
 	}
 
 	return sqlObj, nil
 }
 
+// Each driver wants to be told where the database is in its own way. For SQLite, the name of
+// the database is the path to its file, or blank or ":memory:" for a database in memory, and the
+// host, port, and credentials are ignored.
+func getConnectionString(driverAsPipefishEnum, name, host string, port int, user, password string) string {
+	hostAndPort := net.JoinHostPort(host, strconv.Itoa(port))
+	switch driverAsPipefishEnum {
+	case "COCKROACHDB", "POSTGRESQL":
+		u := url.URL{Scheme: "postgres", User: url.UserPassword(user, password), Host: hostAndPort,
+			Path: "/" + name, RawQuery: "sslmode=disable"}
+		return u.String()
+	case "MARIADB", "MYSQL", "TIDB":
+		cfg := mysql.NewConfig()
+		cfg.User, cfg.Passwd, cfg.Net, cfg.Addr, cfg.DBName = user, password, "tcp", hostAndPort, name
+		cfg.ParseTime = true // So that we can read timestamps into the Time type.
+		return cfg.FormatDSN()
+	case "MICROSOFT_SQL_SERVER":
+		u := url.URL{Scheme: "sqlserver", User: url.UserPassword(user, password), Host: hostAndPort,
+			RawQuery: url.Values{"database": {name}}.Encode()}
+		return u.String()
+	case "ORACLE":
+		return go_ora.BuildUrl(host, port, name, user, password, nil)
+	case "FIREBIRD_SQL":
+		return url.UserPassword(user, password).String() + "@" + hostAndPort + "/" + name
+	case "SQLITE":
+		if isInMemory(name) {
+			return ":memory:"
+		}
+		// The hub's tables need foreign keys, and the hub may be handling several requests at once.
+		return "file:" + name + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+	}
+	return url.UserPassword(user, password).String() + "@" + hostAndPort + "/" + name
+}
+
+func isInMemory(name string) bool {
+	return name == "" || name == ":memory:"
+}
+
 func GetDriverOptions() string {
 	result := "The following SQL drivers are available: \n\n"
 	for k, v := range GetSortedDrivers() {
@@ -62,10 +131,24 @@ func GetDriverOptions() string {
 
 func GetSortedDrivers() []string { // TODO --- could be done once on initialization.
 	dr := []string{}
-	for k := range driversFromPipefishEnum {
+	for _, k := range getSortedDriverEnums() {
 		dr = append(dr, enumToEnglish(k))
 	}
-	sort.Strings(dr)
+	return dr
+}
+
+// Returns the driver as a Pipefish enum element, given its number in the list of options.
+func GetDriverEnum(number int) string {
+	return getSortedDriverEnums()[number]
+}
+
+// In the order of their names in English, so that the numbers of the options match.
+func getSortedDriverEnums() []string {
+	dr := []string{}
+	for k := range driversFromPipefishEnum {
+		dr = append(dr, k)
+	}
+	sort.Slice(dr, func(i, j int) bool { return enumToEnglish(dr[i]) < enumToEnglish(dr[j]) })
 	return dr
 }
 
@@ -262,6 +345,34 @@ func GetGroupsOfUser(db *sql.DB, username string, ownGroups bool) (string, error
 	return result, nil
 }
 
+// Returns the names of the groups the user belongs to, for checking the permissions of services.
+func GetGroupNamesOfUser(db *sql.DB, username string) ([]string, error) {
+	return getNames(db, "SELECT groupName FROM _GroupMemberships WHERE username = $1", username)
+}
+
+// Returns the names of the users of the group, for reporting the permissions of services.
+func GetUserNamesOfGroup(db *sql.DB, groupName string) ([]string, error) {
+	return getNames(db, "SELECT username FROM _GroupMemberships WHERE groupName = $1", groupName)
+}
+
+func getNames(db *sql.DB, query, arg string) ([]string, error) {
+	rows, err := db.Query(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, rows.Err()
+}
+
 func GetUsersOfGroup(db *sql.DB, groupName string) (string, error) {
 	rows, err := db.Query("SELECT * FROM _GroupMemberships WHERE groupName = $1", groupName)
 	if err != nil {
@@ -561,6 +672,142 @@ VALUES ($1)`
 	return err
 }
 
+// The migrations of a service's tables are recorded in the _Migrations table, by the name of the
+// service's script and the version number of the migration.
+
+func createMigrationsTable(db *sql.DB) error {
+	query :=
+		`CREATE TABLE IF NOT EXISTS _Migrations (
+    serviceName varchar(255),
+    version integer,
+    script varchar(255),
+    applied timestamp,
+PRIMARY KEY (serviceName, version))`
+	_, err := db.Exec(query)
+	return err
+}
+
+func GetAppliedMigrations(db *sql.DB, serviceName string) (map[int]bool, error) {
+	err := createMigrationsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT version FROM _Migrations WHERE serviceName = $1`, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		result[version] = true
+	}
+	return result, rows.Err()
+}
+
+// Runs the statements of the migration and records it in one transaction, so that either all of it
+// is applied or none of it is.
+func ApplyMigration(db *sql.DB, serviceName string, version int, script string, statements []string) error {
+	err := createMigrationsTable(db)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%w, running '%s'", err, statement)
+		}
+	}
+	query :=
+		`INSERT INTO _Migrations(serviceName, version, script, applied)
+	VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(query, serviceName, version, script, time.Now().UTC()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// The snapshots of the variables of services are kept in the _Snapshots table, by the name of the
+// service and the name of the variable. The values are in Pipefish's binary wire format, which we
+// keep as base64 so that it can be stored as text in any database.
+
+type SnapshotVariable struct {
+	Name  string
+	Type  string
+	Value []byte
+}
+
+func createSnapshotsTable(db *sql.DB) error {
+	query :=
+		`CREATE TABLE IF NOT EXISTS _Snapshots (
+    serviceName varchar(255),
+    name varchar(255),
+    type varchar(255),
+    value text,
+PRIMARY KEY (serviceName, name))`
+	_, err := db.Exec(query)
+	return err
+}
+
+func GetSnapshot(db *sql.DB, serviceName string) ([]SnapshotVariable, error) {
+	err := createSnapshotsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT name, type, value FROM _Snapshots WHERE serviceName = $1`, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []SnapshotVariable{}
+	for rows.Next() {
+		var v SnapshotVariable
+		var value string
+		if err := rows.Scan(&v.Name, &v.Type, &value); err != nil {
+			return nil, err
+		}
+		if v.Value, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, rows.Err()
+}
+
+// Replaces the snapshot of the service in one transaction, so that a snapshot is never half-saved.
+func SaveSnapshot(db *sql.DB, serviceName string, variables []SnapshotVariable) error {
+	err := createSnapshotsTable(db)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM _Snapshots WHERE serviceName = $1`, serviceName); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query :=
+		`INSERT INTO _Snapshots(serviceName, name, type, value)
+	VALUES ($1, $2, $3, $4)`
+	for _, v := range variables {
+		if _, err := tx.Exec(query, serviceName, v.Name, v.Type, base64.StdEncoding.EncodeToString(v.Value)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func encrypt(s string) string {
 	result, _ := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
 	return string(result)
@@ -35,6 +35,16 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"comp/access": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "user " + emph(args[0]) + " isn't permitted to call " + emph(tok.Literal)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The service says which groups of users may call which of its functions and commands by declaring them under lines such as " + emph("for Admins, Editors") + ", and you aren't in any of the groups which may call this one." +
+				"\n\nTo see who can call what, an admin can do " + emph("hub permissions") + "."
+		},
+	},
+
 	"comp/assign": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "malformed assignment"
@@ -601,6 +611,15 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"comp/snippet/database": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "malformed name of database in snippet constructor"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "An SQL snippet can say which of the service's databases it goes to by naming it, as in " + emph("SQL(analytics) ---") + ". The name should be a plain identifier, and only SQL snippets can have one."
+		},
+	},
+
 	"comp/snippet/form/a": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "unmatched " + emph("|") + " in snippet constructor"
@@ -646,6 +665,87 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"comp/sql/column": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "there is no column " + emph(args[0]) + " in " + args[1].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The SQL snippet refers to a column which isn't in the schema imported for its database, either as a column of the table or tables the snippet names, or as the name given to a column by " + emph("AS") + ".\n\nFor more information about checking snippets against a schema see 'hub help \"schemas\"'."
+		},
+	},
+
+	"comp/sql/columns": {
+		Message: func(tok *token.Token, args ...any) string {
+			return fmt.Sprintf("SQL snippet returns %v columns but type %v has %v fields", args[0], emph(args[1]), args[2])
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "When you " + emph("get") + " the rows of a query " + emph("as") + " a struct type, each row is made into a struct with one column to each field, in order, and so the number of columns the query returns must be the same as the number of fields of the type.\n\nFor more information about checking snippets against a schema see 'hub help \"schemas\"'."
+		},
+	},
+
+	"comp/sql/field": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "column " + emph(args[0]) + " of SQL type " + emph(args[1]) + " doesn't fit field " + emph(args[2]) + " of type " + emph(args[3])
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "When you " + emph("get") + " the rows of a query " + emph("as") + " a struct type, each column is put into the field in the same position, and so the type of the column, according to the schema imported for the database, must be one that the field can hold.\n\nFor more information about checking snippets against a schema see 'hub help \"schemas\"'."
+		},
+	},
+
+	"comp/sql/params": {
+		Message: func(tok *token.Token, args ...any) string {
+			return fmt.Sprintf("SQL snippet supplies %v values for the %v columns of table %v", args[2], args[1], emph(args[0]))
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "An " + emph("INSERT") + " statement should supply one value for each of the columns it names, or if it doesn't name any, for each column of the table. Note that if you inject a tuple into a snippet, each of its elements counts as a separate value.\n\nFor more information about checking snippets against a schema see 'hub help \"schemas\"'."
+		},
+	},
+
+	"comp/sql/table": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "there is no table " + emph(args[0]) + " in the schema of " + args[1].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The SQL snippet refers to a table which isn't declared by the schema imported for its database, nor created by an SQL snippet of the module.\n\nFor more information about checking snippets against a schema see 'hub help \"schemas\"'."
+		},
+	},
+
+	"comp/sql/type": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "column " + emph(args[0]) + " of SQL type " + emph(args[1]) + " can't hold a value of type " + emph(args[2])
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "A value injected into an SQL snippet is being inserted into, assigned to, or compared with a column whose type, according to the schema imported for the database, doesn't fit the type of the value.\n\nFor more information about checking snippets against a schema see 'hub help \"schemas\"'."
+		},
+	},
+
+	"comp/transaction/access": {
+		Message: func(tok *token.Token, args ...any) string {
+			return emph("transaction") + " can only be used in a command"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "A " + emph("transaction") + " block changes the database, and so like anything else which changes the state of the world it belongs in the " + emph("cmd") + " section of a script."
+		},
+	},
+
+	"comp/transaction/break": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't " + emph(tok.Literal) + " out of a " + emph("transaction") + " block"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "A " + emph("break") + " or " + emph("continue") + " inside a " + emph("transaction") + " block can only leave a " + emph("for") + " loop inside the block, since otherwise the transaction would never be finished."
+		},
+	},
+
+	"comp/transaction/return": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "trying to return value from " + emph("transaction") + " block"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "A " + emph("transaction") + " block is imperative and can return only success or failure"
+		},
+	},
+
 	"comp/try/return": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "trying to return value from " + emph("try") + " expression"
@@ -812,6 +912,65 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"ext/rejected": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "the hub of external service " + emph(args[0]) + " refused the credentials: " + args[2].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The hub at " + emph(args[1]) + " is administered, and wouldn't let Pipefish log on to it with the " +
+				"username and password you gave when the external service was declared, or refused the token it " +
+				"got by logging on, even after logging on again. Check that the user exists on that hub and is allowed " +
+				"to use the service."
+		},
+	},
+
+	"ext/remote": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "external service " + emph(args[0]) + " returned an error with id " + emph(args[1]) + ": " + args[2].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Pipefish reached the external service and it did what you asked, but the result was an error " +
+				"value, which is described above as the external service described it. The error id is that of the error " +
+				"on the external service, which you can look up there."
+		},
+	},
+
+	"ext/response": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't read the response of external service " + emph(args[0]) + ": " + args[2].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Pipefish reached the hub at " + emph(args[1]) + " but it answered with something other than " +
+				"the result of the call, which may mean that the URL of the external service points at something " +
+				"which isn't a Pipefish hub."
+		},
+	},
+
+	"ext/unreachable": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't reach external service " + emph(args[0]) + ": " + args[2].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Pipefish couldn't get an answer from the hub at " + emph(args[1]) + " in time, or it was too busy " +
+				"or shutting down. Calls to functions are tried a few times before Pipefish gives up, but calls to commands " +
+				"aren't, since they may have been done even though no answer came back. If enough calls in a row " +
+				"fail, then Pipefish stops trying for a while, and calls fail at once. How long to wait and how often to " +
+				"try can be set in the URL of the external service, e.g. " +
+				emph("\"http://example.com:8080/myService?timeout=5s&retries=3&backoff=50ms&failures=10&cooldown=1m\"") + "."
+		},
+	},
+
+	"ext/unscripted": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "no response has been scripted for " + emph(args[1]) + " in the stub of external service " + emph(args[0])
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "While the service is being tested, the external service is replaced by a stub, which only " +
+				"responds to the functions and commands it defines. You can script a response by uncommenting " +
+				emph(args[1]) + " in the stub and giving it a body."
+		},
+	},
+
 	"golang/build": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "failed to compile Go\n\nError was '" + args[0].(string) + "'"
@@ -904,6 +1063,34 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"init/access/form": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "malformed " + emph("for") + " line"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "In the " + emph("cmd") + " and " + emph("def") + " sections, a line consisting of " + emph("for") + " followed by the names of groups of users separated by commas, e.g. " +
+				emph("for Admins, Editors") + ", says that only those groups may call the commands or functions declared after it from outside the service."
+		},
+	},
+
+	"init/access/overload": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "overloaded function " + emph(args[0]) + " is declared for different groups here and at line " + strconv.Itoa(args[1].(int))
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Who may call a public function or command is given by name, and so all the overloads of the function or command must be declared under the same " + emph("for") + " line, or under none."
+		},
+	},
+
+	"init/access/private": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "a function or command can't be both private and declared " + emph("for") + " groups"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "A " + emph("for") + " line says which groups of users may call the functions or commands after it from outside the service, but a private function or command can't be called from outside the service at all."
+		},
+	},
+
 	"init/assign/ident": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "left-hand side of assignment should be identifier"
@@ -969,6 +1156,16 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"init/external/api": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't get the API of external service " + emph(args[0]) + ": " + args[1].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "To know what it can call, Pipefish asks the hub of an external service for the service's " +
+				"public functions and types when the service that uses it is initialized, and this failed."
+		},
+	},
+
 	"init/external/exist/a": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "service " + emph(tok.Literal) + " does not exist"
@@ -987,6 +1184,21 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"init/external/options": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "bad options in path to external service: " + args[0].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The path to an http service may end with options saying how to call it, e.g. " +
+				emph("\"http://example.com:8080/myService?timeout=5s&retries=3&backoff=50ms&failures=10&cooldown=1m\"") +
+				". The " + emph("timeout") + " is how long to wait for each call; " + emph("retries") + " how many more " +
+				"times to try calling a function if the hub can't be reached, waiting for the " + emph("backoff") +
+				" before the first retry and twice as long before each one after; " + emph("failures") + " how many " +
+				"calls in a row can fail to reach the hub before Pipefish stops trying, and " + emph("cooldown") +
+				" for how long. The durations are written like " + emph("5s") + " or " + emph("100ms") + "."
+		},
+	},
+
 	"init/external/path/a": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "malformed path to external service"
@@ -1014,6 +1226,16 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"init/external/stub": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "the stub " + emph(args[1]) + " of external service " + emph(args[0]) + " doesn't compile"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "When the service is tested, the external service is replaced by its stub, which must " +
+				"compile. Starting the stub as a service of its own will show you what's wrong with it."
+		},
+	},
+
 	"init/func/body": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "function definition has no body"
@@ -1275,6 +1497,15 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"init/sql/schema": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "malformed " + emph("CREATE TABLE") + " statement in schema"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Pipefish reads the " + emph("CREATE TABLE") + " statements of a schema imported for a database so that it can check the SQL snippets which go to it, and it couldn't make sense of this one. It should have the name of the table followed by the definitions of its columns in parentheses, each consisting of the name of the column and then its type.\n\nFor more information about checking snippets against a schema see 'hub help \"schemas\"'."
+		},
+	},
+
 	"init/type/exists": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "type " + emph(tok.Literal) + " already exists"
@@ -1972,6 +2203,15 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"parse/transaction/colon": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "found " + text.DescribeTok(tok) + " in 'transaction' expression"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "'transaction' should be followed by a colon and then by the commands to be run in the transaction."
+		},
+	},
+
 	"parse/try/colon": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "found " + text.DescribeTok(tok) + " in 'try' expression"
@@ -2036,6 +2276,15 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"sql/exists/named": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't find SQL database " + emph(args[0])
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The snippet asks for a database by name, but none of that name has been configured for the service. You can do this with 'hub config db \"<name>\"'."
+		},
+	},
+
 	"sql/in/read": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "can't read from SQL database; error was \"" + args[0].(string) + "\""
@@ -2054,9 +2303,18 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"sql/in/columns": {
+		Message: func(tok *token.Token, args ...any) string {
+			return fmt.Sprintf("the query returned %v columns but type %v has %v fields", args[0], emph(args[1]), args[2])
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Each column returned by the query is put into the corresponding field of the struct, and so there should be as many columns as fields."
+		},
+	},
+
 	"sql/in/type/a": {
 		Message: func(tok *token.Token, args ...any) string {
-			return "can't read from database into type" + emph(args[0])
+			return "can't read from database into type " + emph(args[0])
 		},
 		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
 			return "Pipefish expects a subtype of 'struct' here that matches the data you're trying to fetch from the database."
@@ -2065,10 +2323,12 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 
 	"sql/in/type/b": {
 		Message: func(tok *token.Token, args ...any) string {
-			return "failed type conversion"
+			return "can't convert " + args[1].(string) + " in column " + emph(args[0]) + " to type " + emph(args[2])
 		},
 		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
-			return "At present Pipefish only works with the varchar, int, and bool types. This is because the author has had other things to do."
+			return "Pipefish can read the int, float, bool, string, and varchar types from the database, and these types " +
+				"with '?' for nullable columns; enums, by name or ordinal; clones of these; and the Time type, from timestamps. " +
+				"But the value in the column must fit the type of the corresponding field of the struct."
 		},
 	},
 
@@ -2081,6 +2341,25 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"sql/out/type": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't write value of type " + emph(args[0]) + " to SQL database"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Pipefish can write the int, float, bool, and string types to the database, and NULL; " +
+				"enums, by name; clones of these; and the Time type, as a timestamp."
+		},
+	},
+
+	"sql/transaction": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't " + args[0].(string) + " transaction; error was \"" + args[1].(string) + "\""
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Hopefully the error returned from SQL makes it clear why this has happened. If the transaction couldn't be committed, then none of its changes have been made."
+		},
+	},
+
 	"sql/sig": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "can't convert Pipefish struct to SQL table"
@@ -2351,6 +2630,25 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"vm/json/decode": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't decode JSON: " + args[0].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Either the string isn't valid JSON, or it doesn't describe a value of the type you asked for. " +
+				"The path after the " + emph("$") + " says where in the JSON the problem is."
+		},
+	},
+
+	"vm/json/encode": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't encode value as JSON: " + args[0].(string)
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Values such as errors, functions, and infinite floats have no representation in JSON."
+		},
+	},
+
 	"vm/label/exist": {
 		Message: func(tok *token.Token, args ...any) string {
 			return fmt.Sprintf("can't convert string %v to a label", emphStr(args[0]))
@@ -2360,6 +2658,51 @@ var ErrorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"vm/limit/cancel": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "the call was cancelled"
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "Whatever started the call, e.g. the hub or a Go program using Pipefish as a library, told it to stop before it had finished."
+		},
+	},
+
+	"vm/limit/depth": {
+		Message: func(tok *token.Token, args ...any) string {
+			return fmt.Sprintf("recursion went deeper than the limit of %v", emph(args[0]))
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The service has a limit on how deep its recursive functions may go, so that a function which recurses forever will return an error rather than hanging the service. Either the function recurses forever, or the limit should be raised."
+		},
+	},
+
+	"vm/limit/instructions": {
+		Message: func(tok *token.Token, args ...any) string {
+			return fmt.Sprintf("the call took more than the limit of %v instructions", emph(args[0]))
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The service has a limit on how many instructions of bytecode a call may execute, so that a loop or a recursion that never ends will return an error rather than hanging the service. Either the call would never have finished, or the limit should be raised."
+		},
+	},
+
+	"vm/limit/memory": {
+		Message: func(tok *token.Token, args ...any) string {
+			return fmt.Sprintf("call used more than the limit of %v values of memory", emph(args[0]))
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The service has a limit on how many values a call to it may add to memory, counting the elements of lists, sets, maps, tuples and structs, and what recursive functions keep while they wait for one another to return. This is so that a runaway loop or recursion will return an error rather than using up all the memory of the machine."
+		},
+	},
+
+	"vm/limit/time": {
+		Message: func(tok *token.Token, args ...any) string {
+			return fmt.Sprintf("the call took longer than the limit of %v", emph(args[0]))
+		},
+		Explanation: func(errors Errors, pos int, tok *token.Token, args ...any) string {
+			return "The call wasn't allowed to take as long as it did, either because the service has a time limit or because whatever started the call gave it a deadline. Either the call would never have finished, or it needs more time."
+		},
+	},
+
 	"vm/map/pair": {
 		Message: func(tok *token.Token, args ...any) string {
 			return fmt.Sprintf("can't use value of type %v as a key-value pair", emph(args[0]))
@@ -0,0 +1,204 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/auth"
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// An administered hub checks usernames and passwords either against the tables of its database or,
+// if 'hub config auth' has given it one, against a static users file. An HTTP client logs in with
+// its username and password by posting them as JSON to
+//
+//	POST /login
+//
+// and gets back a bearer token, which it then sends with its requests in the header as
+// 'Authorization: Bearer <token>'. It can give the token up before it expires with
+//
+//	POST /logout
+//
+// The tokens are signed with a secret kept in 'user/token.key' in the Pipefish home directory.
+
+const (
+	LOGIN_PATH  = "POST /login"
+	LOGOUT_PATH = "POST /logout"
+
+	DEFAULT_TOKEN_LIFETIME = 60 // In minutes.
+)
+
+type loginRequest = struct {
+	Username string
+	Password string
+}
+
+type loginResponse = struct {
+	Token   string `json:",omitempty"`
+	Service string `json:",omitempty"`
+	Expires int64  `json:",omitempty"` // In seconds since the Unix epoch.
+	Error   string `json:",omitempty"`
+}
+
+// Says who the user is, checking a token if they have one and their username and password if not.
+func (h *Hub) authenticate(c auth.Credentials) (auth.User, error) {
+	if c.Token != "" {
+		tokens, err := h.tokenIssuer()
+		if err != nil {
+			return auth.User{}, err
+		}
+		return tokens.Authenticate(c)
+	}
+	provider, err := h.passwordProvider()
+	if err != nil {
+		return auth.User{}, err
+	}
+	return provider.Authenticate(c)
+}
+
+func (h *Hub) passwordProvider() (auth.Provider, error) {
+	h.authMu.Lock()
+	defer h.authMu.Unlock()
+	path := h.usersFile
+	if path == "" {
+		return auth.NewSqlProvider(h.Db), nil
+	}
+	if h.users == nil || h.users.Path() != path {
+		users, err := auth.NewFileProvider(path)
+		if err != nil {
+			return nil, err
+		}
+		h.users = users
+	}
+	return h.users, nil
+}
+
+func (h *Hub) tokenIssuer() (*auth.Tokens, error) {
+	h.authMu.Lock()
+	defer h.authMu.Unlock()
+	if h.tokens == nil {
+		secret, err := auth.LoadOrCreateSecret(h.pipefishHomeDirectory + "user/token.key")
+		if err != nil {
+			return nil, err
+		}
+		h.tokens = auth.NewTokens(secret, time.Duration(h.tokenLifetime)*time.Minute)
+	}
+	return h.tokens, nil
+}
+
+// Reads how authentication is configured from the hub file. Hub files from before there were users
+// files and tokens don't have the variables.
+func (h *Hub) readAuthConfig() {
+	h.usersFile, h.tokenLifetime = "", DEFAULT_TOKEN_LIFETIME
+	if v, e := h.services["hub"].GetVariable("usersFile"); e == nil && v.T == pf.STRING {
+		h.usersFile = v.V.(string)
+	}
+	if v, e := h.services["hub"].GetVariable("tokenLifetime"); e == nil && v.T == pf.INT && v.V.(int) > 0 {
+		h.tokenLifetime = v.V.(int)
+	}
+}
+
+// Gets the credentials from the header of a request, which may have either a bearer token or a
+// username and password supplied by basic authentication.
+func credentialsOfRequest(r *http.Request) (auth.Credentials, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return auth.Credentials{Token: strings.TrimSpace(token)}, true
+	}
+	username, password, ok := r.BasicAuth()
+	return auth.Credentials{Username: username, Password: password}, ok
+}
+
+func (h *Hub) handleLoginRequest(w http.ResponseWriter, r *http.Request) {
+	var request loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeLoginResponse(w, http.StatusBadRequest, loginResponse{Error: err.Error()})
+		return
+	}
+	user, err := h.authenticate(auth.Credentials{Username: request.Username, Password: request.Password})
+	if err != nil {
+		writeLoginResponse(w, http.StatusUnauthorized, loginResponse{Error: err.Error()})
+		return
+	}
+	tokens, err := h.tokenIssuer()
+	if err != nil {
+		writeLoginResponse(w, http.StatusInternalServerError, loginResponse{Error: err.Error()})
+		return
+	}
+	token, expires, err := tokens.Issue(user)
+	if err != nil {
+		writeLoginResponse(w, http.StatusInternalServerError, loginResponse{Error: err.Error()})
+		return
+	}
+	writeLoginResponse(w, http.StatusOK, loginResponse{Token: token, Service: user.Service, Expires: expires.Unix()})
+}
+
+func (h *Hub) handleLogoutRequest(w http.ResponseWriter, r *http.Request) {
+	creds, ok := credentialsOfRequest(r)
+	if !ok || creds.Token == "" {
+		writeLoginResponse(w, http.StatusBadRequest, loginResponse{Error: "a bearer token is required"})
+		return
+	}
+	tokens, err := h.tokenIssuer()
+	if err == nil {
+		err = tokens.Revoke(creds.Token)
+	}
+	if err != nil {
+		writeLoginResponse(w, http.StatusUnauthorized, loginResponse{Error: err.Error()})
+		return
+	}
+	writeLoginResponse(w, http.StatusOK, loginResponse{})
+}
+
+func writeLoginResponse(w http.ResponseWriter, status int, response loginResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+const (
+	AUTH_USERS_FILE     = "Users file (blank to use the hub's database)"
+	AUTH_TOKEN_LIFETIME = "Lifetime of tokens in minutes (blank for 60)"
+)
+
+func (h *Hub) configAuth() {
+	h.CurrentForm = &Form{Fields: []string{AUTH_USERS_FILE, AUTH_TOKEN_LIFETIME},
+		Call:   func(f *Form) { h.handleConfigAuthForm(f) },
+		Result: make(map[string]string)}
+}
+
+func (h *Hub) handleConfigAuthForm(f *Form) {
+	h.CurrentForm = nil
+	lifetime := DEFAULT_TOKEN_LIFETIME
+	if s := strings.TrimSpace(f.Result[AUTH_TOKEN_LIFETIME]); s != "" {
+		var err error
+		lifetime, err = strconv.Atoi(s)
+		if err == nil && lifetime <= 0 {
+			err = errors.New("the lifetime of a token should be a positive number of minutes")
+		}
+		if err != nil {
+			h.WriteError("hub/auth/config/a: " + err.Error())
+			return
+		}
+	}
+	path := strings.TrimSpace(f.Result[AUTH_USERS_FILE])
+	var users *auth.FileProvider
+	if path != "" {
+		var err error
+		users, err = auth.NewFileProvider(path)
+		if err != nil {
+			h.WriteError("hub/auth/config/b: " + err.Error())
+			return
+		}
+	}
+	h.authMu.Lock()
+	h.usersFile, h.users, h.tokenLifetime = path, users, lifetime
+	if h.tokens != nil {
+		h.tokens.SetLifetime(time.Duration(lifetime) * time.Minute)
+	}
+	h.authMu.Unlock()
+	h.WriteString(GREEN_OK + "\n")
+}
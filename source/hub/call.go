@@ -0,0 +1,158 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/auth"
+	"github.com/tim-hardcastle/Pipefish/source/compiler"
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// Lets HTTP clients call the public functions and commands of a service directly, with the
+// arguments as a JSON array in the body of a request to
+//
+//	POST /services/{name}/call/{function}
+//
+// rather than sending a line of Pipefish and parsing what comes back. The response is a JSON
+// object with the value returned as `result`, or with `error` if the value is a runtime error
+// or the function couldn't be called; and with anything posted to `Output()` as `output`.
+// An OpenAPI document describing the functions of a service is at
+//
+//	GET /services/{name}/openapi.json
+//
+// If the hub is administered, the caller supplies either a bearer token from `/login`, or its
+// username and password by basic authentication. If the service is in session mode, the call
+// is made in the caller's session. (See sessions.go.)
+
+const (
+	CALL_PATH    = "POST /services/{name}/call/{function}"
+	OPENAPI_PATH = "GET /services/{name}/openapi.json"
+)
+
+func (h *Hub) handleCallRequest(w http.ResponseWriter, r *http.Request) {
+	service, user, ok := h.serviceForHttpRequest(w, r)
+	if !ok {
+		return
+	}
+	caller, e := h.callerFor(user.Name)
+	if e != nil {
+		writeCallError(w, http.StatusInternalServerError, e.Error())
+		return
+	}
+	body, e := io.ReadAll(r.Body)
+	if e != nil {
+		writeCallError(w, http.StatusBadRequest, "could not read body: "+e.Error())
+		return
+	}
+	args := []json.RawMessage{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if e := json.Unmarshal(body, &args); e != nil {
+			writeCallError(w, http.StatusBadRequest, "the arguments should be a JSON array: "+e.Error())
+			return
+		}
+	}
+	var out bytes.Buffer
+	ctx := withSession(pf.WithCaller(r.Context(), caller), r, user.Name)
+	start := time.Now()
+	val, e := service.CallJson(ctx, r.PathValue("function"), args, &out)
+	if e == nil {
+		h.observeRequest(r.PathValue("name"), service, r.PathValue("function"), "", start, val)
+	}
+	switch {
+	case errors.Is(e, compiler.ErrAccessDenied):
+		writeCallError(w, http.StatusForbidden, e.Error())
+		return
+	case errors.Is(e, compiler.ErrNoSuchFunction):
+		writeCallError(w, http.StatusNotFound, e.Error())
+		return
+	case errors.Is(e, compiler.ErrNoMatchingOverload):
+		writeCallError(w, http.StatusBadRequest, e.Error())
+		return
+	case e != nil:
+		writeCallError(w, http.StatusInternalServerError, e.Error())
+		return
+	}
+	result, e := service.ToJsonResult(val)
+	if e != nil {
+		writeCallError(w, http.StatusInternalServerError, e.Error())
+		return
+	}
+	result.Output = out.String()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Hub) handleOpenApiRequest(w http.ResponseWriter, r *http.Request) {
+	service, _, ok := h.serviceForHttpRequest(w, r)
+	if !ok {
+		return
+	}
+	doc, e := service.OpenApi(r.PathValue("name"), h.administered)
+	if e != nil {
+		writeCallError(w, http.StatusInternalServerError, e.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+// Checks the user's credentials, if the hub is administered, and finds the service named in
+// the path. If either fails, it writes the error and returns false. Otherwise it also returns
+// who the user is, which is no-one in particular if the hub isn't administered.
+func (h *Hub) serviceForHttpRequest(w http.ResponseWriter, r *http.Request) (*pf.Service, auth.User, bool) {
+	var user auth.User
+	if h.administered {
+		creds, ok := credentialsOfRequest(r)
+		if !ok {
+			writeCallError(w, http.StatusUnauthorized, "a bearer token or a username and password are required")
+			return nil, user, false
+		}
+		var e error
+		if user, e = h.authenticate(creds); e != nil {
+			writeCallError(w, http.StatusUnauthorized, e.Error())
+			return nil, user, false
+		}
+	}
+	name := r.PathValue("name")
+	h.mu.Lock()
+	h.installWatchedBuilds()
+	service, ok := h.services[name]
+	h.mu.Unlock()
+	if !ok || name == "hub" || name == "" {
+		writeCallError(w, http.StatusNotFound, "the hub has no service called '"+name+"'")
+		return nil, user, false
+	}
+	return service, user, true
+}
+
+// Writes the OpenAPI document for the current service to a file, for `hub openapi`. Since the
+// file can be anywhere the hub can write, on an administered hub only admins may do this.
+func (hub *Hub) writeOpenApi(filename string) {
+	name := hub.currentServiceName()
+	service, ok := hub.services[name]
+	if !ok || name == "" {
+		hub.WriteError("there is no current service to describe.")
+		return
+	}
+	doc, e := service.OpenApi(name, hub.administered)
+	if e == nil {
+		e = os.WriteFile(filename, doc, 0644)
+	}
+	if e != nil {
+		hub.WriteError("couldn't write the OpenAPI document: " + e.Error() + ".")
+		return
+	}
+	hub.WriteString(GREEN_OK + "\n")
+}
+
+func writeCallError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(pf.JsonResult{Error: &pf.JsonError{Message: message}})
+}
@@ -0,0 +1,295 @@
+package hub
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lmorg/readline"
+
+	"github.com/tim-hardcastle/Pipefish/source/auth"
+	"github.com/tim-hardcastle/Pipefish/source/dap"
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// The hub's side of the debugger. The hub is a `DebugHandler`: when the service it's debugging
+// stops, it shows the user where, and then runs a little REPL of its own until the user
+// gives one of the `hub debug` verbs that tells the service to carry on. The stopped call still
+// holds the lock on the service, so while it's stopped we can only use the `hub debug` verbs,
+// which look at it through the debugger.
+
+type hubDebugHandler struct {
+	hub *Hub
+}
+
+func (h *hubDebugHandler) Stopped(d *pf.Debugger, reason string) pf.DebugAction {
+	hub := h.hub
+	hub.showStop(d, reason)
+	rline := readline.NewInstance()
+	rline.SetPrompt("debug " + PROMPT)
+	for {
+		line, e := rline.Readline()
+		if e != nil {
+			return pf.DEBUG_RESUME
+		}
+		line = strings.TrimSpace(line)
+		hubWords := strings.Fields(line)
+		switch {
+		case line == "":
+		case len(hubWords) > 0 && hubWords[0] == "hub":
+			if len(hubWords) < 2 || (hubWords[1] != "debug" && hubWords[1] != "help") {
+				hub.WriteError("the service is stopped in the debugger, so you can only use the 'hub debug' verbs. " +
+					"Do 'hub debug resume' to let it carry on, or 'hub debug off' to detach the debugger.")
+				continue
+			}
+			hub.Do(line, auth.Credentials{Username: hub.Username, Password: hub.Password}, hub.currentServiceName())
+		default:
+			if v, ok := d.Variable(0, line); ok {
+				hub.WriteString(v.Value + "\n")
+			} else {
+				hub.WriteError("the service is stopped in the debugger, so you can only look at the values of " +
+					"variables. Do 'hub debug resume' to let it carry on.")
+			}
+		}
+		if hub.debugAction != nil {
+			action := *hub.debugAction
+			hub.debugAction = nil
+			return action
+		}
+	}
+}
+
+// Tells the user where the service has stopped, and shows them the line.
+func (hub *Hub) showStop(d *pf.Debugger, reason string) {
+	frame := d.Stack()[0]
+	where := ""
+	if frame.Name != "" {
+		where = " in '" + frame.Name + "'"
+	}
+	description := map[string]string{"breakpoint": "at breakpoint", "step": "after step", "pause": "on request"}[reason]
+	hub.WritePretty("\nStopped " + description + where + " at " + d.DescribePosition(frame.Token) + ".\n")
+	if frame.Token == nil {
+		return
+	}
+	sources, _ := hub.debugService.GetSources()
+	if lines, ok := sources[frame.Token.Source]; ok && 0 < frame.Token.Line && frame.Token.Line <= len(lines) {
+		hub.WriteString("\n" + Cyan(strconv.Itoa(frame.Token.Line)+" | ") + lines[frame.Token.Line-1] + "\n\n")
+	}
+}
+
+// Gets the debugger of the current service, attaching one if necessary and if `attach` is set.
+func (hub *Hub) getDebugger(attach bool) (*pf.Debugger, bool) {
+	service, ok := hub.services[hub.currentServiceName()]
+	if !ok || hub.currentServiceName() == "" {
+		hub.WriteError("there is no current service to debug.")
+		return nil, false
+	}
+	if d, ok := service.GetDebugger(); ok && service == hub.debugService {
+		return d, true
+	}
+	if !attach {
+		hub.WriteError("the debugger isn't attached to the current service.")
+		return nil, false
+	}
+	if hub.debugIsStopped() {
+		hub.WriteError("the debugger can't be moved to another service while the one it's attached to is stopped.")
+		return nil, false
+	}
+	hub.stopDebugging()
+	d, e := service.StartDebugging(&hubDebugHandler{hub})
+	if e != nil {
+		hub.WriteError("can't debug the service: " + e.Error() + ".")
+		return nil, false
+	}
+	hub.debugService = service
+	return d, true
+}
+
+// True if the service being debugged is stopped, in which case it's locked until it carries on.
+func (hub *Hub) debugIsStopped() bool {
+	if hub.debugService == nil {
+		return false
+	}
+	d, ok := hub.debugService.GetDebugger()
+	return ok && d.IsStopped()
+}
+
+// Detaches the debugger and closes the DAP server, if any.
+func (hub *Hub) stopDebugging() {
+	if hub.debugServer != nil {
+		hub.debugServer.Close()
+		hub.debugServer = nil
+	}
+	if hub.debugService != nil {
+		hub.debugService.StopDebugging()
+		hub.debugService = nil
+	}
+}
+
+// Tells a stopped service what to do next. The handler above picks this up when the hub
+// command returns.
+func (hub *Hub) resumeDebugging(d *pf.Debugger, action pf.DebugAction) {
+	if !d.IsStopped() {
+		hub.WriteError("the service isn't stopped in the debugger.")
+		return
+	}
+	hub.debugAction = &action
+}
+
+func (hub *Hub) doDebugCommand(verb string, args []string) {
+	switch verb {
+	case "debug-at":
+		d, ok := hub.getDebugger(true)
+		if !ok {
+			return
+		}
+		filename := args[0]
+		if filename == "" {
+			filename, _ = hub.services[hub.currentServiceName()].GetFilepath()
+		}
+		line, e := strconv.Atoi(args[1])
+		if e != nil {
+			hub.WriteError("a breakpoint should be on a line number, not '" + args[1] + "'.")
+			return
+		}
+		if d.SetBreakpoint(filename, line) {
+			hub.WriteString(GREEN_OK + "\n")
+		} else {
+			hub.WritePretty("Breakpoint set, but no code was compiled from line " + args[1] + " of '" + filename + "', so the debugger can't stop there.\n")
+		}
+	case "debug-clear":
+		if d, ok := hub.getDebugger(false); ok {
+			d.ClearBreakpoints("")
+			hub.WriteString(GREEN_OK + "\n")
+		}
+	case "debug-dap":
+		if hub.debugServer != nil {
+			hub.WriteError("the hub is already running a debug adapter on " + hub.debugServer.Addr() + ".")
+			return
+		}
+		if hub.debugIsStopped() {
+			hub.WriteError("can't start a debug adapter while the service is stopped in the debugger.")
+			return
+		}
+		server, e := dap.Listen("localhost:" + args[0])
+		if e != nil {
+			hub.WriteError("can't start the debug adapter: " + e.Error() + ".")
+			return
+		}
+		service, ok := hub.services[hub.currentServiceName()]
+		if !ok || hub.currentServiceName() == "" {
+			server.Close()
+			hub.WriteError("there is no current service to debug.")
+			return
+		}
+		hub.stopDebugging()
+		d, e := service.StartDebugging(server)
+		if e != nil {
+			server.Close()
+			hub.WriteError("can't debug the service: " + e.Error() + ".")
+			return
+		}
+		hub.debugService = service
+		hub.debugServer = server
+		go server.Serve(d)
+		hub.WriteString(GREEN_OK + "\n")
+		hub.WritePretty("\nDebug adapter is listening on " + server.Addr() + ".\n\n")
+	case "debug-globals":
+		if d, ok := hub.getDebugger(false); ok {
+			hub.showVariables(d.Globals())
+		}
+	case "debug-locals":
+		d, ok := hub.getDebugger(false)
+		if !ok {
+			return
+		}
+		if !d.IsStopped() {
+			hub.WriteError("the service isn't stopped in the debugger.")
+			return
+		}
+		frame, e := strconv.Atoi(args[0])
+		if e != nil || frame < 0 || frame >= len(d.Stack()) {
+			hub.WriteError("there is no frame " + args[0] + " in the callstack.")
+			return
+		}
+		hub.showVariables(d.Locals(frame))
+	case "debug-off":
+		if d, ok := hub.getDebugger(false); ok {
+			if d.IsStopped() {
+				action := pf.DEBUG_DETACH
+				hub.debugAction = &action
+			}
+			hub.stopDebugging()
+			hub.WriteString(GREEN_OK + "\n")
+		}
+	case "debug-on":
+		if d, ok := hub.getDebugger(true); ok {
+			d.RequestPause()
+			hub.WriteString(GREEN_OK + "\n")
+		}
+	case "debug-out":
+		if d, ok := hub.getDebugger(false); ok {
+			hub.resumeDebugging(d, pf.DEBUG_STEP_OUT)
+		}
+	case "debug-over":
+		if d, ok := hub.getDebugger(false); ok {
+			hub.resumeDebugging(d, pf.DEBUG_STEP_OVER)
+		}
+	case "debug-points":
+		d, ok := hub.getDebugger(false)
+		if !ok {
+			return
+		}
+		points := d.Breakpoints()
+		if len(points) == 0 {
+			hub.WriteString("There are no breakpoints.\n")
+			return
+		}
+		hub.WriteString("\n")
+		for _, point := range points {
+			hub.WriteString(BULLET + point + "\n")
+		}
+		hub.WriteString("\n")
+	case "debug-resume":
+		if d, ok := hub.getDebugger(false); ok {
+			hub.resumeDebugging(d, pf.DEBUG_RESUME)
+		}
+	case "debug-stack":
+		d, ok := hub.getDebugger(false)
+		if !ok {
+			return
+		}
+		if !d.IsStopped() {
+			hub.WriteError("the service isn't stopped in the debugger.")
+			return
+		}
+		hub.WriteString("\n")
+		for i, frame := range d.Stack() {
+			name := frame.Name
+			if name == "" {
+				name = "<top level>"
+			}
+			hub.WriteString("[" + strconv.Itoa(i) + "] " + name + " at " + d.DescribePosition(frame.Token) + "\n")
+		}
+		hub.WriteString("\n")
+	case "debug-step":
+		if d, ok := hub.getDebugger(false); ok {
+			hub.resumeDebugging(d, pf.DEBUG_STEP_IN)
+		}
+	}
+}
+
+func (hub *Hub) showVariables(vars []pf.DebugVariable) {
+	if len(vars) == 0 {
+		hub.WriteString("There are no variables.\n")
+		return
+	}
+	hub.WriteString("\n")
+	for _, v := range vars {
+		if v.Type == "" {
+			hub.WriteString(BULLET + v.Name + " : " + v.Value + "\n")
+		} else {
+			hub.WriteString(BULLET + v.Name + " " + v.Type + " = " + v.Value + "\n")
+		}
+	}
+	hub.WriteString("\n")
+}
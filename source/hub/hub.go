@@ -3,22 +3,31 @@ package hub
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/tim-hardcastle/Pipefish/source/auth"
+	"github.com/tim-hardcastle/Pipefish/source/dap"
 	"github.com/tim-hardcastle/Pipefish/source/database"
+	"github.com/tim-hardcastle/Pipefish/source/p2p"
 	"github.com/tim-hardcastle/Pipefish/source/pf"
+	"github.com/tim-hardcastle/Pipefish/source/settings"
 )
 
 type Hub struct {
@@ -26,35 +35,84 @@ type Hub struct {
 	services               map[string]*pf.Service // The services the hub knows about.
 	ers                    []*pf.Error            // The errors produced by the latest compilation/execution of one of the hub's services.
 	in                     io.Reader
-	out                    io.Writer
+	out                    io.Writer  // Where the hub writes, which is a response while it does an HTTP request.
+	repl                   io.Writer  // Where it was told to write, for the watcher's reports.
+	outMu                  sync.Mutex // Held while anything writes to either of the above.
 	anonymousServiceNumber int
 	snap                   *Snap
-	oldServiceName         string // Somewhere to keep the old service name while taking a snap. TODO --- you can now take snaps on their own dedicated hub, saving a good deal of faffing around.
+	oldServiceName         string            // Somewhere to keep the old service name while taking a snap. TODO --- you can now take snaps on their own dedicated hub, saving a good deal of faffing around.
+	testStubs              map[string]string // The stubs which the service being tested uses in place of its external services, by name. (See TestScript.)
 	Sources                map[string][]string
 	lastRun                []string
 	CurrentForm            *Form // TODO!!! --- deprecate, you've had IO for a while.
 	Db                     *sql.DB
+	namedDbs               map[string]map[string]*sql.DB  // The named databases of each service, by service and then by name.
+	namedDbConfigs         map[string]map[string]dbConfig // How they were configured, so that we can save them in the hub file.
 	administered           bool
 	listeningToHttp        bool
 	port, path             string
+	server                 *http.Server  // The HTTP server, if the hub is listening. (See listen.go.)
+	drained                chan struct{} // Closed when the last server has finished its requests.
+	tlsCertFile            string        // The certificate for HTTPS, or "" for plain HTTP.
+	tlsKeyFile             string
 	Username               string
 	Password               string
 	pipefishHomeDirectory  string
+	imageCache             string                        // Where the services cache images of themselves, or "" not to. (See pf.Service.SetImageCache.)
+	debugService           *pf.Service                   // The service the debugger is attached to, if any.
+	debugServer            *dap.Server                   // The Debug Adapter Protocol server, if one is running.
+	debugAction            *pf.DebugAction               // Set by the verbs which tell a stopped service what to do next.
+	limits                 map[string]pf.Limits          // The limits set on services by name, so that they survive recompilation.
+	sessions               map[string]*pf.SessionOptions // Likewise how the services in session mode keep their sessions.
+	usersFile              string                        // The file of users and passwords, or "" to use the database.
+	tokenLifetime          int                           // In minutes.
+	users                  *auth.FileProvider            // Made from the users file when it's first needed.
+	tokens                 *auth.Tokens                  // Made when the first token is issued or checked.
+	snapshotInterval       int                           // In minutes, or 0 to take snapshots only when told to or on quitting.
+	snapshotsIn            string                        // SNAPSHOTS_IN_FILES or SNAPSHOTS_IN_DATABASE.
+	lastSnapshot           time.Time                     // When the hub last saved snapshots of all its services.
+	watcher                *watcher                      // The watcher, if the hub is in watch mode. (See watch.go.)
+	metrics                *hubMetrics                   // What the hub and its services have done. (See metrics.go.)
+	streams                streams                       // The lines being streamed to HTTP clients. (See stream.go.)
+	authMu                 sync.Mutex                    // Held while the hub makes the above.
+	mu                     sync.Mutex                    // Held by HTTP requests while they use the hub's own state.
 }
 
 func New(in io.Reader, out io.Writer) *Hub {
 
 	hub := Hub{
-		services: make(map[string]*pf.Service),
-		in:       in,
-		out:      out,
-		lastRun:  []string{},
-	}
+		services:         make(map[string]*pf.Service),
+		limits:           make(map[string]pf.Limits),
+		sessions:         make(map[string]*pf.SessionOptions),
+		namedDbs:         make(map[string]map[string]*sql.DB),
+		namedDbConfigs:   make(map[string]map[string]dbConfig),
+		in:               in,
+		out:              out,
+		repl:             out,
+		lastRun:          []string{},
+		tokenLifetime:    DEFAULT_TOKEN_LIFETIME,
+		snapshotInterval: DEFAULT_SNAPSHOT_INTERVAL,
+		snapshotsIn:      SNAPSHOTS_IN_FILES,
+		lastSnapshot:     time.Now(),
+	}
+	hub.metrics = hub.newMetrics()
 	appDir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
 	hub.pipefishHomeDirectory = appDir + "/"
 	return &hub
 }
 
+// Makes the services the hub starts cache images of themselves in the given directory, so
+// that they start without recompiling when their sources haven't changed. By default, or if
+// the directory is "", they cache nothing.
+func (hub *Hub) SetImageCache(dir string) {
+	hub.imageCache = dir
+}
+
+// Where Pipefish run from the command line caches the images of services.
+func DefaultImageCache() string {
+	return filepath.Join(settings.PipefishHomeDirectory, "pipefish-rsc", "images")
+}
+
 func (hub *Hub) currentServiceName() string {
 	cs := hub.getSV("currentService")
 	if cs.T == pf.NULL {
@@ -64,21 +122,95 @@ func (hub *Hub) currentServiceName() string {
 	}
 }
 
+// Says whether the service is one the hub is running for its users, rather than the hub itself, the
+// empty service, or one the hub has made for testing.
+func isUserService(name string) bool {
+	return name != "" && name != "hub" && name[0] != '#'
+}
+
 func (hub *Hub) hasDatabase() bool {
 	return hub.getSV("database").T != pf.NULL
 }
 
-func (hub *Hub) getDB() (string, string, string, int, string, string) {
-	dbStruct := hub.getSV("database").V.([]pf.Value)
-	driver := hub.services["hub"].ToLiteral(dbStruct[0])
-	return driver, dbStruct[1].V.(string), dbStruct[2].V.(string), dbStruct[3].V.(int), dbStruct[4].V.(string), dbStruct[5].V.(string)
+// What we need to connect to a database, as kept in the hub file in a `Database` struct.
+type dbConfig struct {
+	driver, name, host string
+	port               int
+	username, password string
+	pool               database.PoolSettings
+}
+
+func (c dbConfig) open() (*sql.DB, error) {
+	return database.GetdB(c.driver, c.name, c.host, c.port, c.username, c.password, c.pool)
+}
+
+// Hub files from before there were pool settings have `Database` structs without them.
+func (hub *Hub) dbConfigFromStruct(dbStruct []pf.Value) dbConfig {
+	result := dbConfig{driver: hub.services["hub"].ToLiteral(dbStruct[0]), name: dbStruct[1].V.(string),
+		host: dbStruct[2].V.(string), port: dbStruct[3].V.(int), username: dbStruct[4].V.(string), password: dbStruct[5].V.(string)}
+	if len(dbStruct) >= 9 {
+		result.pool = database.PoolSettings{MaxOpen: dbStruct[6].V.(int), MaxIdle: dbStruct[7].V.(int),
+			MaxLifetime: time.Duration(dbStruct[8].V.(int)) * time.Second}
+	}
+	return result
+}
+
+func (hub *Hub) getDB() dbConfig {
+	return hub.dbConfigFromStruct(hub.getSV("database").V.([]pf.Value))
 }
 
-func (hub *Hub) setDB(driver, name, path string, port int, username, password string) {
+func (hub *Hub) setDB(c dbConfig) {
 	hubService := hub.services["hub"]
-	driverAsEnumValue, _ := hubService.Do(driver)
+	driverAsEnumValue, _ := hubService.Do(c.driver)
 	structType, _ := hubService.TypeNameToType("Database")
-	hub.setSV("database", structType, []pf.Value{driverAsEnumValue, {pf.STRING, name}, {pf.STRING, path}, {pf.INT, port}, {pf.STRING, username}, {pf.STRING, password}})
+	hub.setSV("database", structType, []pf.Value{driverAsEnumValue, {pf.STRING, c.name}, {pf.STRING, c.host}, {pf.INT, c.port},
+		{pf.STRING, c.username}, {pf.STRING, c.password}, {pf.INT, c.pool.MaxOpen}, {pf.INT, c.pool.MaxIdle},
+		{pf.INT, int(c.pool.MaxLifetime / time.Second)}})
+}
+
+// Writes the config as a `Database` struct literal for the hub file, indenting the continuation lines.
+func (c dbConfig) literal(indent string) string {
+	fields := []string{"driver::" + c.driver, "name::" + strconv.Quote(c.name), "host::" + strconv.Quote(c.host),
+		"port::" + strconv.Itoa(c.port), "username::" + strconv.Quote(c.username), "password::" + strconv.Quote(c.password),
+		"maxOpen::" + strconv.Itoa(c.pool.MaxOpen), "maxIdle::" + strconv.Itoa(c.pool.MaxIdle),
+		"maxLifetime::" + strconv.Itoa(int(c.pool.MaxLifetime/time.Second))}
+	return "Database with (" + strings.Join(fields, ",\n"+indent+".. ") + ")"
+}
+
+// Opens the named databases of the services as saved in the hub file. Hub files from before there
+// were named databases don't have the variable.
+func (hub *Hub) openNamedDbs() {
+	v, e := hub.services["hub"].GetVariable("namedDatabases")
+	if e != nil || v.T != pf.MAP {
+		return
+	}
+	for _, servicePair := range v.V.(pf.Map).AsSlice() {
+		serviceName := servicePair.Key.V.(string)
+		for _, dbPair := range servicePair.Val.V.(pf.Map).AsSlice() {
+			c := hub.dbConfigFromStruct(dbPair.Val.V.([]pf.Value))
+			db, err := c.open()
+			if err != nil {
+				hub.WriteError("couldn't open database '" + dbPair.Key.V.(string) + "' of service '" + serviceName + "': " + err.Error())
+				continue
+			}
+			hub.addNamedDb(serviceName, dbPair.Key.V.(string), c, db)
+		}
+	}
+}
+
+func (hub *Hub) addNamedDb(serviceName, dbName string, c dbConfig, db *sql.DB) {
+	if hub.namedDbs[serviceName] == nil {
+		hub.namedDbs[serviceName] = make(map[string]*sql.DB)
+		hub.namedDbConfigs[serviceName] = make(map[string]dbConfig)
+	}
+	if old, ok := hub.namedDbs[serviceName][dbName]; ok {
+		old.Close()
+	}
+	hub.namedDbs[serviceName][dbName] = db
+	hub.namedDbConfigs[serviceName][dbName] = c
+	if service, ok := hub.services[serviceName]; ok {
+		service.SetNamedDatabase(dbName, db)
+	}
 }
 
 func (hub *Hub) isLive() bool {
@@ -109,7 +241,7 @@ func (hub *Hub) setSV(sv string, ty pf.Type, v any) {
 // This takes the input from the REPL, interprets it as a hub command if it begins with 'hub';
 // as an instruction to the os if it begins with 'os', and as an expression to be passed to
 // the current service if none of the above hold.
-func (hub *Hub) Do(line, username, password, passedServiceName string) (string, bool) {
+func (hub *Hub) Do(line string, creds auth.Credentials, passedServiceName string) (string, bool) {
 
 	if hub.administered && !hub.listeningToHttp && hub.Password == "" &&
 		!(line == "hub register" || line == "hub log on" || line == "hub quit") {
@@ -119,6 +251,9 @@ func (hub *Hub) Do(line, username, password, passedServiceName string) (string,
 		return passedServiceName, false
 	}
 
+	hub.snapshotIfDue()
+	hub.installWatchedBuilds()
+
 	// We may be talking to the hub itself.
 
 	hubWords := strings.Fields(line)
@@ -131,10 +266,10 @@ func (hub *Hub) Do(line, username, password, passedServiceName string) (string,
 		if verb == "error" || verb == "OK" {
 			return passedServiceName, false
 		}
-		hubResult := hub.DoHubCommand(username, password, verb, args)
+		hubResult := hub.DoHubCommand(creds.Username, creds.Password, verb, args)
 		if len(hubWords) > 1 && hubWords[1] == "run" && hub.administered { // TODO: find out what it does and where it should be now that we have ++ for hub commands.
-			serviceName, _ := database.ValidateUser(hub.Db, username, password)
-			return serviceName, false
+			user, _ := hub.authenticate(creds)
+			return user.Service, false
 		}
 		if hubResult {
 			return passedServiceName, true
@@ -171,10 +306,36 @@ func (hub *Hub) Do(line, username, password, passedServiceName string) (string,
 
 	// Otherwise, we're talking to the current service.
 
+	serviceToUse, ok := hub.serviceForLine(line, passedServiceName)
+	if !ok {
+		return passedServiceName, false
+	}
+
+	caller, err := hub.callerFor(creds.Username)
+	if err != nil {
+		hub.WriteError(err.Error())
+		return passedServiceName, false
+	}
+
+	// *** THIS IS THE BIT WHERE WE DO THE THING!
+	val := serviceDoAs(serviceToUse, line, caller, creds.Username)
+	// *** FROM ALL THAT LOGIC, WE EXTRACT ONE PIPEFISH VALUE !!!
+	errorsExist, _ := serviceToUse.ErrorsExist()
+	if errorsExist { // Any lex-parse-compile errors should end up in the parser of the compiler of the service, returned in p.
+		hub.GetAndReportErrors(serviceToUse)
+		return passedServiceName, false
+	}
+	hub.writeValue(serviceToUse, val)
+	return passedServiceName, false
+}
+
+// Finds the service that a line which isn't addressed to the hub or the os should go to,
+// recompiling it if it's live and has changed. Returns false if there's nothing to do.
+func (hub *Hub) serviceForLine(line, passedServiceName string) (*pf.Service, bool) {
 	serviceToUse, ok := hub.services[passedServiceName]
 	if !ok {
 		hub.WriteError("the hub can't find the service '" + passedServiceName + "'.")
-		return passedServiceName, false
+		return nil, false
 	}
 
 	// The service may be broken, in which case we'll let the empty service handle the input.
@@ -184,33 +345,28 @@ func (hub *Hub) Do(line, username, password, passedServiceName string) (string,
 	}
 	hub.Sources["REPL input"] = []string{line}
 	needsUpdate := hub.serviceNeedsUpdate(hub.currentServiceName())
-	if hub.isLive() && needsUpdate {
+	if hub.isLive() && hub.watcher == nil && needsUpdate { // In watch mode, the watcher does this instead.
 		path, _ := hub.services[hub.currentServiceName()].GetFilepath()
 		hub.StartAndMakeCurrent(hub.Username, hub.currentServiceName(), path)
 		serviceToUse = hub.services[hub.currentServiceName()]
 		if serviceToUse.IsBroken() {
-			return passedServiceName, false
+			return nil, false
 		}
 	}
 
 	if match, _ := regexp.MatchString(`^\s*(|\/\/.*)$`, line); match {
 		hub.WriteString("")
-		return passedServiceName, false
+		return nil, false
 	}
 
 	if hub.currentServiceName() == "#snap" {
 		hub.snap.AddInput(line)
 	}
+	return serviceToUse, true
+}
 
-	// *** THIS IS THE BIT WHERE WE DO THE THING!
-	val := ServiceDo(serviceToUse, line)
-	// *** FROM ALL THAT LOGIC, WE EXTRACT ONE PIPEFISH VALUE !!!
-	errorsExist, _ := serviceToUse.ErrorsExist()
-	if errorsExist { // Any lex-parse-compile errors should end up in the parser of the compiler of the service, returned in p.
-		hub.GetAndReportErrors(serviceToUse)
-		return passedServiceName, false
-	}
-
+// Writes the value returned by a service in the way the hub's settings say to.
+func (hub *Hub) writeValue(serviceToUse *pf.Service, val pf.Value) {
 	if val.T == pf.ERROR {
 		hub.WriteString("\n[0] " + valToString(serviceToUse, val))
 		hub.WriteString("\n")
@@ -231,7 +387,6 @@ func (hub *Hub) Do(line, username, password, passedServiceName string) (string,
 			hub.snap.AddOutput(out)
 		}
 	}
-	return passedServiceName, false
 }
 
 func (hub *Hub) ParseHubCommand(line string) (string, []string) {
@@ -286,10 +441,12 @@ func (hub *Hub) DoHubCommand(username, password, verb string, args []string) boo
 			hub.WriteError("b/" + err.Error())
 			return false
 		}
-		if !isAdmin && (verb == "config-db" || verb == "create" || verb == "let" ||
-			verb == "live-on" || verb == "live-off" || verb == "listen" ||
-			verb == "run" || verb == "reset" || verb == "rerun" ||
-			verb == "replay" || verb == "replay-diff" || verb == "snap" || verb == "test" ||
+		if !isAdmin && (verb == "config-auth" || verb == "config-db" || verb == "config-snapshots" || verb == "config-tls" || verb == "create" || verb == "let" ||
+			verb == "limit" || verb == "limit-off" ||
+			verb == "live-on" || verb == "live-off" || verb == "listen" || verb == "listen-off" || strings.HasPrefix(verb, "debug-") ||
+			verb == "migrate" || verb == "migrate-plan" || verb == "openapi" || verb == "permissions" || verb == "sessions" || verb == "sessions-on" || verb == "sessions-off" ||
+			verb == "run" || verb == "reset" || verb == "rerun" || verb == "save" || verb == "restore" || verb == "watch-on" || verb == "watch-off" ||
+			verb == "replay" || verb == "replay-diff" || verb == "snap" || verb == "stub" || verb == "test" ||
 			verb == "groups-of-user" || verb == "groups-of-service" || verb == "services of group" ||
 			verb == "services-of-user" || verb == "users-of-service" || verb == "users-of-group" ||
 			verb == "let-use" || verb == "let-own") {
@@ -325,8 +482,21 @@ func (hub *Hub) DoHubCommand(username, password, verb string, args []string) boo
 			hub.WriteError("this hub is already administered.")
 			return false
 		}
+	case "config-auth":
+		hub.configAuth()
+		return false
+	case "config-tls":
+		hub.configTls()
+		return false
+	case "config-snapshots":
+		hub.configSnapshots()
+		return false
 	case "config-db":
-		hub.configDb()
+		if len(args) == 0 {
+			hub.configDb("")
+		} else {
+			hub.configDb(args[0])
+		}
 		return false
 	case "create":
 		err := database.AddGroup(hub.Db, args[0])
@@ -341,6 +511,10 @@ func (hub *Hub) DoHubCommand(username, password, verb string, args []string) boo
 		}
 		hub.WriteString(GREEN_OK + "\n")
 		return false
+	case "debug-at", "debug-clear", "debug-dap", "debug-globals", "debug-locals", "debug-off", "debug-on",
+		"debug-out", "debug-over", "debug-points", "debug-resume", "debug-stack", "debug-step":
+		hub.doDebugCommand(verb, args)
+		return false
 	case "edit":
 		command := exec.Command("vim", args[0])
 		command.Stdin = os.Stdin
@@ -384,6 +558,8 @@ func (hub *Hub) DoHubCommand(username, password, verb string, args []string) boo
 			return false
 		}
 		delete(hub.services, name)
+		delete(hub.limits, name)
+		delete(hub.sessions, name)
 		hub.WriteString(GREEN_OK + "\n")
 		if name == hub.currentServiceName() {
 			hub.makeEmptyServiceCurrent()
@@ -415,10 +591,28 @@ func (hub *Hub) DoHubCommand(username, password, verb string, args []string) boo
 		}
 		hub.WriteString(GREEN_OK + "\n")
 		return false
+	case "limit", "limit-off", "limits":
+		hub.doLimitCommand(verb, args)
+		return false
 	case "listen":
+		if hub.server != nil {
+			hub.WriteError("the hub is already listening. To stop it, do 'hub listen off'.")
+			return false
+		}
+		if err := hub.StartHttp("/"+args[0], args[1]); err != nil {
+			hub.WriteError("the hub can't listen: " + err.Error() + ".")
+			return false
+		}
 		hub.WriteString(GREEN_OK)
-		hub.WriteString("\nHub is listening.\n\n")
-		hub.StartHttp("/"+args[0], args[1])
+		hub.WriteString("\nHub is listening for " + strings.ToUpper(hub.scheme()) + " on port " + hub.port + ".\n\n")
+		return false
+	case "listen-off":
+		if hub.server == nil {
+			hub.WriteError("the hub isn't listening.")
+			return false
+		}
+		hub.stopHttp()
+		hub.WriteString(GREEN_OK + "\n")
 		return false
 	case "live-on":
 		hub.setLive(true)
@@ -469,10 +663,37 @@ func (hub *Hub) DoHubCommand(username, password, verb string, args []string) boo
 			hub.list()
 			return false
 		}
+	case "migrate", "migrate-plan":
+		hub.doMigrateCommand(verb)
+		return false
+	case "openapi":
+		hub.writeOpenApi(args[0])
+		return false
+	case "permissions":
+		hub.showPermissions()
+		return false
+	case "sessions", "sessions-on", "sessions-off":
+		hub.doSessionsCommand(verb, args)
+		return false
 	case "quit":
 		hub.quit()
 		return true
+	case "watch-on":
+		hub.startWatching()
+		hub.WriteString(GREEN_OK + "\n")
+		return false
+	case "watch-off":
+		hub.stopWatching()
+		hub.WriteString(GREEN_OK + "\n")
+		return false
+	case "save", "restore":
+		hub.doSnapshotCommand(verb)
+		return false
 	case "register":
+		if hub.usersFile != "" {
+			hub.WriteError("this hub takes its users from the file '" + hub.usersFile + "': ask an admin to add you to it.")
+			return false
+		}
 		hub.addUserAsGuest()
 		return false
 	case "replay":
@@ -626,6 +847,9 @@ func (hub *Hub) DoHubCommand(username, password, verb string, args []string) boo
 		} else {
 			hub.WriteError("service '" + args[0] + "' doesn't exist")
 		}
+	case "stub":
+		hub.writeStubs(args[0])
+		return false
 	case "test":
 		file, err := os.Open(args[0])
 		if err != nil {
@@ -786,6 +1010,10 @@ func getUnusedTestFilename(scriptFilepath string) string {
 }
 
 func (hub *Hub) quit() {
+	hub.stopWatching()
+	if err := hub.saveSnapshots(); err != nil {
+		hub.WriteError(err.Error() + ".")
+	}
 	hub.saveHubFile()
 	hub.WriteString(GREEN_OK + "\n" + Logo() + "Thank you for using Pipefish. Have a nice day!\n\n")
 }
@@ -819,9 +1047,19 @@ func (hub *Hub) WriteError(s string) {
 }
 
 func (hub *Hub) WriteString(s string) {
+	hub.outMu.Lock()
+	defer hub.outMu.Unlock()
 	io.WriteString(hub.out, s)
 }
 
+// Writes to the REPL whatever the hub is doing meanwhile, for the goroutines which aren't part of
+// it, like the watcher.
+func (hub *Hub) writeToRepl(s string) {
+	hub.outMu.Lock()
+	defer hub.outMu.Unlock()
+	io.WriteString(hub.repl, s)
+}
+
 var helpStrings = map[string]string{}
 
 var helpTopics = []string{}
@@ -830,11 +1068,10 @@ var helpTopics = []string{}
 var StandardLibraries = map[string]struct{}{} // TODO, start using the official Go sets.
 
 func init() {
-	for _, v := range []string{"filepath", "fmt", "math", "path", "regexp", "strings", "time", "unicode"} {
+	for _, v := range []string{"filepath", "fmt", "json", "math", "path", "regexp", "strings", "time", "unicode"} {
 		StandardLibraries[v] = struct{}{}
 	}
-	cwd, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-	file, err := os.Open(cwd + "/rsc/text/helpfile.txt")
+	file, err := os.Open(settings.PipefishHomeDirectory + "rsc/text/helpfile.txt")
 	if err != nil {
 		panic("Can't find helpfile 'rsc/text/helpfile.txt'.")
 	}
@@ -925,9 +1162,8 @@ func (hub *Hub) createService(name, scriptFilepath string) bool {
 		return false
 	}
 
-	newService := pf.NewService()
-	newService.SetDatabase(hub.Db)
-	newService.SetLocalExternalServices(hub.services)
+	oldService := hub.services[name]
+	newService := hub.settingsFor(name).newService()
 	newService.InitializeFromFilepath(scriptFilepath)
 	hub.services[name] = newService
 	hub.Sources, _ = newService.GetSources()
@@ -941,13 +1177,71 @@ func (hub *Hub) createService(name, scriptFilepath string) bool {
 		}
 		return false
 	}
+	hub.carryOverVariables(name, oldService, newService)
 	return true
 }
 
+// What the hub gives a service of a given name before initializing it. They're copied out of the
+// hub, so that the watcher can make services without touching the hub's own state. (See watch.go.)
+type serviceSettings struct {
+	db       *sql.DB
+	namedDbs map[string]*sql.DB
+	locals   map[string]*pf.Service
+	limits   pf.Limits
+	sessions *pf.SessionOptions
+	stubs    map[string]string
+	images   string
+}
+
+func (hub *Hub) settingsFor(name string) serviceSettings {
+	var stubs map[string]string
+	if name == "#test" {
+		stubs = maps.Clone(hub.testStubs)
+	}
+	return serviceSettings{
+		db:       hub.Db,
+		namedDbs: maps.Clone(hub.namedDbs[name]),
+		locals:   maps.Clone(hub.services),
+		limits:   hub.limits[name],
+		sessions: hub.sessions[name],
+		stubs:    stubs,
+		images:   hub.imageCache,
+	}
+}
+
+// Makes a service with the settings, ready to be initialized.
+func (s serviceSettings) newService() *pf.Service {
+	newService := pf.NewService()
+	newService.SetDatabase(s.db)
+	for dbName, db := range s.namedDbs {
+		newService.SetNamedDatabase(dbName, db)
+	}
+	newService.SetLocalExternalServices(s.locals)
+	newService.SetLimits(s.limits)
+	newService.SetSessions(s.sessions)
+	newService.SetExternalStubs(s.stubs)
+	newService.SetImageCache(s.images)
+	return newService
+}
+
 func StartServiceFromCli() {
 	filename := os.Args[2]
 	newService := pf.NewService()
-	newService.InitializeFromFilepath(filename)
+	if filepath.Ext(filename) == ".pfi" {
+		file, e := os.Open(filename)
+		if e == nil {
+			e = newService.InitializeFromImage(file)
+			file.Close()
+		}
+		if e != nil {
+			fmt.Println("\nUnable to load the image " + Cyan("'"+filename+"'") + ": " + e.Error() + ".")
+			fmt.Print("Closing Pipefish.\n\n")
+			os.Exit(3)
+		}
+	} else {
+		newService.SetImageCache(DefaultImageCache())
+		newService.InitializeFromFilepath(filename)
+	}
 	if newService.IsBroken() {
 		fmt.Println("\nThere were errors running the script " + Cyan("'"+filename+"'") + ".")
 		s, _ := newService.GetErrorReport()
@@ -966,6 +1260,37 @@ func StartServiceFromCli() {
 	os.Exit(0)
 }
 
+func BuildImageFromCli() {
+	filename := os.Args[2]
+	imageFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".pfi"
+	if len(os.Args) > 3 {
+		imageFilename = os.Args[3]
+	}
+	newService := pf.NewService()
+	newService.InitializeFromFilepath(filename)
+	if newService.IsBroken() {
+		fmt.Println("\nThere were errors compiling the script " + Cyan("'"+filename+"'") + ".")
+		s, _ := newService.GetErrorReport()
+		fmt.Println(pf.PrettyString(s, 0, 92))
+		fmt.Print("Closing Pipefish.\n\n")
+		os.Exit(3)
+	}
+	file, e := os.Create(imageFilename)
+	if e == nil {
+		e = newService.WriteImage(file)
+		if closeError := file.Close(); e == nil {
+			e = closeError
+		}
+	}
+	if e != nil {
+		fmt.Println("\nUnable to write the image " + Cyan("'"+imageFilename+"'") + ": " + e.Error() + ".")
+		fmt.Print("Closing Pipefish.\n\n")
+		os.Exit(5)
+	}
+	fmt.Print("\nWrote the image " + Cyan("'"+imageFilename+"'") + ".\n\n")
+	os.Exit(0)
+}
+
 func (hub *Hub) GetAndReportErrors(sv *pf.Service) {
 	hub.ers = sv.GetErrors()
 	r, _ := sv.GetErrorReport()
@@ -982,7 +1307,8 @@ TextDisplayMode = enum LITERAL, STRING
 DatabaseDrivers = enum COCKROACHDB, FIREBIRD_SQL, MARIADB, MICROSOFT_SQL_SERVER, MYSQL, ORACLE, 
                     .. POSTGRESQL, SNOWFLAKE, SQLITE, TIDB
 
-Database = struct(driver DatabaseDrivers, name, host string, port int, username, password string)
+Database = struct(driver DatabaseDrivers, name, host string, port int, username, password string,
+               .. maxOpen, maxIdle, maxLifetime int)
 
 var
 
@@ -1029,29 +1355,44 @@ func (hub *Hub) saveHubFile() string {
 	buf.WriteString(hubService.ToLiteral(hub.getSV("width")))
 	buf.WriteString("\n\n")
 	buf.WriteString("database Database? = ")
-	dbVal := hub.getSV("database")
-	if dbVal.T == pf.NULL {
+	if hub.getSV("database").T == pf.NULL {
+		buf.WriteString("NULL\n")
+	} else {
+		buf.WriteString(hub.getDB().literal("                                 "))
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	buf.WriteString("namedDatabases map? = ")
+	if len(hub.namedDbConfigs) == 0 {
+		buf.WriteString("NULL\n")
+	} else {
+		buf.WriteString(hub.namedDbsLiteral())
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	buf.WriteString("usersFile string? = ")
+	if hub.usersFile == "" {
 		buf.WriteString("NULL\n")
 	} else {
-		args := dbVal.V.([]pf.Value)
-		buf.WriteString("Database with (driver::")
-		buf.WriteString(hubService.ToLiteral(args[0]))
-		buf.WriteString(",\n")
-		buf.WriteString("                                 .. name::")
-		buf.WriteString(hubService.ToLiteral(args[1]))
-		buf.WriteString(",\n")
-		buf.WriteString("                                 .. host::")
-		buf.WriteString(hubService.ToLiteral(args[2]))
-		buf.WriteString(",\n")
-		buf.WriteString("                                 .. port::")
-		buf.WriteString(hubService.ToLiteral(args[3]))
-		buf.WriteString(",\n")
-		buf.WriteString("                                 .. username::")
-		buf.WriteString(hubService.ToLiteral(args[4]))
-		buf.WriteString(",\n")
-		buf.WriteString("                                 .. password::")
-		buf.WriteString(hubService.ToLiteral(args[5]))
-		buf.WriteString(")\n")
+		buf.WriteString(strconv.Quote(hub.usersFile) + "\n")
+	}
+	buf.WriteString("tokenLifetime = ")
+	buf.WriteString(strconv.Itoa(hub.tokenLifetime))
+	buf.WriteString("\n\n")
+	buf.WriteString("snapshotInterval = ")
+	buf.WriteString(strconv.Itoa(hub.snapshotInterval))
+	buf.WriteString("\n")
+	buf.WriteString("snapshotsIn = ")
+	buf.WriteString(strconv.Quote(hub.snapshotsIn))
+	buf.WriteString("\n\n")
+	buf.WriteString("tlsCertFile string? = ")
+	if hub.tlsCertFile == "" {
+		buf.WriteString("NULL\n")
+		buf.WriteString("tlsKeyFile string? = NULL\n")
+	} else {
+		buf.WriteString(strconv.Quote(hub.tlsCertFile) + "\n")
+		buf.WriteString("tlsKeyFile string? = ")
+		buf.WriteString(strconv.Quote(hub.tlsKeyFile) + "\n")
 	}
 
 	fname := hub.MakeFilepath(hub.hubFilepath)
@@ -1066,6 +1407,40 @@ func (hub *Hub) saveHubFile() string {
 
 }
 
+// Writes the named databases of the services for the hub file, as a map from the names of the
+// services to maps from the names of the databases to their configs.
+func (hub *Hub) namedDbsLiteral() string {
+	var buf strings.Builder
+	buf.WriteString("map(")
+	serviceNames := []string{}
+	for serviceName := range hub.namedDbConfigs {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+	for i, serviceName := range serviceNames {
+		if i > 0 {
+			buf.WriteString(",\n                  .. ")
+		}
+		buf.WriteString(strconv.Quote(serviceName) + "::map(")
+		dbNames := []string{}
+		for dbName := range hub.namedDbConfigs[serviceName] {
+			dbNames = append(dbNames, dbName)
+		}
+		sort.Strings(dbNames)
+		for j, dbName := range dbNames {
+			if j > 0 {
+				buf.WriteString(",\n                      .. ")
+			}
+			buf.WriteString(strconv.Quote(dbName) + "::(")
+			buf.WriteString(hub.namedDbConfigs[serviceName][dbName].literal("                           "))
+			buf.WriteString(")")
+		}
+		buf.WriteString(")")
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
+
 func (hub *Hub) OpenHubFile(hubFilepath string) {
 	hub.createService("hub", hubFilepath)
 	hubService := hub.services["hub"]
@@ -1073,18 +1448,22 @@ func (hub *Hub) OpenHubFile(hubFilepath string) {
 	v, _ := hubService.GetVariable("allServices")
 	services := v.V.(pf.Map).AsSlice()
 
-	var driver, name, host, username, password string
-	var port int
-
 	if hub.hasDatabase() {
-		driver, name, host, port, username, password = hub.getDB()
-		hub.Db, _ = database.GetdB(driver, host, name, port, username, password)
+		hub.Db, _ = hub.getDB().open()
 	}
+	hub.openNamedDbs()
+	hub.readAuthConfig()
+	hub.readSnapshotConfig()
+	hub.readTlsConfig()
 
 	for _, pair := range services {
 		serviceName := pair.Key.V.(string)
 		serviceFilepath := pair.Val.V.(string)
-		hub.createService(serviceName, serviceFilepath)
+		if hub.createService(serviceName, serviceFilepath) {
+			if err := hub.restoreSnapshot(serviceName); err != nil {
+				hub.WriteError("couldn't restore the service '" + serviceName + "': " + err.Error() + ".")
+			}
+		}
 	}
 	hub.createService("", "")
 
@@ -1120,11 +1499,13 @@ func (hub *Hub) TestScript(scriptFilepath string, testOutputType TestOutputType)
 	directoryName := dname + "/-tests/" + fname
 
 	hub.oldServiceName = hub.currentServiceName()
+	hub.testStubs = stubsFor(scriptFilepath)
 	files, _ := os.ReadDir(directoryName)
 	for _, testFileInfo := range files {
 		testFilepath := directoryName + "/" + testFileInfo.Name()
 		hub.RunTest(scriptFilepath, testFilepath, testOutputType)
 	}
+	hub.testStubs = nil
 	_, ok := hub.services["#test"]
 	if ok {
 		delete(hub.services, "#test")
@@ -1133,6 +1514,63 @@ func (hub *Hub) TestScript(scriptFilepath string, testOutputType TestOutputType)
 
 }
 
+// Where `hub stub` puts the stubs of the external services of a script, and where `hub test` finds them.
+func stubDirectory(scriptFilepath string) string {
+	fname := filepath.Base(scriptFilepath)
+	fname = fname[:len(fname)-len(filepath.Ext(fname))]
+	return filepath.Dir(scriptFilepath) + "/-stubs/" + fname
+}
+
+// The stubs of the external services of a script, by the names of the services.
+func stubsFor(scriptFilepath string) map[string]string {
+	stubs := map[string]string{}
+	directoryName := stubDirectory(scriptFilepath)
+	files, _ := os.ReadDir(directoryName)
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".pf" {
+			stubs[strings.TrimSuffix(file.Name(), ".pf")] = directoryName + "/" + file.Name()
+		}
+	}
+	return stubs
+}
+
+// Writes a stub of each of the external services of the script, with the API of the service, for
+// `hub test` to use in place of the service. The API is brought up to date, but a stub which already
+// exists is left alone, since its responses may have been scripted.
+func (hub *Hub) writeStubs(scriptFilepath string) {
+	service := hub.settingsFor("").newService()
+	if service.InitializeFromFilepath(scriptFilepath) != nil {
+		hub.GetAndReportErrors(service)
+		return
+	}
+	stubs, e := service.ExternalStubs()
+	if e != nil {
+		hub.WriteError("couldn't make the stubs: " + e.Error() + ".")
+		return
+	}
+	if len(stubs) == 0 {
+		hub.WriteError("the script has no external services to stub.")
+		return
+	}
+	directoryName := stubDirectory(scriptFilepath)
+	if e := os.MkdirAll(directoryName, 0755); e != nil {
+		hub.WriteError("couldn't make the stubs: " + e.Error() + ".")
+		return
+	}
+	for name, stub := range stubs {
+		stubFilepath := directoryName + "/" + name + ".pf"
+		e := os.WriteFile(pf.StubAPIFilepath(stubFilepath), []byte(stub.API), 0644)
+		if _, statErr := os.Stat(stubFilepath); e == nil && os.IsNotExist(statErr) {
+			e = os.WriteFile(stubFilepath, []byte(stub.Source), 0644)
+		}
+		if e != nil {
+			hub.WriteError("couldn't write the stub of " + Cyan("'"+name+"'") + ": " + e.Error() + ".")
+			return
+		}
+	}
+	hub.WriteString(GREEN_OK + "\n")
+}
+
 func (hub *Hub) RunTest(scriptFilepath, testFilepath string, testOutputType TestOutputType) {
 
 	f, err := os.Open(testFilepath)
@@ -1255,48 +1693,33 @@ func valToString(srv *pf.Service, val pf.Value) string {
 	return srv.ToLiteral(val)
 }
 
-func (h *Hub) StartHttp(path, port string) {
-	h.path = path
-	h.port = port
-	h.listeningToHttp = true
-	if h.administered {
-		http.HandleFunc(path, h.handleJsonRequest)
-	} else {
-		http.HandleFunc(path, h.handleSimpleRequest)
-	}
-	err := http.ListenAndServe(":"+port, nil)
-	if errors.Is(err, http.ErrServerClosed) {
-		h.WriteError("server closed.")
-	} else if err != nil {
-		h.WriteError("error starting server: " + err.Error())
-		return
-	}
-}
-
 // This will simply feed text to the REPL of the hub, and will happen if you
 // tell the interpreter to turn into a server but don't ask for administration.
 func (h *Hub) handleSimpleRequest(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		h.WriteError("could not read body: %s\n")
+		http.Error(w, "could not read body: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 	input := string(body[:])
-	h.out = w
-	h.Do(input, "", "", h.currentServiceName())
+	h.mu.Lock()
+	serviceName := h.currentServiceName()
+	h.mu.Unlock()
+	h.doRequest(withSession(r.Context(), r, ""), w, input, auth.Credentials{}, serviceName)
 	io.WriteString(w, "\n")
 }
 
 // By contrast, once the hub is administered it expects an HTTP request to consist of JSON
-// containing the line to be executed and the username and password of the user.
+// containing the line to be executed, with the bearer token the user got by logging in in the
+// header. (See auth.go.)
 type jsonRequest = struct {
-	Body     string
-	Username string
-	Password string
+	Body string
 }
 
 type jsonResponse = struct {
 	Body    string
 	Service string
+	Error   *pf.JsonError `json:",omitempty"` // If the line returned an error value, so that another hub calling this one can tell.
 }
 
 func (h *Hub) handleJsonRequest(w http.ResponseWriter, r *http.Request) {
@@ -1310,25 +1733,114 @@ func (h *Hub) handleJsonRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var serviceName string
+	var creds auth.Credentials
 
 	if h.administered && !((!h.listeningToHttp) && (request.Body == "hub register" || request.Body == "hub log in")) {
-		serviceName, err = database.ValidateUser(h.Db, request.Username, request.Password)
+		creds, _ = credentialsOfRequest(r)
+		if creds.Token == "" {
+			http.Error(w, "a bearer token is required: log in at /login to get one", http.StatusUnauthorized)
+			return
+		}
+		user, err := h.authenticate(creds)
 		if err != nil {
-			h.WriteError("D/ " + err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
+		serviceName = user.Service
+		creds.Username = user.Name
 	}
 
 	var buf bytes.Buffer
-	h.out = &buf
-	serviceName, _ = h.Do(request.Body, request.Username, request.Password, serviceName)
+	var result pf.Value
+	var resultService *pf.Service
+	serviceName, errorValue := h.doRequestWith(withSession(r.Context(), r, creds.Username), &buf, request.Body, creds, serviceName,
+		func(service *pf.Service, ctx context.Context) (pf.Value, error) {
+			val, e := service.DoWithOutput(ctx, request.Body, &buf)
+			if e == nil {
+				result, resultService = val, service
+			}
+			return val, e
+		})
+
+	// A client such as another hub calling one of our services as an external service may ask for
+	// the value itself in the wire format, rather than as Pipefish source.
+	if resultService != nil && result.T != pf.ERROR && strings.Contains(r.Header.Get("Accept"), p2p.VALUE_CONTENT_TYPE) {
+		if data, e := resultService.EncodeValue(result); e == nil {
+			w.Header().Set("Content-Type", p2p.VALUE_CONTENT_TYPE)
+			w.Write(data)
+			return
+		}
+	}
 
-	response := jsonResponse{Body: buf.String(), Service: serviceName}
+	response := jsonResponse{Body: buf.String(), Service: serviceName, Error: errorValue}
 
 	json.NewEncoder(w).Encode(response)
 
 }
 
+// Does a line sent over HTTP, writing the output to the writer supplied, and returns the
+// name of the service the user should talk to next, and the error if the line returned an
+// error value. As the hub may be handling many requests
+// at once, they take turns with the hub's own state, and the services take turns with their
+// vms; but the hub isn't held while a service is running, so requests to different services
+// run concurrently.
+func (h *Hub) doRequest(ctx context.Context, w io.Writer, line string, creds auth.Credentials, serviceName string) (string, *pf.JsonError) {
+	return h.doRequestWith(ctx, w, line, creds, serviceName, func(service *pf.Service, ctx context.Context) (pf.Value, error) {
+		return service.DoWithOutput(ctx, line, w)
+	})
+}
+
+// Does the work of the above, getting the service to do the line with the function supplied, so
+// that where the line's output goes is up to the caller.
+func (h *Hub) doRequestWith(ctx context.Context, w io.Writer, line string, creds auth.Credentials, serviceName string,
+	do func(*pf.Service, context.Context) (pf.Value, error)) (string, *pf.JsonError) {
+	h.mu.Lock()
+	out := h.out
+	h.out = w
+	defer func() {
+		h.out = out
+		h.mu.Unlock()
+	}()
+	hubWords := strings.Fields(line)
+	if len(hubWords) > 0 && (hubWords[0] == "hub" || hubWords[0] == "os") {
+		serviceName, _ = h.Do(line, creds, serviceName)
+		return serviceName, nil
+	}
+	h.installWatchedBuilds()
+	serviceToUse, ok := h.serviceForLine(line, serviceName)
+	if !ok {
+		return serviceName, nil
+	}
+	caller, e := h.callerFor(creds.Username)
+	if e != nil {
+		h.WriteError(e.Error() + ".")
+		return serviceName, nil
+	}
+	h.out = out
+	h.mu.Unlock()
+	start := time.Now()
+	val, e := do(serviceToUse, pf.WithCaller(ctx, caller))
+	h.mu.Lock()
+	h.out = w
+	if lineError, ok := e.(*pf.LineError); ok {
+		h.ers = lineError.Errors
+		h.WritePretty(lineError.Report)
+		return serviceName, nil
+	}
+	if e != nil {
+		h.WriteError(e.Error() + ".")
+		return serviceName, nil
+	}
+	h.observeRequest(serviceName, serviceToUse, "", line, start, val)
+	h.writeValue(serviceToUse, val)
+	if val.T == pf.ERROR {
+		if result, e := serviceToUse.ToJsonResult(val); e == nil {
+			return serviceName, result.Error
+		}
+	}
+	return serviceName, nil
+}
+
 // So, the Form type. Yes, I basically am reinventing the object here because the fields of
 // a struct aren't first-class objects in Go, unlike other superior langages I could name.
 // I can get rid of the whole thing when I do SQL integration and can just make the hub into
@@ -1409,7 +1921,10 @@ func (h *Hub) handleConfigAdminForm(f *Form) {
 
 	// If the hub's already an HTTP server we should restart it to tell it to expect Json.
 	if h.listeningToHttp {
-		h.StartHttp(h.path, h.port)
+		h.stopHttp()
+		if err := h.StartHttp(h.path, h.port); err != nil {
+			h.WriteError("the hub can't listen: " + err.Error() + ".")
+		}
 	}
 }
 
@@ -1421,7 +1936,7 @@ func (h *Hub) getLogin() {
 
 func (h *Hub) handleLoginForm(f *Form) {
 	h.CurrentForm = nil
-	_, err := database.ValidateUser(h.Db, f.Result["Username"], f.Result["*Password"])
+	_, err := h.authenticate(auth.Credentials{Username: f.Result["Username"], Password: f.Result["*Password"]})
 	if err != nil {
 		h.WriteError("I/ " + err.Error())
 		h.WriteString("Please try again.\n\n")
@@ -1432,38 +1947,81 @@ func (h *Hub) handleLoginForm(f *Form) {
 	h.WriteString(GREEN_OK + "\n")
 }
 
-func (h *Hub) configDb() {
-	h.CurrentForm = &Form{Fields: []string{database.GetDriverOptions(), "Host", "Port", "Database name", "Username for database access", "*Password for database access"},
-		Call:   func(f *Form) { h.handleConfigDbForm(f) },
+const (
+	DB_HOST         = "Host (blank for SQLite)"
+	DB_PORT         = "Port (blank for SQLite)"
+	DB_NAME         = "Database name, or the file for SQLite (blank for in-memory)"
+	DB_USERNAME     = "Username for database access"
+	DB_PASSWORD     = "*Password for database access"
+	DB_MAX_OPEN     = "Maximum open connections (blank for no limit)"
+	DB_MAX_IDLE     = "Maximum idle connections (blank for the default)"
+	DB_MAX_LIFETIME = "Maximum lifetime of a connection in seconds (blank for no limit)"
+)
+
+// With no name, this configures the database of the hub, which all the services use; with a
+// name, it configures a database of the current service which SQL snippets can go to by name.
+func (h *Hub) configDb(dbName string) {
+	if dbName != "" && h.currentServiceName() == "" {
+		h.WriteError("there is no current service to give the database to.")
+		return
+	}
+	h.CurrentForm = &Form{Fields: []string{database.GetDriverOptions(), DB_HOST, DB_PORT, DB_NAME, DB_USERNAME, DB_PASSWORD,
+		DB_MAX_OPEN, DB_MAX_IDLE, DB_MAX_LIFETIME},
+		Call:   func(f *Form) { h.handleConfigDbForm(f, dbName) },
 		Result: make(map[string]string)}
 }
 
-func (h *Hub) handleConfigDbForm(f *Form) {
+func (h *Hub) handleConfigDbForm(f *Form, dbName string) {
 	h.CurrentForm = nil
 	number, err := strconv.Atoi(f.Result[database.GetDriverOptions()])
-	if err != nil {
-		h.WriteError("hub/db/config/a: " + err.Error())
+	if err != nil || number < 0 || number >= len(database.GetSortedDrivers()) {
+		h.WriteError("hub/db/config/a: there is no driver numbered '" + f.Result[database.GetDriverOptions()] + "'.")
 		return
 	}
-	port, err := strconv.Atoi(f.Result["Port"])
-	if err != nil {
-		h.WriteError("hub/db/config/b: " + err.Error())
-		return
+	numbers := map[string]int{}
+	for _, field := range []string{DB_PORT, DB_MAX_OPEN, DB_MAX_IDLE, DB_MAX_LIFETIME} {
+		if strings.TrimSpace(f.Result[field]) == "" {
+			continue
+		}
+		numbers[field], err = strconv.Atoi(strings.TrimSpace(f.Result[field]))
+		if err != nil {
+			h.WriteError("hub/db/config/b: " + err.Error())
+			return
+		}
 	}
-	DbDriverAsPfEnum := database.GetSortedDrivers()[number]
-	h.Db, err = database.GetdB(DbDriverAsPfEnum, f.Result["Host"], f.Result["Database name"], port,
-		f.Result["Username for database access"], f.Result["*Password for database access"])
-	h.setDB(DbDriverAsPfEnum, f.Result["Host"], f.Result["Database name"], port,
-		f.Result["Username for database access"], f.Result["*Password for database access"])
+	c := dbConfig{driver: database.GetDriverEnum(number), name: f.Result[DB_NAME], host: f.Result[DB_HOST],
+		port: numbers[DB_PORT], username: f.Result[DB_USERNAME], password: f.Result[DB_PASSWORD],
+		pool: database.PoolSettings{MaxOpen: numbers[DB_MAX_OPEN], MaxIdle: numbers[DB_MAX_IDLE],
+			MaxLifetime: time.Duration(numbers[DB_MAX_LIFETIME]) * time.Second}}
+	db, err := c.open()
 	if err != nil {
 		h.WriteError("hub/db/config/c: " + err.Error())
 		return
 	}
+	if dbName != "" {
+		h.addNamedDb(h.currentServiceName(), dbName, c, db)
+		h.WriteString(GREEN_OK + "\n")
+		return
+	}
+	h.Db = db
+	h.setDB(c)
+	for _, service := range h.services {
+		service.SetDatabase(db)
+	}
 	h.WriteString(GREEN_OK + "\n")
 }
 
+// Ctrl-C stops the line being run, rather than the hub.
 func ServiceDo(serviceToUse *pf.Service, line string) pf.Value {
-	v, _ := serviceToUse.Do(line)
+	return serviceDoAs(serviceToUse, line, nil, "")
+}
+
+// As above, but checking the line against the permissions of the service for the caller, and
+// doing it in the user's session if the service is in session mode.
+func serviceDoAs(serviceToUse *pf.Service, line string, caller *pf.Caller, username string) pf.Value {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	v, _ := serviceToUse.DoContext(withSession(pf.WithCaller(ctx, caller), nil, username), line)
 	return v
 }
 
@@ -1488,7 +2046,12 @@ const HELP = "\nUsage: pipefish [-v | --version] [-h | --help]\n" +
 	"                <command> [args]\n\n" +
 	"Commands are:\n\n" +
 	"  tui           Starts the Pipfish TUI (text user interface).\n" +
-	"  run <file>    Runs a Pipefish script if it has a 'main' command.\n\n"
+	"  run <file>    Runs a Pipefish script, or an image made with 'build', if it\n" +
+	"                has a 'main' command.\n" +
+	"  build <file> [<image>]\n" +
+	"                Compiles a Pipefish script to an image which starts without\n" +
+	"                recompiling.\n" +
+	"  lsp           Starts a Language Server Protocol server on stdin/stdout.\n\n"
 
 func Red(s string) string {
 	return "\033[31m" + s + "\033[0m"
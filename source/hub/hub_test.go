@@ -0,0 +1,117 @@
+package hub
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tim-hardcastle/Pipefish/source/database"
+	"github.com/tim-hardcastle/Pipefish/source/settings"
+)
+
+// A writer which the hub and the test can use at once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Makes a hub which runs the hub service from a copy of the hub file, so that the test can't
+// change the real one, and the empty service, as OpenHubFile does, and which writes to the
+// buffer returned.
+func newTestHub(t *testing.T) (*Hub, *syncBuffer) {
+	code, e := os.ReadFile(filepath.Join(settings.PipefishHomeDirectory, "hub", "hub.hub"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	out := &syncBuffer{}
+	h := New(strings.NewReader(""), out)
+	h.pipefishHomeDirectory = settings.PipefishHomeDirectory
+	h.createService("hub", writeFile(t, t.TempDir(), "test.hub", string(code)))
+	h.createService("", "")
+	return h, out
+}
+
+// The text the hub wrote, without the escape codes which color it.
+func plain(s string) string {
+	return regexp.MustCompile("\x1b\\[[0-9;]*m").ReplaceAllString(s, "")
+}
+
+func writeFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if e := os.WriteFile(path, []byte(contents), 0644); e != nil {
+		t.Fatal(e)
+	}
+	return path
+}
+
+// Makes the hub administered, with a database in its own home directory, an admin called "admin",
+// and a user called "user" who is just in the Users group, both of whom talk to the service named.
+func administer(t *testing.T, h *Hub, service string) {
+	h.pipefishHomeDirectory = t.TempDir() + "/"
+	if e := os.Mkdir(h.pipefishHomeDirectory+"user", 0755); e != nil {
+		t.Fatal(e)
+	}
+	db, e := sql.Open("sqlite", h.pipefishHomeDirectory+"users.db")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { db.Close() })
+	h.Db = db
+	if e := database.AddAdmin(db, "admin", "Ada", "Min", "admin@example.com", "secret", service, h.pipefishHomeDirectory); e != nil {
+		t.Fatal(e)
+	}
+	if e := database.AddUser(db, "user", "Ursula", "Ser", "user@example.com", "secret", service); e != nil {
+		t.Fatal(e)
+	}
+	if e := database.AddUserToGroup(db, "user", "Users", false); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// Checks that the verbs which only admins may use are refused to other users.
+func TestAdminOnlyVerbs(t *testing.T) {
+	h, out := newTestHub(t)
+	administer(t, h, "limited")
+	if !h.StartAndMakeCurrent("admin", "limited", writeFile(t, t.TempDir(), "limited.pf", "def\n\nsquare(n int) : n * n\n")) {
+		t.Fatal("couldn't start the service")
+	}
+	tests := []struct {
+		verb string
+		args []string
+	}{
+		{"limit", []string{"time", "1000"}},
+		{"limit-off", []string{}},
+		{"openapi", []string{filepath.Join(t.TempDir(), "openapi.json")}},
+		{"sessions", []string{}},
+		{"migrate-plan", []string{}},
+	}
+	for _, test := range tests {
+		before := len(out.String())
+		h.DoHubCommand("user", "secret", test.verb, test.args)
+		if got := plain(out.String()[before:]); !strings.Contains(got, "you don't have the admin status") {
+			t.Errorf("%s: wanted a non-admin to be refused | got %q", test.verb, got)
+		}
+		before = len(out.String())
+		h.DoHubCommand("admin", "secret", test.verb, test.args)
+		if got := plain(out.String()[before:]); strings.Contains(got, "admin status") {
+			t.Errorf("%s: wanted an admin to be let do it | got %q", test.verb, got)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// The hub's side of the limits on what a call to a service may do. They're kept by the name of
+// the service as well as being set on the service, so that they survive recompilation. On an
+// administered hub, only admins may set them, since they protect the hub.
+
+func (hub *Hub) doLimitCommand(verb string, args []string) {
+	name := hub.currentServiceName()
+	service, ok := hub.services[name]
+	if !ok || name == "" {
+		hub.WriteError("there is no current service to limit.")
+		return
+	}
+	limits := hub.limits[name]
+	switch verb {
+	case "limit":
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			hub.WriteError("a limit should be a whole number, not '" + args[1] + "'.")
+			return
+		}
+		if n < 0 {
+			hub.WriteError("a limit can't be negative. To remove it, set it to 0.")
+			return
+		}
+		switch args[0] {
+		case "depth":
+			limits.RecursionDepth = n
+		case "instructions":
+			limits.Instructions = n
+		case "memory":
+			limits.Memory = n
+		case "time":
+			limits.Time = time.Duration(n) * time.Millisecond
+		}
+	case "limit-off":
+		limits = pf.Limits{}
+	case "limits":
+		hub.WriteString("\nThe limits on the service " + Cyan("'"+name+"'") + " are:\n\n")
+		hub.WriteString(BULLET + "instructions: " + describeLimit(limits.Instructions, "") + "\n")
+		hub.WriteString(BULLET + "time: " + describeLimit(int(limits.Time/time.Millisecond), " ms") + "\n")
+		hub.WriteString(BULLET + "recursion depth: " + describeLimit(limits.RecursionDepth, "") + "\n")
+		hub.WriteString(BULLET + "memory: " + describeLimit(limits.Memory, " values") + "\n\n")
+		return
+	}
+	hub.limits[name] = limits
+	service.SetLimits(limits)
+	hub.WriteString(GREEN_OK + "\n")
+}
+
+func describeLimit(n int, units string) string {
+	if n == 0 {
+		return "none"
+	}
+	return strconv.Itoa(n) + units
+}
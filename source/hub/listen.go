@@ -0,0 +1,249 @@
+package hub
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// The hub's HTTP server. 'hub listen' starts it in the background, so that the REPL can go on being
+// used, and 'hub listen off' stops it, letting the requests it's already handling finish first. If
+// 'hub config tls' has given the hub a certificate and key, it serves HTTPS.
+//
+// As well as the endpoints for doing lines and calling functions, the server has
+//
+//	GET /healthz
+//	GET /readyz
+//
+// which both report which services are broken. The first is OK for as long as the hub is serving;
+// the second only if no service is broken, so that a load balancer can hold off sending requests
+// to a hub whose services won't compile.
+
+const (
+	HEALTH_PATH = "GET /healthz"
+	READY_PATH  = "GET /readyz"
+
+	SHUTDOWN_TIMEOUT = 30 * time.Second // How long 'hub listen off' waits for requests to finish.
+)
+
+// Starts the server in the background, having first waited for the last one, if any, to drain.
+// If the port is "0", the server listens on any free port, which it then keeps in `h.port`.
+func (h *Hub) StartHttp(path, port string) error {
+	if h.drained != nil {
+		<-h.drained
+		h.drained = nil
+	}
+	mux := http.NewServeMux()
+	if h.administered {
+		mux.HandleFunc(path, h.handleJsonRequest)
+		mux.HandleFunc(LOGIN_PATH, h.handleLoginRequest)
+		mux.HandleFunc(LOGOUT_PATH, h.handleLogoutRequest)
+	} else {
+		mux.HandleFunc(path, h.handleSimpleRequest)
+	}
+	mux.HandleFunc(CALL_PATH, h.handleCallRequest)
+	mux.HandleFunc(OPENAPI_PATH, h.handleOpenApiRequest)
+	mux.HandleFunc(HEALTH_PATH, h.handleHealthRequest)
+	mux.HandleFunc(READY_PATH, h.handleReadyRequest)
+	mux.HandleFunc(STREAM_PATH, h.handleStreamRequest)
+	mux.HandleFunc(STREAM_INPUT_PATH, h.handleStreamInputRequest)
+	mux.HandleFunc(METRICS_PATH, h.handleMetricsRequest)
+	server := &http.Server{Addr: ":" + port, Handler: mux}
+	if h.tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(h.tlsCertFile, h.tlsKeyFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	if server.TLSConfig != nil {
+		listener = tls.NewListener(listener, server.TLSConfig)
+	}
+	h.path, h.port = path, strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	h.server = server
+	h.listeningToHttp = true
+	go server.Serve(listener)
+	return nil
+}
+
+// Stops the server from taking new requests, and lets the ones it has finish in the background,
+// for up to SHUTDOWN_TIMEOUT, since they may be waiting for the hub.
+func (h *Hub) stopHttp() {
+	server := h.server
+	drained := make(chan struct{})
+	h.server, h.drained = nil, drained
+	h.listeningToHttp = false
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if server.Shutdown(ctx) != nil {
+			server.Close()
+		}
+		close(drained)
+	}()
+}
+
+func (h *Hub) scheme() string {
+	if h.tlsCertFile != "" {
+		return "https"
+	}
+	return "http"
+}
+
+type healthResponse = struct {
+	Ready    bool
+	Services map[string]string // "ok" or "broken", by the names of the services.
+}
+
+// Reports on the services the hub is running. This only reads the hub's state, so a build the
+// watcher has made is reported on once the hub has put it in place. (See watch.go.)
+func (h *Hub) health() healthResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := healthResponse{Ready: h.server != nil, Services: map[string]string{}}
+	for name, service := range h.services {
+		if !isUserService(name) {
+			continue
+		}
+		if service.IsBroken() {
+			result.Services[name] = "broken"
+			result.Ready = false
+		} else {
+			result.Services[name] = "ok"
+		}
+	}
+	return result
+}
+
+func (h *Hub) handleHealthRequest(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, http.StatusOK, h.health())
+}
+
+func (h *Hub) handleReadyRequest(w http.ResponseWriter, r *http.Request) {
+	health := h.health()
+	status := http.StatusOK
+	if !health.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealthResponse(w, status, health)
+}
+
+func writeHealthResponse(w http.ResponseWriter, status int, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Reads the certificate and key from the hub file. Hub files from before there was TLS don't have
+// the variables.
+func (h *Hub) readTlsConfig() {
+	h.tlsCertFile, h.tlsKeyFile = "", ""
+	cert, e := h.services["hub"].GetVariable("tlsCertFile")
+	if e != nil || cert.T != pf.STRING {
+		return
+	}
+	key, e := h.services["hub"].GetVariable("tlsKeyFile")
+	if e != nil || key.T != pf.STRING {
+		return
+	}
+	h.tlsCertFile, h.tlsKeyFile = cert.V.(string), key.V.(string)
+}
+
+const (
+	TLS_CERT_FILE = "Certificate file (blank for no TLS)"
+	TLS_KEY_FILE  = "Key file"
+)
+
+func (h *Hub) configTls() {
+	h.CurrentForm = &Form{Fields: []string{TLS_CERT_FILE, TLS_KEY_FILE},
+		Call:   func(f *Form) { h.handleConfigTlsForm(f) },
+		Result: make(map[string]string)}
+}
+
+// If neither file exists, the hub makes a self-signed certificate for 'localhost' and its key, which
+// clients will only accept if told to trust it, but which is good enough for testing.
+func (h *Hub) handleConfigTlsForm(f *Form) {
+	h.CurrentForm = nil
+	certFile := strings.TrimSpace(f.Result[TLS_CERT_FILE])
+	keyFile := strings.TrimSpace(f.Result[TLS_KEY_FILE])
+	if certFile == "" {
+		h.tlsCertFile, h.tlsKeyFile = "", ""
+		h.WriteString(GREEN_OK + "\n")
+		return
+	}
+	if keyFile == "" {
+		h.WriteError("hub/tls/config/a: a certificate needs a key.")
+		return
+	}
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		if err := makeSelfSignedCertificate(certFile, keyFile); err != nil {
+			h.WriteError("hub/tls/config/b: " + err.Error())
+			return
+		}
+		h.WritePretty("The hub has made a self-signed certificate for 'localhost' in '" + certFile + "', and its key in '" + keyFile + "'.\n")
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		h.WriteError("hub/tls/config/c: " + err.Error())
+		return
+	}
+	h.tlsCertFile, h.tlsKeyFile = certFile, keyFile
+	h.WriteString(GREEN_OK + "\n")
+	if h.listeningToHttp {
+		h.WritePretty("The hub will use the certificate the next time it starts to listen.\n")
+	}
+}
+
+func makeSelfSignedCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Pipefish"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
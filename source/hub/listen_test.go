@@ -0,0 +1,114 @@
+package hub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tim-hardcastle/Pipefish/source/auth"
+)
+
+const listenTestCode = `def
+
+double(n int) : n + n
+`
+
+// Serves HTTPS with a self-signed certificate, checking that the health checks report on the
+// services, and that 'hub listen off' lets a request which is already in flight finish.
+func TestListen(t *testing.T) {
+	h, _ := newTestHub(t)
+	dir := t.TempDir()
+	if !h.StartAndMakeCurrent("", "good", writeFile(t, dir, "good.pf", listenTestCode)) {
+		t.Fatal("couldn't start the service")
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if e := makeSelfSignedCertificate(certFile, keyFile); e != nil {
+		t.Fatal(e)
+	}
+	h.tlsCertFile, h.tlsKeyFile = certFile, keyFile
+	if e := h.StartHttp("/do", "0"); e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		if h.server != nil {
+			h.server.Close()
+		}
+	}()
+	cert, _ := os.ReadFile(certFile)
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(cert) {
+		t.Fatal("couldn't read the certificate")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	url := "https://localhost:" + h.port
+	get := func(path string) (int, healthResponse) {
+		resp, e := client.Get(url + path)
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer resp.Body.Close()
+		var health healthResponse
+		if e := json.NewDecoder(resp.Body).Decode(&health); e != nil {
+			t.Fatalf("%s: %v", path, e)
+		}
+		return resp.StatusCode, health
+	}
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if status, health := get(path); status != http.StatusOK || !health.Ready || health.Services["good"] != "ok" {
+			t.Errorf("%s: wanted 200 and good ok | got %d, %v", path, status, health)
+		}
+	}
+
+	h.mu.Lock()
+	h.createService("bad", writeFile(t, dir, "bad.pf", "def\n\nbroken(n int) : zort n\n"))
+	h.mu.Unlock()
+	if status, _ := get("/healthz"); status != http.StatusOK {
+		t.Errorf("/healthz: wanted 200 while the hub is serving | got %d", status)
+	}
+	if status, health := get("/readyz"); status != http.StatusServiceUnavailable || health.Ready || health.Services["bad"] != "broken" {
+		t.Errorf("/readyz: wanted 503 and bad broken | got %d, %v", status, health)
+	}
+
+	// The request waits for the hub, which the test holds until it's turned the server off once
+	// the server has read the request. It has its own connection, since the server closes idle
+	// ones when it stops.
+	h.mu.Lock()
+	active := make(chan struct{}, 1)
+	h.server.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateActive {
+			select {
+			case active <- struct{}{}:
+			default:
+			}
+		}
+	}
+	result := make(chan string)
+	go func() {
+		inFlight := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, DisableKeepAlives: true}}
+		resp, e := inFlight.Post(url+"/do", "text/plain", strings.NewReader("double 21"))
+		if e != nil {
+			result <- e.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		result <- strings.TrimSpace(string(body))
+	}()
+	<-active
+	h.Do("hub listen off", auth.Credentials{}, "good")
+	h.mu.Unlock()
+	if got := <-result; got != "42" {
+		t.Errorf("wanted the request in flight to finish with 42 | got %q", got)
+	}
+	<-h.drained
+	if _, e := client.Get(url + "/healthz"); e == nil {
+		t.Errorf("wanted the server to have stopped")
+	}
+}
@@ -0,0 +1,140 @@
+package hub
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/metrics"
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// The hub's metrics, which it serves at
+//
+//	GET /metrics
+//
+// in the text format which Prometheus scrapes, whenever it's listening. The hub counts the HTTP
+// requests to each service and how long they took, both by the function or command called,
+// and the errors they returned, by their error ids. The services count what their vms do,
+// which the hub reads when it's asked for the metrics. All of this is always on, since it costs
+// little.
+
+const METRICS_PATH = "GET /metrics"
+
+// The label of the requests which do a line that doesn't start with the name of a function or
+// command, e.g. an expression.
+const LINE_LABEL = "(line)"
+
+type hubMetrics struct {
+	registry  *metrics.Registry
+	requests  *metrics.Counter
+	durations *metrics.Histogram
+	errors    *metrics.Counter
+}
+
+func (h *Hub) newMetrics() *hubMetrics {
+	r := metrics.NewRegistry()
+	m := &hubMetrics{registry: r,
+		requests: r.Counter("pipefish_requests_total",
+			"HTTP requests to the services of the hub, by service and the function or command called.",
+			"service", "function"),
+		durations: r.Histogram("pipefish_request_duration_seconds",
+			"How long HTTP requests to the services of the hub took, by service and the function or command called.",
+			metrics.DEFAULT_BUCKETS, "service", "function"),
+		errors: r.Counter("pipefish_errors_total",
+			"Error values returned by HTTP requests to the services of the hub, by service and error id.",
+			"service", "error_id"),
+	}
+	r.HistogramFunc("pipefish_external_call_duration_seconds",
+		"How long calls from the services of the hub to external services took, by service and external service.",
+		metrics.DEFAULT_BUCKETS, []string{"service", "external"}, h.externalCallSamples)
+	r.CounterFunc("pipefish_vm_instructions_total",
+		"Instructions of bytecode executed by the vm of each service since it was built.",
+		[]string{"service"}, h.vmSamples(func(m pf.Metrics) float64 { return float64(m.Instructions) }))
+	r.GaugeFunc("pipefish_vm_memory_values",
+		"Values in the memory of the vm of each service at the end of its last run.",
+		[]string{"service"}, h.vmSamples(func(m pf.Metrics) float64 { return float64(m.MemSize) }))
+	r.GaugeFunc("pipefish_service_broken",
+		"Whether each service of the hub is broken, i.e. failed to compile.",
+		[]string{"service"}, h.brokenSamples)
+	return m
+}
+
+// Records a request to the service which called the function, or did the line if the function
+// is "", and returned the value.
+func (h *Hub) observeRequest(name string, service *pf.Service, function, line string, start time.Time, val pf.Value) {
+	if function == "" {
+		function = functionOfLine(service, line)
+	}
+	h.metrics.requests.Inc(name, function)
+	h.metrics.durations.Observe(time.Since(start).Seconds(), name, function)
+	if val.T == pf.ERROR {
+		if e, ok := val.V.(*pf.Error); ok {
+			h.metrics.errors.Inc(name, e.ErrorId)
+		}
+	}
+}
+
+var headword = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Only the names of the service's own functions and commands are used as labels, so that
+// there's a fixed number of them.
+func functionOfLine(service *pf.Service, line string) string {
+	match := headword.FindStringSubmatch(line)
+	if match == nil || !service.HasFunction(match[1]) {
+		return LINE_LABEL
+	}
+	return match[1]
+}
+
+// The user services the hub is running, by name. Like the health checks, this only reads the
+// hub's state.
+func (h *Hub) userServices() map[string]*pf.Service {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := map[string]*pf.Service{}
+	for name, service := range h.services {
+		if isUserService(name) {
+			result[name] = service
+		}
+	}
+	return result
+}
+
+func (h *Hub) vmSamples(value func(pf.Metrics) float64) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		result := []metrics.Sample{}
+		for name, service := range h.userServices() {
+			result = append(result, metrics.Sample{Labels: []string{name}, Value: value(service.GetMetrics())})
+		}
+		return result
+	}
+}
+
+func (h *Hub) externalCallSamples() []metrics.HistogramSample {
+	result := []metrics.HistogramSample{}
+	for name, service := range h.userServices() {
+		for _, sample := range service.GetMetrics().ExternalCalls {
+			sample.Labels = append([]string{name}, sample.Labels...)
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+func (h *Hub) brokenSamples() []metrics.Sample {
+	result := []metrics.Sample{}
+	for name, service := range h.userServices() {
+		broken := 0.0
+		if service.IsBroken() {
+			broken = 1
+		}
+		result = append(result, metrics.Sample{Labels: []string{name}, Value: broken})
+	}
+	return result
+}
+
+func (h *Hub) handleMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.CONTENT_TYPE)
+	h.metrics.registry.WriteText(w)
+}
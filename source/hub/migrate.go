@@ -0,0 +1,253 @@
+package hub
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tim-hardcastle/Pipefish/source/database"
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// The hub's side of migrating the tables of a service to fit its struct types. The migrations are
+// written as numbered scripts in the directory 'migrations/<name of script>' next to the service's
+// script, so that they can be kept with the code and applied to other copies of the database; and
+// the versions applied to the service's database are recorded in it.
+
+// 'hub migrate' first applies any scripts in the directory which haven't been applied yet, and then
+// if the tables still don't fit their types, asks the user to confirm any renaming of columns, and
+// writes and applies a new script. 'hub migrate plan' says what it would do without doing it.
+
+type migrator struct {
+	hub     *Hub
+	service *pf.Service
+	db      *sql.DB // The database of the service, which the plan is made from and the scripts applied to.
+	source  string  // The name of the service's script, which the migrations are recorded under.
+	dir     string
+	applied map[int]bool
+	scripts map[int]string // The filenames of the scripts in the directory by version.
+}
+
+var migrationFilenameRegex = regexp.MustCompile(`^(\d+)_.*\.sql$`)
+
+func (hub *Hub) doMigrateCommand(verb string) {
+	name := hub.currentServiceName()
+	service, ok := hub.services[name]
+	if !ok || name == "" {
+		hub.WriteError("there is no current service to migrate.")
+		return
+	}
+	db := service.GetDatabase()
+	if db == nil {
+		hub.WriteError("database has not been configured: do 'hub config db' first.")
+		return
+	}
+	scriptFilepath, _ := service.GetFilepath()
+	if scriptFilepath == "" {
+		hub.WriteError("the service has no script to keep the migrations with.")
+		return
+	}
+	source := strings.TrimSuffix(filepath.Base(scriptFilepath), filepath.Ext(scriptFilepath))
+	m := &migrator{hub: hub, service: service, db: db, source: source,
+		dir: filepath.Join(filepath.Dir(scriptFilepath), "migrations", source)}
+	if e := m.readVersions(); e != nil {
+		hub.WriteError("couldn't read the migrations: " + e.Error() + ".")
+		return
+	}
+	pending := m.pending()
+	if verb == "migrate-plan" {
+		m.describe(pending)
+		return
+	}
+	for _, version := range pending {
+		if !m.applyScript(version) {
+			return
+		}
+	}
+	plan, e := service.PlanMigration()
+	if e != nil {
+		hub.WriteError("couldn't compare the tables with the types: " + e.Error() + ".")
+		return
+	}
+	if len(plan.Tables) == 0 {
+		hub.WriteString(GREEN_OK + "\n")
+		return
+	}
+	questions := []string{}
+	for _, tm := range plan.Tables {
+		for _, rename := range tm.Renames {
+			questions = append(questions, "Has column '"+rename.From+"' of table '"+tm.Table+"' been renamed to '"+rename.To+"'? (y/n)")
+		}
+	}
+	if len(questions) == 0 {
+		m.writeAndApply(plan)
+		return
+	}
+	hub.CurrentForm = &Form{Fields: questions,
+		Call: func(f *Form) {
+			hub.CurrentForm = nil
+			i := 0
+			for _, tm := range plan.Tables {
+				for j := range tm.Renames {
+					answer := strings.ToLower(strings.TrimSpace(f.Result[questions[i]]))
+					tm.Renames[j].Confirmed = answer == "y" || answer == "yes"
+					i++
+				}
+			}
+			m.writeAndApply(plan)
+		},
+		Result: make(map[string]string)}
+}
+
+// Finds which versions have been applied, and which are in the directory.
+func (m *migrator) readVersions() error {
+	var e error
+	m.applied, e = database.GetAppliedMigrations(m.db, m.source)
+	if e != nil {
+		return e
+	}
+	m.scripts = map[int]string{}
+	entries, e := os.ReadDir(m.dir)
+	if os.IsNotExist(e) {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	for _, entry := range entries {
+		if match := migrationFilenameRegex.FindStringSubmatch(entry.Name()); match != nil && !entry.IsDir() {
+			version, _ := strconv.Atoi(match[1])
+			m.scripts[version] = entry.Name()
+		}
+	}
+	return nil
+}
+
+// The versions of the scripts in the directory which haven't been applied, in order.
+func (m *migrator) pending() []int {
+	result := []int{}
+	for version := range m.scripts {
+		if !m.applied[version] {
+			result = append(result, version)
+		}
+	}
+	sort.Ints(result)
+	return result
+}
+
+func (m *migrator) nextVersion() int {
+	result := 1
+	for version := range m.applied {
+		result = max(result, version+1)
+	}
+	for version := range m.scripts {
+		result = max(result, version+1)
+	}
+	return result
+}
+
+func (m *migrator) describe(pending []int) {
+	hub := m.hub
+	if len(pending) > 0 {
+		hub.WriteString("\nThese scripts in " + Cyan("'"+m.dir+"'") + " haven't been applied yet:\n\n")
+		for _, version := range pending {
+			hub.WriteString(BULLET + m.scripts[version] + "\n")
+		}
+		hub.WritePretty("\nOnce they have, the tables will be compared with the struct types of the service again.\n\n")
+		return
+	}
+	plan, e := m.service.PlanMigration()
+	if e != nil {
+		hub.WriteError("couldn't compare the tables with the types: " + e.Error() + ".")
+		return
+	}
+	if len(plan.Tables) == 0 {
+		hub.WriteString("\nThe tables of the service fit its struct types.\n\n")
+		return
+	}
+	hub.WriteString("\nThe tables of the service have drifted from its struct types:\n\n")
+	for _, tm := range plan.Tables {
+		hub.WritePretty(BULLET + tm.String() + "\n")
+		for _, rename := range tm.Renames {
+			hub.WritePretty("  (column '" + rename.From + "' may have been renamed to '" + rename.To + "')\n")
+		}
+	}
+	hub.WriteString("\n")
+}
+
+func (m *migrator) writeAndApply(plan *pf.MigrationPlan) {
+	version := m.nextVersion()
+	tables, descriptions, statements := []string{}, []string{}, []string{}
+	for _, tm := range plan.Tables {
+		tables = append(tables, tm.Table)
+		descriptions = append(descriptions, "-- "+tm.String()+"\n")
+		statements = append(statements, tm.Statements()...)
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "-- Migration %d of the tables of '%s', written by 'hub migrate'.\n", version, m.source)
+	for _, description := range descriptions {
+		buf.WriteString(description)
+	}
+	buf.WriteString("\n")
+	for _, statement := range statements {
+		buf.WriteString(statement + ";\n")
+	}
+	filename := fmt.Sprintf("%04d_%s.sql", version, strings.Join(tables, "_"))
+	if e := os.MkdirAll(m.dir, 0755); e != nil {
+		m.hub.WriteError("couldn't write the migration: " + e.Error() + ".")
+		return
+	}
+	if e := os.WriteFile(filepath.Join(m.dir, filename), []byte(buf.String()), 0644); e != nil {
+		m.hub.WriteError("couldn't write the migration: " + e.Error() + ".")
+		return
+	}
+	m.scripts[version] = filename
+	m.hub.WriteString("Wrote " + Cyan("'"+filepath.Join(m.dir, filename)+"'") + ".\n")
+	if m.applyScript(version) {
+		m.hub.WriteString(GREEN_OK + "\n")
+	}
+}
+
+func (m *migrator) applyScript(version int) bool {
+	filename := m.scripts[version]
+	contents, e := os.ReadFile(filepath.Join(m.dir, filename))
+	if e == nil {
+		e = database.ApplyMigration(m.db, m.source, version, filename, splitSqlScript(string(contents)))
+	}
+	if e != nil {
+		m.hub.WriteError("couldn't apply the migration " + Cyan("'"+filename+"'") + ": " + e.Error() + ".")
+		return false
+	}
+	m.applied[version] = true
+	m.hub.WriteString("Applied " + Cyan("'"+filename+"'") + ".\n")
+	return true
+}
+
+// Splits a script into statements. Since we only split at the ends of lines, a statement may contain
+// a semicolon so long as it isn't at the end of one.
+func splitSqlScript(script string) []string {
+	result := []string{}
+	statement := []string{}
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		if strings.HasSuffix(trimmed, ";") {
+			statement = append(statement, strings.TrimSuffix(trimmed, ";"))
+			result = append(result, strings.Join(statement, "\n"))
+			statement = []string{}
+			continue
+		}
+		statement = append(statement, trimmed)
+	}
+	if len(statement) > 0 {
+		result = append(result, strings.Join(statement, "\n"))
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/tim-hardcastle/Pipefish/source/database"
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// The hub's side of the permissions which services declare on their functions and commands. (See
+// permissions.go in the compiler.) The hub says who is calling by putting a `pf.Caller` in the
+// context of the line or call, and the service checks it against the groups its functions and commands
+// are declared for.
+
+// Returns the caller to tell a service about. This is nil, meaning that they can call anything,
+// if the hub isn't administered or the user is an admin.
+func (hub *Hub) callerFor(username string) (*pf.Caller, error) {
+	if !hub.administered || hub.Db == nil {
+		return nil, nil
+	}
+	isAdmin, err := database.IsUserAdmin(hub.Db, username)
+	if err != nil {
+		return nil, err
+	}
+	if isAdmin {
+		return nil, nil
+	}
+	groups, err := database.GetGroupNamesOfUser(hub.Db, username)
+	if err != nil {
+		return nil, err
+	}
+	return &pf.Caller{Name: username, Groups: groups}, nil
+}
+
+// Reports which groups, and in an administered hub which users, can call the restricted functions
+// and commands of the current service.
+func (hub *Hub) showPermissions() {
+	name := hub.currentServiceName()
+	service, ok := hub.services[name]
+	if !ok || name == "" {
+		hub.WriteError("there is no current service to show the permissions of.")
+		return
+	}
+	permissions, err := service.GetPermissions()
+	if err != nil {
+		hub.WriteError(err.Error() + ".")
+		return
+	}
+	if len(permissions) == 0 {
+		hub.WriteString("\nThe service " + Cyan("'"+name+"'") + " doesn't restrict who can call its functions and commands.\n\n")
+		return
+	}
+	fnNames := []string{}
+	for fnName := range permissions {
+		fnNames = append(fnNames, fnName)
+	}
+	sort.Strings(fnNames)
+	hub.WriteString("\nThe functions and commands of the service " + Cyan("'"+name+"'") + " which can only be called by some groups are:\n\n")
+	for _, fnName := range fnNames {
+		groups := []string{}
+		for _, group := range permissions[fnName] {
+			groups = append(groups, hub.describeGroup(group))
+		}
+		if len(groups) == 0 {
+			groups = []string{"no-one"}
+		}
+		hub.WriteString(BULLET + fnName + " : " + strings.Join(groups, ", ") + "\n")
+	}
+	hub.WriteString("\n")
+	hub.WritePretty("Admins can call everything, and anyone who can use the service can call its other public functions and commands.")
+	hub.WriteString("\n\n")
+}
+
+// Describes a group with its users, if the hub knows who they are.
+func (hub *Hub) describeGroup(group string) string {
+	if !hub.administered || hub.Db == nil {
+		return group
+	}
+	users, err := database.GetUserNamesOfGroup(hub.Db, group)
+	if err != nil || len(users) == 0 {
+		return group + " (no users)"
+	}
+	return group + " (" + strings.Join(users, ", ") + ")"
+}
@@ -5,6 +5,8 @@ import (
 	"strings"
 
 	"github.com/lmorg/readline"
+
+	"github.com/tim-hardcastle/Pipefish/source/auth"
 )
 
 func StartHub(hub *Hub, in io.Reader, out io.Writer) {
@@ -50,8 +52,12 @@ func StartHub(hub *Hub, in io.Reader, out io.Writer) {
 
 		line = strings.TrimSpace(line)
 
-		_, quitCharm := hub.Do(line, hub.Username, hub.Password, hub.currentServiceName())
+		_, quitCharm := hub.Do(line, auth.Credentials{Username: hub.Username, Password: hub.Password}, hub.currentServiceName())
 		if quitCharm {
+			if hub.server != nil { // We let the server finish what it's doing.
+				hub.stopHttp()
+				<-hub.drained
+			}
 			break
 		}
 	}
@@ -0,0 +1,97 @@
+package hub
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// The hub's side of session mode, in which each user of a service gets their own copy of its
+// global variables. (See sessions.go in pf.) Like the limits, whether a service is in session mode
+// is kept by the name of the service, so that it survives recompilation, and the hub saves the
+// sessions in 'user/sessions/<service name>' in the Pipefish home directory, so that they do too.
+//
+// In an administered hub, a user's session is named after them. A client which wants more than one
+// session, or any session at all in a hub which isn't administered, says which one in the header
+// of its HTTP requests as 'Pipefish-Session: <name>'.
+
+const (
+	SESSION_HEADER = "Pipefish-Session"
+
+	DEFAULT_SESSION_IDLE = 60 // In minutes.
+)
+
+func (hub *Hub) doSessionsCommand(verb string, args []string) {
+	name := hub.currentServiceName()
+	service, ok := hub.services[name]
+	if !ok || name == "" {
+		hub.WriteError("there is no current service to give sessions to.")
+		return
+	}
+	switch verb {
+	case "sessions-on":
+		idle := DEFAULT_SESSION_IDLE
+		if len(args) > 0 {
+			var err error
+			idle, err = strconv.Atoi(args[0])
+			if err != nil {
+				hub.WriteError("the time after which sessions expire should be a whole number of minutes, not '" + args[0] + "'.")
+				return
+			}
+			if idle < 0 {
+				hub.WriteError("a session can't expire after a negative number of minutes. For sessions which never expire, say 0.")
+				return
+			}
+		}
+		options := hub.sessionOptions(name, time.Duration(idle)*time.Minute)
+		hub.sessions[name] = options
+		service.SetSessions(options)
+	case "sessions-off":
+		delete(hub.sessions, name)
+		service.SetSessions(nil)
+	case "sessions":
+		options, ok := hub.sessions[name]
+		if !ok {
+			hub.WriteString("\nThe service " + Cyan("'"+name+"'") + " isn't in session mode.\n\n")
+			return
+		}
+		expiry := "never expire"
+		if options.Idle > 0 {
+			expiry = "expire after " + strconv.Itoa(int(options.Idle/time.Minute)) + " minutes unused"
+		}
+		ids := service.GetSessions()
+		if len(ids) == 0 {
+			hub.WriteString("\nThe service " + Cyan("'"+name+"'") + " has no sessions, which " + expiry + ".\n\n")
+			return
+		}
+		hub.WriteString("\nThe sessions of the service " + Cyan("'"+name+"'") + ", which " + expiry + ", are:\n\n")
+		for _, id := range ids {
+			hub.WriteString(BULLET + id + "\n")
+		}
+		hub.WriteString("\n")
+		return
+	}
+	hub.WriteString(GREEN_OK + "\n")
+}
+
+func (hub *Hub) sessionOptions(name string, idle time.Duration) *pf.SessionOptions {
+	return &pf.SessionOptions{Idle: idle, Store: pf.DirSessionStore{Dir: hub.pipefishHomeDirectory + "user/sessions/" + name}}
+}
+
+// Says which session a line or call belongs to: the user's own in an administered hub, or one of
+// theirs if they name it in the header; otherwise the one named in the header, if any.
+func withSession(ctx context.Context, r *http.Request, username string) context.Context {
+	id := ""
+	if r != nil {
+		id = r.Header.Get(SESSION_HEADER)
+	}
+	if username != "" && id != "" {
+		id = username + "/" + id
+	} else if username != "" {
+		id = username
+	}
+	return pf.WithSession(ctx, id)
+}
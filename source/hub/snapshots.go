@@ -0,0 +1,226 @@
+package hub
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/database"
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// The hub's side of snapshots of the variables of services. (See snapshots.go in pf.) When the hub
+// rebuilds a service because its script has changed, it carries the variables over from the old
+// service to the new one. It also saves snapshots of all its services every so often, when it quits,
+// and when told to by 'hub save', and restores them when it starts up, or when told to by 'hub
+// restore'. They're kept either in 'user/snapshots' in the Pipefish home directory, or in the
+// _Snapshots table of the hub's database, as 'hub config snapshots' says.
+
+const (
+	DEFAULT_SNAPSHOT_INTERVAL = 10 // In minutes.
+
+	SNAPSHOTS_IN_FILES    = "file"
+	SNAPSHOTS_IN_DATABASE = "database"
+)
+
+func (hub *Hub) snapshotStore() (pf.SnapshotStore, error) {
+	if hub.snapshotsIn == SNAPSHOTS_IN_DATABASE {
+		if hub.Db == nil {
+			return nil, errors.New("the hub has no database to keep snapshots in")
+		}
+		return sqlSnapshotStore{hub.Db}, nil
+	}
+	return pf.DirSnapshotStore{Dir: hub.pipefishHomeDirectory + "user/snapshots"}, nil
+}
+
+func (hub *Hub) saveSnapshot(name string) error {
+	service, ok := hub.services[name]
+	if !ok || service.IsBroken() {
+		return nil
+	}
+	store, err := hub.snapshotStore()
+	if err != nil {
+		return err
+	}
+	snapshot, err := service.SnapshotVariables()
+	if err != nil {
+		return err
+	}
+	return store.Save(name, snapshot)
+}
+
+// Saves snapshots of all the services, returning the first error if any.
+func (hub *Hub) saveSnapshots() error {
+	hub.lastSnapshot = time.Now()
+	var result error
+	for name := range hub.services {
+		if !isUserService(name) {
+			continue
+		}
+		if err := hub.saveSnapshot(name); err != nil && result == nil {
+			result = errors.New("couldn't save a snapshot of the service '" + name + "': " + err.Error())
+		}
+	}
+	return result
+}
+
+// Called whenever the hub is given a line to do, since it has no clock of its own.
+func (hub *Hub) snapshotIfDue() {
+	if hub.snapshotInterval == 0 || time.Since(hub.lastSnapshot) < time.Duration(hub.snapshotInterval)*time.Minute {
+		return
+	}
+	if err := hub.saveSnapshots(); err != nil {
+		hub.WriteError(err.Error() + ".")
+	}
+}
+
+// Restores the service from its saved snapshot, if there is one.
+func (hub *Hub) restoreSnapshot(name string) error {
+	store, err := hub.snapshotStore()
+	if err != nil {
+		return err
+	}
+	snapshot, ok, err := store.Load(name)
+	if err != nil || !ok {
+		return err
+	}
+	return hub.restoreVariables(name, snapshot)
+}
+
+// Carries the variables of a service over to the service which the hub has just built to replace it.
+func (hub *Hub) carryOverVariables(name string, old, new *pf.Service) {
+	if old == nil || old.IsBroken() || new.IsBroken() || !isUserService(name) {
+		return
+	}
+	snapshot, err := old.SnapshotVariables()
+	if err == nil {
+		err = hub.restoreVariables(name, snapshot)
+	}
+	if err != nil {
+		hub.WriteError("couldn't keep the variables of the service '" + name + "': " + err.Error() + ".")
+	}
+}
+
+func (hub *Hub) restoreVariables(name string, snapshot pf.Snapshot) error {
+	dropped, err := hub.services[name].RestoreVariables(snapshot)
+	if err != nil {
+		return err
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	hub.WriteString("\nThe service " + Cyan("'"+name+"'") + " couldn't keep the values of these variables:\n\n")
+	for _, v := range dropped {
+		hub.WriteString(BULLET + v.Name + ", because " + v.Reason + ".\n")
+	}
+	hub.WriteString("\n")
+	return nil
+}
+
+func (hub *Hub) doSnapshotCommand(verb string) {
+	name := hub.currentServiceName()
+	if _, ok := hub.services[name]; !ok || !isUserService(name) {
+		hub.WriteError("there is no current service to " + verb + ".")
+		return
+	}
+	var err error
+	switch verb {
+	case "save":
+		err = hub.saveSnapshot(name)
+	case "restore":
+		err = hub.restoreSnapshot(name)
+	}
+	if err != nil {
+		hub.WriteError(err.Error() + ".")
+		return
+	}
+	hub.WriteString(GREEN_OK + "\n")
+}
+
+// Reads how snapshots are configured from the hub file. Hub files from before there were snapshots
+// don't have the variables.
+func (hub *Hub) readSnapshotConfig() {
+	hub.snapshotInterval, hub.snapshotsIn = DEFAULT_SNAPSHOT_INTERVAL, SNAPSHOTS_IN_FILES
+	if v, e := hub.services["hub"].GetVariable("snapshotInterval"); e == nil && v.T == pf.INT && v.V.(int) >= 0 {
+		hub.snapshotInterval = v.V.(int)
+	}
+	if v, e := hub.services["hub"].GetVariable("snapshotsIn"); e == nil && v.T == pf.STRING && v.V.(string) == SNAPSHOTS_IN_DATABASE {
+		hub.snapshotsIn = SNAPSHOTS_IN_DATABASE
+	}
+}
+
+const (
+	SNAPSHOT_INTERVAL = "Minutes between snapshots (blank for 10, 0 for never)"
+	SNAPSHOTS_IN      = "Keep snapshots in 'file' or 'database' (blank for 'file')"
+)
+
+func (hub *Hub) configSnapshots() {
+	hub.CurrentForm = &Form{Fields: []string{SNAPSHOT_INTERVAL, SNAPSHOTS_IN},
+		Call:   func(f *Form) { hub.handleConfigSnapshotsForm(f) },
+		Result: make(map[string]string)}
+}
+
+func (hub *Hub) handleConfigSnapshotsForm(f *Form) {
+	hub.CurrentForm = nil
+	interval := DEFAULT_SNAPSHOT_INTERVAL
+	if s := strings.TrimSpace(f.Result[SNAPSHOT_INTERVAL]); s != "" {
+		var err error
+		interval, err = strconv.Atoi(s)
+		if err == nil && interval < 0 {
+			err = errors.New("the interval between snapshots can't be a negative number of minutes")
+		}
+		if err != nil {
+			hub.WriteError("hub/snapshots/config/a: " + err.Error())
+			return
+		}
+	}
+	where := strings.TrimSpace(f.Result[SNAPSHOTS_IN])
+	switch where {
+	case "":
+		where = SNAPSHOTS_IN_FILES
+	case SNAPSHOTS_IN_FILES:
+	case SNAPSHOTS_IN_DATABASE:
+		if hub.Db == nil {
+			hub.WriteError("hub/snapshots/config/b: the hub has no database to keep snapshots in. Use 'hub config db' to give it one.")
+			return
+		}
+	default:
+		hub.WriteError("hub/snapshots/config/c: snapshots can be kept in a 'file' or in the 'database'.")
+		return
+	}
+	hub.snapshotInterval, hub.snapshotsIn = interval, where
+	hub.WriteString(GREEN_OK + "\n")
+}
+
+// A `pf.SnapshotStore` which keeps the snapshots in the hub's database.
+type sqlSnapshotStore struct {
+	db *sql.DB
+}
+
+func (s sqlSnapshotStore) Load(service string) (pf.Snapshot, bool, error) {
+	variables, err := database.GetSnapshot(s.db, service)
+	if err != nil || len(variables) == 0 {
+		return nil, false, err
+	}
+	result := pf.Snapshot{}
+	for _, v := range variables {
+		result[v.Name] = pf.SnapshotVariable{Type: v.Type, Value: v.Value}
+	}
+	return result, true, nil
+}
+
+func (s sqlSnapshotStore) Save(service string, snapshot pf.Snapshot) error {
+	names := []string{}
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	variables := []database.SnapshotVariable{}
+	for _, name := range names {
+		variables = append(variables, database.SnapshotVariable{Name: name, Type: snapshot[name].Type, Value: snapshot[name].Value})
+	}
+	return database.SaveSnapshot(s.db, service, variables)
+}
@@ -0,0 +1,205 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/tim-hardcastle/Pipefish/source/auth"
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+)
+
+// Streaming lines over HTTP. The other endpoints only answer once the line has finished, with all
+// its output at once. A client which posts the line to
+//
+//	POST /stream
+//
+// instead gets back Server-Sent Events as the line runs:
+//
+//	event: stream   data: {"Id": ...}                 first, naming the stream
+//	event: output   data: "..."                       whenever the line posts to `Output()`
+//	event: input    data: {"Prompt": ...}             whenever it's waiting to get from `Input()`
+//	event: result   data: {"Body": ..., "Service": ...} when it's finished, as from the JSON endpoint
+//
+// and answers the line's questions by posting the text of each answer to
+//
+//	POST /stream/{id}/input
+//
+// which may be done before they're asked. If the hub is administered, both requests need the
+// user's bearer token, or their username and password by basic authentication, and only the user
+// who opened the stream can answer it. If the client goes away, the line is stopped.
+
+const (
+	STREAM_PATH       = "POST /stream"
+	STREAM_INPUT_PATH = "POST /stream/{id}/input"
+
+	STREAM_INPUT_BUFFER = 16 // How many answers a client can send before they're asked for.
+)
+
+type stream struct {
+	id       string
+	username string // Who opened it, if the hub is administered.
+	ctx      context.Context
+	w        http.ResponseWriter
+	inputs   chan string
+	buf      bytes.Buffer
+	literal  *pf.SimpleOutHandler // Writes what the line posts to `Output()` to buf, as the other endpoints would.
+}
+
+// The streams which are open, by id.
+type streams struct {
+	mu   sync.Mutex
+	byId map[string]*stream
+}
+
+func (ss *streams) add(s *stream) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.byId == nil {
+		ss.byId = map[string]*stream{}
+	}
+	ss.byId[s.id] = s
+}
+
+func (ss *streams) remove(s *stream) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.byId, s.id)
+}
+
+func (ss *streams) get(id string) (*stream, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.byId[id]
+	return s, ok
+}
+
+type streamOpened = struct {
+	Id string
+}
+
+type streamInput = struct {
+	Prompt string
+}
+
+func (h *Hub) handleStreamRequest(w http.ResponseWriter, r *http.Request) {
+	var creds auth.Credentials
+	var serviceName string
+	if h.administered {
+		user, ok := h.userOfStreamRequest(w, r)
+		if !ok {
+			return
+		}
+		creds.Username, serviceName = user.Name, user.Service
+	} else {
+		h.mu.Lock()
+		serviceName = h.currentServiceName()
+		h.mu.Unlock()
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	line := string(body)
+	id := make([]byte, 16)
+	rand.Read(id)
+	s := &stream{id: hex.EncodeToString(id), username: creds.Username, ctx: r.Context(), w: w,
+		inputs: make(chan string, STREAM_INPUT_BUFFER)}
+	h.streams.add(s)
+	defer h.streams.remove(s)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	s.send("stream", streamOpened{s.id})
+	var out bytes.Buffer
+	serviceName, errorValue := h.doRequestWith(withSession(r.Context(), r, creds.Username), &out, line, creds, serviceName,
+		func(service *pf.Service, ctx context.Context) (pf.Value, error) {
+			s.literal = service.MakeStringWritingOutHandler(&s.buf)
+			return service.DoWithHandlers(ctx, line, s, s)
+		})
+	s.send("result", jsonResponse{Body: out.String(), Service: serviceName, Error: errorValue})
+}
+
+func (h *Hub) handleStreamInputRequest(w http.ResponseWriter, r *http.Request) {
+	var username string
+	if h.administered {
+		user, ok := h.userOfStreamRequest(w, r)
+		if !ok {
+			return
+		}
+		username = user.Name
+	}
+	s, ok := h.streams.get(r.PathValue("id"))
+	if !ok || s.username != username {
+		http.Error(w, "there is no stream '"+r.PathValue("id")+"'", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case s.inputs <- strings.TrimSuffix(strings.TrimSuffix(string(body), "\n"), "\r"):
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "the stream has too many answers waiting", http.StatusTooManyRequests)
+	}
+}
+
+func (h *Hub) userOfStreamRequest(w http.ResponseWriter, r *http.Request) (auth.User, bool) {
+	creds, ok := credentialsOfRequest(r)
+	if !ok {
+		http.Error(w, "a bearer token or a username and password are required", http.StatusUnauthorized)
+		return auth.User{}, false
+	}
+	user, err := h.authenticate(creds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return auth.User{}, false
+	}
+	return user, true
+}
+
+// Sends an event with the data as JSON. The stream is only written to by the request which
+// opened it, so there's no need for a lock.
+func (s *stream) send(event string, data any) {
+	payload, _ := json.Marshal(data)
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload)
+	http.NewResponseController(s.w).Flush()
+}
+
+// A stream is the `OutHandler` and `InHandler` of the line it's running.
+
+func (s *stream) Out(v pf.Value) {
+	s.literal.Out(v)
+	s.send("output", s.buf.String())
+	s.buf.Reset()
+}
+
+func (s *stream) Write(str string) {
+	s.send("output", str)
+}
+
+func (s *stream) Get() string {
+	return s.GetWithPrompt("")
+}
+
+// Returns "" if the client goes away, which stops the line soon after.
+func (s *stream) GetWithPrompt(prompt string) string {
+	s.send("input", streamInput{prompt})
+	select {
+	case line := <-s.inputs:
+		return line
+	case <-s.ctx.Done():
+		return ""
+	}
+}
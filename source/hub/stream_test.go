@@ -0,0 +1,121 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const streamTestCode = `cmd
+
+greet :
+    get name from Input("What's your name? ")
+    post "Hello " + name to Output()
+`
+
+// Reads the next Server-Sent Event, returning io.EOF once the stream has ended.
+func readEvent(r *bufio.Reader) (string, string, error) {
+	var event, data string
+	for {
+		line, e := r.ReadString('\n')
+		if e != nil {
+			return event, data, e
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return event, data, nil
+		case strings.HasPrefix(line, "event: "):
+			event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			data = line[len("data: "):]
+		}
+	}
+}
+
+// Streams a line which asks for input on an administered hub, checking the events, that only the
+// user who opened the stream can answer it, and that when the client goes away the line is stopped
+// and the stream is forgotten.
+func TestStream(t *testing.T) {
+	h, _ := newTestHub(t)
+	administer(t, h, "app")
+	h.administered = true
+	h.createService("app", writeFile(t, t.TempDir(), "app.pf", streamTestCode))
+	mux := http.NewServeMux()
+	mux.HandleFunc(STREAM_PATH, h.handleStreamRequest)
+	mux.HandleFunc(STREAM_INPUT_PATH, h.handleStreamInputRequest)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	post := func(ctx context.Context, path, username, body string) *http.Response {
+		req, _ := http.NewRequestWithContext(ctx, "POST", server.URL+path, strings.NewReader(body))
+		if username != "" {
+			req.SetBasicAuth(username, "secret")
+		}
+		resp, e := http.DefaultClient.Do(req)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return resp
+	}
+	open := func(ctx context.Context, line string) (*http.Response, *bufio.Reader, string) {
+		resp := post(ctx, "/stream", "user", line)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("wanted an event stream | got %d, %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		events := bufio.NewReader(resp.Body)
+		event, data, e := readEvent(events)
+		var opened streamOpened
+		if e != nil || event != "stream" || json.Unmarshal([]byte(data), &opened) != nil || opened.Id == "" {
+			t.Fatalf("wanted the stream to be named | got %s %s, %v", event, data, e)
+		}
+		return resp, events, opened.Id
+	}
+	expect := func(events *bufio.Reader, wantEvent, wantData string) {
+		if event, data, e := readEvent(events); e != nil || event != wantEvent || data != wantData {
+			t.Fatalf("wanted %s %s | got %s %s, %v", wantEvent, wantData, event, data, e)
+		}
+	}
+
+	resp, events, id := open(context.Background(), "greet")
+	defer resp.Body.Close()
+	expect(events, "input", `{"Prompt":"What's your name? "}`)
+	for username, want := range map[string]int{"": http.StatusUnauthorized, "admin": http.StatusNotFound} {
+		if resp := post(context.Background(), "/stream/"+id+"/input", username, "Mallory\n"); resp.StatusCode != want {
+			t.Errorf("%q answering another user's stream: wanted %d | got %d", username, want, resp.StatusCode)
+		}
+	}
+	if resp := post(context.Background(), "/stream/"+id+"/input", "user", "Ann\n"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("wanted the answer to be taken | got %d", resp.StatusCode)
+	}
+	expect(events, "output", `"\"Hello Ann\"\n"`)
+	expect(events, "result", `{"Body":"OK","Service":"app"}`)
+	if event, data, e := readEvent(events); e != io.EOF {
+		t.Errorf("wanted the stream to end after the result | got %s %s, %v", event, data, e)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, events, id = open(ctx, "greet")
+	expect(events, "input", `{"Prompt":"What's your name? "}`)
+	cancel()
+	resp.Body.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := h.streams.get(id); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("wanted the stream to be forgotten when the client went away")
+		}
+	}
+	if resp := post(context.Background(), "/stream/"+id+"/input", "user", "Bob\n"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wanted an answer to a closed stream to be refused | got %d", resp.StatusCode)
+	}
+	resp, events, _ = open(context.Background(), "2 + 2")
+	defer resp.Body.Close()
+	expect(events, "result", `{"Body":"4","Service":"app"}`)
+}
@@ -0,0 +1,218 @@
+package hub
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+	"github.com/tim-hardcastle/Pipefish/source/text"
+)
+
+// Watch mode. Normally the hub only notices that a script has changed when it's next given a line
+// for the service, if the hub is live. In watch mode, a goroutine keeps an eye on every file each
+// service was built from, i.e. its script, the modules it imports, and its SQL schemas, and so also
+// the `golang` blocks in them, whose Go is recompiled as `gotimes.dat` says. When any of them
+// changes, the watcher rebuilds the service in the background. If the new build has errors, it
+// reports them at once in the REPL, and the hub goes on using the old one; if not, the hub puts it
+// in place of the old one, carrying over the variables, the next time it's given a line to do or
+// an HTTP request, so that HTTP clients always get the last good build.
+//
+// The watcher doesn't touch the hub's own state, which belongs to whatever is using the hub.
+// Instead, the hub hands it the services to watch, and collects the new builds, whenever it calls
+// `installWatchedBuilds`.
+
+const WATCH_INTERVAL = 500 * time.Millisecond
+
+type watcher struct {
+	mu       sync.Mutex
+	services map[string]watchedService // The services the hub is running, as of the last time it looked.
+	ready    map[string]*pf.Service    // The builds which compiled cleanly, waiting for the hub to use them.
+	broken   map[string]*pf.Service    // The builds which didn't, for `hub why` and `hub where`.
+	stamps   map[string]map[string]int64
+	report   func(string) // Writes to the REPL. (See Hub.writeToRepl.)
+	width    int
+	stop     chan struct{}
+}
+
+type watchedService struct {
+	service  *pf.Service
+	sources  []string // Copied out of the service, whose sources the hub adds the REPL input to.
+	settings serviceSettings
+}
+
+func (hub *Hub) startWatching() {
+	if hub.watcher != nil {
+		return
+	}
+	hub.watcher = &watcher{
+		ready:  map[string]*pf.Service{},
+		broken: map[string]*pf.Service{},
+		stamps: map[string]map[string]int64{},
+		report: hub.writeToRepl,
+		width:  hub.getSV("width").V.(int),
+		stop:   make(chan struct{}),
+	}
+	hub.installWatchedBuilds()
+	go hub.watcher.watch()
+}
+
+func (hub *Hub) stopWatching() {
+	if hub.watcher == nil {
+		return
+	}
+	close(hub.watcher.stop)
+	hub.watcher = nil
+}
+
+// Puts the builds the watcher has made in place of the services they rebuild, and tells the
+// watcher what the hub is now running. It's called by whatever is using the hub, before it uses
+// the services.
+func (hub *Hub) installWatchedBuilds() {
+	w := hub.watcher
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name, newService := range w.ready {
+		oldService, ok := hub.services[name]
+		if !ok || oldService != w.services[name].service { // Then the hub has halted or replaced it meanwhile.
+			continue
+		}
+		hub.services[name] = newService
+		hub.carryOverVariables(name, oldService, newService)
+		if name == hub.currentServiceName() {
+			hub.Sources, _ = newService.GetSources()
+		}
+	}
+	w.ready = map[string]*pf.Service{}
+	if broken, ok := w.broken[hub.currentServiceName()]; ok {
+		hub.ers = broken.GetErrors()
+	}
+	w.broken = map[string]*pf.Service{}
+	w.services = map[string]watchedService{}
+	for name, service := range hub.services {
+		if isUserService(name) && !isRemote(service) {
+			w.services[name] = watchedService{service, sourcesOf(service), hub.settingsFor(name)}
+		}
+	}
+}
+
+func isRemote(service *pf.Service) bool {
+	path, _ := service.GetFilepath()
+	return len(path) >= 5 && path[0:5] == "http:"
+}
+
+func (w *watcher) watch() {
+	ticker := time.NewTicker(WATCH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			services := w.services
+			w.mu.Unlock()
+			for name, watched := range services {
+				w.check(name, watched)
+			}
+		}
+	}
+}
+
+// Rebuilds the service if any of its files have changed since the watcher last built it or, if
+// it hasn't, since the hub did.
+func (w *watcher) check(name string, watched watchedService) {
+	stamps, ok := w.stamps[name]
+	if !ok {
+		stamps = timestampsOf(watched.sources, nil)
+		w.stamps[name] = stamps
+		if needsUpdate, _ := watched.service.NeedsUpdate(); !needsUpdate {
+			return
+		}
+	} else if !changed(stamps) {
+		return
+	}
+	w.mu.Lock()
+	_, waiting := w.ready[name]
+	w.mu.Unlock()
+	if waiting {
+		return
+	}
+	path, _ := watched.service.GetFilepath()
+	before := currentTimestamps(stamps)
+	newService := watched.settings.newService()
+	newService.InitializeFromFilepath(path)
+	w.stamps[name] = timestampsOf(sourcesOf(newService), before)
+	w.mu.Lock()
+	if newService.IsBroken() {
+		w.broken[name] = newService
+		w.mu.Unlock()
+		report, _ := newService.GetErrorReport()
+		w.report("\nThe service " + Cyan("'"+name+"'") + " has changed, but the hub will go on using the old version until the errors are fixed.\n" +
+			pf.PrettyString(report, 0, w.width))
+		return
+	}
+	delete(w.broken, name)
+	w.ready[name] = newService
+	w.mu.Unlock()
+	w.report("\nThe service " + Cyan("'"+name+"'") + " has been rebuilt.\n\n")
+}
+
+func sourcesOf(service *pf.Service) []string {
+	result := []string{}
+	sources, _ := service.GetSources()
+	for source := range sources {
+		result = append(result, source)
+	}
+	return result
+}
+
+// The times the sources were last modified, by filepath, keeping those already known.
+func timestampsOf(sources []string, known map[string]int64) map[string]int64 {
+	result := map[string]int64{}
+	for source, stamp := range known {
+		result[source] = stamp
+	}
+	for _, source := range sources {
+		if _, ok := result[source]; ok {
+			continue
+		}
+		if stamp, ok := timestampOf(source); ok {
+			result[source] = stamp
+		}
+	}
+	return result
+}
+
+func currentTimestamps(stamps map[string]int64) map[string]int64 {
+	result := map[string]int64{}
+	for source := range stamps {
+		result[source], _ = timestampOf(source)
+	}
+	return result
+}
+
+func changed(stamps map[string]int64) bool {
+	for source, stamp := range stamps {
+		if now, _ := timestampOf(source); now != stamp {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the time the source was last modified, or false if it isn't a file, e.g. if it's REPL
+// input or a library built into Pipefish.
+func timestampOf(source string) (int64, bool) {
+	if source == "" || source == "REPL input" {
+		return 0, false
+	}
+	file, e := os.Stat(text.MakeFilepath(source))
+	if e != nil {
+		return 0, false
+	}
+	return file.ModTime().UnixMilli(), true
+}
@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/auth"
+)
+
+const watchTestCode = `import
+
+lib::"%s"
+
+var
+
+count = 0
+`
+
+// Edits a module imported by a watched service, checking that while the module is broken the old
+// service goes on answering HTTP requests, and that once it's fixed the new build is put in place
+// with the variables of the old one.
+func TestWatch(t *testing.T) {
+	h, out := newTestHub(t)
+	dir := t.TempDir()
+	lib := writeFile(t, dir, "lib.pf", "def\n\nvalue : 1\n")
+	if !h.StartAndMakeCurrent("", "app", writeFile(t, dir, "app.pf", strings.Replace(watchTestCode, "%s", lib, 1))) {
+		t.Fatal("couldn't start the service")
+	}
+	h.Do("count = 5", auth.Credentials{}, "app")
+	if e := h.StartHttp("/do", "0"); e != nil {
+		t.Fatal(e)
+	}
+	defer h.server.Close()
+	h.Do("hub watch on", auth.Credentials{}, "app")
+	defer h.stopWatching()
+	ask := func() string {
+		resp, e := http.Post("http://localhost:"+h.port+"/do", "text/plain", strings.NewReader("lib.value + count"))
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return strings.TrimSpace(string(body))
+	}
+	if got := ask(); got != "6" {
+		t.Fatalf("wanted 6 | got %q", got)
+	}
+	edit := func(contents, report string, age time.Duration) {
+		writeFile(t, dir, "lib.pf", contents)
+		later := time.Now().Add(age) // So that the edit changes the timestamp however coarse it is.
+		if e := os.Chtimes(lib, later, later); e != nil {
+			t.Fatal(e)
+		}
+		for deadline := time.Now().Add(10 * time.Second); !strings.Contains(out.String(), report); time.Sleep(WATCH_INTERVAL / 5) {
+			if time.Now().After(deadline) {
+				t.Fatalf("wanted the watcher to report %q | got %q", report, out.String())
+			}
+		}
+	}
+
+	edit("def\n\nvalue : zort 1\n", "has changed", time.Second)
+	if got := ask(); got != "6" {
+		t.Errorf("wanted the old service to answer 6 | got %q", got)
+	}
+	h.mu.Lock()
+	service := h.services["app"]
+	h.mu.Unlock()
+
+	edit("def\n\nvalue : 2\n", "has been rebuilt", 2*time.Second)
+	if got := ask(); got != "7" {
+		t.Errorf("wanted the new service to answer 7 | got %q", got)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.services["app"] == service {
+		t.Errorf("wanted the new build to be in place")
+	}
+}
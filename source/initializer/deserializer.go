@@ -17,6 +17,29 @@ import (
 // xserve is the external service number: set to DUMMY it will indicate that we're just doing this for human readers and
 // can therefore leave off the 'xcall' hooks.
 func SerializedAPIToDeclarations(serializedAPI string, xserve uint32) string {
+	return serializedAPIToSource(serializedAPI, func(parts []string, isCommand bool) string {
+		return makeCommandOrFunctionDeclarationFromParts(parts, xserve)
+	})
+}
+
+// This turns the serialized API of the external service of the given name into the source code of a
+// stub service, which declares the same types, and the functions and commands commented out. The developer
+// uncomments and scripts the ones the tests need, and the stub returns an error for the rest. (See
+// `hub stub`.)
+func SerializedAPIToStub(serializedAPI, name string) string {
+	var buf strings.Builder
+	buf.WriteString("// A stub of the external service '")
+	buf.WriteString(name)
+	buf.WriteString("', which 'hub test' uses in its place. Uncomment the\n")
+	buf.WriteString("// functions and commands the tests call, and script their responses: the others return an error.\n\n")
+	buf.WriteString(serializedAPIToSource(serializedAPI, makeStubFromParts))
+	// The stub leaves a blank line after each function, which we don't want at the end of a section.
+	return strings.ReplaceAll(strings.TrimRight(buf.String(), "\n"), "\n\n\n", "\n\n") + "\n"
+}
+
+// Does the work of the two previous functions, which supply the means of turning the parts of a line
+// describing a function or command into its declaration.
+func serializedAPIToSource(serializedAPI string, makeFunction func(parts []string, isCommand bool) string) string {
 	var buf strings.Builder
 	lines := strings.Split(strings.TrimRight(serializedAPI, "\n"), "\n")
 	lineNo := 0
@@ -31,7 +54,7 @@ func SerializedAPIToDeclarations(serializedAPI string, xserve uint32) string {
 			}
 			buf.WriteString(parts[1])
 			buf.WriteString(" = enum ")
-			buf.WriteString(strings.Join(strings.Split(parts[2], " "), ", "))
+			buf.WriteString(strings.Join(parts[2:], ", "))
 			buf.WriteString("\n")
 			lineNo++
 		case "STRUCT":
@@ -64,18 +87,19 @@ func SerializedAPIToDeclarations(serializedAPI string, xserve uint32) string {
 			buf.WriteString(parts[1])
 			buf.WriteString(" = abstract ")
 			buf.WriteString(strings.Join(strings.Split(parts[2], " "), "/"))
+			buf.WriteString("\n")
 			lineNo++
 		case "COMMAND":
-			if !hasHappened["CMD"] {
+			if !hasHappened["COMMAND"] {
 				buf.WriteString("\ncmd\n\n")
 			}
-			buf.WriteString(makeCommandOrFunctionDeclarationFromParts(parts[1:], xserve))
+			buf.WriteString(makeFunction(parts[1:], true))
 			lineNo++
 		case "FUNCTION":
-			if !hasHappened["DEF"] {
+			if !hasHappened["FUNCTION"] {
 				buf.WriteString("\ndef\n\n")
 			}
-			buf.WriteString(makeCommandOrFunctionDeclarationFromParts(parts[1:], xserve))
+			buf.WriteString(makeFunction(parts[1:], false))
 			lineNo++
 		case "":
 			lineNo++
@@ -89,6 +113,28 @@ func SerializedAPIToDeclarations(serializedAPI string, xserve uint32) string {
 
 func makeCommandOrFunctionDeclarationFromParts(parts []string, xserve uint32) string {
 	var buf strings.Builder
+	functionName := parts[0]
+	position := makeSignatureFromParts(&buf, parts)
+	if xserve != DUMMY { // Then we need to insert the hook.
+		buf.WriteString(" : xcall ")
+		buf.WriteString(strconv.Itoa(int(xserve)))
+		buf.WriteString(", ")
+		buf.WriteString("\"")
+		buf.WriteString(functionName)
+		buf.WriteString("\"")
+		buf.WriteString(", ")
+		buf.WriteString(strconv.Itoa(int(position)))
+		buf.WriteString(", ")
+		buf.WriteString("\"")
+		buf.WriteString(parts[len(parts)-1])
+		buf.WriteString("\"")
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// Writes the signature of the function or command described by the parts, returning its position.
+func makeSignatureFromParts(buf *strings.Builder, parts []string) uint32 {
 	// We have snipped off the part saying "FUNCTION" or "COMMAND", so the list of parts now looks like this:
 	// functionName | 0, 1, 2, 3 for prefix/infix/suffix/unfix | parameterName1 type1 | parameterName2 type2 | serialization of typescheme
 	// We can't use the serialization of the typescheme here, so we can break it down into parts:
@@ -97,7 +143,8 @@ func makeCommandOrFunctionDeclarationFromParts(parts []string, xserve uint32) st
 	position := uint32(posInt)
 	params := parts[2 : len(parts)-1]
 	if position == compiler.UNFIX {
-		return functionName
+		buf.WriteString(functionName)
+		return position
 	}
 	if position == compiler.PREFIX {
 		buf.WriteString(functionName)
@@ -127,27 +174,31 @@ func makeCommandOrFunctionDeclarationFromParts(parts []string, xserve uint32) st
 		buf.WriteString(bits[0])
 		buf.WriteString(" ")
 		buf.WriteString(bits[1])
+		lastWasBling = false
+	}
+	if !lastWasBling {
+		buf.WriteString(")")
 	}
-	buf.WriteString(")")
 	if position == compiler.SUFFIX {
 		buf.WriteString(" ")
 		buf.WriteString(functionName)
 	}
-	if xserve != DUMMY { // Then we need to insert the hook.
-		buf.WriteString(" : xcall ")
-		buf.WriteString(strconv.Itoa(int(xserve)))
-		buf.WriteString(", ")
-		buf.WriteString("\"")
-		buf.WriteString(functionName)
-		buf.WriteString("\"")
-		buf.WriteString(", ")
-		buf.WriteString(strconv.Itoa(int(position)))
-		buf.WriteString(", ")
-		buf.WriteString("\"")
-		buf.WriteString(parts[len(parts)-1])
-		buf.WriteString("\"")
+	return position
+}
+
+// Makes the declaration of a function or command of a stub, commented out, with a body for the developer
+// to replace.
+func makeStubFromParts(parts []string, isCommand bool) string {
+	var buf strings.Builder
+	buf.WriteString("// ")
+	makeSignatureFromParts(&buf, parts)
+	buf.WriteString(" :\n//     ")
+	if isCommand {
+		buf.WriteString("OK")
+	} else {
+		buf.WriteString("NULL")
 	}
-	buf.WriteString("\n")
+	buf.WriteString("\n\n")
 	return buf.String()
 }
 
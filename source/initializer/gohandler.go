@@ -2,6 +2,7 @@ package initializer
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -17,6 +18,7 @@ import (
 	"github.com/tim-hardcastle/Pipefish/source/settings"
 	"github.com/tim-hardcastle/Pipefish/source/text"
 	"github.com/tim-hardcastle/Pipefish/source/token"
+	"github.com/tim-hardcastle/Pipefish/source/values"
 )
 
 // This allows the compiler to extract functions and converter data from the relevant `.so` files,
@@ -108,8 +110,7 @@ func (iz *initializer) compileGo() {
 		if !ok || sourceCodeModified != int64(objectCodeModified) {
 			plugins = iz.makeNewSoFile(source, sourceCodeModified)
 		} else {
-			soFile := settings.PipefishHomeDirectory + "pipefish-rsc/" + text.Flatten(source) + "_" + strconv.Itoa(int(sourceCodeModified)) + ".so"
-			plugins, err = plugin.Open(soFile)
+			plugins, err = plugin.Open(goPluginFilepath(source, sourceCodeModified))
 			if err != nil {
 				iz.Throw("golang/open/b", sourceToken, err.Error())
 				return
@@ -121,27 +122,18 @@ func (iz *initializer) compileGo() {
 		}
 
 		// We extract the conversion data from the object code, reformat it, and store the results
-		// in the vm.
-		newGoConverter := make([](func(t uint32, v any) any), len(iz.cp.Vm.ConcreteTypeInfo))
-		copy(newGoConverter, iz.cp.Vm.GoConverter)
-		functionConverterSymbol, _ := plugins.Lookup("PIPEFISH_FUNCTION_CONVERTER")
-		functionConverter := *functionConverterSymbol.(*map[string](func(t uint32, v any) any))
-		for k, v := range BUILTIN_FUNCTION_CONVERTER {
-			functionConverter[k] = v
+		// in the vm. We also keep the type numbers, so that we can do this again when we load
+		// a bytecode image.
+		functionConverter, valueConverter := getGoConverters(plugins)
+		goPlugin := compiler.GoPlugin{Source: source, Converters: map[string]values.ValueType{}}
+		for typeName := range functionConverter {
+			goPlugin.Converters[typeName] = iz.cp.ConcreteTypeNow(typeName)
 		}
-		for typeName, constructor := range functionConverter {
-			typeNumber := iz.cp.ConcreteTypeNow(typeName)
-			newGoConverter[typeNumber] = constructor
-		}
-		iz.cp.Vm.GoConverter = newGoConverter
-		valueConverterSymbol, _ := plugins.Lookup("PIPEFISH_VALUE_CONVERTER")
-		valueConverter := *valueConverterSymbol.(*map[string]any)
-		for k, v := range BUILTIN_VALUE_CONVERTER {
-			valueConverter[k] = v
-		}
-		for typeName, goValue := range valueConverter {
-			iz.cp.Vm.GoToPipefishTypes[reflect.TypeOf(goValue).Elem()] = iz.cp.ConcreteTypeNow(typeName)
+		for typeName := range valueConverter {
+			goPlugin.Converters[typeName] = iz.cp.ConcreteTypeNow(typeName)
 		}
+		addGoConverters(iz.cp.Vm, functionConverter, valueConverter, goPlugin.Converters)
+		iz.cp.Vm.GoPlugins = append(iz.cp.Vm.GoPlugins, goPlugin)
 		//We attach the compiled functions to the (pointers to) the functions, which are
 		// also pointed to by the compiler's function table and by the list of common functions
 		// in the common parser bindle. I.e. we are returning our result by mutating the
@@ -160,6 +152,70 @@ func (iz *initializer) compileGo() {
 	}
 }
 
+// Gets the converters from the object code, adding the ones for the builtin types.
+func getGoConverters(plugins *plugin.Plugin) (map[string](func(t uint32, v any) any), map[string]any) {
+	functionConverterSymbol, _ := plugins.Lookup("PIPEFISH_FUNCTION_CONVERTER")
+	functionConverter := *functionConverterSymbol.(*map[string](func(t uint32, v any) any))
+	for k, v := range BUILTIN_FUNCTION_CONVERTER {
+		functionConverter[k] = v
+	}
+	valueConverterSymbol, _ := plugins.Lookup("PIPEFISH_VALUE_CONVERTER")
+	valueConverter := *valueConverterSymbol.(*map[string]any)
+	for k, v := range BUILTIN_VALUE_CONVERTER {
+		valueConverter[k] = v
+	}
+	return functionConverter, valueConverter
+}
+
+// Puts the converters in the vm, given the numbers of the types they convert to and from.
+func addGoConverters(vm *compiler.Vm, functionConverter map[string](func(t uint32, v any) any), valueConverter map[string]any, typeNumbers map[string]values.ValueType) {
+	newGoConverter := make([](func(t uint32, v any) any), len(vm.ConcreteTypeInfo))
+	copy(newGoConverter, vm.GoConverter)
+	for typeName, constructor := range functionConverter {
+		newGoConverter[typeNumbers[typeName]] = constructor
+	}
+	vm.GoConverter = newGoConverter
+	for typeName, goValue := range valueConverter {
+		vm.GoToPipefishTypes[reflect.TypeOf(goValue).Elem()] = typeNumbers[typeName]
+	}
+}
+
+// When we load a bytecode image, the vm knows which plugins its Go functions came from, and by what
+// names, but not the functions themselves, so we reopen the plugins and look them up. The sources
+// must be unchanged since the image was made, and so the plugins will be where `compileGo` put them.
+func reopenGoPlugins(vm *compiler.Vm) error {
+	opened := map[string]*plugin.Plugin{}
+	for _, goPlugin := range vm.GoPlugins {
+		f, err := os.Stat(text.MakeFilepath(goPlugin.Source))
+		if err != nil {
+			return err
+		}
+		plugins, err := plugin.Open(goPluginFilepath(goPlugin.Source, f.ModTime().UnixMilli()))
+		if err != nil {
+			return err
+		}
+		functionConverter, valueConverter := getGoConverters(plugins)
+		addGoConverters(vm, functionConverter, valueConverter, goPlugin.Converters)
+		opened[goPlugin.Source] = plugins
+	}
+	for i, goFn := range vm.GoFns {
+		plugins, ok := opened[goFn.Source]
+		if !ok {
+			return errors.New("can't find the plugin for Go function '" + goFn.Symbol + "'")
+		}
+		goFunction, err := plugins.Lookup(goFn.Symbol)
+		if err != nil {
+			return err
+		}
+		vm.GoFns[i].Code = reflect.ValueOf(goFunction)
+	}
+	return nil
+}
+
+func goPluginFilepath(source string, timestamp int64) string {
+	return filepath.Join(settings.PipefishHomeDirectory, filepath.FromSlash("pipefish-rsc/"+text.Flatten(source)+"_"+strconv.Itoa(int(timestamp))+".so"))
+}
+
 // But list, set, pair, and map can't go in here because of the recursion.
 var BUILTIN_FUNCTION_CONVERTER = map[string](func(t uint32, v any) any){
 	"bool":   func(t uint32, v any) any { return v.(bool) },
@@ -223,10 +279,10 @@ func (iz *initializer) makeNewSoFile(source string, newTime int64) *plugin.Plugi
 		fmt.Fprint(sb, pureGo)
 	}
 	counter++ // The number of the gocode_<counter>.go source file we're going to write.
-	soFile := filepath.Join(settings.PipefishHomeDirectory, filepath.FromSlash("pipefish-rsc/"+text.Flatten(source)+"_"+strconv.Itoa(int(newTime))+".so"))
+	soFile := goPluginFilepath(source, newTime)
 	timeMap := iz.getGoTimes()
 	if oldTime, ok := timeMap[source]; ok {
-		os.Remove(filepath.Join(settings.PipefishHomeDirectory, filepath.FromSlash("pipefish-rsc/"+text.Flatten(source)+"_"+strconv.Itoa(int(oldTime))+".so")))
+		os.Remove(goPluginFilepath(source, oldTime))
 	}
 	goFile := filepath.Join(settings.PipefishHomeDirectory, "gocode_"+strconv.Itoa(counter)+".go")
 	iz.cmG("Creating goFile with filepath '" + goFile + "'\n\n", source)
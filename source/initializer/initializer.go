@@ -3,6 +3,7 @@ package initializer
 import (
 	"database/sql"
 	"embed"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
@@ -15,6 +16,7 @@ import (
 	"github.com/tim-hardcastle/Pipefish/source/dtypes"
 	"github.com/tim-hardcastle/Pipefish/source/err"
 	"github.com/tim-hardcastle/Pipefish/source/lexer"
+	"github.com/tim-hardcastle/Pipefish/source/p2p"
 	"github.com/tim-hardcastle/Pipefish/source/parser"
 	"github.com/tim-hardcastle/Pipefish/source/settings"
 	"github.com/tim-hardcastle/Pipefish/source/text"
@@ -66,12 +68,14 @@ func NewInitializer() *initializer {
 // The CommonInitializerBindle contains information that all the initializers need to share.
 type CommonInitializerBindle struct {
 	Functions map[FuncSource]*ast.PrsrFunction
+	Stubs     map[string]string // The filepaths of the stubs to use in place of the external services of the given names.
 }
 
 // Initializes the `CommonInitializerBindle`
 func NewCommonInitializerBindle() *CommonInitializerBindle {
 	b := CommonInitializerBindle{
 		Functions: make(map[FuncSource]*ast.PrsrFunction),
+		Stubs:     make(map[string]string),
 	}
 	return &b
 }
@@ -102,12 +106,34 @@ func StartCompilerFromFilepath(filepath string, db *sql.DB, svs map[string]*comp
 	return StartCompiler(filepath, sourcecode, db, svs), nil
 }
 
+// Starts a compiler from a bytecode image written by `compiler.WriteImage`, reopening the plugins of
+// any Go functions it uses.
+func StartCompilerFromImage(r io.Reader, db *sql.DB, hubServices map[string]*compiler.Compiler) (*compiler.Compiler, error) {
+	cp, e := compiler.ReadImage(r, compiler.BlankVm(db, hubServices))
+	if e != nil {
+		return nil, e
+	}
+	if e := reopenGoPlugins(cp.Vm); e != nil {
+		return nil, e
+	}
+	return cp, nil
+}
+
 // We begin by manufacturing a blank VM, a `CommonParserBindle` for all the parsers to share, and a
 // `CommonInitializerBindle` for the initializers to share. These Common bindles are then passed down to the
 // "children" of the intitializer and the parser when new modules are created.
 func StartCompiler(scriptFilepath, sourcecode string, db *sql.DB, hubServices map[string]*compiler.Compiler) *compiler.Compiler {
+	return StartCompilerWithStubs(scriptFilepath, sourcecode, db, hubServices, nil)
+}
+
+// Starts a compiler which uses the stubs in the given files in place of the external services of the
+// given names, as `hub test` does. (See `SerializedAPIToStub`.)
+func StartCompilerWithStubs(scriptFilepath, sourcecode string, db *sql.DB, hubServices map[string]*compiler.Compiler, stubs map[string]string) *compiler.Compiler {
 	iz := NewInitializer()
 	iz.Common = NewCommonInitializerBindle()
+	for name, stubFilepath := range stubs {
+		iz.Common.Stubs[name] = stubFilepath
+	}
 	// We then carry out five phases of initialization each of which is performed recursively on all of the
 	// modules in the dependency tree before moving on to the next. (The need to do this is in fact what
 	// defines the phases, so you shouldn't bother looking for some deeper logic in that.)
@@ -319,6 +345,7 @@ func (iz *initializer) MakeParserAndTokenizedProgram() {
 	lastTokenWasColon := false
 	typeDefined := declarationType(DUMMY)
 	IsPrivate := false
+	var access []string // The groups named by the last 'for' line in the section, if any.
 	var (
 		tok token.Token
 	)
@@ -351,6 +378,7 @@ func (iz *initializer) MakeParserAndTokenizedProgram() {
 			}
 			currentSection = tokenTypeToSection[tok.Type]
 			IsPrivate = false
+			access = nil
 			lastTokenWasColon = false
 			colonMeansFunctionOrCommand = (currentSection == CmdSection || currentSection == DefSection)
 			continue
@@ -359,6 +387,9 @@ func (iz *initializer) MakeParserAndTokenizedProgram() {
 			if IsPrivate {
 				iz.Throw("init/private", &tok)
 			}
+			if access != nil {
+				iz.Throw("init/access/private", &tok)
+			}
 			IsPrivate = true
 			continue
 		}
@@ -392,6 +423,14 @@ func (iz *initializer) MakeParserAndTokenizedProgram() {
 				colonMeansFunctionOrCommand = (currentSection == CmdSection || currentSection == DefSection)
 				continue
 			}
+			if (currentSection == CmdSection || currentSection == DefSection) && iz.isAccessDeclaration(line) {
+				if IsPrivate {
+					iz.Throw("init/access/private", &tok)
+				}
+				access = iz.getAccessDeclaration(line)
+				line = token.NewCodeChunk()
+				continue
+			}
 			switch currentSection {
 			case ImportSection:
 				iz.addTokenizedDeclaration(importDeclaration, line, IsPrivate)
@@ -404,6 +443,7 @@ func (iz *initializer) MakeParserAndTokenizedProgram() {
 				if line.Length() == 1 && line.NextToken().Type == token.GOCODE {
 					iz.addTokenizedDeclaration(golangDeclaration, line, IsPrivate)
 				} else {
+					line.Access = access
 					iz.addTokenizedDeclaration(commandDeclaration, line, IsPrivate)
 				}
 			case DefSection:
@@ -411,6 +451,7 @@ func (iz *initializer) MakeParserAndTokenizedProgram() {
 				if line.Length() == 1 && line.NextToken().Type == token.GOCODE {
 					iz.addTokenizedDeclaration(golangDeclaration, line, IsPrivate)
 				} else {
+					line.Access = access
 					iz.addTokenizedDeclaration(functionDeclaration, line, IsPrivate)
 				}
 			case VarSection, ConstSection:
@@ -458,7 +499,7 @@ func (iz *initializer) MakeParserAndTokenizedProgram() {
 
 		lastTokenWasColon = (tok.Type == token.COLON)
 
-		if (lastTokenWasColon || tok.Type == token.PIPE) && colonMeansFunctionOrCommand { // If we found the first : in a command/function declaration, then what is to the left of the colon is the command/function's signature.
+		if (lastTokenWasColon || tok.Type == token.PIPE) && colonMeansFunctionOrCommand && !iz.isAccessDeclaration(line) { // If we found the first : in a command/function declaration, then what is to the left of the colon is the command/function's signature.
 			colonMeansFunctionOrCommand = false
 			iz.addWordsToParser(line)
 		}
@@ -468,7 +509,40 @@ func (iz *initializer) MakeParserAndTokenizedProgram() {
 	iz.p.Common.Errors = err.MergeErrors(iz.p.TokenizedCode.(*lexer.Relexer).GetErrors(), iz.p.Common.Errors)
 }
 
-// Function auxiliary to the above and to `createInterfaceTypes“. This extracts the words from a function definition
+// Functions auxiliary to the above. In the `cmd` and `def` sections, a line such as `for Admins, Editors`
+// says that the commands or functions declared after it, up to the end of the section or the next such
+// line, may only be called from outside the service by users in those groups. (See permissions.go in
+// the compiler.)
+func (iz *initializer) isAccessDeclaration(line *token.TokenizedCodeChunk) bool {
+	if line.Length() == 0 {
+		return false
+	}
+	line.ToStart()
+	return line.NextToken().Type == token.FOR
+}
+
+// Returns the groups named by the line, which should be `for` followed by a list of them.
+func (iz *initializer) getAccessDeclaration(line *token.TokenizedCodeChunk) []string {
+	line.ToStart()
+	forTok := line.NextToken()
+	groups := []string{}
+	for i := 1; i < line.Length(); i++ {
+		tok := line.NextToken()
+		if i%2 == 1 && tok.Type != token.IDENT || i%2 == 0 && tok.Type != token.COMMA {
+			iz.Throw("init/access/form", &tok)
+			return groups
+		}
+		if tok.Type == token.IDENT {
+			groups = append(groups, tok.Literal)
+		}
+	}
+	if len(groups) == 0 || line.Length()%2 == 1 {
+		iz.Throw("init/access/form", &forTok)
+	}
+	return groups
+}
+
+// Function auxiliary to `MakeParserAndTokenizedProgram` and to `createInterfaceTypes“. This extracts the words from a function definition
 // and decides on their "grammatical" role: are they prefixes, suffixes, bling?
 func (iz *initializer) addWordsToParser(currentChunk *token.TokenizedCodeChunk) {
 	inParenthesis := false
@@ -576,6 +650,13 @@ func (iz *initializer) ParseNamespacedImportsAndReturnUnnamespacedImports() []st
 		default:
 			namespace, scriptFilepath = iz.getPartsOfImportOrExternalDeclaration(imp)
 		}
+		if strings.HasSuffix(scriptFilepath, ".sql") { // Then it's the schema of a database rather than a module.
+			if _, ok := imp.(*ast.StringLiteral); ok {
+				namespace = "" // ... since a schema imported without a name is for the service's own database.
+			}
+			iz.importSqlSchema(imp.GetToken(), namespace, scriptFilepath)
+			continue
+		}
 		if namespace == "" {
 			unnamespacedImports = append(unnamespacedImports, scriptFilepath)
 		}
@@ -597,6 +678,18 @@ func (iz *initializer) ParseNamespacedImportsAndReturnUnnamespacedImports() []st
 	return unnamespacedImports
 }
 
+// Imports the schema of one of the service's databases, so that the compiler can check the SQL
+// snippets which go to it.
+func (iz *initializer) importSqlSchema(tok *token.Token, database, schemaFilepath string) {
+	sourcecode, e := compiler.GetSourceCode(schemaFilepath)
+	if e != nil {
+		iz.Throw("init/import/file", tok, schemaFilepath, e)
+		return
+	}
+	iz.p.Common.Sources[schemaFilepath] = strings.Split(sourcecode, "\n")
+	iz.cp.AddSqlSchema(database, schemaFilepath, sourcecode)
+}
+
 // Phase 1D of compilation. We add the external services, initializing them if necessary.
 //
 // There are three possibilities. Either we have a namespace without a path, in which case we're looking for
@@ -616,16 +709,30 @@ func (iz *initializer) ParseNamespacedImportsAndReturnUnnamespacedImports() []st
 func (iz *initializer) initializeExternals() {
 	for _, declaration := range iz.ParsedDeclarations[externalDeclaration] {
 		name, path := iz.getPartsOfImportOrExternalDeclaration(declaration)
+		if stubFilepath, ok := iz.Common.Stubs[name]; ok {
+			iz.addStub(stubFilepath, name, declaration.GetToken())
+			continue
+		}
 		if path == "" { // Then this will work only if there's already an instance of a service of that name running on the hub.
 			externalCP, ok := iz.cp.Vm.HubServices[name]
 			if !ok {
 				iz.Throw("init/external/exist/a", declaration.GetToken())
 				continue
 			}
-			iz.addExternalOnSameHub(externalCP.ScriptFilepath, name)
+			iz.addExternalOnSameHub(externalCP.ScriptFilepath, name, declaration.GetToken())
 			continue
 		}
 		if len(path) >= 5 && path[0:5] == "http:" {
+			options := p2p.DefaultOptions
+			if pos := strings.Index(path, "?"); pos != -1 {
+				var e error
+				options, e = p2p.ParseOptions(path[pos+1:])
+				if e != nil {
+					iz.Throw("init/external/options", declaration.GetToken(), e.Error())
+					continue
+				}
+				path = path[0:pos]
+			}
 			pos := strings.LastIndex(path, "/")
 			if pos == -1 {
 				iz.Throw("init/external/path/a", declaration.GetToken())
@@ -647,7 +754,7 @@ func (iz *initializer) initializeExternals() {
 			rline.SetPrompt("Password: ")
 			rline.PasswordMask = '▪'
 			password, _ := rline.Readline()
-			iz.addHttpService(hostpath, serviceName, username, password)
+			iz.addHttpService(hostpath, serviceName, username, password, options, declaration.GetToken())
 			continue
 		}
 
@@ -657,7 +764,7 @@ func (iz *initializer) initializeExternals() {
 			if hubServiceCp.ScriptFilepath != path {
 				iz.Throw("init/external/exist/b", declaration.GetToken(), hubServiceCp.ScriptFilepath)
 			} else {
-				iz.addExternalOnSameHub(path, name)
+				iz.addExternalOnSameHub(path, name, declaration.GetToken())
 			}
 			continue // Either we've thrown an error or we don't need to do anything.
 		}
@@ -670,27 +777,61 @@ func (iz *initializer) initializeExternals() {
 			newServiceCp.P.Common.IsBroken = true
 		}
 		iz.cp.Vm.HubServices[name] = newServiceCp
-		iz.addExternalOnSameHub(path, name)
+		iz.addExternalOnSameHub(path, name, declaration.GetToken())
 	}
 }
 
 // Functions auxiliary to the above.
-func (iz *initializer) addExternalOnSameHub(path, name string) {
+
+func (iz *initializer) addExternalOnSameHub(path, name string, tok *token.Token) {
 	hubService := iz.cp.Vm.HubServices[name]
-	serviceToAdd := compiler.ExternalCallToHubHandler{hubService}
-	iz.addAnyExternalService(serviceToAdd, path, name)
+	serviceToAdd := compiler.NewExternalCallToHubHandler(hubService, name+"."+iz.p.NamespacePath)
+	iz.addAnyExternalService(serviceToAdd, path, name, tok)
 }
 
-func (iz *initializer) addHttpService(path, name, username, password string) {
-	serviceToAdd := compiler.ExternalHttpCallHandler{path, name, username, password}
-	iz.addAnyExternalService(serviceToAdd, path, name)
+// A stub is started as a service of its own, but isn't put on the hub, since the real external
+// service may be running there. If the API of the real service was saved alongside the stub, the
+// stub presents that instead of its own. (See `SerializedAPIToStub`.)
+func (iz *initializer) addStub(stubFilepath, name string, tok *token.Token) {
+	stubCp, e := StartCompilerFromFilepath(stubFilepath, iz.cp.Vm.Database, iz.cp.Vm.HubServices)
+	if e != nil {
+		iz.Throw("init/external/source", tok, stubFilepath)
+		return
+	}
+	if len(stubCp.P.Common.Errors) > 0 {
+		iz.Throw("init/external/stub", tok, name, stubFilepath)
+		return
+	}
+	api, e := os.ReadFile(StubAPIFilepath(stubFilepath))
+	if e != nil && !os.IsNotExist(e) {
+		iz.Throw("init/external/source", tok, StubAPIFilepath(stubFilepath))
+		return
+	}
+	serviceToAdd := compiler.NewExternalStubHandler(stubCp, name+"."+iz.p.NamespacePath, string(api))
+	iz.addAnyExternalService(serviceToAdd, stubFilepath, name, tok)
+}
+
+// Where the serialized API of the real service is kept alongside the stub of it in the given file.
+func StubAPIFilepath(stubFilepath string) string {
+	return strings.TrimSuffix(stubFilepath, filepath.Ext(stubFilepath)) + ".api"
 }
 
-func (iz *initializer) addAnyExternalService(handlerForService compiler.ExternalCallHandler, path, name string) {
+func (iz *initializer) addHttpService(path, name, username, password string, options p2p.Options, tok *token.Token) {
+	serviceToAdd := compiler.ExternalHttpCallHandler{Host: path, Service: name, Namespace: name + "." + iz.p.NamespacePath,
+		Session: p2p.NewSessionWithOptions(path, username, password, options)}
+	iz.addAnyExternalService(serviceToAdd, path, name, tok)
+}
+
+func (iz *initializer) addAnyExternalService(handlerForService compiler.ExternalCallHandler, path, name string, tok *token.Token) {
+	serializedAPI, e := handlerForService.GetAPI()
+	if e != nil {
+		iz.Throw("init/external/api", tok, name, e.Error())
+		return
+	}
 	externalServiceOrdinal := uint32(len(iz.cp.Vm.ExternalCallHandlers))
 	iz.cp.CallHandlerNumbersByName[name] = externalServiceOrdinal
 	iz.cp.Vm.ExternalCallHandlers = append(iz.cp.Vm.ExternalCallHandlers, handlerForService)
-	serializedAPI := handlerForService.GetAPI()
+	iz.cp.Vm.ExternalServiceNames = append(iz.cp.Vm.ExternalServiceNames, name)
 	sourcecode := SerializedAPIToDeclarations(serializedAPI, externalServiceOrdinal) // This supplies us with a stub that know how to call the external servie.
 	newIz := NewInitializer()
 	newIz.Common = iz.Common
@@ -750,7 +891,7 @@ func (iz *initializer) createEnums() {
 			}
 			tok = tokens.NextToken()
 		}
-		iz.cp.Vm.ConcreteTypeInfo = append(iz.cp.Vm.ConcreteTypeInfo, compiler.EnumType{Name: tok1.Literal, Path: iz.p.NamespacePath, ElementNames: elementNameList, Private: iz.IsPrivate(int(enumDeclaration), i)})
+		iz.cp.Vm.ConcreteTypeInfo = append(iz.cp.Vm.ConcreteTypeInfo, compiler.EnumType{Name: tok1.Literal, Path: iz.p.NamespacePath, ElementNames: elementNameList, Private: iz.IsPrivate(int(enumDeclaration), i), IsMI: settings.MandatoryImportSet().Contains(tok1.Source)})
 	}
 }
 
@@ -781,7 +922,7 @@ func (iz *initializer) createClones() {
 		} else {
 			typeNo = values.ValueType(len(iz.cp.Vm.ConcreteTypeInfo))
 			iz.setDeclaration(decCLONE, &tok1, DUMMY, typeNo)
-			iz.cp.Vm.ConcreteTypeInfo = append(iz.cp.Vm.ConcreteTypeInfo, compiler.CloneType{Name: name, Path: iz.p.NamespacePath, Parent: parentTypeNo, Private: iz.IsPrivate(int(cloneDeclaration), i)})
+			iz.cp.Vm.ConcreteTypeInfo = append(iz.cp.Vm.ConcreteTypeInfo, compiler.CloneType{Name: name, Path: iz.p.NamespacePath, Parent: parentTypeNo, Private: iz.IsPrivate(int(cloneDeclaration), i), IsMI: settings.MandatoryImportSet().Contains(tok1.Source)})
 			if parentTypeNo == values.LIST || parentTypeNo == values.STRING || parentTypeNo == values.SET || parentTypeNo == values.MAP {
 				iz.cp.Vm.IsRangeable = iz.cp.Vm.IsRangeable.Union(altType(typeNo))
 			}
@@ -993,6 +1134,12 @@ func (iz *initializer) addConstructorsToParserAndParseStructDeclarations() {
 		iz.TokenizedDeclarations[structDeclaration][chunk].NextToken() // We skip the = sign.
 		iz.p.AllFunctionIdents.Add(tok1.Literal)
 		iz.p.Functions.Add(tok1.Literal)
+		// So that the fields of one struct can have the type of another. The types are filled in
+		// by `createStructNamesAndLabels`.
+		if !iz.p.TypeExists(tok1.Literal) {
+			iz.p.TypeMap[tok1.Literal] = values.MakeAbstractType()
+			iz.p.TypeMap[tok1.Literal+"?"] = values.MakeAbstractType(values.NULL)
+		}
 	}
 	// Now we can parse them.
 	for chunk := 0; chunk < len(iz.TokenizedDeclarations[structDeclaration]); chunk++ {
@@ -1050,7 +1197,7 @@ func (iz *initializer) createStructNamesAndLabels() {
 				}
 			}
 			iz.structDeclarationNumberToTypeNumber[i] = values.ValueType(len(iz.cp.Vm.ConcreteTypeInfo))
-			stT := compiler.StructType{Name: name, Path: iz.p.NamespacePath, LabelNumbers: labelsForStruct, Private: iz.IsPrivate(int(structDeclaration), i)}
+			stT := compiler.StructType{Name: name, Path: iz.p.NamespacePath, LabelNumbers: labelsForStruct, Private: iz.IsPrivate(int(structDeclaration), i), IsMI: settings.MandatoryImportSet().Contains(node.GetToken().Source)}
 			stT = stT.AddLabels(labelsForStruct)
 			iz.cp.Vm.ConcreteTypeInfo = append(iz.cp.Vm.ConcreteTypeInfo, stT)
 		}
@@ -1203,6 +1350,8 @@ func (iz *initializer) addFieldsToStructs() {
 		structInfo.AlternateStructFields = typesForStruct // TODO --- even assuming we want this data duplicated, the AlternateType can't possibly be needed  at runtime and presumably belongs in a Common compiler bindle.
 		structInfo.AbstractStructFields = typesForStructForVm
 		iz.cp.Vm.ConcreteTypeInfo[structNumber] = structInfo
+		// The signature of the constructor may refer to structs which hadn't been created when it was made.
+		iz.fnIndex[fnSource{structDeclaration, i}].Sig = iz.p.MakeAbstractSigFromStringSig(sig)
 	}
 }
 
@@ -1224,7 +1373,7 @@ func (iz *initializer) createSnippetTypesPart2() {
 			iz.cp.Vm.ConcreteTypeInfo[typeNo] = typeInfo
 		} else {
 			iz.setDeclaration(decSTRUCT, &decTok, DUMMY, structInfo{typeNo, iz.IsPrivate(int(snippetDeclaration), i)})
-			iz.cp.Vm.ConcreteTypeInfo = append(iz.cp.Vm.ConcreteTypeInfo, compiler.StructType{Name: name, Path: iz.p.NamespacePath, Snippet: true, Private: iz.IsPrivate(int(snippetDeclaration), i), AbstractStructFields: abTypes, AlternateStructFields: altTypes})
+			iz.cp.Vm.ConcreteTypeInfo = append(iz.cp.Vm.ConcreteTypeInfo, compiler.StructType{Name: name, Path: iz.p.NamespacePath, Snippet: true, Private: iz.IsPrivate(int(snippetDeclaration), i), AbstractStructFields: abTypes, AlternateStructFields: altTypes, IsMI: settings.MandatoryImportSet().Contains(decTok.Source)})
 			iz.addStructLabelsToVm(name, typeNo, sig, &decTok)
 			iz.cp.Vm.CodeGeneratingTypes.Add(typeNo)
 		}
@@ -1302,7 +1451,7 @@ func (iz *initializer) parseEverythingElse() {
 		for chunk := 0; chunk < len(iz.TokenizedDeclarations[declarations]); chunk++ {
 			iz.p.TokenizedCode = iz.TokenizedDeclarations[declarations][chunk]
 			iz.TokenizedDeclarations[declarations][chunk].ToStart()
-			iz.ParsedDeclarations[declarations] = append(iz.ParsedDeclarations[declarations], iz.p.ParseTokenizedChunk())
+			iz.ParsedDeclarations[declarations] = append(iz.ParsedDeclarations[declarations], iz.p.ParseTokenizedDeclaration(declarations == commandDeclaration))
 		}
 	}
 
@@ -1415,7 +1564,7 @@ func (iz *initializer) makeFunctionTable() {
 				return
 			}
 			functionToAdd := &ast.PrsrFunction{FName: functionName, Sig: iz.p.MakeAbstractSigFromStringSig(sig), NameSig: sig, Position: position, NameRets: rTypes, RtnSig: iz.p.MakeAbstractSigFromStringSig(rTypes), Body: body, Given: given,
-				Cmd: j == commandDeclaration, Private: iz.IsPrivate(int(j), i), Number: DUMMY, Compiler: iz.cp, Tok: body.GetToken()}
+				Cmd: j == commandDeclaration, Private: iz.IsPrivate(int(j), i), Access: iz.accessOf(int(j), i), Number: DUMMY, Compiler: iz.cp, Tok: body.GetToken()}
 			iz.fnIndex[fnSource{j, i}] = functionToAdd
 			if iz.shareable(functionToAdd) || settings.MandatoryImportSet().Contains(tok.Source) {
 				iz.cmI("Adding " + functionName + " to Common functions.")
@@ -1627,10 +1776,11 @@ func (iz *initializer) addSigToTree(tree *ast.FnTreeNode, fn *ast.PrsrFunction,
 	sig := fn.Sig
 	nameSig := fn.NameSig
 	if pos < len(sig) {
-		var currentTypeName string
+		var currentTypeName, bling string
 		currentAbstractType := sig[pos].VarType
 		if nameSig[pos].VarType == "bling" {
 			currentTypeName = nameSig[pos].VarName
+			bling = nameSig[pos].VarName
 		} else {
 			currentTypeName = nameSig[pos].VarType
 		}
@@ -1640,16 +1790,16 @@ func (iz *initializer) addSigToTree(tree *ast.FnTreeNode, fn *ast.PrsrFunction,
 		}
 		isPresent := false
 		for _, v := range tree.Branch {
-			if currentAbstractType.Equals(v.Type) {
+			if currentAbstractType.Equals(v.Type) && v.Bling == bling {
 				isPresent = true
 				break
 			}
 		}
 		if !isPresent {
-			tree.Branch = append(tree.Branch, &ast.TypeNodePair{Type: currentAbstractType, IsVararg: isVararg, Node: &ast.FnTreeNode{Fn: nil, Branch: []*ast.TypeNodePair{}}})
+			tree.Branch = append(tree.Branch, &ast.TypeNodePair{Type: currentAbstractType, IsVararg: isVararg, Bling: bling, Node: &ast.FnTreeNode{Fn: nil, Branch: []*ast.TypeNodePair{}}})
 		}
 		for _, branch := range tree.Branch {
-			if branch.Type.IsSubtypeOf(currentAbstractType) {
+			if branch.Type.IsSubtypeOf(currentAbstractType) && branch.Bling == bling {
 				branch.Node = iz.addSigToTree(branch.Node, fn, pos+1)
 				if currentTypeName == "tuple" && !(branch.Type.Contains(values.TUPLE)) {
 					iz.addSigToTree(branch.Node, fn, pos)
@@ -1845,9 +1995,9 @@ func (iz *initializer) CompileEverything() [][]labeledParsedCodeChunk {
 		for _, dec := range groupOfDeclarations {
 			switch dec.decType {
 			case functionDeclaration:
-				iz.compileFunction(iz.ParsedDeclarations[functionDeclaration][dec.decNumber], iz.IsPrivate(int(dec.decType), dec.decNumber), iz.cp.GlobalConsts, functionDeclaration)
+				iz.compileFunction(iz.ParsedDeclarations[functionDeclaration][dec.decNumber], iz.IsPrivate(int(dec.decType), dec.decNumber), iz.accessOf(int(dec.decType), dec.decNumber), iz.cp.GlobalConsts, functionDeclaration)
 			case commandDeclaration:
-				iz.compileFunction(iz.ParsedDeclarations[commandDeclaration][dec.decNumber], iz.IsPrivate(int(dec.decType), dec.decNumber), iz.cp.GlobalVars, commandDeclaration)
+				iz.compileFunction(iz.ParsedDeclarations[commandDeclaration][dec.decNumber], iz.IsPrivate(int(dec.decType), dec.decNumber), iz.accessOf(int(dec.decType), dec.decNumber), iz.cp.GlobalVars, commandDeclaration)
 			}
 			iz.fnIndex[fnSource{dec.decType, dec.decNumber}].Number = uint32(len(iz.cp.Fns) - 1) // TODO --- is this necessary given the line a little above which seems to do this pre-emptively?
 		}
@@ -1861,6 +2011,10 @@ func (iz *initializer) CompileEverything() [][]labeledParsedCodeChunk {
 			iz.cp.Vm.Code[addr+2].Args[1] = iz.cp.Fns[funcNumber].OutReg
 		}
 	}
+	iz.cmI("Checking the permissions.")
+	iz.cp.CheckPermissions()
+	iz.cmI("Checking SQL snippets against the schemas.")
+	iz.cp.CheckSqlSnippets()
 	iz.cmI("Calling 'init' if it exists.")
 	iz.cp.CallIfExists("init")
 	return result
@@ -1966,7 +2120,7 @@ func (iz *initializer) getEnvAndAccessForConstOrVarDeclaration(dT declarationTyp
 }
 
 // Method for compiling a top-level function.
-func (iz *initializer) compileFunction(node ast.Node, private bool, outerEnv *compiler.Environment, dec declarationType) *compiler.CpFunc {
+func (iz *initializer) compileFunction(node ast.Node, private bool, access []string, outerEnv *compiler.Environment, dec declarationType) *compiler.CpFunc {
 	if info, functionExists := iz.getDeclaration(decFUNCTION, node.GetToken(), DUMMY); functionExists {
 		iz.cp.Fns = append(iz.cp.Fns, info.(*compiler.CpFunc))
 		return info.(*compiler.CpFunc)
@@ -1980,6 +2134,7 @@ func (iz *initializer) compileFunction(node ast.Node, private bool, outerEnv *co
 		cpF.Command = true
 	}
 	cpF.Private = private
+	cpF.Access = access
 	functionName, _, sig, rtnSig, body, given := iz.p.ExtractPartsOfFunction(node)
 	iz.cp.Cm("Compiling function '"+functionName+"' with sig "+sig.String()+".", body.GetToken())
 
@@ -1999,6 +2154,8 @@ func (iz *initializer) compileFunction(node ast.Node, private bool, outerEnv *co
 	}
 	fnenv := compiler.NewEnvironment()
 	fnenv.Ext = outerEnv
+	cpF.Name = functionName
+	cpF.Env = fnenv
 	cpF.LoReg = iz.cp.MemTop()
 	for _, pair := range sig {
 		iz.cp.Reserve(values.UNDEFINED_TYPE, DUMMY, node.GetToken())
@@ -2064,16 +2221,18 @@ func (iz *initializer) compileFunction(node ast.Node, private bool, outerEnv *co
 	case token.GOCODE:
 		cpF.GoNumber = uint32(len(iz.cp.Vm.GoFns))
 		cpF.HasGo = true
-		iz.cp.Vm.GoFns = append(iz.cp.Vm.GoFns, compiler.GoFn{Code: body.(*ast.GolangExpression).GoFunction})
+		iz.cp.Vm.GoFns = append(iz.cp.Vm.GoFns, compiler.GoFn{Code: body.(*ast.GolangExpression).GoFunction,
+			Source: body.GetToken().Source, Symbol: text.Capitalize(functionName)})
 	case token.XCALL:
 	default:
 		logFlavor := compiler.LF_NONE
 		if iz.cp.GetLoggingScope() == 2 {
 			logFlavor = compiler.LF_TRACK
 		}
+		cpF.CodeStart = iz.cp.CodeTop()
 		if given != nil {
 			iz.cp.ThunkList = []compiler.ThunkData{}
-			givenContext := compiler.Context{fnenv, functionName, compiler.DEF, false, nil, cpF.LoReg, logFlavor}
+			givenContext := compiler.Context{fnenv, functionName, compiler.DEF, false, nil, cpF.LoReg, logFlavor, nil}
 			iz.cp.CompileGivenBlock(given, givenContext)
 			cpF.CallTo = iz.cp.CodeTop()
 			if len(iz.cp.ThunkList) > 0 {
@@ -2091,7 +2250,7 @@ func (iz *initializer) compileFunction(node ast.Node, private bool, outerEnv *co
 		}
 
 		// Now the main body of the function, just as a lagniappe.
-		bodyContext := compiler.Context{fnenv, functionName, ac, true, iz.cp.ReturnSigToAlternateType(rtnSig), cpF.LoReg, logFlavor}
+		bodyContext := compiler.Context{fnenv, functionName, ac, true, iz.cp.ReturnSigToAlternateType(rtnSig), cpF.LoReg, logFlavor, nil}
 		cpF.RtnTypes, _ = iz.cp.CompileNode(body, bodyContext) // TODO --- could we in fact do anything useful if we knew it was a constant?
 		cpF.OutReg = iz.cp.That()
 
@@ -2100,6 +2259,7 @@ func (iz *initializer) compileFunction(node ast.Node, private bool, outerEnv *co
 		}
 
 		iz.cp.Emit(compiler.Ret)
+		cpF.CodeEnd = iz.cp.CodeTop()
 	}
 	iz.cp.Fns = append(iz.cp.Fns, &cpF)
 	if ac == compiler.DEF && !cpF.RtnTypes.IsLegalDefReturn() {
@@ -2159,7 +2319,8 @@ func (iz *initializer) AddType(name, supertype string, typeNo values.ValueType)
 func (iz *initializer) AddTypeToVm(typeInfo values.AbstractTypeInfo) {
 	for i, existingTypeInfo := range iz.cp.Vm.AbstractTypes {
 		if typeInfo.Name == existingTypeInfo.Name {
-			if typeInfo.Path == existingTypeInfo.Path {
+			if typeInfo.Path == existingTypeInfo.Path { // Then we're updating it, e.g. an interface which has now been populated.
+				iz.cp.Vm.AbstractTypes[i] = typeInfo
 				return
 			}
 			if strings.Count(typeInfo.Path, ".") < strings.Count(existingTypeInfo.Path, ".") {
@@ -2183,6 +2344,10 @@ func (i initializer) IsPrivate(x, y int) bool {
 	return i.TokenizedDeclarations[x][y].Private
 }
 
+func (i initializer) accessOf(x, y int) []string {
+	return i.TokenizedDeclarations[x][y].Access
+}
+
 // For indexing the functions in the common function map, to prevent duplication.
 type FuncSource struct {
 	Filename     string
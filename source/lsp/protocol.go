@@ -0,0 +1,182 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// This file contains the wire format of the Language Server Protocol: JSON-RPC 2.0 messages,
+// each preceded by a `Content-Length` header, plus the handful of LSP structures we actually use.
+// We only implement the subset of the protocol that the server in `server.go` needs.
+
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  any              `json:"result"`
+	Error   *responseError   `json:"error,omitempty"`
+}
+
+type notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC error codes.
+const (
+	METHOD_NOT_FOUND = -32601
+	INVALID_PARAMS   = -32602
+)
+
+// Reads one message from the client.
+func readMessage(r *bufio.Reader) (*message, error) {
+	header, e := textproto.NewReader(r).ReadMIMEHeader()
+	if e != nil {
+		return nil, e
+	}
+	length, e := strconv.Atoi(strings.TrimSpace(header.Get("Content-Length")))
+	if e != nil {
+		return nil, errors.New("missing or malformed Content-Length header")
+	}
+	body := make([]byte, length)
+	if _, e := io.ReadFull(r, body); e != nil {
+		return nil, e
+	}
+	var msg message
+	if e := json.Unmarshal(body, &msg); e != nil {
+		return nil, e
+	}
+	return &msg, nil
+}
+
+// Writes one message to the client.
+func writeMessage(w io.Writer, v any) error {
+	body, e := json.Marshal(v)
+	if e != nil {
+		return e
+	}
+	if _, e := io.WriteString(w, "Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"); e != nil {
+		return e
+	}
+	_, e = w.Write(body)
+	return e
+}
+
+// The LSP structures. Note that LSP lines and characters are zero-based, whereas Pipefish
+// lines are one-based and its characters zero-based.
+
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+type location struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type textDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type textDocumentItem struct {
+	URI     string `json:"uri"`
+	Version int    `json:"version"`
+	Text    string `json:"text"`
+}
+
+type didOpenParams struct {
+	TextDocument textDocumentItem `json:"textDocument"`
+}
+
+type didChangeParams struct {
+	TextDocument   textDocumentItem `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type didSaveParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+	Text         *string                `json:"text,omitempty"`
+}
+
+type didCloseParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+}
+
+type textDocumentPositionParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+	Position     position               `json:"position"`
+}
+
+type diagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type publishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+type markupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type hover struct {
+	Contents markupContent `json:"contents"`
+}
+
+type completionItem struct {
+	Label      string    `json:"label"`
+	Kind       int       `json:"kind"`
+	Detail     string    `json:"detail,omitempty"`
+	FilterText string    `json:"filterText,omitempty"`
+	TextEdit   *textEdit `json:"textEdit,omitempty"`
+}
+
+type textEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+// LSP constants.
+const (
+	SEVERITY_ERROR = 1
+
+	TEXT_DOCUMENT_SYNC_FULL = 1
+
+	COMPLETION_FUNCTION    = 3
+	COMPLETION_FIELD       = 5
+	COMPLETION_VARIABLE    = 6
+	COMPLETION_KEYWORD     = 14
+	COMPLETION_ENUM_MEMBER = 20
+	COMPLETION_STRUCT      = 22
+)
@@ -0,0 +1,178 @@
+package lsp
+
+// A Language Server Protocol server for Pipefish, started by `pipefish lsp`. It talks JSON-RPC
+// over stdin and stdout. Every time a document is opened, changed or saved we run the initializer
+// over it and publish its errors as diagnostics; and we use the parser's function tables and the
+// compiler's type information to answer hover, go-to-definition, find-references and completion
+// requests.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+type server struct {
+	out  io.Writer
+	docs map[string]*document
+}
+
+// Serves LSP requests from `in` until the client sends `exit` or closes the stream.
+func Serve(in io.Reader, out io.Writer) error {
+	s := &server{out: out, docs: map[string]*document{}}
+	r := bufio.NewReader(in)
+	for {
+		msg, e := readMessage(r)
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		if e := s.handle(msg); e != nil {
+			return e
+		}
+	}
+}
+
+func (s *server) handle(msg *message) error {
+	switch msg.Method {
+	case "initialize":
+		return s.reply(msg, map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":   TEXT_DOCUMENT_SYNC_FULL,
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"referencesProvider": true,
+				"completionProvider": map[string]any{"triggerCharacters": []string{".", " "}},
+			},
+			"serverInfo": map[string]any{"name": "pipefish"},
+		})
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil
+	case "shutdown":
+		return s.reply(msg, nil)
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if e := json.Unmarshal(msg.Params, &params); e != nil {
+			return s.replyError(msg, INVALID_PARAMS, e.Error())
+		}
+		doc := newDocument(params.TextDocument.URI, params.TextDocument.Text)
+		s.docs[doc.uri] = doc
+		return s.update(doc)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if e := json.Unmarshal(msg.Params, &params); e != nil {
+			return s.replyError(msg, INVALID_PARAMS, e.Error())
+		}
+		doc := s.document(params.TextDocument.URI)
+		if len(params.ContentChanges) > 0 {
+			doc.text = params.ContentChanges[len(params.ContentChanges)-1].Text // Since we ask for full synchronization, the last change is the whole text.
+		}
+		return s.update(doc)
+	case "textDocument/didSave":
+		var params didSaveParams
+		if e := json.Unmarshal(msg.Params, &params); e != nil {
+			return s.replyError(msg, INVALID_PARAMS, e.Error())
+		}
+		doc := s.document(params.TextDocument.URI)
+		if params.Text != nil {
+			doc.text = *params.Text
+		}
+		return s.update(doc)
+	case "textDocument/didClose":
+		var params didCloseParams
+		if e := json.Unmarshal(msg.Params, &params); e != nil {
+			return s.replyError(msg, INVALID_PARAMS, e.Error())
+		}
+		delete(s.docs, params.TextDocument.URI)
+		return s.notify("textDocument/publishDiagnostics",
+			publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []diagnostic{}})
+	case "textDocument/hover":
+		doc, pos, ok := s.position(msg)
+		if !ok {
+			return s.replyError(msg, INVALID_PARAMS, "malformed position")
+		}
+		if description, ok := doc.hover(doc.wordAt(pos)); ok {
+			return s.reply(msg, hover{Contents: markupContent{Kind: "markdown", Value: description}})
+		}
+		return s.reply(msg, nil)
+	case "textDocument/definition":
+		doc, pos, ok := s.position(msg)
+		if !ok {
+			return s.replyError(msg, INVALID_PARAMS, "malformed position")
+		}
+		return s.reply(msg, nonNil(doc.definitions(doc.wordAt(pos))))
+	case "textDocument/references":
+		doc, pos, ok := s.position(msg)
+		if !ok {
+			return s.replyError(msg, INVALID_PARAMS, "malformed position")
+		}
+		return s.reply(msg, nonNil(doc.references(doc.wordAt(pos))))
+	case "textDocument/completion":
+		doc, pos, ok := s.position(msg)
+		if !ok {
+			return s.replyError(msg, INVALID_PARAMS, "malformed position")
+		}
+		return s.reply(msg, doc.completions(doc.prefixAt(pos)))
+	}
+	if msg.ID != nil {
+		return s.replyError(msg, METHOD_NOT_FOUND, "method not supported: "+msg.Method)
+	}
+	return nil // Notifications we don't understand are ignored, as the protocol requires.
+}
+
+// Gets the document with the given URI, creating it if the client has neglected to open it.
+func (s *server) document(uri string) *document {
+	doc, ok := s.docs[uri]
+	if !ok {
+		doc = newDocument(uri, "")
+		s.docs[uri] = doc
+	}
+	return doc
+}
+
+// Unpacks the parameters of a request which refers to a position in a document.
+func (s *server) position(msg *message) (*document, position, bool) {
+	var params textDocumentPositionParams
+	if e := json.Unmarshal(msg.Params, &params); e != nil {
+		return nil, position{}, false
+	}
+	return s.document(params.TextDocument.URI), params.Position, true
+}
+
+// Recompiles the document and tells the client about any errors.
+func (s *server) update(doc *document) error {
+	doc.compile()
+	return s.notify("textDocument/publishDiagnostics",
+		publishDiagnosticsParams{URI: doc.uri, Diagnostics: doc.diagnostics()})
+}
+
+func (s *server) reply(msg *message, result any) error {
+	if msg.ID == nil {
+		return nil
+	}
+	return writeMessage(s.out, response{JSONRPC: "2.0", ID: msg.ID, Result: result})
+}
+
+func (s *server) replyError(msg *message, code int, text string) error {
+	if msg.ID == nil {
+		return nil
+	}
+	return writeMessage(s.out, response{JSONRPC: "2.0", ID: msg.ID, Error: &responseError{Code: code, Message: text}})
+}
+
+func (s *server) notify(method string, params any) error {
+	return writeMessage(s.out, notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// The protocol wants an empty array rather than null when we've found nothing.
+func nonNil(locs []location) []location {
+	if locs == nil {
+		return []location{}
+	}
+	return locs
+}
@@ -0,0 +1,226 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A client which talks to the server over pipes, as an editor would over stdin and stdout.
+type testClient struct {
+	t      *testing.T
+	in     *io.PipeWriter
+	out    *bufio.Reader
+	nextId int
+	diags  map[string][]diagnostic // The latest diagnostics published for each document.
+}
+
+type testMessage struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+func newTestClient(t *testing.T) *testClient {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go func() {
+		Serve(inR, outW)
+		outW.Close()
+	}()
+	c := &testClient{t: t, in: inW, out: bufio.NewReader(outR), diags: map[string][]diagnostic{}}
+	t.Cleanup(func() { c.notify("exit", nil) })
+	c.request("initialize", map[string]any{})
+	c.notify("initialized", map[string]any{})
+	return c
+}
+
+func (c *testClient) send(v any) {
+	if e := writeMessage(c.in, v); e != nil {
+		c.t.Fatal(e)
+	}
+}
+
+func (c *testClient) read() testMessage {
+	header, e := textproto.NewReader(c.out).ReadMIMEHeader()
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	length, _ := strconv.Atoi(header.Get("Content-Length"))
+	body := make([]byte, length)
+	if _, e := io.ReadFull(c.out, body); e != nil {
+		c.t.Fatal(e)
+	}
+	var msg testMessage
+	if e := json.Unmarshal(body, &msg); e != nil {
+		c.t.Fatal(e)
+	}
+	if msg.Method == "textDocument/publishDiagnostics" {
+		var params publishDiagnosticsParams
+		if e := json.Unmarshal(msg.Params, &params); e != nil {
+			c.t.Fatal(e)
+		}
+		c.diags[params.URI] = params.Diagnostics
+	}
+	return msg
+}
+
+func (c *testClient) notify(method string, params any) {
+	c.send(notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// Sends a request and returns the result, skipping any notifications on the way.
+func (c *testClient) request(method string, params any) json.RawMessage {
+	c.nextId++
+	id := json.RawMessage(strconv.Itoa(c.nextId))
+	c.send(map[string]any{"jsonrpc": "2.0", "id": &id, "method": method, "params": params})
+	for {
+		msg := c.read()
+		if msg.ID != nil && *msg.ID == c.nextId {
+			if msg.Error != nil {
+				c.t.Fatalf("%s: %s", method, msg.Error.Message)
+			}
+			return msg.Result
+		}
+	}
+}
+
+func (c *testClient) open(uri, text string) {
+	c.notify("textDocument/didOpen", didOpenParams{TextDocument: textDocumentItem{URI: uri, Version: 1, Text: text}})
+	for {
+		if msg := c.read(); msg.Method == "textDocument/publishDiagnostics" {
+			return
+		}
+	}
+}
+
+func (c *testClient) at(method, uri string, line, character int, result any) {
+	raw := c.request(method, textDocumentPositionParams{TextDocument: textDocumentIdentifier{URI: uri}, Position: position{line, character}})
+	if e := json.Unmarshal(raw, result); e != nil {
+		c.t.Fatalf("%s: %v", method, e)
+	}
+}
+
+const lspTestCode = `newtype
+
+Color = enum RED, GREEN
+
+var
+
+twice = double 2
+
+def
+
+double(n int) :
+    n + n
+
+double(s string) :
+    s + s
+
+quadruple(n int) :
+    double double n
+
+// We shouldn't double count this, or "double" in a string.
+describe(c Color) :
+    c == RED : "double red"
+    else : "green"
+`
+
+const lspTestURI = "file:///lsp_test.pf"
+
+func TestLsp(t *testing.T) {
+	c := newTestClient(t)
+	c.open(lspTestURI, lspTestCode)
+	if len(c.diags[lspTestURI]) != 0 {
+		t.Errorf("wanted no diagnostics | got %v", c.diags[lspTestURI])
+	}
+	var locs []location
+	c.at("textDocument/definition", lspTestURI, 17, 5, &locs)
+	if got := describeLocations(locs); got != "10:0-6, 13:0-6" {
+		t.Errorf("definition of double: wanted both overloads | got %s", got)
+	}
+	c.at("textDocument/definition", lspTestURI, 21, 10, &locs)
+	if got := describeLocations(locs); got != "2:13-16" {
+		t.Errorf("definition of RED: wanted the enum | got %s", got)
+	}
+	c.at("textDocument/references", lspTestURI, 10, 1, &locs)
+	if got := describeLocations(locs); got != "10:0-6, 13:0-6, 17:4-10, 17:11-17, 6:8-14" {
+		t.Errorf("references to double: got %s", got)
+	}
+	var h hover
+	c.at("textDocument/hover", lspTestURI, 17, 5, &h)
+	for _, want := range []string{"def double (n int) -> int", "def double (s string) -> string"} {
+		if !strings.Contains(h.Contents.Value, want) {
+			t.Errorf("hover over double: wanted %q | got %q", want, h.Contents.Value)
+		}
+	}
+	c.at("textDocument/hover", lspTestURI, 20, 12, &h)
+	if !strings.Contains(h.Contents.Value, "Color = enum RED, GREEN") {
+		t.Errorf("hover over Color: got %q", h.Contents.Value)
+	}
+	var items []completionItem
+	c.at("textDocument/completion", lspTestURI, 17, 8, &items)
+	if got := describeCompletions(items); got != "double" {
+		t.Errorf("completion of 'doub': got %s", got)
+	}
+}
+
+// Checks that errors are published as diagnostics where they happen, and go away when fixed.
+func TestLspDiagnostics(t *testing.T) {
+	c := newTestClient(t)
+	c.open(lspTestURI, "def\n\nf(x int) :\n    zort x\n")
+	diags := c.diags[lspTestURI]
+	if len(diags) == 0 || diags[0].Severity != SEVERITY_ERROR || diags[0].Range.Start.Line != 3 || diags[0].Range.Start.Character != 4 {
+		t.Fatalf("wanted an error at 3:4 | got %v", diags)
+	}
+	change := didChangeParams{TextDocument: textDocumentItem{URI: lspTestURI, Version: 2}}
+	change.ContentChanges = append(change.ContentChanges, struct {
+		Text string `json:"text"`
+	}{"def\n\nf(x int) :\n    x\n"})
+	c.notify("textDocument/didChange", change)
+	for msg := c.read(); msg.Method != "textDocument/publishDiagnostics"; msg = c.read() {
+	}
+	if len(c.diags[lspTestURI]) != 0 {
+		t.Errorf("wanted no diagnostics | got %v", c.diags[lspTestURI])
+	}
+}
+
+// Checks that the verbs of the hub are completed whole, however many words they have.
+func TestLspHubCompletion(t *testing.T) {
+	c := newTestClient(t)
+	c.open(lspTestURI, "hub debug a")
+	var items []completionItem
+	c.at("textDocument/completion", lspTestURI, 0, 11, &items)
+	if got := describeCompletions(items); got != "debug at" {
+		t.Fatalf("wanted 'debug at' | got %s", got)
+	}
+	if edit := items[0].TextEdit; edit == nil || edit.Range != (lspRange{position{0, 4}, position{0, 11}}) || edit.NewText != "debug at" {
+		t.Errorf("wanted the completion to replace 'debug a' | got %v", edit)
+	}
+	c.at("textDocument/completion", lspTestURI, 0, 9, &items)
+	if got := describeCompletions(items); !strings.Contains(got, "debug resume") || !strings.Contains(got, "debug at") {
+		t.Errorf("wanted the debug verbs | got %s", got)
+	}
+}
+
+func describeLocations(locs []location) string {
+	result := []string{}
+	for _, loc := range locs {
+		result = append(result, strconv.Itoa(loc.Range.Start.Line)+":"+strconv.Itoa(loc.Range.Start.Character)+"-"+strconv.Itoa(loc.Range.End.Character))
+	}
+	return strings.Join(result, ", ")
+}
+
+func describeCompletions(items []completionItem) string {
+	result := []string{}
+	for _, item := range items {
+		result = append(result, item.Label)
+	}
+	return strings.Join(result, ", ")
+}
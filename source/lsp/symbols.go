@@ -0,0 +1,579 @@
+package lsp
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tim-hardcastle/Pipefish/source/ast"
+	"github.com/tim-hardcastle/Pipefish/source/compiler"
+	"github.com/tim-hardcastle/Pipefish/source/initializer"
+	"github.com/tim-hardcastle/Pipefish/source/lexer"
+	"github.com/tim-hardcastle/Pipefish/source/text"
+	"github.com/tim-hardcastle/Pipefish/source/token"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+)
+
+// An open buffer in the editor, together with the compiler we got from initializing it.
+type document struct {
+	uri      string
+	path     string
+	text     string
+	cp       *compiler.Compiler // The result of the latest initialization, broken or not.
+	lastGood *compiler.Compiler // The latest compiler that initialized without errors, which we use to answer queries while the user is halfway through typing something.
+	panicked string             // If the initializer panicked, the reason why.
+}
+
+func newDocument(uri, text string) *document {
+	return &document{uri: uri, path: uriToPath(uri), text: text}
+}
+
+// Runs the initializer on the contents of the buffer. The initializer is not guaranteed to
+// survive arbitrary half-typed code, so we recover from panics and report them as a diagnostic.
+func (d *document) compile() {
+	d.panicked = ""
+	defer func() {
+		if r := recover(); r != nil {
+			d.cp = nil
+			d.panicked = "the Pipefish initializer failed on this code"
+		}
+	}()
+	d.cp = initializer.StartCompiler(d.path, d.text+"\n", nil, map[string]*compiler.Compiler{})
+	if !d.cp.P.Common.IsBroken {
+		d.lastGood = d.cp
+	}
+}
+
+// The compiler to use to look things up in.
+func (d *document) symbols() *compiler.Compiler {
+	if d.cp != nil && !d.cp.P.Common.IsBroken {
+		return d.cp
+	}
+	return d.lastGood
+}
+
+// Turns the errors from the latest initialization into diagnostics. Errors in other files
+// (e.g. in a module the document imports) are attached to the top of the document so that the
+// user can see why the service is broken.
+func (d *document) diagnostics() []diagnostic {
+	result := []diagnostic{}
+	if d.panicked != "" {
+		return append(result, diagnostic{Severity: SEVERITY_ERROR, Source: "pipefish", Message: d.panicked})
+	}
+	if d.cp == nil {
+		return result
+	}
+	for _, e := range d.cp.P.Common.Errors {
+		diag := diagnostic{Severity: SEVERITY_ERROR, Code: e.ErrorId, Source: "pipefish", Message: e.Message}
+		if e.Token != nil && e.Token.Source == d.path {
+			diag.Range = tokenRange(e.Token)
+		} else if e.Token != nil && strings.HasPrefix(e.Token.Source, "rsc-pf/") {
+			continue // These are knock-on errors from the builtin modules and would tell the user nothing.
+		} else if e.Token != nil && e.Token.Source != "" {
+			diag.Message = diag.Message + " (at line " + strconv.Itoa(e.Token.Line) + " of '" + e.Token.Source + "')"
+		}
+		result = append(result, diag)
+	}
+	return result
+}
+
+// Converts the position of a token to an LSP range.
+func tokenRange(tok *token.Token) lspRange {
+	line := max(tok.Line-1, 0)
+	start := max(tok.ChStart, 0)
+	end := tok.ChEnd
+	if end <= start {
+		end = start + 1
+	}
+	return lspRange{Start: position{line, start}, End: position{line, end}}
+}
+
+// Finds the identifier under the cursor.
+func (d *document) wordAt(pos position) string {
+	lines := strings.Split(d.text, "\n")
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return ""
+	}
+	line := []rune(lines[pos.Line])
+	start := min(pos.Character, len(line))
+	end := start
+	for start > 0 && isIdentRune(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isIdentRune(line[end]) {
+		end++
+	}
+	return string(line[start:end])
+}
+
+// Finds what to complete to the left of the cursor. This is the partial identifier there; or, if the
+// line is a hub command, everything after 'hub', since the verbs of the hub may have more than one
+// word. We also return the range it occupies, which is what a completion should replace.
+func (d *document) prefixAt(pos position) (string, lspRange, bool) {
+	lines := strings.Split(d.text, "\n")
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return "", lspRange{pos, pos}, false
+	}
+	line := []rune(lines[pos.Line])
+	end := min(pos.Character, len(line))
+	start := end
+	for start > 0 && isIdentRune(line[start-1]) {
+		start--
+	}
+	if before := strings.Fields(string(line[:start])); len(before) > 0 && before[0] == "hub" {
+		verbStart := len(line) - len(strings.TrimLeftFunc(string(line), unicode.IsSpace)) + len("hub")
+		for verbStart < start && unicode.IsSpace(line[verbStart]) {
+			verbStart++
+		}
+		return string(line[verbStart:end]), lspRange{position{pos.Line, verbStart}, position{pos.Line, end}}, true
+	}
+	return string(line[start:end]), lspRange{position{pos.Line, start}, position{pos.Line, end}}, false
+}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '$'
+}
+
+// Finds the definitions of an identifier: first by looking for the functions in its overload tree,
+// and then by looking for a top-level declaration of a type, constant, variable, enum element or
+// struct field.
+func (d *document) definitions(word string) []location {
+	cp := d.symbols()
+	if cp == nil || word == "" {
+		return nil
+	}
+	result := []location{}
+	for _, fn := range overloads(cp, word) {
+		if loc, ok := d.functionLocation(cp, fn); ok {
+			result = append(result, loc)
+		}
+	}
+	if len(result) > 0 {
+		return result
+	}
+	for _, source := range d.sourceNames(cp) {
+		for _, l := range declarationLines(cp.P.Common.Sources[source], word) {
+			result = append(result, d.locationInSource(cp, source, l, word))
+		}
+	}
+	return result
+}
+
+// Finds the references to an identifier. If it's the name of a function of the service, we find
+// the declarations of its overloads and the calls to it in the parsed bodies of the functions and
+// commands, where a parameter or local variable of the same name won't be mistaken for it. Outside
+// of the def and cmd sections, where the code isn't kept parsed, we look for it as a token.
+func (d *document) references(word string) []location {
+	cp := d.symbols()
+	if cp == nil || word == "" {
+		return nil
+	}
+	result := []location{}
+	_, isFunction := cp.P.FunctionForest[word]
+	if isFunction {
+		for _, fn := range overloads(cp, word) {
+			if loc, ok := d.functionLocation(cp, fn); ok {
+				result = append(result, loc)
+			}
+		}
+		result = append(result, d.calls(cp, word)...)
+	}
+	for _, source := range d.sourceNames(cp) {
+		uri := d.sourceURI(source)
+		code := strings.Join(cp.P.Common.Sources[source], "\n")
+		if source == d.path {
+			code = d.text
+		}
+		lx := lexer.NewLexer(source, code+"\n")
+		section := token.TokenType(token.DEF)
+		for i := 0; i <= len(code); i++ { // The lexer consumes at least one character per token, so this is just a guard.
+			tok := lx.NextToken()
+			if tok.ChStart < 0 {
+				continue
+			}
+			if tok.Type == token.EOF {
+				break
+			}
+			switch tok.Type {
+			case token.CMD, token.CONST, token.DEF, token.EXTERN, token.IMPORT, token.NEWTYPE, token.VAR:
+				section = tok.Type
+			}
+			if isFunction && (section == token.DEF || section == token.CMD) {
+				continue
+			}
+			if tok.Type == token.IDENT && tok.Literal == word {
+				result = append(result, location{URI: uri, Range: tokenRange(&tok)})
+			}
+		}
+	}
+	return result
+}
+
+// Finds the calls to the function with the given name in the bodies and 'given' blocks of the
+// functions and commands of the service, i.e. the nodes which the compiler will resolve through
+// the function's overload tree.
+func (d *document) calls(cp *compiler.Compiler, name string) []location {
+	result := []location{}
+	sources := map[string]bool{}
+	for _, source := range d.sourceNames(cp) {
+		sources[source] = true
+	}
+	var walk func(node ast.Node)
+	walk = func(node ast.Node) {
+		if node == nil {
+			return
+		}
+		if operator, namespace, ok := functionCalled(node); ok && operator == name && len(namespace) == 0 {
+			if tok := node.GetToken(); sources[tok.Source] {
+				result = append(result, location{URI: d.sourceURI(tok.Source), Range: tokenRange(tok)})
+			}
+		}
+		for _, child := range node.Children() {
+			walk(child)
+		}
+	}
+	fnNames := make([]string, 0, len(cp.P.FunctionTable))
+	for fnName := range cp.P.FunctionTable {
+		fnNames = append(fnNames, fnName)
+	}
+	sort.Strings(fnNames)
+	for _, fnName := range fnNames {
+		for _, fn := range cp.P.FunctionTable[fnName] {
+			walk(fn.Body)
+			walk(fn.Given)
+		}
+	}
+	return result
+}
+
+// If the node is a call to a function, returns the name of the function and its namespace.
+func functionCalled(node ast.Node) (string, []string, bool) {
+	switch node := node.(type) {
+	case *ast.PrefixExpression:
+		return node.Operator, node.Namespace, true
+	case *ast.InfixExpression:
+		return node.Operator, node.Namespace, true
+	case *ast.SuffixExpression:
+		return node.Operator, node.Namespace, true
+	case *ast.UnfixExpression:
+		return node.Operator, node.Namespace, true
+	}
+	return "", nil, false
+}
+
+// Says what we know about the identifier: the signatures and inferred return types of a function,
+// the inferred type of a variable or constant, the definition of a type, etc.
+func (d *document) hover(word string) (string, bool) {
+	cp := d.symbols()
+	if cp == nil || word == "" {
+		return "", false
+	}
+	var lines []string
+	for _, fn := range overloads(cp, word) {
+		lines = append(lines, describeFunction(cp, word, fn))
+	}
+	if v, ok := cp.GlobalConsts.GetVar(word); ok {
+		lines = append(lines, "const "+word+" "+cp.Vm.DescribeTypeScheme(v.Types()))
+	}
+	if v, ok := cp.GlobalVars.GetVar(word); ok {
+		lines = append(lines, "var "+word+" "+cp.Vm.DescribeTypeScheme(v.Types()))
+	}
+	if el, ok := cp.EnumElements[word]; ok {
+		lines = append(lines, word+" "+cp.Vm.DescribeType(el.T, compiler.LITERAL))
+	}
+	if typeNo, ok := cp.GetConcreteType(word); ok {
+		lines = append(lines, describeType(cp, typeNo))
+	} else if abType, ok := cp.P.TypeMap[word]; ok {
+		lines = append(lines, word+" = "+cp.Vm.DescribeAbstractType(abType, compiler.LITERAL))
+	}
+	if len(lines) == 0 {
+		for _, label := range cp.Vm.Labels {
+			if label == word {
+				lines = append(lines, "field label "+word)
+				break
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return "", false
+	}
+	return "```\n" + strings.Join(lines, "\n") + "\n```", true
+}
+
+// Supplies completions for what's to the left of the cursor: if it's a hub command then the verbs
+// of the hub, otherwise the functions, types, variables, enum elements, and field labels of the
+// service. Since a verb of the hub may be more than one word, its completion replaces everything
+// after 'hub' up to the cursor, rather than just the word the editor thinks we're in.
+func (d *document) completions(prefix string, replace lspRange, isHubCommand bool) []completionItem {
+	items := map[string]completionItem{}
+	add := func(label string, kind int, detail string) {
+		if strings.HasPrefix(label, prefix) && label != "" && !strings.ContainsAny(label, "* ") {
+			if _, ok := items[label]; !ok {
+				items[label] = completionItem{Label: label, Kind: kind, Detail: detail}
+			}
+		}
+	}
+	if isHubCommand {
+		for _, verb := range hubVerbs() {
+			if strings.HasPrefix(verb, prefix) {
+				items[verb] = completionItem{Label: verb, Kind: COMPLETION_KEYWORD, Detail: "hub verb", FilterText: verb,
+					TextEdit: &textEdit{Range: replace, NewText: verb}}
+			}
+		}
+		return sortedItems(items)
+	}
+	cp := d.symbols()
+	if cp == nil {
+		return []completionItem{}
+	}
+	for name, tree := range cp.P.FunctionForest {
+		detail := ""
+		fns := leaves(tree.Tree)
+		if len(fns) > 0 {
+			detail = describeFunction(cp, name, fns[0])
+		}
+		add(name, COMPLETION_FUNCTION, detail)
+	}
+	for name := range cp.GlobalConsts.Data {
+		add(name, COMPLETION_VARIABLE, "const")
+	}
+	for name := range cp.GlobalVars.Data {
+		add(name, COMPLETION_VARIABLE, "var")
+	}
+	for name, el := range cp.EnumElements {
+		add(name, COMPLETION_ENUM_MEMBER, cp.Vm.DescribeType(el.T, compiler.LITERAL))
+	}
+	for name := range cp.P.TypeMap {
+		add(name, COMPLETION_STRUCT, "type")
+	}
+	for _, label := range cp.Vm.Labels {
+		add(label, COMPLETION_FIELD, "field")
+	}
+	return sortedItems(items)
+}
+
+func sortedItems(items map[string]completionItem) []completionItem {
+	result := make([]completionItem, 0, len(items))
+	for _, item := range items {
+		result = append(result, item)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Label < result[j].Label })
+	return result
+}
+
+// Gets the overloaded versions of a function, in the order in which the function tree would try them.
+func overloads(cp *compiler.Compiler, name string) []*ast.PrsrFunction {
+	if tree, ok := cp.P.FunctionForest[name]; ok {
+		return leaves(tree.Tree)
+	}
+	return cp.P.FunctionTable[name]
+}
+
+// Walks an overload tree to find the functions at its leaves.
+func leaves(tree *ast.FnTreeNode) []*ast.PrsrFunction {
+	result := []*ast.PrsrFunction{}
+	seen := map[*ast.PrsrFunction]bool{}
+	var walk func(node *ast.FnTreeNode)
+	walk = func(node *ast.FnTreeNode) {
+		if node == nil {
+			return
+		}
+		if node.Fn != nil && !seen[node.Fn] {
+			seen[node.Fn] = true
+			result = append(result, node.Fn)
+		}
+		for _, branch := range node.Branch {
+			walk(branch.Node)
+		}
+	}
+	walk(tree)
+	return result
+}
+
+// Describes a function by its signature and the return types the compiler inferred for it.
+// (Struct constructors have no FName, so we pass the name we looked it up by.)
+func describeFunction(cp *compiler.Compiler, name string, fn *ast.PrsrFunction) string {
+	result := "def "
+	if fn.Cmd {
+		result = "cmd "
+	}
+	result = result + name + " " + fn.NameSig.String()
+	if fnCp, ok := fn.Compiler.(*compiler.Compiler); ok && fn.Number < uint32(len(fnCp.Fns)) {
+		if rtnTypes := fnCp.Fns[fn.Number].RtnTypes; len(rtnTypes) > 0 {
+			result = result + " -> " + fnCp.Vm.DescribeTypeScheme(rtnTypes)
+		}
+	} else if len(fn.NameRets) > 0 {
+		result = result + " -> " + fn.NameRets.String()
+	}
+	return result
+}
+
+func describeType(cp *compiler.Compiler, typeNo values.ValueType) string {
+	name := cp.Vm.DescribeType(typeNo, compiler.LITERAL)
+	switch typeInfo := cp.Vm.ConcreteTypeInfo[typeNo].(type) {
+	case compiler.StructType:
+		fields := []string{}
+		for i, lb := range typeInfo.LabelNumbers {
+			fields = append(fields, cp.Vm.Labels[lb]+" "+cp.Vm.DescribeAbstractType(typeInfo.AbstractStructFields[i], compiler.LITERAL))
+		}
+		return name + " = struct(" + strings.Join(fields, ", ") + ")"
+	case compiler.EnumType:
+		return name + " = enum " + strings.Join(typeInfo.ElementNames, ", ")
+	case compiler.CloneType:
+		return name + " = clone " + cp.Vm.DescribeType(typeInfo.Parent, compiler.LITERAL)
+	}
+	return name
+}
+
+// The names of the sources of the service which are files the editor can open, with the document
+// itself first.
+func (d *document) sourceNames(cp *compiler.Compiler) []string {
+	result := []string{d.path}
+	others := []string{}
+	for source := range cp.P.Common.Sources {
+		if source == d.path || source == "" || source == "REPL input" || strings.HasPrefix(source, "rsc-pf/") {
+			continue
+		}
+		others = append(others, source)
+	}
+	sort.Strings(others)
+	return append(result, others...)
+}
+
+func (d *document) sourceURI(source string) string {
+	if source == d.path {
+		return d.uri
+	}
+	return pathToURI(text.MakeFilepath(source))
+}
+
+// Functions only know where their bodies start, so we go back from there to the nearest
+// unindented line, which will be the signature.
+func (d *document) functionLocation(cp *compiler.Compiler, fn *ast.PrsrFunction) (location, bool) {
+	if fn.Tok == nil || fn.Tok.Line < 1 {
+		return location{}, false
+	}
+	lines, ok := cp.P.Common.Sources[fn.Tok.Source]
+	if !ok || fn.Tok.Source == "REPL input" || strings.HasPrefix(fn.Tok.Source, "rsc-pf/") {
+		return location{}, false
+	}
+	for l := min(fn.Tok.Line-1, len(lines)-1); l >= 0; l-- {
+		if len(lines[l]) > 0 && !unicode.IsSpace(rune(lines[l][0])) && !strings.HasPrefix(lines[l], "//") {
+			return d.locationInSource(cp, fn.Tok.Source, l, fn.FName), true
+		}
+	}
+	return location{}, false
+}
+
+func (d *document) locationInSource(cp *compiler.Compiler, source string, line int, word string) location {
+	col := 0
+	if line < len(cp.P.Common.Sources[source]) {
+		col = max(strings.Index(cp.P.Common.Sources[source][line], word), 0)
+	}
+	return location{URI: d.sourceURI(source),
+		Range: lspRange{Start: position{line, col}, End: position{line, col + len(word)}}}
+}
+
+// Finds the lines on which a top-level declaration introduces the word. A declaration starts at
+// the left-hand margin and may be continued with `..`; the name it declares comes first, except
+// that the elements of enums and the labels of structs are declared inside it.
+func declarationLines(lines []string, word string) []int {
+	result := []int{}
+	inEnumOrStruct := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case len(line) > 0 && !unicode.IsSpace(rune(line[0])):
+			inEnumOrStruct = strings.Contains(line, "enum ") || strings.Contains(line, "struct(")
+			if startsWithWord(line, word) {
+				result = append(result, i)
+				continue
+			}
+		case strings.HasPrefix(trimmed, ".."):
+		default:
+			inEnumOrStruct = false
+		}
+		if inEnumOrStruct && containsWord(line, word) {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+func startsWithWord(line, word string) bool {
+	if !strings.HasPrefix(line, word) {
+		return false
+	}
+	rest := []rune(line[len(word):])
+	return len(rest) == 0 || !isIdentRune(rest[0])
+}
+
+func containsWord(line, word string) bool {
+	for i := strings.Index(line, word); i >= 0; {
+		before := i == 0 || !isIdentRune(rune(line[i-1]))
+		after := i+len(word) == len(line) || !isIdentRune(rune(line[i+len(word)]))
+		if before && after {
+			return true
+		}
+		next := strings.Index(line[i+1:], word)
+		if next < 0 {
+			return false
+		}
+		i = i + 1 + next
+	}
+	return false
+}
+
+var cachedHubVerbs []string
+
+// The verbs of the hub are defined by `rsc-pf/hub.pf`, which is added to the namespace of anything
+// with a `.hub` extension. So we initialize an empty hub file and see what we get.
+func hubVerbs() []string {
+	if cachedHubVerbs != nil {
+		return cachedHubVerbs
+	}
+	cachedHubVerbs = []string{}
+	cp := initializer.StartCompiler("lsp.hub", "\n", nil, map[string]*compiler.Compiler{})
+	verbs := map[string]bool{}
+	for name, fns := range cp.P.FunctionTable {
+		for _, fn := range fns {
+			if fn.Tok == nil || fn.Tok.Source != "rsc-pf/hub.pf" {
+				continue
+			}
+			words := []string{name}
+			for _, param := range fn.NameSig {
+				if param.VarType == "bling" {
+					words = append(words, param.VarName)
+				}
+			}
+			verbs[strings.Join(words, " ")] = true
+		}
+	}
+	for verb := range verbs {
+		cachedHubVerbs = append(cachedHubVerbs, verb)
+	}
+	sort.Strings(cachedHubVerbs)
+	return cachedHubVerbs
+}
+
+func uriToPath(uri string) string {
+	u, e := url.Parse(uri)
+	if e != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathToURI(path string) string {
+	if abs, e := filepath.Abs(path); e == nil {
+		path = abs
+	}
+	if _, e := os.Stat(path); e != nil {
+		return "file://" + filepath.ToSlash(path)
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -0,0 +1,273 @@
+package metrics
+
+// Metrics for monitoring, written in the text format which Prometheus scrapes. (See
+// https://prometheus.io/docs/instrumenting/exposition_formats/.) A `Counter` or a `Histogram`
+// keeps its own series, one for each combination of the values of its labels, and is cheap
+// enough to update on every request. A `Registry` gives each metric its name and help text,
+// and writes them all out when asked; a metric can also be registered as a function which
+// supplies its samples at that point, for things which are counted somewhere else, such as in
+// the vm of a service.
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The content type of the text format.
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// The upper bounds of the buckets of a histogram of durations, in seconds.
+var DEFAULT_BUCKETS = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A sample of a counter or gauge, with the values of its labels in the order the labels were
+// registered in.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// A sample of a histogram. `Counts` has the number of observations in each bucket, not
+// cumulatively, plus one more for those greater than the last bound.
+type HistogramSample struct {
+	Labels []string
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+// Separates the values of the labels in the keys of the maps of series, since it can't be in
+// a valid UTF-8 string.
+const labelSeparator = "\xff"
+
+// A counter with a series for each combination of values of its labels.
+type Counter struct {
+	mu     sync.Mutex
+	series map[string]*Sample
+}
+
+func NewCounter() *Counter {
+	return &Counter{series: map[string]*Sample{}}
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSeparator)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &Sample{Labels: append([]string{}, labelValues...)}
+		c.series[key] = s
+	}
+	s.Value += v
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Returns copies of the series, in order of the values of their labels.
+func (c *Counter) Samples() []Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]Sample, 0, len(c.series))
+	for _, s := range c.series {
+		result = append(result, *s)
+	}
+	sortSamples(result, func(i int) []string { return result[i].Labels })
+	return result
+}
+
+// A histogram with a series for each combination of values of its labels.
+type Histogram struct {
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*HistogramSample
+}
+
+// The bounds of the buckets should be in ascending order.
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, series: map[string]*HistogramSample{}}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSeparator)
+	bucket := sort.SearchFloat64s(h.buckets, v) // The first bound which isn't less than v.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &HistogramSample{Labels: append([]string{}, labelValues...), Counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.Counts[bucket]++
+	s.Count++
+	s.Sum += v
+}
+
+// Returns copies of the series, in order of the values of their labels.
+func (h *Histogram) Samples() []HistogramSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := make([]HistogramSample, 0, len(h.series))
+	for _, s := range h.series {
+		sample := *s
+		sample.Counts = append([]uint64{}, s.Counts...)
+		result = append(result, sample)
+	}
+	sortSamples(result, func(i int) []string { return result[i].Labels })
+	return result
+}
+
+func sortSamples[S any](samples []S, labels func(int) []string) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(labels(i), labelSeparator) < strings.Join(labels(j), labelSeparator)
+	})
+}
+
+// The metrics of a program, by name, in the order they were registered.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+type family struct {
+	name       string
+	help       string
+	kind       string // "counter", "gauge", or "histogram".
+	labels     []string
+	buckets    []float64
+	samples    func() []Sample
+	histograms func() []HistogramSample
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f *family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// Makes and registers a counter.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := NewCounter()
+	r.CounterFunc(name, help, labels, c.Samples)
+	return c
+}
+
+// Makes and registers a histogram.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := NewHistogram(buckets)
+	r.HistogramFunc(name, help, buckets, labels, h.Samples)
+	return h
+}
+
+// Registers a counter whose samples are supplied by the function whenever the metrics are
+// written.
+func (r *Registry) CounterFunc(name, help string, labels []string, samples func() []Sample) {
+	r.register(&family{name: name, help: help, kind: "counter", labels: labels, samples: samples})
+}
+
+// Likewise for a gauge.
+func (r *Registry) GaugeFunc(name, help string, labels []string, samples func() []Sample) {
+	r.register(&family{name: name, help: help, kind: "gauge", labels: labels, samples: samples})
+}
+
+// Likewise for a histogram, whose samples must have been made with the same buckets.
+func (r *Registry) HistogramFunc(name, help string, buckets []float64, labels []string, samples func() []HistogramSample) {
+	r.register(&family{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, histograms: samples})
+}
+
+// Writes all the metrics in the text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family{}, r.families...)
+	r.mu.Unlock()
+	b := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(b)
+	}
+	return b.Flush()
+}
+
+func (f *family) write(b *bufio.Writer) {
+	b.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+	b.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+	if f.kind != "histogram" {
+		samples := f.samples()
+		sortSamples(samples, func(i int) []string { return samples[i].Labels })
+		for _, s := range samples {
+			writeSample(b, f.name, f.labels, s.Labels, "", "", s.Value)
+		}
+		return
+	}
+	samples := f.histograms()
+	sortSamples(samples, func(i int) []string { return samples[i].Labels })
+	for _, s := range samples {
+		cumulative := uint64(0)
+		for i, bound := range f.buckets {
+			cumulative += s.Counts[i]
+			writeSample(b, f.name+"_bucket", f.labels, s.Labels, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(b, f.name+"_bucket", f.labels, s.Labels, "le", "+Inf", float64(s.Count))
+		writeSample(b, f.name+"_sum", f.labels, s.Labels, "", "", s.Sum)
+		writeSample(b, f.name+"_count", f.labels, s.Labels, "", "", float64(s.Count))
+	}
+}
+
+// Writes a line of the form `name{label="value",...} value`, with an extra label if it's named.
+func writeSample(b *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	b.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		b.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			b.WriteString(label + `="` + escapeLabelValue(value) + `"`)
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(extraLabel + `="` + extraValue + `"`)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
@@ -0,0 +1,236 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests, by service.", "service")
+	requests.Inc("shop")
+	requests.Add(2, "bank")
+	durations := r.Histogram("request_duration_seconds", "How long requests took.", []float64{0.1, 1}, "service")
+	durations.Observe(0.05, "shop")
+	durations.Observe(0.5, "shop")
+	durations.Observe(3, "shop")
+	r.GaugeFunc("memory_values", "Values in memory.\nOr \\ thereabouts.", nil, func() []Sample {
+		return []Sample{{Value: 42}}
+	})
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests, by service.
+# TYPE requests_total counter
+requests_total{service="bank"} 2
+requests_total{service="shop"} 1
+# HELP request_duration_seconds How long requests took.
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{service="shop",le="0.1"} 1
+request_duration_seconds_bucket{service="shop",le="1"} 2
+request_duration_seconds_bucket{service="shop",le="+Inf"} 3
+request_duration_seconds_sum{service="shop"} 3.55
+request_duration_seconds_count{service="shop"} 3
+# HELP memory_values Values in memory.\nOr \\ thereabouts.
+# TYPE memory_values gauge
+memory_values 42
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func TestExpositionFormat(t *testing.T) {
+	r := NewRegistry()
+	errs := r.Counter("pipefish_errors_total", "Errors, by service and error id.", "service", "error_id")
+	errs.Inc("shop", "vm/div/zero")
+	errs.Inc("a \"quoted\"\nservice\\", "eval/user")
+	durations := r.Histogram("pipefish_request_duration_seconds", "Requests.", DEFAULT_BUCKETS, "service", "function")
+	for _, v := range []float64{0, 0.0005, 0.002, 0.3, 7, 100, math.Inf(1)} {
+		durations.Observe(v, "shop", "buy")
+	}
+	durations.Observe(0.01, "bank", "")
+	r.CounterFunc("pipefish_vm_instructions_total", "Instructions.", []string{"service"}, func() []Sample {
+		return []Sample{{Labels: []string{"shop"}, Value: 12345678901}}
+	})
+	r.GaugeFunc("pipefish_empty", "A gauge with no samples.", []string{"service"}, func() []Sample { return nil })
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(buf.String()); err != nil {
+		t.Errorf("%v in\n%s", err, buf.String())
+	}
+}
+
+// The validator should itself catch what it's meant to.
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"no type", "x 1\n"},
+		{"bad name", "# TYPE 1x counter\n1x 1\n"},
+		{"bad type", "# TYPE x widget\nx 1\n"},
+		{"bad value", "# TYPE x counter\nx one\n"},
+		{"unquoted label", "# TYPE x counter\nx{a=b} 1\n"},
+		{"bad escape", "# TYPE x counter\nx{a=\"\\t\"} 1\n"},
+		{"negative counter", "# TYPE x counter\nx -1\n"},
+		{"duplicate series", "# TYPE x counter\nx{a=\"b\"} 1\nx{a=\"b\"} 2\n"},
+		{"no +Inf bucket", "# TYPE h histogram\nh_bucket{le=\"1\"} 1\nh_sum 1\nh_count 1\n"},
+		{"decreasing buckets", "# TYPE h histogram\nh_bucket{le=\"1\"} 2\nh_bucket{le=\"2\"} 1\nh_bucket{le=\"+Inf\"} 2\nh_sum 1\nh_count 2\n"},
+		{"count isn't +Inf", "# TYPE h histogram\nh_bucket{le=\"+Inf\"} 2\nh_sum 1\nh_count 3\n"},
+		{"no newline", "# TYPE x counter\nx 1"},
+	}
+	for _, test := range tests {
+		if validate(test.text) == nil {
+			t.Errorf("%s: validated", test.name)
+		}
+	}
+}
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(.*)\})? (\S+)$`)
+	labelPair  = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\\n]|\\[\\"n])*)"(,|$)`)
+)
+
+type histogramSeries struct {
+	buckets    []float64 // The counts, in order of their bounds.
+	bounds     []float64
+	count      float64
+	hasCount   bool
+	hasSum     bool
+	infinities float64
+}
+
+// Checks that the text is in the Prometheus text format, version 0.0.4: that every sample
+// belongs to a metric whose type was declared before it, that names, labels and values are
+// well-formed, that counters aren't negative, that no series appears twice, and that the
+// buckets of each histogram are cumulative and end with +Inf, which equals its count.
+func validate(text string) error {
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		return errors.New("the text doesn't end with a newline")
+	}
+	types := map[string]string{}
+	seen := map[string]bool{}
+	histograms := map[string]*histogramSeries{}
+	for n, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("line %d: %s", n+1, fmt.Sprintf(format, args...))
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 || fields[1] != "HELP" && fields[1] != "TYPE" {
+				continue // It's a comment.
+			}
+			if !metricName.MatchString(fields[2]) {
+				return fail("bad metric name %q", fields[2])
+			}
+			if fields[1] == "TYPE" {
+				if len(fields) != 4 || !strings.Contains(" counter gauge histogram summary untyped ", " "+fields[3]+" ") {
+					return fail("bad type %q", line)
+				}
+				if _, ok := types[fields[2]]; ok {
+					return fail("type of %s declared twice", fields[2])
+				}
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		match := sampleLine.FindStringSubmatch(line)
+		if match == nil {
+			return fail("malformed sample %q", line)
+		}
+		name, labelText, valueText := match[1], match[3], match[4]
+		value, err := strconv.ParseFloat(valueText, 64)
+		if err != nil && valueText != "+Inf" && valueText != "-Inf" && valueText != "NaN" {
+			return fail("bad value %q", valueText)
+		}
+		labels := map[string]string{}
+		series := []string{}
+		for labelText != "" {
+			pair := labelPair.FindStringSubmatch(labelText)
+			if pair == nil || !labelName.MatchString(pair[1]) {
+				return fail("malformed labels %q", labelText)
+			}
+			if _, ok := labels[pair[1]]; ok {
+				return fail("label %s given twice", pair[1])
+			}
+			labels[pair[1]] = pair[2]
+			if pair[1] != "le" {
+				series = append(series, pair[1]+"="+pair[2])
+			}
+			labelText = labelText[len(pair[0]):]
+		}
+		key := name + "{" + strings.Join(series, ",") + "}" + labels["le"]
+		if seen[key] {
+			return fail("series %s given twice", key)
+		}
+		seen[key] = true
+		family, suffix := name, ""
+		for _, s := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, s); base != name && types[base] == "histogram" {
+				family, suffix = base, s
+			}
+		}
+		kind, ok := types[family]
+		if !ok {
+			return fail("no type declared for %s", name)
+		}
+		if kind == "counter" && value < 0 {
+			return fail("counter %s is negative", name)
+		}
+		if kind != "histogram" {
+			continue
+		}
+		seriesKey := family + "{" + strings.Join(series, ",") + "}"
+		h, ok := histograms[seriesKey]
+		if !ok {
+			h = &histogramSeries{}
+			histograms[seriesKey] = h
+		}
+		switch suffix {
+		case "_bucket":
+			le, ok := labels["le"]
+			if !ok {
+				return fail("bucket without le")
+			}
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				return fail("bad bound %q", le)
+			}
+			if len(h.bounds) > 0 && (bound <= h.bounds[len(h.bounds)-1] || value < h.buckets[len(h.buckets)-1]) {
+				return fail("buckets of %s aren't cumulative and in order", seriesKey)
+			}
+			h.bounds = append(h.bounds, bound)
+			h.buckets = append(h.buckets, value)
+			if math.IsInf(bound, 1) {
+				h.infinities = value
+			}
+		case "_sum":
+			h.hasSum = true
+		case "_count":
+			h.hasCount, h.count = true, value
+		default:
+			return fail("histogram %s has a sample without a suffix", family)
+		}
+	}
+	for key, h := range histograms {
+		if len(h.bounds) == 0 || !math.IsInf(h.bounds[len(h.bounds)-1], 1) {
+			return fmt.Errorf("histogram %s has no +Inf bucket", key)
+		}
+		if !h.hasSum || !h.hasCount || h.count != h.infinities {
+			return fmt.Errorf("histogram %s needs a sum, and a count equal to its +Inf bucket", key)
+		}
+	}
+	return nil
+}
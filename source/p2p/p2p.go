@@ -3,48 +3,361 @@ package p2p
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tim-hardcastle/Pipefish/source/settings"
 )
 
 type jsonRequest = struct {
-	Body     string
-	Username string
-	Password string
+	Body string
 }
 
 type jsonResponse = struct {
 	Body    string
 	Service string
+	Error   *jsonError // If the line returned an error value.
+}
+
+type jsonError = struct {
+	ErrorId string `json:"errorId"`
+	Message string `json:"message"`
+}
+
+// The content type of values in the binary wire format of the compiler. A session which asks
+// for it gets the result of a line in that format if the hub can encode it, and as Pipefish
+// source in the JSON response otherwise, e.g. if the result is an error, or the hub is too old
+// to know about the format.
+const VALUE_CONTENT_TYPE = "application/vnd.pipefish.value"
+
+// What the hub sent back: the encoding of the value, if it was asked for and the hub could
+// provide it, and the result as Pipefish source otherwise.
+type Reply struct {
+	Literal string
+	Value   []byte
+}
+
+type loginRequest = struct {
+	Username string
+	Password string
+}
+
+type loginResponse = struct {
+	Token string
+	Error string
+}
+
+// How a session talks to its hub.
+type Options struct {
+	Timeout          time.Duration // How long to wait for each request, including reading the response.
+	Retries          int           // How many more times to try a call to a function if the hub can't be reached. Calls to commands are never retried.
+	Backoff          time.Duration // How long to wait before the first retry, doubling for each one after.
+	FailureThreshold int           // How many calls in a row can fail to reach the hub before the circuit breaker opens, or 0 for it never to open.
+	Cooldown         time.Duration // How long the breaker stays open, failing calls without trying them, before it lets one through.
+}
+
+var DefaultOptions = Options{Timeout: 30 * time.Second, Retries: 2, Backoff: 100 * time.Millisecond,
+	FailureThreshold: 5, Cooldown: 30 * time.Second}
+
+// Reads options from the query of the URL of an external service, e.g.
+// `timeout=5s&retries=3&backoff=50ms&failures=10&cooldown=1m`. Anything not given has its
+// default value.
+func ParseOptions(query string) (Options, error) {
+	options := DefaultOptions
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return options, err
+	}
+	for key, values := range params {
+		value := values[len(values)-1]
+		switch key {
+		case "timeout":
+			options.Timeout, err = parseDuration(key, value)
+		case "retries":
+			options.Retries, err = parseNatural(key, value)
+		case "backoff":
+			options.Backoff, err = parseDuration(key, value)
+		case "failures":
+			options.FailureThreshold, err = parseNatural(key, value)
+		case "cooldown":
+			options.Cooldown, err = parseDuration(key, value)
+		default:
+			err = errors.New("there is no option '" + key + "'")
+		}
+		if err != nil {
+			return options, err
+		}
+	}
+	return options, nil
+}
+
+func parseDuration(key, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, errors.New("'" + key + "' should be a duration, e.g. '5s'")
+	}
+	return d, nil
+}
+
+func parseNatural(key, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New("'" + key + "' should be a natural number")
+	}
+	return n, nil
 }
 
-func Do(host, line, username, password string) string {
-	jRq := jsonRequest{Body: line, Username: username, Password: password}
+// The kinds of failure to get a value back from a hub. An `*Error` wraps one of them.
+var (
+	ErrUnreachable = errors.New("can't reach the hub")
+	ErrRejected    = errors.New("the hub refused the credentials")
+	ErrResponse    = errors.New("can't read the response of the hub")
+)
+
+// Says which of the above went wrong, and how.
+type Error struct {
+	Kind   error // One of the above.
+	Host   string
+	Detail string
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + " at '" + e.Host + "': " + e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// The hub did the line, which returned an error value. `Message` is the message of the error
+// as the remote service gave it.
+type RemoteError struct {
+	Host    string
+	ErrorId string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "the hub at '" + e.Host + "' returned an error with id '" + e.ErrorId + "': " + e.Message
+}
+
+// Sends a line to the hub at the host, with a bearer token if the hub is administered, and
+// returns the hub's response.
+func post(client *http.Client, host, line, token string, wantValue bool) (Reply, error) {
+	jRq := jsonRequest{Body: line}
 	body, _ := json.Marshal(jRq)
 	request, err := http.NewRequest("POST", host, bytes.NewBuffer(body))
 	if err != nil {
-		return "error \"Can't parse request\"" // Obviously this one shouldn't happen.
+		return Reply{}, &Error{ErrUnreachable, host, err.Error()}
 	}
 	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
-
-	client := &http.Client{}
+	if wantValue {
+		request.Header.Set("Accept", VALUE_CONTENT_TYPE+", application/json;q=0.9")
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
 	response, err := client.Do(request)
 	if err != nil {
-		return "error \"Can't get response from '" + host + "'\""
+		return Reply{}, &Error{ErrUnreachable, host, err.Error()}
 	}
-
 	defer response.Body.Close()
-	rBody, _ := io.ReadAll(response.Body)
+	rBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return Reply{}, &Error{ErrUnreachable, host, err.Error()}
+	}
 	if settings.SHOW_XCALLS {
-		rawJ := ""
-		for _, c := range rBody {
-			rawJ = rawJ + (string(c))
-		}
-		println("Raw json is", rawJ)
+		println("Raw json is", string(rBody))
+	}
+	if err := statusError(host, response.StatusCode, rBody); err != nil {
+		return Reply{}, err
+	}
+	if wantValue && response.Header.Get("Content-Type") == VALUE_CONTENT_TYPE {
+		return Reply{Value: rBody}, nil
 	}
 	var jRsp jsonResponse
-	json.Unmarshal(rBody, &jRsp)
-	return jRsp.Body
+	if err := json.Unmarshal(rBody, &jRsp); err != nil {
+		return Reply{}, &Error{ErrResponse, host, err.Error()}
+	}
+	if jRsp.Error != nil {
+		return Reply{}, &RemoteError{host, jRsp.Error.ErrorId, jRsp.Error.Message}
+	}
+	return Reply{Literal: jRsp.Body}, nil
+}
+
+// A hub which is overloaded or shutting down may be back soon, so we treat it as unreachable.
+func statusError(host string, status int, body []byte) error {
+	detail := strings.TrimSpace(string(body))
+	if detail == "" {
+		detail = http.StatusText(status)
+	}
+	switch {
+	case status == http.StatusOK:
+		return nil
+	case status == http.StatusUnauthorized:
+		return &Error{ErrRejected, host, detail}
+	case status >= 500:
+		return &Error{ErrUnreachable, host, "status " + strconv.Itoa(status) + ": " + detail}
+	default:
+		return &Error{ErrResponse, host, "status " + strconv.Itoa(status) + ": " + detail}
+	}
+}
+
+// Logs on to the hub at the host, which should be the URL it listens at, returning a bearer token
+// to send with the requests.
+func Login(host, username, password string) (string, error) {
+	return login(http.DefaultClient, host, username, password)
+}
+
+func login(client *http.Client, host, username, password string) (string, error) {
+	loginUrl, err := url.Parse(host)
+	if err != nil {
+		return "", &Error{ErrUnreachable, host, err.Error()}
+	}
+	loginUrl.Path = "/login"
+	body, _ := json.Marshal(loginRequest{Username: username, Password: password})
+	response, err := client.Post(loginUrl.String(), "application/json; charset=UTF-8", bytes.NewBuffer(body))
+	if err != nil {
+		return "", &Error{ErrUnreachable, host, err.Error()}
+	}
+	defer response.Body.Close()
+	var lRsp loginResponse
+	if err := json.NewDecoder(response.Body).Decode(&lRsp); err != nil {
+		if err := statusError(host, response.StatusCode, nil); err != nil {
+			return "", err
+		}
+		return "", &Error{ErrResponse, host, "can't read response from '" + loginUrl.String() + "'"}
+	}
+	if lRsp.Error != "" {
+		if response.StatusCode >= 500 {
+			return "", &Error{ErrUnreachable, host, lRsp.Error}
+		}
+		return "", &Error{ErrRejected, host, lRsp.Error}
+	}
+	return lRsp.Token, nil
+}
+
+// Talks to a hub on behalf of a user, logging on the first time it's used and again whenever the
+// hub refuses the token, e.g. because it's expired. If there's no username, then the hub isn't
+// administered and it sends no token. The session keeps its connections to the hub open between
+// calls, and has a circuit breaker: once enough calls in a row have failed to reach the hub, it
+// fails the calls after them at once until the cooldown is over.
+type Session struct {
+	host      string
+	username  string
+	password  string
+	options   Options
+	client    *http.Client
+	mu        sync.Mutex
+	token     string
+	failures  int       // How many calls in a row have failed to reach the hub.
+	openUntil time.Time // When the breaker will next let a call through, if it's open.
+}
+
+func NewSession(host, username, password string) *Session {
+	return NewSessionWithOptions(host, username, password, DefaultOptions)
+}
+
+func NewSessionWithOptions(host, username, password string, options Options) *Session {
+	return &Session{host: host, username: username, password: password, options: options,
+		client: &http.Client{Timeout: options.Timeout}}
+}
+
+// Does the line on the hub, returning the result as Pipefish source. If the line is idempotent,
+// i.e. it calls a function rather than a command, then it's tried again, after a backoff, when
+// the hub can't be reached. The error is an `*Error` or a `*RemoteError`.
+func (s *Session) Do(line string, idempotent bool) (string, error) {
+	reply, err := s.do(line, idempotent, false)
+	return reply.Literal, err
+}
+
+// Like `Do`, but asks the hub for the result in the wire format, which it sends if it can.
+func (s *Session) DoForValue(line string, idempotent bool) (Reply, error) {
+	return s.do(line, idempotent, true)
+}
+
+func (s *Session) do(line string, idempotent, wantValue bool) (Reply, error) {
+	if err := s.checkBreaker(); err != nil {
+		return Reply{}, err
+	}
+	attempts := 1
+	if idempotent {
+		attempts += s.options.Retries
+	}
+	backoff := s.options.Backoff
+	var result Reply
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		result, err = s.doLoggedOn(line, wantValue)
+		if !errors.Is(err, ErrUnreachable) {
+			break
+		}
+	}
+	s.recordResult(err)
+	return result, err
+}
+
+func (s *Session) checkBreaker() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().Before(s.openUntil) {
+		return &Error{ErrUnreachable, s.host, strconv.Itoa(s.failures) + " calls in a row have failed, so no more will be tried until " +
+			s.openUntil.Format(time.TimeOnly)}
+	}
+	return nil
+}
+
+// Only failures to reach the hub count towards opening the breaker, since the others show that
+// the hub is up.
+func (s *Session) recordResult(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !errors.Is(err, ErrUnreachable) {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.options.FailureThreshold > 0 && s.failures >= s.options.FailureThreshold {
+		s.openUntil = time.Now().Add(s.options.Cooldown)
+	}
+}
+
+func (s *Session) doLoggedOn(line string, wantValue bool) (Reply, error) {
+	if s.username == "" {
+		return post(s.client, s.host, line, "", wantValue)
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		s.mu.Lock()
+		token := s.token
+		s.mu.Unlock()
+		if token == "" {
+			token, err = login(s.client, s.host, s.username, s.password)
+			if err != nil {
+				return Reply{}, err
+			}
+			s.mu.Lock()
+			s.token = token
+			s.mu.Unlock()
+		}
+		var result Reply
+		result, err = post(s.client, s.host, line, token, wantValue)
+		if !errors.Is(err, ErrRejected) {
+			return result, err
+		}
+		s.mu.Lock()
+		s.token = ""
+		s.mu.Unlock()
+	}
+	return Reply{}, err
 }
@@ -0,0 +1,227 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testOptions = Options{Timeout: time.Second, Retries: 2, Backoff: time.Millisecond, FailureThreshold: 0}
+
+// A hub which answers each line with the response the function gives it, counting the requests.
+func testHub(t *testing.T, respond func(n int64, w http.ResponseWriter, r *http.Request)) (*httptest.Server, *atomic.Int64) {
+	var count atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(count.Add(1), w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &count
+}
+
+func answer(w http.ResponseWriter, body string) {
+	json.NewEncoder(w).Encode(jsonResponse{Body: body})
+}
+
+func TestRetriesFunctionsButNotCommands(t *testing.T) {
+	var failures atomic.Int64
+	server, count := testHub(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		answer(w, "42")
+	})
+	s := NewSessionWithOptions(server.URL, "", "", testOptions)
+	failures.Store(2)
+	result, err := s.Do("f(1)", true)
+	if err != nil || result != "42" || count.Load() != 3 {
+		t.Errorf("function: got %q, %v after %d requests", result, err, count.Load())
+	}
+	failures.Store(2)
+	count.Store(0)
+	_, err = s.Do("c(1)", false)
+	if !errors.Is(err, ErrUnreachable) || count.Load() != 1 {
+		t.Errorf("command: got %v after %d requests", err, count.Load())
+	}
+	failures.Store(5)
+	count.Store(0)
+	_, err = s.Do("f(1)", true)
+	if !errors.Is(err, ErrUnreachable) || count.Load() != 3 {
+		t.Errorf("function which keeps failing: got %v after %d requests", err, count.Load())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	server, _ := testHub(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		answer(w, "42")
+	})
+	s := NewSessionWithOptions(server.URL, "", "", Options{Timeout: 20 * time.Millisecond})
+	start := time.Now()
+	_, err := s.Do("f(1)", true)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("got %v", err)
+	}
+	if time.Since(start) > 150*time.Millisecond {
+		t.Errorf("took %v", time.Since(start))
+	}
+}
+
+func TestRejected(t *testing.T) {
+	var logins atomic.Int64
+	server, _ := testHub(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			var request loginRequest
+			json.NewDecoder(r.Body).Decode(&request)
+			if request.Password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(loginResponse{Error: "wrong password"})
+				return
+			}
+			json.NewEncoder(w).Encode(loginResponse{Token: "token" + string(rune('0'+logins.Add(1)))})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token2" { // So the first token has expired.
+			http.Error(w, "token has expired", http.StatusUnauthorized)
+			return
+		}
+		answer(w, "42")
+	})
+	s := NewSessionWithOptions(server.URL, "alice", "secret", testOptions)
+	result, err := s.Do("f(1)", false)
+	if err != nil || result != "42" || logins.Load() != 2 {
+		t.Errorf("got %q, %v after %d logins", result, err, logins.Load())
+	}
+	s = NewSessionWithOptions(server.URL, "alice", "guess", testOptions)
+	_, err = s.Do("f(1)", true)
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != ErrRejected || e.Detail != "wrong password" {
+		t.Errorf("wrong password: got %v", err)
+	}
+	s = NewSessionWithOptions(server.URL, "alice", "secret", testOptions)
+	logins.Store(2) // So that no token is accepted.
+	_, err = s.Do("f(1)", true)
+	if !errors.Is(err, ErrRejected) || logins.Load() != 4 {
+		t.Errorf("refused token: got %v after %d logins", err, logins.Load())
+	}
+}
+
+func TestRemoteAndBadResponses(t *testing.T) {
+	server, _ := testHub(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		switch n {
+		case 1:
+			json.NewEncoder(w).Encode(jsonResponse{Body: "\n[0] division by zero", Error: &jsonError{"vm/div/zero", "division by zero"}})
+		case 2:
+			w.Write([]byte("<html>Not a hub</html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	s := NewSessionWithOptions(server.URL, "", "", testOptions)
+	_, err := s.Do("1 / 0", true)
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.ErrorId != "vm/div/zero" || remote.Message != "division by zero" {
+		t.Errorf("error value: got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Do("f(1)", true); !errors.Is(err, ErrResponse) {
+			t.Errorf("bad response %d: got %v", i, err)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var up atomic.Bool
+	server, count := testHub(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		answer(w, "42")
+	})
+	s := NewSessionWithOptions(server.URL, "", "", Options{Timeout: time.Second, FailureThreshold: 2, Cooldown: 50 * time.Millisecond})
+	for i := 0; i < 4; i++ {
+		if _, err := s.Do("f(1)", true); !errors.Is(err, ErrUnreachable) {
+			t.Errorf("call %d: got %v", i, err)
+		}
+	}
+	if count.Load() != 2 {
+		t.Errorf("the hub got %d requests while the breaker was open", count.Load())
+	}
+	up.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	if result, err := s.Do("f(1)", true); err != nil || result != "42" {
+		t.Errorf("after the cooldown: got %q, %v", result, err)
+	}
+	up.Store(false)
+	if _, err := s.Do("f(1)", true); !errors.Is(err, ErrUnreachable) || count.Load() != 4 {
+		t.Errorf("the breaker didn't close after the call succeeded: got %v after %d requests", err, count.Load())
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	var connections atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		answer(w, "42")
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	s := NewSessionWithOptions(server.URL, "", "", testOptions)
+	for i := 0; i < 5; i++ {
+		if _, err := s.Do("f(1)", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if connections.Load() != 1 {
+		t.Errorf("made %d connections", connections.Load())
+	}
+}
+
+func TestValueNegotiation(t *testing.T) {
+	server, _ := testHub(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), VALUE_CONTENT_TYPE) && r.URL.Query().Get("old") == "" {
+			w.Header().Set("Content-Type", VALUE_CONTENT_TYPE)
+			w.Write([]byte("PFV\x01"))
+			return
+		}
+		answer(w, "42")
+	})
+	s := NewSessionWithOptions(server.URL, "", "", testOptions)
+	if reply, err := s.DoForValue("f(1)", true); err != nil || string(reply.Value) != "PFV\x01" || reply.Literal != "" {
+		t.Errorf("asking for a value: got %+v, %v", reply, err)
+	}
+	if result, err := s.Do("f(1)", true); err != nil || result != "42" {
+		t.Errorf("not asking for a value: got %q, %v", result, err)
+	}
+	s = NewSessionWithOptions(server.URL+"?old=true", "", "", testOptions) // A hub which doesn't know about the format.
+	if reply, err := s.DoForValue("f(1)", true); err != nil || reply.Value != nil || reply.Literal != "42" {
+		t.Errorf("asking an old hub for a value: got %+v, %v", reply, err)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	options, err := ParseOptions("timeout=5s&retries=3&backoff=50ms&failures=10&cooldown=1m")
+	expected := Options{Timeout: 5 * time.Second, Retries: 3, Backoff: 50 * time.Millisecond, FailureThreshold: 10, Cooldown: time.Minute}
+	if err != nil || options != expected {
+		t.Errorf("got %+v, %v", options, err)
+	}
+	if options, err := ParseOptions("retries=0"); err != nil || options.Retries != 0 || options.Timeout != DefaultOptions.Timeout {
+		t.Errorf("got %+v, %v", options, err)
+	}
+	for _, query := range []string{"timeout=5", "retries=-1", "failures=lots", "colour=blue"} {
+		if _, err := ParseOptions(query); err == nil {
+			t.Errorf("%s: no error", query)
+		}
+	}
+}
@@ -516,7 +516,7 @@ func (p *Parser) isPositionallyFunctional() bool {
 			return true
 		}
 		if p.peekToken.Literal == "from" {
-			return true
+			return p.prevToken.Literal != "as" // Because of 'get x as T from SQL ---'.
 		}
 		if p.Infixes.Contains(p.peekToken.Literal) {
 			return false
@@ -20,10 +20,12 @@ type Parser struct {
 
 	TokenizedCode    TokenSupplier
 	nesting          dtypes.Stack[token.Token]
+	prevToken        token.Token
 	curToken         token.Token
 	peekToken        token.Token
 	Logging          bool
 	CurrentNamespace []string
+	imperative       bool // Whether we're parsing a command or a line from the REPL, where `transaction` can begin a block.
 
 	// When we call a function in a namespace, we wish to parse it so that literal enum elements and bling are looked for
 	// in that namespace without being namespaced.
@@ -126,6 +128,21 @@ func (p *Parser) ParseLine(source, input string) ast.Node {
 	return result
 }
 
+// Parses a line of imperative code supplied as a string, i.e. a line from the REPL.
+func (p *Parser) ParseImperativeLine(source, input string) ast.Node {
+	p.imperative = true
+	defer func() { p.imperative = false }()
+	return p.ParseLine(source, input)
+}
+
+// Parses the chunk of tokenized code as a command if `imperative` is true, otherwise as
+// any other declaration.
+func (p *Parser) ParseTokenizedDeclaration(imperative bool) ast.Node {
+	p.imperative = imperative
+	defer func() { p.imperative = false }()
+	return p.ParseTokenizedChunk()
+}
+
 // Shows output of parser for debugging purposes.
 func (p *Parser) ParseDump(source, input string) {
 	parsedLine := p.ParseLine(source, input)
@@ -206,6 +223,12 @@ func (p *Parser) parseExpression(precedence int) ast.Node {
 		leftExp = p.parseForExpression()
 	case token.GOCODE:
 		leftExp = p.parseGolangExpression()
+	case token.IDENT:
+		if p.startsTransaction() {
+			leftExp = p.parseTransactionExpression()
+		} else {
+			noNativePrefix = true
+		}
 	case token.INT:
 		leftExp = p.parseIntegerLiteral()
 	case token.LBRACK:
@@ -868,6 +891,26 @@ func (p *Parser) parseSuffixExpression(left ast.Node) ast.Node {
 	return expression
 }
 
+// `transaction` isn't a keyword, since it's a name people give to things. It begins a transaction
+// block only when it's followed by a colon in a command or the REPL, and the user hasn't declared it
+// as a function with no parameters.
+func (p *Parser) startsTransaction() bool {
+	return p.imperative && p.curToken.Literal == "transaction" && p.peekToken.Type == token.COLON &&
+		!p.Unfixes.Contains("transaction")
+}
+
+func (p *Parser) parseTransactionExpression() ast.Node {
+	tok := p.curToken
+	p.NextToken()
+	if p.curToken.Type != token.COLON {
+		p.Throw("parse/transaction/colon", &p.curToken)
+		return nil
+	}
+	p.NextToken()
+	exp := p.parseExpression(COLON)
+	return &ast.TransactionExpression{Token: tok, Right: exp}
+}
+
 func (p *Parser) parseTryExpression() ast.Node {
 	p.NextToken()
 	if p.curToken.Type == token.COLON {
@@ -976,6 +1019,7 @@ func (p *Parser) NextToken() {
 }
 
 func (p *Parser) SafeNextToken() {
+	p.prevToken = p.curToken
 	p.curToken = p.peekToken
 	p.peekToken = p.TokenizedCode.NextToken()
 }
@@ -276,6 +276,15 @@ func (p *Parser) prettyPrint(node ast.Node, ctxt printContext) string {
 			out.WriteString(" ")
 		}
 		out.WriteString(node.Operator)
+	case *ast.TransactionExpression:
+		out.WriteString("transaction : ")
+		switch ctxt.flavor {
+		case ppOUTER:
+			out.WriteString("\n")
+			out.WriteString(p.prettyPrint(node.Right, ctxt.in()))
+		case ppINLINE:
+			out.WriteString(p.prettyPrint(node.Right, inlineCtxt))
+		}
 	case *ast.TryExpression:
 		out.WriteString("try ")
 		if node.VarName != "" {
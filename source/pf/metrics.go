@@ -0,0 +1,25 @@
+package pf
+
+// What the vm of a service has done, for monitoring, e.g. by the hub's `/metrics` endpoint. The
+// service keeps the counters rather than its vm, so that they aren't lost when the service is
+// recompiled after being loaded from an image.
+
+import (
+	"github.com/tim-hardcastle/Pipefish/source/metrics"
+)
+
+type Metrics struct {
+	Instructions  uint64                    // How many instructions of bytecode the service has executed.
+	MemSize       int                       // How many values its vm had in memory at the end of its last run.
+	ExternalCalls []metrics.HistogramSample // How many seconds its calls to external services took, labelled by their names.
+}
+
+// Gets the metrics of the service. Unlike most methods of a service, it doesn't wait for the
+// service to finish what it's doing.
+func (sv *Service) GetMetrics() Metrics {
+	return Metrics{
+		Instructions:  sv.metrics.Instructions.Load(),
+		MemSize:       int(sv.metrics.MemSize.Load()),
+		ExternalCalls: sv.metrics.ExternalCalls.Samples(),
+	}
+}
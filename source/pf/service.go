@@ -1,12 +1,17 @@
 package pf
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 
 	"github.com/tim-hardcastle/Pipefish/source/compiler"
 	"github.com/tim-hardcastle/Pipefish/source/err"
@@ -21,7 +26,14 @@ import (
 type Service struct {
 	cp             *compiler.Compiler
 	localExternals map[string]*Service
+	stubs          map[string]string // The filepaths of the stubs used in place of the external services of the given names.
 	db             *sql.DB
+	databases      map[string]*sql.DB // The named databases, as used by e.g. `SQL(analytics) ---`.
+	limits         Limits
+	sessions       *sessions           // The sessions, if the service is in session mode, or nil. (See sessions.go.)
+	metrics        *compiler.VmMetrics // Kept by the service so as to outlive its vm. (See metrics.go.)
+	imageCache     string              // The directory in which the service caches images of itself, or "" not to.
+	mu             sync.Mutex          // Held while anything uses the vm, whose memory is changed in place.
 }
 
 // Returns a new service.
@@ -29,21 +41,146 @@ func NewService() *Service {
 	return &Service{cp: nil,
 		localExternals: make(map[string]*Service),
 		db:             nil,
+		databases:      make(map[string]*sql.DB),
+		metrics:        compiler.NewVmMetrics(),
 	}
 }
 
+// Takes the lock on the vm, returning the function to release it. A service stopped in the
+// debugger is still locked by the call which stopped, so anything else waits until the debugger
+// lets it carry on.
+func (sv *Service) lock() func() {
+	sv.mu.Lock()
+	return sv.mu.Unlock
+}
+
+// Makes the compiler the service's, so that other services on the same hub which call it
+// take the service's lock as well.
+func (sv *Service) setCompiler(cp *compiler.Compiler) {
+	sv.cp = cp
+	cp.Vm.Lock = sv.lock
+}
+
 // Initializes the service with the source code supplied in the string.
 func (sv *Service) InitializeFromCode(code string) error {
 	return sv.initialize("InitializeFromCode", code)
 }
 
 // Initializes the service with the source code supplied in the file indicated by the filepath.
+// If the service has an image cache, and an image of the service has been cached there and none of
+// its sources have changed since, the service is loaded from that instead; otherwise an image is
+// cached after compilation.
 func (sv *Service) InitializeFromFilepath(scriptFilepath string) error {
+	if len(sv.stubs) == 0 && sv.initializeFromImageCache(scriptFilepath) {
+		return nil
+	}
 	sourcecode, e := compiler.GetSourceCode(scriptFilepath)
 	if e != nil {
 		return e
 	}
-	return sv.initialize(scriptFilepath, sourcecode)
+	e = sv.initialize(scriptFilepath, sourcecode)
+	if e == nil {
+		sv.writeImageCache(scriptFilepath)
+	}
+	return e
+}
+
+// Initializes the service from an image written by `WriteImage`. A service loaded from an
+// image can do anything a service compiled from its sources can, without needing the sources.
+func (sv *Service) InitializeFromImage(r io.Reader) error {
+	compilerMap := make(map[string]*compiler.Compiler)
+	for k, v := range sv.localExternals {
+		compilerMap[k] = v.cp
+	}
+	cp, e := initializer.StartCompilerFromImage(r, sv.db, compilerMap)
+	if e != nil {
+		return e
+	}
+	cp.Vm.NamedDatabases = sv.databases
+	cp.Vm.Limits = sv.limits
+	cp.Vm.Metrics = sv.metrics
+	sv.setCompiler(cp)
+	return nil
+}
+
+// Writes an image of the compiled service, from which it can be restarted with
+// `InitializeFromImage`. This fails if the service uses external services, since they
+// can't be put in an image.
+func (sv *Service) WriteImage(w io.Writer) error {
+	if sv.cp == nil {
+		return errors.New("service is uninitialized")
+	}
+	if sv.IsBroken() {
+		return errors.New("service is broken")
+	}
+	return sv.cp.WriteImage(w)
+}
+
+// Where the image of the service with the given root file is cached, if it has an image cache.
+func (sv *Service) imageCacheFilepath(scriptFilepath string) (string, bool) {
+	if sv.imageCache == "" || scriptFilepath == "" {
+		return "", false
+	}
+	absolutePath, e := filepath.Abs(scriptFilepath)
+	if e != nil {
+		return "", false
+	}
+	return filepath.Join(sv.imageCache, text.Flatten(absolutePath)+".pfi"), true
+}
+
+// Tries to load the service from its cached image, which it won't do if the image is older than
+// the Pipefish executable, or if the sources have changed since it was written.
+func (sv *Service) initializeFromImageCache(scriptFilepath string) bool {
+	imageFilepath, ok := sv.imageCacheFilepath(scriptFilepath)
+	if !ok {
+		return false
+	}
+	imageInfo, e := os.Stat(imageFilepath)
+	if e != nil {
+		return false
+	}
+	executable, e := os.Executable()
+	if e != nil {
+		return false
+	}
+	executableInfo, e := os.Stat(executable)
+	if e != nil || imageInfo.ModTime().Before(executableInfo.ModTime()) {
+		return false
+	}
+	file, e := os.Open(imageFilepath)
+	if e != nil {
+		return false
+	}
+	defer file.Close()
+	oldCp := sv.cp
+	if sv.InitializeFromImage(file) != nil || sv.cp.ScriptFilepath != scriptFilepath {
+		sv.cp = oldCp
+		return false
+	}
+	if needsUpdate, e := sv.cp.NeedsUpdate(); needsUpdate || e != nil {
+		sv.cp = oldCp
+		return false
+	}
+	return true
+}
+
+// Caches an image of the service if it can. Since this is only an optimization, failure is silent.
+func (sv *Service) writeImageCache(scriptFilepath string) {
+	imageFilepath, ok := sv.imageCacheFilepath(scriptFilepath)
+	if !ok || os.MkdirAll(filepath.Dir(imageFilepath), 0755) != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if sv.WriteImage(&buf) != nil {
+		return
+	}
+	temporaryFilepath := imageFilepath + ".tmp"
+	if os.WriteFile(temporaryFilepath, buf.Bytes(), 0644) != nil {
+		return
+	}
+	if os.Rename(temporaryFilepath, imageFilepath) != nil {
+		os.Remove(temporaryFilepath)
+	}
 }
 
 // Initializes the service on behalf of both the previous methods. As the
@@ -56,10 +193,16 @@ func (sv *Service) initialize(scriptFilepath, sourcecode string) error {
 	for k, v := range sv.localExternals {
 		compilerMap[k] = v.cp
 	}
-	cp := initializer.StartCompiler(scriptFilepath, sourcecode, sv.db, compilerMap)
-	sv.cp = cp
+	cp := initializer.StartCompilerWithStubs(scriptFilepath, sourcecode, sv.db, compilerMap, sv.stubs)
+	cp.Vm.NamedDatabases = sv.databases
+	cp.Vm.Limits = sv.limits
+	cp.Vm.Metrics = sv.metrics
+	sv.setCompiler(cp)
 	for k, v := range compilerMap {
-		sv.localExternals[k].cp = v
+		if _, ok := sv.localExternals[k]; !ok {
+			sv.localExternals[k] = NewService()
+		}
+		sv.localExternals[k].setCompiler(v)
 	}
 	if sv.IsBroken() {
 		return errors.New("compilation error")
@@ -85,6 +228,10 @@ type InHandler = compiler.InHandler
 // which if necessary allows the user to write a string to the same place.
 type OutHandler = compiler.OutHandler
 
+// An InHandler which is also given the prompt of the `Input` the Pipefish code is getting from,
+// by its method `GetWithPrompt(prompt string) string`, which is called instead of `Get()`.
+type PromptingInHandler = compiler.PromptingInHandler
+
 // An InHandler which just gets an input from an io.Reader supplied at its construction.
 type SimpleInHandler = compiler.SimpleInHandler
 
@@ -107,6 +254,51 @@ type Set = values.Set
 // The representation of a Pipefish set in the `V` field of a `Value` with `T` = `ERROR`.
 type Error = err.Error
 
+// Limits on how many instructions a call to a service may execute, how long it may take, how
+// deep its recursion may go, and how much memory its recursion may use. A zero field means
+// no limit of that kind.
+type Limits = compiler.Limits
+
+// How the tables declared by a service differ from its struct types. Each `TableMigration` has
+// the SQL statements which would make a table fit its type, and the possible renames of columns,
+// which are only made if they're confirmed.
+type MigrationPlan = compiler.MigrationPlan
+
+// How one table differs from the struct type it was declared from.
+type TableMigration = compiler.TableMigration
+
+// Who is calling a service, with the groups they belong to, so that it can check whether they're
+// permitted to call the functions and commands it has declared for only some groups.
+type Caller = compiler.Caller
+
+// A step debugger attached to a service, which can set breakpoints and inspect the
+// callstack and variables when the service is stopped.
+type Debugger = compiler.Debugger
+
+// An interface with one method, `Stopped(d *Debugger, reason string) DebugAction`,
+// which the debugger calls when the service stops, and which should block until the
+// user says whether to resume or step. Since the service is still locked by the call
+// which stopped, the handler should look at it only through the `Debugger`.
+type DebugHandler = compiler.DebugHandler
+
+// What a `DebugHandler` tells the debugger to do next.
+type DebugAction = compiler.DebugAction
+
+// A frame of the callstack of a stopped service.
+type StackFrame = compiler.StackFrame
+
+// A variable of a stopped service, with its type and value described as literals.
+type DebugVariable = compiler.DebugVariable
+
+// Constants representing debug actions.
+const (
+	DEBUG_RESUME    = compiler.DEBUG_RESUME
+	DEBUG_STEP_IN   = compiler.DEBUG_STEP_IN
+	DEBUG_STEP_OVER = compiler.DEBUG_STEP_OVER
+	DEBUG_STEP_OUT  = compiler.DEBUG_STEP_OUT
+	DEBUG_DETACH    = compiler.DEBUG_DETACH
+)
+
 // Constants representing Pipefish types.
 const (
 	UNDEFINED_TYPE Type = values.UNDEFINED_TYPE
@@ -172,6 +364,54 @@ func (sv *Service) SetLocalExternalServices(svs map[string]*Service) {
 	sv.localExternals = svs
 }
 
+// Makes the service cache images of itself in the given directory when it's initialized from a
+// file, and start from them when its sources haven't changed since. By default, or if the
+// directory is "", it caches nothing. This must be done before the service is initialized.
+func (sv *Service) SetImageCache(dir string) {
+	sv.imageCache = dir
+}
+
+// Makes the service use the stubs in the given files in place of the external services of
+// the given names, as `hub test` does. This must be done before the service is initialized.
+func (sv *Service) SetExternalStubs(stubs map[string]string) {
+	sv.stubs = stubs
+}
+
+// Where the API of an external service is kept alongside the stub of it in the given file, so that
+// the service using the stub compiles as it would with the real one.
+func StubAPIFilepath(stubFilepath string) string {
+	return initializer.StubAPIFilepath(stubFilepath)
+}
+
+// What `ExternalStubs` supplies for each external service.
+type ExternalStub struct {
+	API    string // The serialized API of the external service.
+	Source string // The source code of a stub of the external service, to which responses can be added.
+}
+
+// Returns a stub of each of the external services of the service, by name. The source code of the
+// stub can be edited to script its responses, and then saved to a file, with the API in the file
+// given by `StubAPIFilepath`, and supplied to `SetExternalStubs`.
+func (sv *Service) ExternalStubs() (map[string]ExternalStub, error) {
+	if sv.cp == nil {
+		return nil, errors.New("service is uninitialized")
+	}
+	if sv.IsBroken() {
+		return nil, errors.New("service is broken")
+	}
+	defer sv.lock()()
+	result := map[string]ExternalStub{}
+	for i, handler := range sv.cp.Vm.ExternalCallHandlers {
+		name := sv.cp.Vm.ExternalServiceNames[i]
+		serializedAPI, e := handler.GetAPI()
+		if e != nil {
+			return nil, fmt.Errorf("can't get the API of external service %s: %w", name, e)
+		}
+		result[name] = ExternalStub{API: serializedAPI, Source: initializer.SerializedAPIToStub(serializedAPI, name)}
+	}
+	return result, nil
+}
+
 // Sets an InHandler, i.e. the thing that decides what happens when you do
 // `get x from Input()`.
 func (sv *Service) SetInHandler(in InHandler) error {
@@ -181,6 +421,7 @@ func (sv *Service) SetInHandler(in InHandler) error {
 	if sv.IsBroken() {
 		return errors.New("service is broken")
 	}
+	defer sv.lock()()
 	sv.cp.Vm.InHandle = in
 	return nil
 }
@@ -194,10 +435,41 @@ func (sv *Service) SetOutHandler(out compiler.OutHandler) error {
 	if sv.IsBroken() {
 		return errors.New("service is broken")
 	}
+	defer sv.lock()()
 	sv.cp.Vm.OutHandle = out
 	return nil
 }
 
+// Attaches a debugger to the service, replacing any debugger already attached. The
+// handler will be called whenever the service stops at a breakpoint or after a step.
+func (sv *Service) StartDebugging(handler DebugHandler) (*Debugger, error) {
+	if sv.cp == nil {
+		return nil, errors.New("service is uninitialized")
+	}
+	if sv.IsBroken() {
+		return nil, errors.New("service is broken")
+	}
+	defer sv.lock()()
+	return sv.cp.StartDebugging(handler), nil
+}
+
+// Detaches the debugger from the service, if there is one.
+func (sv *Service) StopDebugging() error {
+	if sv.cp == nil {
+		return errors.New("service is uninitialized")
+	}
+	sv.cp.StopDebugging()
+	return nil
+}
+
+// Gets the debugger attached to the service, if there is one.
+func (sv *Service) GetDebugger() (*Debugger, bool) {
+	if sv.cp == nil || sv.cp.Vm.Debugger == nil {
+		return nil, false
+	}
+	return sv.cp.Vm.Debugger, true
+}
+
 // Sets the database to be used by the service.
 func (sv *Service) SetDatabase(db *sql.DB) {
 	sv.db = db
@@ -206,41 +478,303 @@ func (sv *Service) SetDatabase(db *sql.DB) {
 	}
 }
 
+// Gets the database used by the service, which is the one its SQL snippets go to if
+// they don't name one, and which `PlanMigration` compares the struct types with.
+func (sv *Service) GetDatabase() *sql.DB {
+	if sv.cp != nil {
+		return sv.cp.Vm.Database
+	}
+	return sv.db
+}
+
+// Sets a database which SQL snippets can go to by name, as in `SQL(analytics) ---`,
+// rather than to the database set by `SetDatabase`. Setting it to `nil` removes it.
+func (sv *Service) SetNamedDatabase(name string, db *sql.DB) {
+	defer sv.lock()()
+	if db == nil {
+		delete(sv.databases, name)
+		return
+	}
+	sv.databases[name] = db
+}
+
+// Sets the limits on what each call to the service may do. When a call exceeds one,
+// it returns a Pipefish error rather than carrying on. They last until they are set
+// again, including when the service is reinitialized.
+func (sv *Service) SetLimits(limits Limits) {
+	defer sv.lock()()
+	sv.limits = limits
+	if sv.cp != nil {
+		sv.cp.Vm.Limits = limits
+	}
+}
+
+// Gets the limits on what each call to the service may do.
+func (sv *Service) GetLimits() Limits {
+	defer sv.lock()()
+	return sv.limits
+}
+
+type callerKey struct{}
+
+// Returns a copy of the context which says who is calling the service, so that the lines they
+// do and the functions they call by name are checked against the groups those are declared for. If
+// the context doesn't say, or the caller is nil, they may call anything.
+func WithCaller(ctx context.Context, caller *Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func callerOf(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerKey{}).(*Caller)
+	return caller
+}
+
+// Returns the permissions the service declares with its `for` lines, as a map from the names of
+// its restricted functions and commands to the groups of users which may call them.
+func (sv *Service) GetPermissions() (map[string][]string, error) {
+	if sv.cp == nil {
+		return nil, errors.New("service is uninitialized")
+	}
+	defer sv.lock()()
+	return sv.cp.Permissions(), nil
+}
+
 // Once the service is initialized, will interpret the string supplied as though
 // it had been entered into the REPL of the service. The error field will be non-nil
 // in the case of a compile-time error. In the case of a runtime error, it will be
 // nil, and the error will be returned as the `Value`.
 func (sv *Service) Do(line string) (Value, error) {
+	return sv.DoContext(context.Background(), line)
+}
+
+// Like `Do`, except that if the context is cancelled or its deadline passes before the
+// line has finished running, it is stopped and a Pipefish error is returned as the
+// `Value`, as it is if it exceeds the limits of the service.
+func (sv *Service) DoContext(ctx context.Context, line string) (Value, error) {
+	if sv.cp == nil {
+		return Value{}, errors.New("service is uninitialized")
+	}
+	if sv.IsBroken() {
+		return Value{}, errors.New("service is broken")
+	}
+	defer sv.lock()()
+	return sv.do(ctx, line)
+}
+
+// Returned by `DoWithOutput` when the line can't be parsed or compiled. As the service may
+// have gone on to do other things by the time the caller looks at its errors, this keeps
+// them and the report on them.
+type LineError struct {
+	Errors []*Error
+	Report string
+}
+
+func (e *LineError) Error() string {
+	return "error compiling input"
+}
+
+// Like `DoContext`, except that anything the line posts to `Output()` is written as a string
+// to the writer supplied rather than going to the service's own `OutHandler`; and that if the
+// line can't be compiled, the error returned is a `*LineError`. This is for when a service is
+// handling many requests at once: each gets its own output and its own errors, and the
+// requests take turns with the vm.
+func (sv *Service) DoWithOutput(ctx context.Context, line string, out io.Writer) (Value, error) {
+	return sv.doWithHandlers(ctx, line, nil, func(vm *compiler.Vm) OutHandler {
+		return compiler.MakeSimpleOutHandler(out, vm, false)
+	})
+}
+
+// Like `DoWithOutput`, except that what the line posts to `Output()` goes to the `OutHandler`
+// supplied, and what it gets from `Input()` comes from the `InHandler`, e.g. so that they can be
+// streamed to and from a client over the network while the line is running. If the `InHandler`
+// is nil, the service's own is used. The handlers are called while the service is busy with the
+// line, so they mustn't call its methods, though they may use an `OutHandler` made beforehand by
+// one of the `Make...OutHandler` methods to turn values into strings.
+func (sv *Service) DoWithHandlers(ctx context.Context, line string, in InHandler, out OutHandler) (Value, error) {
+	return sv.doWithHandlers(ctx, line, in, func(*compiler.Vm) OutHandler { return out })
+}
+
+func (sv *Service) doWithHandlers(ctx context.Context, line string, in InHandler, out func(*compiler.Vm) OutHandler) (Value, error) {
 	if sv.cp == nil {
 		return Value{}, errors.New("service is uninitialized")
 	}
 	if sv.IsBroken() {
 		return Value{}, errors.New("service is broken")
 	}
+	defer sv.lock()()
+	inHandle, outHandle := sv.cp.Vm.InHandle, sv.cp.Vm.OutHandle
+	sv.cp.Vm.OutHandle = out(sv.cp.Vm)
+	if in != nil {
+		sv.cp.Vm.InHandle = in
+	}
+	defer func() { sv.cp.Vm.InHandle, sv.cp.Vm.OutHandle = inHandle, outHandle }()
+	v, e := sv.do(ctx, line)
+	if e != nil && sv.cp.P.ErrorsExist() {
+		return v, &LineError{Errors: sv.cp.P.Common.Errors, Report: sv.cp.P.ReturnErrors()}
+	}
+	return v, e
+}
+
+// Does the work of the previous functions. The caller must hold the lock.
+func (sv *Service) do(ctx context.Context, line string) (Value, error) {
+	return sv.doInEnvironment(ctx, line, sv.cp.GlobalVars)
+}
+
+func (sv *Service) doInEnvironment(ctx context.Context, line string, env *compiler.Environment) (Value, error) {
+	defer sv.enterSession(ctx)()
 	sv.cp.P.ResetAfterError()
 	sv.cp.Vm.LiveTracking = make([]compiler.TrackingData, 0)
+	defer sv.cp.Vm.SetFoldingContext(ctx)()
 	state := sv.cp.GetState()
 	cT := sv.cp.CodeTop()
-	node := sv.cp.P.ParseLine("REPL input", line)
+	node := sv.cp.P.ParseImperativeLine("REPL input", line)
 	if settings.SHOW_PARSER {
 		fmt.Println("Parsed line:", node.String())
 	}
 	if sv.cp.P.ErrorsExist() {
 		return Value{}, errors.New("error parsing input")
 	}
-	ctxt := compiler.Context{Env: sv.cp.GlobalVars, Access: compiler.REPL, LowMem: compiler.DUMMY, LogFlavor: compiler.LF_NONE}
+	ctxt := compiler.Context{Env: env, Access: compiler.REPL, LowMem: compiler.DUMMY, LogFlavor: compiler.LF_NONE, Caller: callerOf(ctx)}
 	sv.cp.CompileNode(node, ctxt)
 	if sv.cp.P.ErrorsExist() {
 		return Value{}, errors.New("error compiling input")
 	}
 	sv.cp.Emit(compiler.Ret)
 	sv.cp.Cm("Calling Run from Do.", node.GetToken())
-	sv.cp.Vm.Run(cT)
-	result := sv.cp.Vm.Mem[sv.cp.That()]
+	result, ok := sv.cp.Vm.RunContext(ctx, cT)
+	if ok {
+		result = sv.cp.Vm.Mem[sv.cp.That()]
+	}
 	sv.cp.Rollback(state, node.GetToken())
 	return result, nil
 }
 
+// Calls the public function or command of the given name with arguments given as JSON, which
+// are converted to Pipefish values of the types in its signature, as described in `vmjson.go`
+// in the compiler. The first overload of the function which the arguments fit is the one
+// called. As with `DoWithOutput`, anything posted to `Output()` goes to the writer supplied.
+//
+// The error returned is `compiler.ErrNoSuchFunction` or `compiler.ErrNoMatchingOverload`, or
+// wraps one of them, if the function can't be called with the arguments, and wraps
+// `compiler.ErrAccessDenied` if the caller given by `WithCaller` isn't permitted to call it;
+// a runtime error is returned as the `Value`.
+func (sv *Service) CallJson(ctx context.Context, function string, args []json.RawMessage, out io.Writer) (Value, error) {
+	if sv.cp == nil {
+		return Value{}, errors.New("service is uninitialized")
+	}
+	if sv.IsBroken() {
+		return Value{}, errors.New("service is broken")
+	}
+	decoded := make([]any, len(args))
+	for i, arg := range args {
+		decoder := json.NewDecoder(bytes.NewReader(arg))
+		decoder.UseNumber()
+		if e := decoder.Decode(&decoded[i]); e != nil {
+			return Value{}, e
+		}
+	}
+	defer sv.lock()()
+	fn, vals, e := sv.cp.MatchJsonArguments(function, decoded)
+	if e != nil {
+		return Value{}, e
+	}
+	if caller := callerOf(ctx); !compiler.MayCall(caller, fn.Access) {
+		return Value{}, fmt.Errorf("%w: user %s may not call %s", compiler.ErrAccessDenied, text.Emph(caller.Name), text.Emph(function))
+	}
+	outHandle := sv.cp.Vm.OutHandle
+	sv.cp.Vm.OutHandle = compiler.MakeSimpleOutHandler(out, sv.cp.Vm, false)
+	defer func() { sv.cp.Vm.OutHandle = outHandle }()
+	state := sv.cp.GetState()
+	line, env := sv.cp.MakeCallLine(fn, vals)
+	defer sv.cp.Rollback(state, fn.Tok)
+	v, e := sv.doInEnvironment(ctx, line, env)
+	if e != nil && sv.cp.P.ErrorsExist() {
+		return v, &LineError{Errors: sv.cp.P.Common.Errors, Report: sv.cp.P.ReturnErrors()}
+	}
+	return v, e
+}
+
+// Returns true if the service has a public function or command of the given name, such as
+// `CallJson` could call.
+func (sv *Service) HasFunction(name string) bool {
+	if sv.IsBroken() {
+		return false
+	}
+	defer sv.lock()()
+	return sv.cp.HasApiFunction(name)
+}
+
+// The JSON representation of a `Value` returned by a function, with the value as `Result`,
+// unless it's a runtime error, in which case it's given as `Error`, so that the two can't
+// be confused. `Output` is for whatever the function posted to `Output()`, if the caller
+// wants to send it along too.
+type JsonResult struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *JsonError      `json:"error,omitempty"`
+	Output string          `json:"output,omitempty"`
+}
+
+type JsonError struct {
+	ErrorId string `json:"errorId,omitempty"`
+	Message string `json:"message"`
+}
+
+// Converts a `Value` to a `JsonResult`, as described in `vmjson.go` in the compiler. The error
+// is non-nil if the value has no JSON representation, e.g. if it's a lambda.
+func (sv *Service) ToJsonResult(v Value) (*JsonResult, error) {
+	defer sv.lock()()
+	if v.T == ERROR {
+		e := sv.toJsonError(v.V.(*Error))
+		return &JsonResult{Error: &e}, nil
+	}
+	goValue, e := sv.cp.Vm.PipefishToJson(v)
+	if e != nil {
+		return nil, e
+	}
+	result, e := json.Marshal(goValue)
+	if e != nil {
+		return nil, e
+	}
+	return &JsonResult{Result: result}, nil
+}
+
+// Returns an OpenAPI 3.1 document describing how to call the public functions and commands
+// of the service with `CallJson`, as the hub lets HTTP clients do. The name is the name the
+// hub gives the service, which is needed for the paths, and `basicAuth` says whether the
+// hub wants a username and password.
+func (sv *Service) OpenApi(name string, basicAuth bool) ([]byte, error) {
+	if sv.cp == nil {
+		return nil, errors.New("service is uninitialized")
+	}
+	if sv.IsBroken() {
+		return nil, errors.New("service is broken")
+	}
+	defer sv.lock()()
+	return json.MarshalIndent(sv.cp.OpenApi(name, basicAuth), "", "  ")
+}
+
+// Compares each table which the service declares with `CREATE TABLE <name> |<struct type>|` with
+// the table in its database, and returns how the tables which have drifted from their struct types
+// would have to change to fit them again.
+func (sv *Service) PlanMigration() (*MigrationPlan, error) {
+	if sv.cp == nil {
+		return nil, errors.New("service is uninitialized")
+	}
+	if sv.IsBroken() {
+		return nil, errors.New("service is broken")
+	}
+	defer sv.lock()()
+	return sv.cp.Vm.PlanMigration()
+}
+
+func (sv *Service) toJsonError(e *Error) JsonError {
+	message := e.Message
+	if e.ErrorId != "eval/user" && e.ErrorId != "" {
+		message = err.CreateErr(e.ErrorId, e.Token, e.Args...).Message
+	}
+	return JsonError{ErrorId: e.ErrorId, Message: message}
+}
+
 // Gets the value of a global variable given its name. Unlike using `Do` for the
 // same purpose, this can get the value of private variables.
 func (sv *Service) GetVariable(vname string) (values.Value, error) {
@@ -250,6 +784,7 @@ func (sv *Service) GetVariable(vname string) (values.Value, error) {
 	if sv.IsBroken() {
 		return Value{}, errors.New("service is broken")
 	}
+	defer sv.lock()()
 	v, ok := sv.cp.GlobalVars.GetVar(vname)
 	if !ok {
 		return Value{}, errors.New("Variable does not exist")
@@ -266,6 +801,7 @@ func (sv *Service) SetVariable(vname string, ty values.ValueType, v any) error {
 	if sv.IsBroken() {
 		return errors.New("service is broken")
 	}
+	defer sv.lock()()
 	_, ok := sv.cp.GlobalVars.GetVar(vname)
 	if !ok {
 		return errors.New("Variable does not exist")
@@ -276,7 +812,13 @@ func (sv *Service) SetVariable(vname string, ty values.ValueType, v any) error {
 
 // Calls the `main` function.
 func (s *Service) CallMain() (values.Value, error) {
-	return s.cp.CallIfExists("main")
+	return s.CallMainContext(context.Background())
+}
+
+// Calls the `main` function, subject to the context as `DoContext` is.
+func (s *Service) CallMainContext(ctx context.Context) (values.Value, error) {
+	defer s.lock()()
+	return s.cp.CallIfExistsContext(ctx, "main")
 }
 
 // Checks whether the source code for a service has been changed since it was
@@ -354,11 +896,27 @@ func (sv *Service) GetErrors() []*Error {
 
 // Converts a `Value` to a string using Pipefish's `literal` function.
 func (sv *Service) ToLiteral(v Value) string {
+	defer sv.lock()()
 	return sv.cp.Vm.Literal(v)
 }
 
+// Encodes a `Value` in the binary wire format, which identifies the types by name and so can be
+// decoded by any service which has types of the same names and shapes. Lambdas, iterators and
+// other such values can't be encoded.
+func (sv *Service) EncodeValue(v Value) ([]byte, error) {
+	defer sv.lock()()
+	return sv.cp.Vm.EncodeValue(v)
+}
+
+// Decodes a `Value` encoded by `EncodeValue`, possibly by another service.
+func (sv *Service) DecodeValue(data []byte) (Value, error) {
+	defer sv.lock()()
+	return sv.cp.Vm.DecodeValue(data, "")
+}
+
 // Converts a `Value` to a string using Pipefish's `string` function.
 func (sv *Service) ToString(v Value) string {
+	defer sv.lock()()
 	return sv.cp.Vm.Literal(v)
 }
 
@@ -0,0 +1,1505 @@
+package pf_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/compiler"
+	"github.com/tim-hardcastle/Pipefish/source/err"
+	"github.com/tim-hardcastle/Pipefish/source/pf"
+	"github.com/tim-hardcastle/Pipefish/source/values"
+
+	_ "modernc.org/sqlite"
+)
+
+const concurrencyTestCode = `var
+
+count = 0
+
+cmd
+
+bump :
+    count = count + 1
+
+say(s string) :
+    post s to Output()
+
+def
+
+square(n int) : n * n
+`
+
+// Hammers one service from many goroutines at once, checking that each request gets
+// its own output and result, and that none of the changes to its state are lost.
+func TestConcurrentRequests(t *testing.T) {
+	const goroutines = 32
+	const requests = 100
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4)) // So that the goroutines really do run at the same time.
+	sv := pf.NewService()
+	if e := sv.InitializeFromCode(concurrencyTestCode); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	var wg sync.WaitGroup
+	failures := make(chan string, goroutines*requests)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				var buf bytes.Buffer
+				message := strconv.Itoa(g) + "/" + strconv.Itoa(i)
+				_, e := sv.DoWithOutput(context.Background(), `say "`+message+`"`, &buf)
+				if want := `"` + message + `"` + "\n"; e != nil || buf.String() != want {
+					failures <- "wanted output " + want + " | got " + buf.String()
+				}
+				n := g*requests + i
+				buf.Reset()
+				v, e := sv.DoWithOutput(context.Background(), "square "+strconv.Itoa(n), &buf)
+				if e != nil || v.T != pf.INT || v.V.(int) != n*n || buf.Len() != 0 {
+					failures <- "wrong result squaring " + strconv.Itoa(n) + ": " + sv.ToLiteral(v)
+				}
+				if _, e := sv.DoWithOutput(context.Background(), "bump", &buf); e != nil {
+					failures <- "couldn't bump: " + e.Error()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(failures)
+	for failure := range failures {
+		t.Error(failure)
+	}
+	count, _ := sv.GetVariable("count")
+	if count.V.(int) != goroutines*requests {
+		t.Fatalf("Wanted count %v | Got %v", goroutines*requests, count.V)
+	}
+}
+
+// Checks that a line that can't be compiled reports its own errors however many other
+// requests are being done at the same time.
+func TestConcurrentCompileErrors(t *testing.T) {
+	sv := pf.NewService()
+	if e := sv.InitializeFromCode(concurrencyTestCode); e != nil {
+		t.Fatalf("There were errors initializing the service.")
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				var buf bytes.Buffer
+				if g%2 == 0 {
+					v, e := sv.DoWithOutput(context.Background(), "square 2", &buf)
+					if e != nil || v.V != 4 {
+						t.Errorf("wanted 4 | got %v, %v", v.V, e)
+					}
+					continue
+				}
+				_, e := sv.DoWithOutput(context.Background(), "zort 2", &buf)
+				lineError, ok := e.(*pf.LineError)
+				if !ok || len(lineError.Errors) == 0 || lineError.Report == "" {
+					t.Errorf("wanted a compile error | got %v", e)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// Stops when asked to and waits to be told to carry on.
+type pausingHandler struct {
+	stopped chan struct{}
+	resume  chan struct{}
+}
+
+func (h *pausingHandler) Stopped(d *pf.Debugger, reason string) pf.DebugAction {
+	h.stopped <- struct{}{}
+	<-h.resume
+	return pf.DEBUG_RESUME
+}
+
+// Checks that while one request is stopped in the debugger, another waits for it to carry on
+// rather than running on the same vm.
+func TestRequestsWaitForDebugger(t *testing.T) {
+	sv := pf.NewService()
+	if e := sv.InitializeFromCode(concurrencyTestCode); e != nil {
+		t.Fatalf("There were errors initializing the service.")
+	}
+	handler := &pausingHandler{stopped: make(chan struct{}), resume: make(chan struct{})}
+	d, e := sv.StartDebugging(handler)
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.RequestPause()
+	bumped := make(chan error)
+	go func() {
+		_, e := sv.Do("bump")
+		bumped <- e
+	}()
+	<-handler.stopped
+	counted := make(chan pf.Value)
+	go func() {
+		v, _ := sv.Do("count")
+		counted <- v
+	}()
+	select {
+	case v := <-counted:
+		t.Fatalf("a request ran while another was stopped in the debugger, and got %s", sv.ToLiteral(v))
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(handler.resume)
+	if e := <-bumped; e != nil {
+		t.Fatal(e)
+	}
+	if v := <-counted; v.T != pf.INT || v.V.(int) != 1 {
+		t.Errorf("wanted 1 | got %s", sv.ToLiteral(v))
+	}
+}
+
+const externalCallTestCode = concurrencyTestCode + `
+spin(n int) :
+    from a = 0 for i = 0; true; i + 1 :
+        continue
+`
+
+// Checks that a call from another service on the same hub waits, like a request, while the
+// external service is stopped in the debugger, and that it's subject to the caller's context and
+// to the caller's time limit.
+func TestExternalCallsTakeTurns(t *testing.T) {
+	ext := pf.NewService()
+	if e := ext.InitializeFromCode(externalCallTestCode); e != nil {
+		r, _ := ext.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	client := pf.NewService()
+	client.SetLocalExternalServices(map[string]*pf.Service{"ext": ext})
+	if e := client.InitializeFromCode("external\n\next\n"); e != nil {
+		r, _ := client.GetErrorReport()
+		t.Fatalf("There were errors initializing the client : \n" + r)
+	}
+	handler := &pausingHandler{stopped: make(chan struct{}), resume: make(chan struct{})}
+	d, e := ext.StartDebugging(handler)
+	if e != nil {
+		t.Fatal(e)
+	}
+	d.RequestPause()
+	bumped := make(chan error)
+	go func() {
+		_, e := ext.Do("bump")
+		bumped <- e
+	}()
+	<-handler.stopped
+	squared := make(chan pf.Value)
+	go func() {
+		v, _ := client.Do("ext.square 3")
+		squared <- v
+	}()
+	select {
+	case v := <-squared:
+		t.Fatalf("an external call ran while the service was stopped in the debugger, and got %s", client.ToLiteral(v))
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(handler.resume)
+	if e := <-bumped; e != nil {
+		t.Fatal(e)
+	}
+	if v := <-squared; v.T != pf.INT || v.V.(int) != 9 {
+		t.Errorf("wanted 9 | got %s", client.ToLiteral(v))
+	}
+	ext.StopDebugging()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if v, e := client.DoContext(ctx, "ext.spin 1"); e != nil || v.T != pf.ERROR {
+		t.Errorf("wanted the caller's deadline to stop the external call | got %s, %v", client.ToLiteral(v), e)
+	}
+	client.SetLimits(pf.Limits{Time: 100 * time.Millisecond})
+	if v, e := client.Do("ext.spin 1"); e != nil || v.T != pf.ERROR || !strings.Contains(v.V.(*pf.Error).ErrorId, "vm/limit/time") {
+		t.Errorf("wanted the caller's time limit to stop the external call | got %s, %v", client.ToLiteral(v), e)
+	}
+	if v, e := ext.Do("count"); e != nil || v.V != 1 {
+		t.Errorf("wanted the service to carry on afterwards | got %s, %v", ext.ToLiteral(v), e)
+	}
+}
+
+const jsonTestCode = `newtype
+
+Color = enum RED, GREEN
+Person = struct(name varchar(5), age int, fave Color, pet string?)
+Money = clone int
+
+def
+
+greet(p Person) : "Hi " + p[name]
+greet(s string) : "Hello " + s
+(x int) plus (y int) : x + y
+(x int) squared : x * x
+rest(x int, xs ...int) : xs
+double(m Money) : Money(int(m) * 2)
+recip(x int) : 1 / x
+foo (x int) bar (y int) : x * y
+rekey(m map) : m
+swap(p pair) : p[1]::p[0]
+newborn(s string) : Person(s, 0, GREEN, NULL)
+
+cmd
+
+shout(s string) :
+    post s to Output()
+`
+
+// Checks that functions called with JSON pick the right overload and convert their arguments
+// and results.
+func TestCallJson(t *testing.T) {
+	sv := pf.NewService()
+	if e := sv.InitializeFromCode(jsonTestCode); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	tests := []struct {
+		function string
+		args     string
+		want     string
+	}{
+		{"greet", `[{"name": "Joe", "age": 3, "fave": "RED"}]`, `{"result":"Hi Joe"}`},
+		{"greet", `["Joe"]`, `{"result":"Hello Joe"}`},
+		{"plus", `[2, 3]`, `{"result":5}`},
+		{"squared", `[7]`, `{"result":49}`},
+		{"rest", `[1, 2, 3]`, `{"result":[2,3]}`},
+		{"double", `[21]`, `{"result":42}`},
+		{"recip", `[0]`, `{"error":{"errorId":"vm/div/int","message":"division by zero"}}`},
+		{"foo", `[2, 4]`, `{"result":8}`},
+		{"rekey", `[{"a": [1, 2.5, null]}]`, `{"result":{"a":[1,2.5,null]}}`},
+		{"rekey", `[[[1, "x"]]]`, `{"result":[[1,"x"]]}`},
+		{"swap", `[[1, "x"]]`, `{"result":["x",1]}`},
+		{"newborn", `["Ann"]`, `{"result":{"age":0,"fave":"GREEN","name":"Ann","pet":null}}`},
+		{"shout", `["hey"]`, `{"result":"OK","output":"\"hey\"\n"}`},
+	}
+	for _, test := range tests {
+		var args []json.RawMessage
+		if e := json.Unmarshal([]byte(test.args), &args); e != nil {
+			t.Fatal(e)
+		}
+		var buf bytes.Buffer
+		v, e := sv.CallJson(context.Background(), test.function, args, &buf)
+		if e != nil {
+			t.Errorf("%s %s: %v", test.function, test.args, e)
+			continue
+		}
+		result, e := sv.ToJsonResult(v)
+		if e != nil {
+			t.Errorf("%s %s: %v", test.function, test.args, e)
+			continue
+		}
+		result.Output = buf.String()
+		got, _ := json.Marshal(result)
+		if string(got) != test.want {
+			t.Errorf("%s %s: wanted %s | got %s", test.function, test.args, test.want, got)
+		}
+	}
+	failures := []struct {
+		function string
+		args     string
+		want     error
+	}{
+		{"greet", `[{"name": "Joseph", "age": 3, "fave": "RED"}]`, compiler.ErrNoMatchingOverload},
+		{"greet", `[{"name": "Joe", "age": 3, "fave": "BLUE"}]`, compiler.ErrNoMatchingOverload},
+		{"plus", `[2]`, compiler.ErrNoMatchingOverload},
+		{"zort", `[]`, compiler.ErrNoSuchFunction},
+	}
+	for _, test := range failures {
+		var args []json.RawMessage
+		json.Unmarshal([]byte(test.args), &args)
+		if _, e := sv.CallJson(context.Background(), test.function, args, io.Discard); !errors.Is(e, test.want) {
+			t.Errorf("%s %s: wanted %v | got %v", test.function, test.args, test.want, e)
+		}
+	}
+}
+
+// Checks that the OpenAPI document describes the types and functions of the service, and that
+// everything it refers to is in it.
+func TestOpenApi(t *testing.T) {
+	sv := pf.NewService()
+	if e := sv.InitializeFromCode(jsonTestCode); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	doc, e := sv.OpenApi("test", false)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var api struct {
+		Paths      map[string]map[string]any
+		Components struct{ Schemas map[string]any }
+	}
+	if e := json.Unmarshal(doc, &api); e != nil {
+		t.Fatal(e)
+	}
+	schemas := map[string]string{
+		"Color":  `{"enum":["RED","GREEN"],"type":"string"}`,
+		"Money":  `{"type":"integer"}`,
+		"Person": `{"additionalProperties":false,"properties":{"age":{"type":"integer"},"fave":{"$ref":"#/components/schemas/Color"},"name":{"maxLength":5,"type":"string"},"pet":{"oneOf":[{"type":"null"},{"type":"string"}]}},"required":["name","age","fave"],"type":"object"}`,
+	}
+	for name, want := range schemas {
+		if got, _ := json.Marshal(api.Components.Schemas[name]); string(got) != want {
+			t.Errorf("schema %s: wanted %s | got %s", name, want, got)
+		}
+	}
+	for _, function := range []string{"greet", "plus", "squared", "rest", "foo", "shout"} {
+		if _, ok := api.Paths["/services/test/call/"+function]["post"]; !ok {
+			t.Errorf("no path for %s", function)
+		}
+	}
+	greet, _ := json.Marshal(api.Paths["/services/test/call/greet"]["post"].(map[string]any)["requestBody"])
+	if want := `{"content":{"application/json":{"schema":{"oneOf":[{"maxItems":1,"minItems":1,"prefixItems":[{"$ref":"#/components/schemas/Person"}],"type":"array"},{"maxItems":1,"minItems":1,"prefixItems":[{"type":"string"}],"type":"array"}]}}},"description":"The arguments, as an array."}`; string(greet) != want {
+		t.Errorf("request body of greet: wanted %s | got %s", want, greet)
+	}
+	for _, ref := range regexp.MustCompile(`"#/components/schemas/([^"]*)"`).FindAllStringSubmatch(string(doc), -1) {
+		if _, ok := api.Components.Schemas[ref[1]]; !ok {
+			t.Errorf("no schema for %s", ref[1])
+		}
+	}
+}
+
+const sqlTestCode = `newtype
+
+Color = enum RED, GREEN, BLUE
+Money = clone int
+Thing = struct(tag varchar(3), weight float, count int?, note string?, color Color, price Money, made Time, sound bool)
+Short = struct(tag varchar(2))
+
+cmd
+
+setup :
+    put SQL --- CREATE TABLE Things |Thing|
+
+add (t string, w float, c int?, n string?, k Color, p Money, m Time) :
+    put SQL ---
+        INSERT INTO Things VALUES (|t|, |w|, |c|, |n|, |k|, |p|, |m|, |true|)
+
+addOrdinal :
+    put SQL --- INSERT INTO Things VALUES ('ord', 1, NULL, NULL, 2, 3, '2024-01-02 03:04:05', 0)
+
+show :
+    get things as Thing from SQL --- SELECT * FROM Things
+    post things to Output()
+
+showShort :
+    get things as Short from SQL --- SELECT tag FROM Things
+    post things to Output()
+
+showWrongColumns :
+    get things as Short from SQL --- SELECT * FROM Things
+    post things to Output()
+
+insertBad :
+    put SQL --- INSERT INTO Missing VALUES (1)
+`
+
+// Checks that values of the supported types survive a round trip through the database,
+// and that failures are reported as errors.
+func TestSqlTypes(t *testing.T) {
+	db, e := sql.Open("sqlite", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1) // Each connection to ':memory:' is a different database.
+	sv := pf.NewService()
+	sv.SetDatabase(db)
+	if e := sv.InitializeFromCode(sqlTestCode); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	for _, line := range []string{
+		`setup`,
+		`add "box", 1.5, NULL, "hi", GREEN, Money(3), Time(2024, 5, 6, 7, 8, 9, 0, "UTC")`,
+		`add "pen", 2.0, 7, NULL, BLUE, Money(1), Time(2023, 1, 1, 0, 0, 0, 0, "UTC")`,
+		`addOrdinal`,
+	} {
+		if v, e := sv.Do(line); e != nil || v.T != values.SUCCESSFUL_VALUE {
+			t.Fatalf("%s: got %s, %v", line, sv.ToLiteral(v), e)
+		}
+	}
+	var buf bytes.Buffer
+	if _, e := sv.DoWithOutput(context.Background(), `show`, &buf); e != nil {
+		t.Fatal(e)
+	}
+	want := `[Thing with (tag::"box", weight::1.50000000, count::NULL, note::"hi", color::GREEN, price::Money(3), ` +
+		`made::Time with (year::2024, month::5, day::6, hour::7, minute::8, second::9, nanosecond::0, location::"UTC"), sound::true), ` +
+		`Thing with (tag::"pen", weight::2.00000000, count::7, note::NULL, color::BLUE, price::Money(1), ` +
+		`made::Time with (year::2023, month::1, day::1, hour::0, minute::0, second::0, nanosecond::0, location::"UTC"), sound::true), ` +
+		`Thing with (tag::"ord", weight::1.00000000, count::NULL, note::NULL, color::BLUE, price::Money(3), ` +
+		`made::Time with (year::2024, month::1, day::2, hour::3, minute::4, second::5, nanosecond::0, location::"UTC"), sound::false)]` + "\n"
+	if buf.String() != want {
+		t.Errorf("wanted %s | got %s", want, buf.String())
+	}
+	failures := []struct {
+		line    string
+		errorId string
+		message string
+	}{
+		{`showShort`, "sql/in/type/b", `can't convert "box" in column 'tag' to type 'varchar(2)'`},
+		{`showWrongColumns`, "sql/in/columns", `the query returned 8 columns but type 'Short' has 1 fields`},
+		{`insertBad`, "sql/out", `no such table: Missing`},
+		{`add "bad", 1.0, 1, NULL, RED, Money(1), Time(2023, 1, 1, 0, 0, 0, 0, "Nowhere/Nope")`, "sql/out/type", `can't write value of type 'Time'`},
+	}
+	for _, test := range failures {
+		v, e := sv.Do(test.line)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v.T != values.ERROR {
+			t.Errorf("%s: wanted error | got %s", test.line, sv.ToLiteral(v))
+			continue
+		}
+		pfErr := v.V.(*err.Error)
+		message := err.CreateErr(pfErr.ErrorId, pfErr.Token, pfErr.Args...).Message
+		if pfErr.ErrorId != test.errorId || !strings.Contains(message, test.message) {
+			t.Errorf("%s: wanted %s containing %q | got %s: %s", test.line, test.errorId, test.message, pfErr.ErrorId, message)
+		}
+	}
+}
+
+const transactionTestCode = `newtype
+
+Account = struct(holder string, balance int)
+
+cmd
+
+setup :
+    put SQL --- CREATE TABLE Accounts (holder TEXT PRIMARY KEY, balance INTEGER)
+    put SQL --- INSERT INTO Accounts VALUES ('ann', 100), ('bob', 0)
+
+transfer (n int) :
+    transaction :
+        put SQL --- UPDATE Accounts SET balance = balance - |n| WHERE holder = 'ann'
+        put SQL --- UPDATE Accounts SET balance = balance + |n| WHERE holder = 'bob'
+
+transferToNowhere (n int) :
+    transaction :
+        put SQL --- UPDATE Accounts SET balance = balance - |n| WHERE holder = 'ann'
+        put SQL --- UPDATE Missing SET balance = balance + |n|
+
+transferTooMuch (n int) :
+    transaction :
+        put SQL --- UPDATE Accounts SET balance = balance - |n| WHERE holder = 'ann'
+        n > 50 :
+            error "too much"
+        put SQL --- UPDATE Accounts SET balance = balance + |n| WHERE holder = 'bob'
+
+tryTransfer (n int) :
+    try e :
+        transaction :
+            put SQL --- UPDATE Accounts SET balance = balance - |n| WHERE holder = 'ann'
+            put SQL --- UPDATE Missing SET balance = balance + |n|
+    else :
+        post "caught" to Output()
+
+transferWithTry (n int) :
+    transaction :
+        put SQL --- UPDATE Accounts SET balance = balance - |n| WHERE holder = 'ann'
+        try :
+            put SQL --- UPDATE Missing SET balance = balance + |n|
+        else :
+            put SQL --- UPDATE Accounts SET balance = balance + |n| WHERE holder = 'bob'
+
+nested (n int) :
+    transaction :
+        put SQL --- UPDATE Accounts SET balance = balance - |n| WHERE holder = 'ann'
+        try :
+            transaction :
+                put SQL --- UPDATE Accounts SET balance = balance + |n| WHERE holder = 'bob'
+                put SQL --- UPDATE Missing SET balance = 0
+        else :
+            put SQL --- UPDATE Accounts SET balance = balance + 1000 WHERE holder = 'bob'
+
+balances :
+    get accounts as Account from SQL --- SELECT * FROM Accounts ORDER BY holder
+    post accounts to Output()
+`
+
+// Checks that a `transaction` block commits when it succeeds, rolls back when an SQL statement
+// or anything else in it fails, and works with `try` on either side of it.
+func TestTransactions(t *testing.T) {
+	db, e := sql.Open("sqlite", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	sv := pf.NewService()
+	sv.SetDatabase(db)
+	if e := sv.InitializeFromCode(transactionTestCode); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	balances := func(ann, bob int) string {
+		return fmt.Sprintf(`[Account with (holder::"ann", balance::%d), Account with (holder::"bob", balance::%d)]`+"\n", ann, bob)
+	}
+	tests := []struct {
+		line    string
+		errorId string
+		want    string
+	}{
+		{`setup`, "", balances(100, 0)},
+		{`transfer 10`, "", balances(90, 10)},
+		{`transferToNowhere 10`, "sql/out", balances(90, 10)},
+		{`transferTooMuch 60`, "eval/user", balances(90, 10)},
+		{`tryTransfer 5`, "", balances(90, 10)},
+		{`transferWithTry 7`, "", balances(83, 17)},
+		{`nested 3`, "", balances(80, 1017)},
+		{`transaction : transfer 1`, "", balances(79, 1018)},
+	}
+	for _, test := range tests {
+		v, e := sv.Do(test.line)
+		if e != nil {
+			t.Fatal(e)
+		}
+		switch {
+		case test.errorId == "" && v.T != values.SUCCESSFUL_VALUE:
+			t.Errorf("%s: wanted OK | got %s", test.line, sv.ToLiteral(v))
+		case test.errorId != "" && (v.T != values.ERROR || v.V.(*err.Error).ErrorId != test.errorId):
+			t.Errorf("%s: wanted error %s | got %s", test.line, test.errorId, sv.ToLiteral(v))
+		}
+		var buf bytes.Buffer
+		if _, e := sv.DoWithOutput(context.Background(), `balances`, &buf); e != nil {
+			t.Fatal(e)
+		}
+		if buf.String() != test.want {
+			t.Errorf("%s: wanted %s | got %s", test.line, test.want, buf.String())
+		}
+	}
+}
+
+const transactionLoopTestCode = `cmd
+
+setup :
+    put SQL --- CREATE TABLE Ticks (n INTEGER)
+
+tick (n int) :
+    transaction :
+        for i = 0; i < n; i + 1 :
+            i == 2 :
+                break
+            else :
+                put SQL --- INSERT INTO Ticks VALUES (|i|)
+%s
+`
+
+// Checks that a 'break' or 'continue' in a 'transaction' block may leave a loop inside the block,
+// but not one outside it, which would skip the end of the transaction.
+func TestTransactionsAndLoops(t *testing.T) {
+	db, e := sql.Open("sqlite", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1) // So that a transaction left open would stop the query below.
+	sv := pf.NewService()
+	sv.SetDatabase(db)
+	if e := sv.InitializeFromCode(fmt.Sprintf(transactionLoopTestCode, "")); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	for _, line := range []string{"setup", "tick 5"} {
+		if v, e := sv.Do(line); e != nil || v.T != values.SUCCESSFUL_VALUE {
+			t.Fatalf("%s: wanted OK | got %s, %v", line, sv.ToLiteral(v), e)
+		}
+	}
+	var count int
+	if e := db.QueryRow("SELECT COUNT(*) FROM Ticks").Scan(&count); e != nil || count != 2 {
+		t.Errorf("wanted 2 ticks | got %d, %v", count, e)
+	}
+	for _, exit := range []string{"break", "continue"} {
+		sv := pf.NewService()
+		sv.SetDatabase(db)
+		sv.InitializeFromCode(fmt.Sprintf(transactionLoopTestCode, "\nskip :\n    for i = 0; i < 3; i + 1 :\n        transaction :\n"+
+			"            i == 1 :\n                "+exit+"\n            else :\n                put SQL --- INSERT INTO Ticks VALUES (|i|)"))
+		errors := sv.GetErrors()
+		if len(errors) == 0 || errors[0].ErrorId != "comp/transaction/break" {
+			t.Errorf("%s: wanted error comp/transaction/break | got %v", exit, errors)
+		}
+	}
+}
+
+const transactionNameTestCode = `def
+
+cleared(transaction bool) :
+    transaction :
+        "cleared"
+    else :
+        "pending"
+
+cmd
+
+pay (transaction int) :
+    post transaction to Output()
+`
+
+const transactionFieldTestCode = `newtype
+
+Payment = struct(transaction string, amount int)
+`
+
+// Checks that outside of a transaction block, `transaction` is an ordinary identifier.
+func TestTransactionAsName(t *testing.T) {
+	tests := []struct {
+		code string
+		line string
+		want string
+	}{
+		{transactionNameTestCode, `cleared true`, `"cleared"`},
+		{transactionNameTestCode, `cleared false`, `"pending"`},
+		{transactionNameTestCode, `pay 5`, `OK`},
+		{transactionFieldTestCode, `(Payment "x", 5)[transaction]`, `"x"`},
+	}
+	for _, test := range tests {
+		sv := pf.NewService()
+		if e := sv.InitializeFromCode(test.code); e != nil {
+			r, _ := sv.GetErrorReport()
+			t.Fatalf("There were errors initializing the service : \n" + r)
+		}
+		v, e := sv.Do(test.line)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if got := sv.ToLiteral(v); got != test.want {
+			t.Errorf("%s: wanted %s | got %s", test.line, test.want, got)
+		}
+	}
+}
+
+const migrationTestCode = `newtype
+
+Person = struct(name string, age int, email string?)
+Score = struct(player varchar(10), points int)
+
+cmd
+
+setup :
+    put SQL --- CREATE TABLE IF NOT EXISTS People |Person|
+    put SQL --- CREATE TABLE IF NOT EXISTS Scores |Score|
+
+showPeople :
+    get people as Person from SQL --- SELECT * FROM People ORDER BY age
+    post people to Output()
+`
+
+// Checks that a migration finds the columns which have been added, dropped and renamed, and that
+// its statements make the tables fit their types so that they can be read again.
+func TestMigrations(t *testing.T) {
+	db, e := sql.Open("sqlite", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, statement := range []string{
+		"CREATE TABLE People (fullName VARCHAR(20) NOT NULL, age INTEGER NOT NULL, nick TEXT)",
+		"INSERT INTO People VALUES ('Ann', 30, 'annie'), ('Bob', 40, NULL)",
+	} {
+		if _, e := db.Exec(statement); e != nil {
+			t.Fatal(e)
+		}
+	}
+	sv := pf.NewService()
+	sv.SetDatabase(db)
+	if e := sv.InitializeFromCode(migrationTestCode); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	plan, e := sv.PlanMigration()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(plan.Tables) != 1 || plan.Tables[0].Table != "People" {
+		t.Fatalf("wanted a migration of People | got %v", plan.Tables)
+	}
+	tm := plan.Tables[0]
+	if len(tm.Renames) != 2 || tm.Renames[0].From != "fullName" || tm.Renames[0].To != "name" {
+		t.Fatalf("wanted fullName to be renamed to name | got %v", tm.Renames)
+	}
+	tm.Renames[0].Confirmed = true
+	want := "People: rename column fullName to name; add column email STRING; drop column nick"
+	if tm.String() != want {
+		t.Errorf("wanted %s | got %s", want, tm.String())
+	}
+	for _, statement := range tm.Statements() {
+		if _, e := db.Exec(statement); e != nil {
+			t.Fatalf("%s: %v", statement, e)
+		}
+	}
+	if _, e := sv.Do(`setup`); e != nil {
+		t.Fatal(e)
+	}
+	plan, e = sv.PlanMigration()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(plan.Tables) != 0 {
+		t.Errorf("wanted no migrations | got %v", plan.Tables[0])
+	}
+	var buf bytes.Buffer
+	if _, e := sv.DoWithOutput(context.Background(), `showPeople`, &buf); e != nil {
+		t.Fatal(e)
+	}
+	want = `[Person with (name::"Ann", age::30, email::NULL), Person with (name::"Bob", age::40, email::NULL)]` + "\n"
+	if buf.String() != want {
+		t.Errorf("wanted %s | got %s", want, buf.String())
+	}
+}
+
+const namedDatabaseTestCode = `newtype
+
+Hit = struct(page string, count int)
+
+cmd
+
+setup :
+    put SQL --- CREATE TABLE Hits |Hit|
+    put SQL(analytics) --- CREATE TABLE Hits |Hit|
+    put SQL(analytics) --- INSERT INTO Hits VALUES ('home', 3)
+
+hits :
+    get local as Hit from SQL --- SELECT * FROM Hits
+    get remote as Hit from SQL(analytics) --- SELECT * FROM Hits
+    post local to Output()
+    post remote to Output()
+
+missing :
+    get x as Hit from SQL(archive) --- SELECT * FROM Hits
+    post x to Output()
+`
+
+// Checks that SQL snippets go to the database they name, and to the service's own database
+// if they don't name one.
+func TestNamedDatabases(t *testing.T) {
+	openDb := func() *sql.DB {
+		db, e := sql.Open("sqlite", ":memory:")
+		if e != nil {
+			t.Fatal(e)
+		}
+		db.SetMaxOpenConns(1)
+		return db
+	}
+	db, analytics := openDb(), openDb()
+	defer db.Close()
+	defer analytics.Close()
+	sv := pf.NewService()
+	sv.SetDatabase(db)
+	sv.SetNamedDatabase("analytics", analytics)
+	if e := sv.InitializeFromCode(namedDatabaseTestCode); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	if v, e := sv.Do(`setup`); e != nil || v.T != values.SUCCESSFUL_VALUE {
+		t.Fatalf("setup: wanted OK | got %s", sv.ToLiteral(v))
+	}
+	var buf bytes.Buffer
+	if _, e := sv.DoWithOutput(context.Background(), `hits`, &buf); e != nil {
+		t.Fatal(e)
+	}
+	want := "[]\n" + `[Hit with (page::"home", count::3)]` + "\n"
+	if buf.String() != want {
+		t.Errorf("wanted %s | got %s", want, buf.String())
+	}
+	v, e := sv.Do(`missing`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v.T != values.ERROR || v.V.(*err.Error).ErrorId != "sql/exists/named" {
+		t.Errorf("wanted error sql/exists/named | got %s", sv.ToLiteral(v))
+	}
+}
+
+const sqlSchemaTestSchema = `-- The tables of the shop.
+CREATE TABLE Products (
+    name VARCHAR(32) NOT NULL,
+    price INTEGER NOT NULL,
+    onSale BOOL NOT NULL,
+    PRIMARY KEY (name)
+);
+
+CREATE INDEX ProductPrices ON Products (price);
+`
+
+const sqlSchemaTestCode = `import
+
+%q
+
+newtype
+
+Product = struct(name varchar(32), price int, onSale bool)
+Sale = struct(name string, cost int)
+Hit = struct(page string, count int)
+
+cmd
+
+setup :
+    put SQL --- CREATE TABLE Products (name VARCHAR(32) NOT NULL, price INTEGER NOT NULL, onSale BOOL NOT NULL, PRIMARY KEY (name))
+    put SQL --- CREATE TABLE Hits |Hit|
+    put SQL --- INSERT INTO Products VALUES (|"pen"|, |3|, |true|), ('box', 9, FALSE)
+    put SQL --- INSERT INTO Hits (page, count) VALUES (|"home"|, |1|)
+
+sales(cheap int) :
+    get x as Sale from SQL --- SELECT p.name, price AS cost FROM Products p WHERE price <= |cheap| AND onSale ORDER BY cost
+    post x to Output()
+
+%s
+`
+
+// Checks that SQL snippets are checked against the schema a service imports, and against the
+// tables its snippets create.
+func TestSqlSchemas(t *testing.T) {
+	schemaFilepath := filepath.Join(t.TempDir(), "shop.sql")
+	if e := os.WriteFile(schemaFilepath, []byte(sqlSchemaTestSchema), 0644); e != nil {
+		t.Fatal(e)
+	}
+	db, e := sql.Open("sqlite", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	sv := pf.NewService()
+	sv.SetDatabase(db)
+	if e := sv.InitializeFromCode(fmt.Sprintf(sqlSchemaTestCode, schemaFilepath, "")); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	if v, e := sv.Do(`setup`); e != nil || v.T != values.SUCCESSFUL_VALUE {
+		t.Fatalf("setup: wanted OK | got %s", sv.ToLiteral(v))
+	}
+	var buf bytes.Buffer
+	if _, e := sv.DoWithOutput(context.Background(), `sales 5`, &buf); e != nil {
+		t.Fatal(e)
+	}
+	if want := `[Sale with (name::"pen", cost::3)]` + "\n"; buf.String() != want {
+		t.Errorf("wanted %s | got %s", want, buf.String())
+	}
+	tests := []struct {
+		cmd     string
+		errorId string
+	}{
+		{"bad :\n    put SQL --- DELETE FROM Prodcts WHERE price > 3", "comp/sql/table"},
+		{"bad :\n    put SQL --- UPDATE Products SET prise = 3", "comp/sql/column"},
+		{"bad :\n    put SQL --- SELECT p.nome FROM Products AS p", "comp/sql/column"},
+		{"bad :\n    put SQL --- SELECT page FROM Products", "comp/sql/column"},
+		{"bad :\n    put SQL --- INSERT INTO Products VALUES (|\"pen\"|, |3|)", "comp/sql/params"},
+		{"bad :\n    put SQL --- INSERT INTO Products (name, price) VALUES (|1, 2, 3|)", "comp/sql/params"},
+		{"bad :\n    put SQL --- INSERT INTO Hits VALUES (|1|, |2|)", "comp/sql/type"},
+		{"bad :\n    put SQL --- DELETE FROM Products WHERE |\"cheap\"| > price", "comp/sql/type"},
+		{"bad :\n    get x as Sale from SQL --- SELECT * FROM Products\n    post x to Output()", "comp/sql/columns"},
+		{"bad :\n    get x as Sale from SQL --- SELECT price, name FROM Products\n    post x to Output()", "comp/sql/field"},
+	}
+	for _, test := range tests {
+		sv := pf.NewService()
+		sv.SetDatabase(db)
+		sv.InitializeFromCode(fmt.Sprintf(sqlSchemaTestCode, schemaFilepath, test.cmd))
+		errors := sv.GetErrors()
+		if len(errors) == 0 {
+			t.Errorf("%q: wanted error %s | got none", test.cmd, test.errorId)
+			continue
+		}
+		if errors[0].ErrorId != test.errorId || errors[0].Token.Line == 0 {
+			t.Errorf("%q: wanted error %s | got %s at line %d", test.cmd, test.errorId, errors[0].ErrorId, errors[0].Token.Line)
+		}
+	}
+}
+
+const permissionsTestCode = `
+import
+
+secrets::"%s"
+
+def
+
+leak(x int) : secret x
+
+for Spies
+
+secret(x int) : x * 2
+
+for Spies, Editors
+
+reveal(x int) : x + 1
+`
+
+const permissionsModuleCode = `
+def
+
+for Spies
+
+hidden(x int) : x * 3
+`
+
+// Checks that the lines a caller does and the functions they call by name are checked against
+// the groups the functions are declared for, however they're called, and that the declarations
+// themselves are checked.
+func TestPermissions(t *testing.T) {
+	dir := t.TempDir()
+	moduleFilepath := filepath.Join(dir, "secrets.pf")
+	scriptFilepath := filepath.Join(dir, "permissions.pf")
+	os.WriteFile(moduleFilepath, []byte(permissionsModuleCode), 0644)
+	os.WriteFile(scriptFilepath, []byte(fmt.Sprintf(permissionsTestCode, moduleFilepath)), 0644)
+	sv := pf.NewService()
+	if e := sv.InitializeFromFilepath(scriptFilepath); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	spy := &pf.Caller{Name: "kim", Groups: []string{"Spies"}}
+	editor := &pf.Caller{Name: "lee", Groups: []string{"Readers", "Editors"}}
+	tests := []struct {
+		caller  *pf.Caller
+		line    string
+		errorId string
+	}{
+		{nil, "secret 2", ""},
+		{spy, "secret 2", ""},
+		{spy, "reveal 2", ""},
+		{editor, "reveal 2", ""},
+		{editor, "leak 2", ""}, // Because the permissions don't apply to functions calling functions.
+		{editor, "secret 2", "comp/access"},
+		{editor, "1 + secret 2", "comp/access"},
+		{editor, "[5] >> func(x) : secret x", "comp/access"},
+		{editor, "[5] >> secret that", "comp/access"},
+		{editor, "5 -> secret that", "comp/access"},
+		{spy, "[5] >> func(x) : secret x", ""},
+		{nil, "secrets.hidden 2", ""},
+		{spy, "secrets.hidden 2", ""},
+		{editor, "secrets.hidden 2", "comp/access"},
+		{editor, "[5] >> func(x) : secrets.hidden x", "comp/access"},
+	}
+	for _, test := range tests {
+		_, e := sv.DoContext(pf.WithCaller(context.Background(), test.caller), test.line)
+		errors := sv.GetErrors()
+		switch {
+		case test.errorId == "" && e != nil:
+			t.Errorf("%q: wanted no error | got %v", test.line, e)
+		case test.errorId != "" && (len(errors) == 0 || errors[0].ErrorId != test.errorId):
+			t.Errorf("%q: wanted error %s | got %v", test.line, test.errorId, e)
+		}
+	}
+	if _, e := sv.CallJson(pf.WithCaller(context.Background(), editor), "secret", []json.RawMessage{json.RawMessage("2")}, io.Discard); !errors.Is(e, compiler.ErrAccessDenied) {
+		t.Errorf("wanted %v | got %v", compiler.ErrAccessDenied, e)
+	}
+	if _, e := sv.CallJson(pf.WithCaller(context.Background(), spy), "secret", []json.RawMessage{json.RawMessage("2")}, io.Discard); e != nil {
+		t.Errorf("wanted no error | got %v", e)
+	}
+	permissions, _ := sv.GetPermissions()
+	if len(permissions) != 2 || len(permissions["secret"]) != 1 || len(permissions["reveal"]) != 2 {
+		t.Errorf("wanted the permissions of two functions | got %v", permissions)
+	}
+	failures := []struct {
+		code    string
+		errorId string
+	}{
+		{"def\n\nfor Spies, 42\n\nf(x int) : x\n", "init/access/form"},
+		{"def\n\nfor\n\nf(x int) : x\n", "init/access/form"},
+		{"def\n\nfor Spies Editors\n\nf(x int) : x\n", "init/access/form"},
+		{"def\n\nprivate\n\nfor Spies\n\nf(x int) : x\n", "init/access/private"},
+		{"def\n\nfor Spies\n\nprivate\n\nf(x int) : x\n", "init/access/private"},
+		{"def\n\nf(x int) : x\n\nfor Spies\n\nf(x string) : x\n", "init/access/overload"},
+	}
+	for _, test := range failures {
+		sv := pf.NewService()
+		sv.InitializeFromCode(test.code)
+		errors := sv.GetErrors()
+		if len(errors) == 0 || errors[0].ErrorId != test.errorId {
+			t.Errorf("%q: wanted error %s | got %v", test.code, test.errorId, errors[0].ErrorId)
+		}
+	}
+}
+
+// Checks that in session mode each session has its own copy of the variables, that sessions
+// expire when they've been idle too long, and that they can outlive the service in a store.
+func TestSessions(t *testing.T) {
+	sv := pf.NewService()
+	if e := sv.InitializeFromCode(concurrencyTestCode); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	now := time.Unix(1_000_000, 0)
+	store := pf.DirSessionStore{Dir: t.TempDir()}
+	sv.SetSessions(&pf.SessionOptions{Idle: time.Hour, Store: store, Now: func() time.Time { return now }})
+	do := func(session, line string) pf.Value {
+		v, e := sv.DoContext(pf.WithSession(context.Background(), session), line)
+		if e != nil {
+			t.Fatalf("%s: couldn't do %q: %v", session, line, e)
+		}
+		return v
+	}
+	do("alice", "bump")
+	do("alice", "bump")
+	do("bob", "bump")
+	do("", "count = 10") // Without a session, the line uses the shared variables.
+	tests := []struct {
+		session  string
+		expected int
+	}{
+		{"alice", 2},
+		{"bob", 1},
+		{"", 10},
+	}
+	for _, test := range tests {
+		if v := do(test.session, "count"); v.V != test.expected {
+			t.Errorf("%q: wanted count %d | got %v", test.session, test.expected, v.V)
+		}
+	}
+	if sessions := sv.GetSessions(); len(sessions) != 2 || sessions[0] != "alice" || sessions[1] != "bob" {
+		t.Errorf("wanted sessions alice and bob | got %v", sessions)
+	}
+
+	// A new service with the same store picks up where the old one left off.
+	other := pf.NewService()
+	other.InitializeFromCode(concurrencyTestCode)
+	other.SetSessions(&pf.SessionOptions{Store: store})
+	if v, _ := other.DoContext(pf.WithSession(context.Background(), "alice"), "count"); v.V != 2 {
+		t.Errorf("wanted count 2 from the store | got %v", v.V)
+	}
+
+	// Sessions which have been idle for too long start again from the shared variables.
+	now = now.Add(30 * time.Minute)
+	do("bob", "bump")
+	now = now.Add(45 * time.Minute)
+	if v := do("alice", "count"); v.V != 10 {
+		t.Errorf("wanted alice's session to have expired | got count %v", v.V)
+	}
+	if v := do("bob", "count"); v.V != 2 {
+		t.Errorf("wanted bob's session to have been kept | got count %v", v.V)
+	}
+
+	if e := sv.EndSession("bob"); e != nil {
+		t.Fatal(e)
+	}
+	if _, ok, _ := store.Load("bob"); ok {
+		t.Errorf("wanted bob's session to be deleted from the store")
+	}
+	if v := do("bob", "count"); v.V != 10 {
+		t.Errorf("wanted bob's session to have ended | got count %v", v.V)
+	}
+
+	// Floats come back from the store exactly.
+	floats := pf.NewService()
+	floats.InitializeFromCode("var\n\nratio = 0.0\n")
+	floats.SetSessions(&pf.SessionOptions{Store: store})
+	floats.DoContext(pf.WithSession(context.Background(), "carol"), "ratio = 1.0 / 3.0")
+	reloaded := pf.NewService()
+	reloaded.InitializeFromCode("var\n\nratio = 0.0\n")
+	reloaded.SetSessions(&pf.SessionOptions{Store: store})
+	if v, _ := reloaded.DoContext(pf.WithSession(context.Background(), "carol"), "ratio"); v.V != 1.0/3.0 {
+		t.Errorf("wanted ratio 1/3 from the store | got %v", v.V)
+	}
+}
+
+const snapshotTestCode = `newtype
+
+Person = struct(name string, age int)
+
+var
+
+count = 0
+tag = "none"
+gone = 1
+who any? = NULL
+ratio = 0.0
+
+cmd
+
+setUp :
+    count = 3
+    tag = "set"
+    who = Person("Kim", 30)
+    ratio = 1.0 / 3.0
+`
+
+const snapshotTestChangedCode = `var
+
+count = 0
+tag = 0
+who any? = NULL
+extra = "new"
+ratio = 0.0
+`
+
+// Checks that the variables of a service can be snapshotted and restored into a new version of
+// the service, dropping the ones which no longer fit.
+func TestSnapshots(t *testing.T) {
+	sv := pf.NewService()
+	if e := sv.InitializeFromCode(snapshotTestCode); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	if _, e := sv.Do("setUp"); e != nil {
+		t.Fatal(e)
+	}
+	snapshot, e := sv.SnapshotVariables()
+	if e != nil {
+		t.Fatal(e)
+	}
+	store := pf.DirSnapshotStore{Dir: t.TempDir()}
+	if e := store.Save("test", snapshot); e != nil {
+		t.Fatal(e)
+	}
+	loaded, ok, e := store.Load("test")
+	if e != nil || !ok {
+		t.Fatalf("couldn't load the snapshot: %v", e)
+	}
+
+	// The same service gets everything back.
+	same := pf.NewService()
+	same.InitializeFromCode(snapshotTestCode)
+	if dropped, e := same.RestoreVariables(loaded); e != nil || len(dropped) != 0 {
+		t.Errorf("wanted nothing dropped | got %v, %v", dropped, e)
+	}
+	if v, _ := same.GetVariable("who"); same.ToLiteral(v) != `Person with (name::"Kim", age::30)` {
+		t.Errorf("wanted who restored | got %v", same.ToLiteral(v))
+	}
+	if v, _ := same.GetVariable("ratio"); v.V != 1.0/3.0 {
+		t.Errorf("wanted ratio restored exactly | got %v", v.V)
+	}
+	// What's in the snapshot is decoded as a value, and not run as code.
+	forged := pf.Snapshot{"count": {Type: "int", Value: []byte("setUp")}}
+	if dropped, _ := same.RestoreVariables(forged); len(dropped) != 1 || dropped[0].Name != "count" {
+		t.Errorf("wanted the forged count dropped | got %v", dropped)
+	}
+	if v, _ := same.GetVariable("tag"); same.ToLiteral(v) != `"set"` {
+		t.Errorf("wanted tag to be unchanged | got %s", same.ToLiteral(v))
+	}
+
+	changed := pf.NewService()
+	if e := changed.InitializeFromCode(snapshotTestChangedCode); e != nil {
+		r, _ := changed.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	dropped, e := changed.RestoreVariables(loaded)
+	if e != nil {
+		t.Fatal(e)
+	}
+	names := []string{}
+	for _, v := range dropped {
+		names = append(names, v.Name)
+	}
+	if strings.Join(names, ", ") != "gone, tag, who" {
+		t.Errorf("wanted gone, tag and who dropped | got %v", dropped)
+	}
+	expected := map[string]string{"count": "3", "tag": "0", "who": "NULL", "extra": `"new"`, "ratio": "0.33333333"}
+	for name, literal := range expected {
+		if v, _ := changed.GetVariable(name); changed.ToLiteral(v) != literal {
+			t.Errorf("%s: wanted %s | got %s", name, literal, changed.ToLiteral(v))
+		}
+	}
+	if _, ok, _ := store.Load("other"); ok {
+		t.Errorf("wanted no snapshot of a service which hasn't been saved")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	sv := pf.NewService()
+	if e := sv.InitializeFromCode("def\n\nquadruple(n int) : double(double n)\n\nprivate\n\ndouble(n int) : 2 * n\n"); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	before := sv.GetMetrics()
+	if v, e := sv.Do("quadruple 5"); e != nil || sv.ToLiteral(v) != "20" {
+		t.Fatalf("wanted 20 | got %v, %v", sv.ToLiteral(v), e)
+	}
+	after := sv.GetMetrics()
+	if after.Instructions <= before.Instructions {
+		t.Errorf("wanted the instructions counted | got %d then %d", before.Instructions, after.Instructions)
+	}
+	if after.MemSize == 0 {
+		t.Errorf("wanted the size of memory")
+	}
+	if len(after.ExternalCalls) != 0 {
+		t.Errorf("wanted no external calls | got %+v", after.ExternalCalls)
+	}
+	if !sv.HasFunction("quadruple") || sv.HasFunction("double") || sv.HasFunction("triple") {
+		t.Errorf("wanted quadruple and only quadruple to be a public function of the service")
+	}
+}
+
+type recordingOutHandler struct {
+	buf    bytes.Buffer
+	out    *pf.SimpleOutHandler // Which writes to buf.
+	events []string
+}
+
+func (o *recordingOutHandler) Out(v pf.Value) {
+	o.out.Out(v)
+	o.events = append(o.events, "out "+strings.TrimSuffix(o.buf.String(), "\n"))
+	o.buf.Reset()
+}
+
+func (o *recordingOutHandler) Write(s string) {
+	o.events = append(o.events, "write "+s)
+}
+
+type scriptedInHandler struct {
+	out     *recordingOutHandler
+	answers []string
+}
+
+func (i *scriptedInHandler) Get() string {
+	return i.GetWithPrompt("")
+}
+
+func (i *scriptedInHandler) GetWithPrompt(prompt string) string {
+	i.out.events = append(i.out.events, "prompt "+prompt)
+	answer := i.answers[0]
+	i.answers = i.answers[1:]
+	return answer
+}
+
+func TestDoWithHandlers(t *testing.T) {
+	sv := pf.NewService()
+	if e := sv.InitializeFromCode("cmd\n\ngreet :\n    post \"Hello!\" to Output()\n    get name from Input(\"Name? \")\n    post \"Hi \" + name to Output()\n"); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	out := &recordingOutHandler{}
+	out.out = sv.MakeStringWritingOutHandler(&out.buf)
+	in := &scriptedInHandler{out, []string{"Kim"}}
+	if v, e := sv.DoWithHandlers(context.Background(), "greet", in, out); e != nil || v.T != pf.OK {
+		t.Fatalf("wanted OK | got %v, %v", sv.ToLiteral(v), e)
+	}
+	expected := `out "Hello!"|prompt Name? |out "Hi Kim"`
+	if got := strings.Join(out.events, "|"); got != expected {
+		t.Errorf("wanted %s | got %s", expected, got)
+	}
+	// The service's own handlers are put back.
+	var buf bytes.Buffer
+	sv.SetOutHandler(sv.MakeLiteralWritingOutHandler(&buf))
+	sv.Do(`post "again" to Output()`)
+	if buf.String() != "\"again\"\n" || len(out.events) != 3 {
+		t.Errorf("wanted the output to go to the service's own handler | got %q", buf.String())
+	}
+}
+
+const stubTestServerCode = `newtype
+
+Color = enum RED, GREEN, BLUE
+
+Point = struct(left, top float)
+
+cmd
+
+ping(s string) :
+    post s to Output()
+
+def
+
+answer :
+    42
+
+double(n int) :
+    2 * n
+
+half(f float) :
+    f / 2
+
+move(p Point, c Color) :
+    Point(p[left] + 1.0, p[top] + 1.0), c
+
+swap (a int) with (b int) :
+    b, a
+`
+
+// Makes stubs of an external service from the service using it, scripts some of their
+// responses, and then checks that the service uses the stub in place of the real service,
+// which no longer exists.
+func TestExternalStubs(t *testing.T) {
+	dir := t.TempDir()
+	serverFilepath := filepath.Join(dir, "server.pf")
+	clientFilepath := filepath.Join(dir, "client.pf")
+	stubFilepath := filepath.Join(dir, "-stubs", "client", "server.pf")
+	os.WriteFile(serverFilepath, []byte(stubTestServerCode), 0644)
+	os.WriteFile(clientFilepath, []byte("external\n\n\""+serverFilepath+"\"\n"), 0644)
+	sv := pf.NewService()
+	if e := sv.InitializeFromFilepath(clientFilepath); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	stubs, e := sv.ExternalStubs()
+	if e != nil {
+		t.Fatal(e)
+	}
+	stub, ok := stubs["server"]
+	if !ok || len(stubs) != 1 {
+		t.Fatalf("wanted a stub of server | got %v", stubs)
+	}
+	for _, declaration := range []string{"Color = enum RED, GREEN, BLUE", "// ping (s string) :\n//     OK",
+		"// answer :\n//     NULL", "// swap (a int) with (b int) :\n//     NULL"} {
+		if !strings.Contains(stub.Source, declaration) {
+			t.Errorf("wanted the stub to contain %q | got\n%s", declaration, stub.Source)
+		}
+	}
+	source := stub.Source
+	for _, response := range [][]string{{"answer :", "99"}, {"double (n int) :", "3 * n"},
+		{"move (p Point, c Color) :", "Point(0.0, 0.0), BLUE"}} {
+		source = strings.Replace(source, "// "+response[0]+"\n//     NULL", response[0]+"\n    "+response[1], 1)
+	}
+	os.MkdirAll(filepath.Dir(stubFilepath), 0755)
+	os.WriteFile(stubFilepath, []byte(source), 0644)
+	os.WriteFile(pf.StubAPIFilepath(stubFilepath), []byte(stub.API), 0644)
+	os.Remove(serverFilepath)
+
+	stubbed := pf.NewService()
+	stubbed.SetExternalStubs(map[string]string{"server": stubFilepath})
+	if e := stubbed.InitializeFromFilepath(clientFilepath); e != nil {
+		r, _ := stubbed.GetErrorReport()
+		t.Fatalf("There were errors initializing the service with the stub : \n" + r)
+	}
+	tests := []struct{ line, literal string }{
+		{`server.answer`, `99`},
+		{`server.double 4`, `12`},
+		{`server.double(4) + 1`, `13`},
+		{`server.move(server.Point(1.0, 2.0), server.RED)`, `(server.Point with (left::0.00000000, top::0.00000000), server.BLUE)`},
+	}
+	for _, test := range tests {
+		if v, e := stubbed.Do(test.line); e != nil || stubbed.ToLiteral(v) != test.literal {
+			t.Errorf("%s: wanted %s | got %s, %v", test.line, test.literal, stubbed.ToLiteral(v), e)
+		}
+	}
+	// The functions and commands which haven't been scripted return errors.
+	for _, line := range []string{`server.half 3.0`, `server.ping "x"`} {
+		v, _ := stubbed.Do(line)
+		if v.T != pf.ERROR || v.V.(*err.Error).ErrorId != "ext/unscripted" {
+			t.Errorf("%s: wanted an unscripted error | got %s", line, stubbed.ToLiteral(v))
+		}
+	}
+	// Without the API of the real service, the stub presents its own.
+	os.Remove(pf.StubAPIFilepath(stubFilepath))
+	ownAPI := pf.NewService()
+	ownAPI.SetExternalStubs(map[string]string{"server": stubFilepath})
+	if e := ownAPI.InitializeFromFilepath(clientFilepath); e != nil {
+		r, _ := ownAPI.GetErrorReport()
+		t.Fatalf("There were errors initializing the service with the stub's own API : \n" + r)
+	}
+	if v, _ := ownAPI.Do(`server.double 4`); ownAPI.ToLiteral(v) != "12" {
+		t.Errorf("wanted 12 | got %s", ownAPI.ToLiteral(v))
+	}
+	if _, e := ownAPI.Do(`server.half 3.0`); e == nil {
+		t.Errorf("wanted half not to be part of the stub's own API")
+	}
+}
+
+const imageTestCode = `
+import
+
+lib::"%s"
+
+var
+
+count = 0
+
+cmd
+
+bump :
+    count = count + 1
+
+def
+
+double(n int) : n + n
+`
+
+const imageTestModuleCode = `
+def
+
+triple(n int) : 3 * n
+`
+
+// Checks that a service loaded from an image can compile new lines, be called by name, and be
+// used as an external service without its sources; and that only a service with an image cache
+// caches images of itself.
+func TestImages(t *testing.T) {
+	dir := t.TempDir()
+	moduleFilepath := filepath.Join(dir, "lib.pf")
+	scriptFilepath := filepath.Join(dir, "imaged.pf")
+	os.WriteFile(moduleFilepath, []byte(imageTestModuleCode), 0644)
+	os.WriteFile(scriptFilepath, []byte(fmt.Sprintf(imageTestCode, moduleFilepath)), 0644)
+	sv := pf.NewService()
+	if e := sv.InitializeFromFilepath(scriptFilepath); e != nil {
+		r, _ := sv.GetErrorReport()
+		t.Fatalf("There were errors initializing the service : \n" + r)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("wanted no image to be cached | got %d files", len(files))
+	}
+	var buf bytes.Buffer
+	if e := sv.WriteImage(&buf); e != nil {
+		t.Fatal(e)
+	}
+	os.Remove(moduleFilepath)
+	os.Remove(scriptFilepath)
+
+	imaged := pf.NewService()
+	if e := imaged.InitializeFromImage(&buf); e != nil {
+		t.Fatal(e)
+	}
+	tests := []struct{ line, literal string }{
+		{`double 21`, `42`},
+		{`lib.triple 5`, `15`},
+		{`[1, 2] >> lib.triple that`, `[3, 6]`},
+		{`bump`, `OK`},
+		{`count`, `1`},
+	}
+	for _, test := range tests {
+		if v, e := imaged.Do(test.line); e != nil || imaged.ToLiteral(v) != test.literal {
+			t.Errorf("%s: wanted %s | got %s, %v", test.line, test.literal, imaged.ToLiteral(v), e)
+		}
+	}
+	if v, e := imaged.CallJson(context.Background(), "double", []json.RawMessage{json.RawMessage("4")}, io.Discard); e != nil || imaged.ToLiteral(v) != "8" {
+		t.Errorf("double 4: wanted 8 | got %s, %v", imaged.ToLiteral(v), e)
+	}
+
+	client := pf.NewService()
+	client.SetLocalExternalServices(map[string]*pf.Service{"imaged": imaged})
+	if e := client.InitializeFromCode("external\n\nimaged\n"); e != nil {
+		r, _ := client.GetErrorReport()
+		t.Fatalf("There were errors initializing the client : \n" + r)
+	}
+	if v, e := client.Do(`imaged.double 5`); e != nil || client.ToLiteral(v) != "10" {
+		t.Errorf("imaged.double 5: wanted 10 | got %s, %v", client.ToLiteral(v), e)
+	}
+	// The client calls the same service as the hub does, so they see the same variables.
+	imaged.Do(`bump`)
+	if v, _ := imaged.Do(`count`); imaged.ToLiteral(v) != "2" {
+		t.Errorf("wanted the count to be 2 | got %s", imaged.ToLiteral(v))
+	}
+
+	cacheDir := filepath.Join(dir, "images")
+	os.WriteFile(moduleFilepath, []byte(imageTestModuleCode), 0644)
+	os.WriteFile(scriptFilepath, []byte(fmt.Sprintf(imageTestCode, moduleFilepath)), 0644)
+	for i := 0; i < 2; i++ {
+		cached := pf.NewService()
+		cached.SetImageCache(cacheDir)
+		if e := cached.InitializeFromFilepath(scriptFilepath); e != nil {
+			t.Fatal(e)
+		}
+		if files, _ := os.ReadDir(cacheDir); len(files) != 1 {
+			t.Errorf("wanted one cached image | got %d files", len(files))
+		}
+		if v, e := cached.Do(`lib.triple(double 2)`); e != nil || cached.ToLiteral(v) != "12" {
+			t.Errorf("lib.triple(double 2): wanted 12 | got %s, %v", cached.ToLiteral(v), e)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package pf
+
+// Session mode. Normally a service has one set of global variables, shared by everyone who uses
+// it. In session mode, each session, e.g. each user of an administered hub, has its own copy of
+// the variables, which is made from the shared ones when the session starts. As values are
+// immutable, the copy only needs to copy the `Value` structs and not what they point to.
+//
+// The session is given by the context of `DoContext`, `DoWithOutput` and `CallJson`, using
+// `WithSession`. While the line runs, the vm's memory holds the session's variables, and when it
+// finishes they're copied back out of it and the shared ones put back. A line done without a
+// session, or when the service isn't in session mode, uses the shared variables as usual.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/tim-hardcastle/Pipefish/source/values"
+)
+
+// How a service should keep its sessions.
+type SessionOptions struct {
+	Idle  time.Duration    // How long a session may go unused before it expires, or 0 for never.
+	Store SessionStore     // Where to save the sessions so that they outlive the service, or nil.
+	Now   func() time.Time // The clock, which can be replaced to test expiry. If nil, it's `time.Now`.
+}
+
+// The persistence hook for sessions. The variables are saved as a map from their names to their
+// values in the wire format (see wire.go in the compiler), and are saved every time the session is
+// used, and deleted when it expires. A variable whose value can't be encoded, e.g. a function, or
+// decoded when the session is loaded, e.g. because its type no longer exists, starts with the
+// value of the shared variable instead.
+type SessionStore interface {
+	Load(id string) (map[string][]byte, bool, error) // The bool is false if there's no such session.
+	Save(id string, vars map[string][]byte) error
+	Delete(id string) error
+}
+
+type sessions struct {
+	options  SessionOptions
+	sessions map[string]*session
+}
+
+type session struct {
+	vars     map[string]values.Value
+	lastUsed time.Time
+}
+
+type sessionKey struct{}
+
+// Returns a copy of the context which says which session a line or call belongs to, if the
+// service is in session mode.
+func WithSession(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, id)
+}
+
+func sessionOf(ctx context.Context) string {
+	id, _ := ctx.Value(sessionKey{}).(string)
+	return id
+}
+
+// Puts the service into session mode with the options given, or, if they're nil, takes it out
+// of session mode, forgetting the sessions.
+func (sv *Service) SetSessions(options *SessionOptions) {
+	defer sv.lock()()
+	if options == nil {
+		sv.sessions = nil
+		return
+	}
+	opts := *options
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	sv.sessions = &sessions{options: opts, sessions: map[string]*session{}}
+}
+
+// Returns the IDs of the sessions which haven't expired, in order, or nil if the service isn't in
+// session mode.
+func (sv *Service) GetSessions() []string {
+	defer sv.lock()()
+	if sv.sessions == nil {
+		return nil
+	}
+	sv.expireSessions()
+	result := []string{}
+	for id := range sv.sessions.sessions {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Ends the session, deleting it from the store if there is one.
+func (sv *Service) EndSession(id string) error {
+	defer sv.lock()()
+	if sv.sessions == nil {
+		return errors.New("service isn't in session mode")
+	}
+	delete(sv.sessions.sessions, id)
+	if sv.sessions.options.Store != nil {
+		return sv.sessions.options.Store.Delete(id)
+	}
+	return nil
+}
+
+// Swaps the variables of the session given by the context, if any, into the vm, returning a
+// function which swaps them back out again. The caller must hold the lock.
+func (sv *Service) enterSession(ctx context.Context) func() {
+	id := sessionOf(ctx)
+	if sv.sessions == nil || id == "" {
+		return func() {}
+	}
+	sv.expireSessions()
+	locs := sv.cp.GlobalVariableLocs()
+	shared := map[string]values.Value{}
+	for name, loc := range locs {
+		shared[name] = sv.cp.Vm.Mem[loc]
+	}
+	s, ok := sv.sessions.sessions[id]
+	if !ok {
+		s = &session{vars: shared}
+		sv.sessions.sessions[id] = s
+		if sv.sessions.options.Store != nil {
+			if saved, ok, e := sv.sessions.options.Store.Load(id); e == nil && ok {
+				s.vars = sv.decodeVariables(saved, shared)
+			}
+		}
+	}
+	for name, loc := range locs {
+		if v, ok := s.vars[name]; ok {
+			sv.cp.Vm.Mem[loc] = v
+		}
+	}
+	return func() {
+		vars := map[string]values.Value{}
+		for name, loc := range locs {
+			vars[name] = sv.cp.Vm.Mem[loc]
+			sv.cp.Vm.Mem[loc] = shared[name]
+		}
+		s.vars = vars
+		s.lastUsed = sv.sessions.options.Now()
+		if sv.sessions.options.Store != nil {
+			saved := map[string][]byte{}
+			for name, v := range vars {
+				if data, e := sv.cp.Vm.EncodeValue(v); e == nil {
+					saved[name] = data
+				}
+			}
+			sv.sessions.options.Store.Save(id, saved)
+		}
+	}
+}
+
+// Forgets the sessions which have been idle for too long. The caller must hold the lock.
+func (sv *Service) expireSessions() {
+	idle := sv.sessions.options.Idle
+	if idle == 0 {
+		return
+	}
+	now := sv.sessions.options.Now()
+	for id, s := range sv.sessions.sessions {
+		if now.Sub(s.lastUsed) >= idle {
+			delete(sv.sessions.sessions, id)
+			if sv.sessions.options.Store != nil {
+				sv.sessions.options.Store.Delete(id)
+			}
+		}
+	}
+}
+
+// Turns the variables saved in a store back into values, using the shared values for anything
+// which can't be decoded, or which no longer fits its variable. The caller must hold the lock.
+func (sv *Service) decodeVariables(saved map[string][]byte, shared map[string]values.Value) map[string]values.Value {
+	types := sv.cp.GlobalVariableTypes()
+	result := map[string]values.Value{}
+	for name, v := range shared {
+		result[name] = v
+		data, ok := saved[name]
+		if !ok {
+			continue
+		}
+		if v, e := sv.cp.Vm.DecodeValue(data, ""); e == nil && types[name].Contains(v.T) {
+			result[name] = v
+		}
+	}
+	return result
+}
+
+// A `SessionStore` which keeps each session as a JSON file in a directory, named after the
+// session with anything which can't go in a filename escaped.
+type DirSessionStore struct {
+	Dir string
+}
+
+func (d DirSessionStore) path(id string) string {
+	return filepath.Join(d.Dir, url.PathEscape(id)+".json")
+}
+
+func (d DirSessionStore) Load(id string) (map[string][]byte, bool, error) {
+	contents, e := os.ReadFile(d.path(id))
+	if errors.Is(e, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if e != nil {
+		return nil, false, e
+	}
+	vars := map[string][]byte{}
+	if e := json.Unmarshal(contents, &vars); e != nil {
+		return nil, false, e
+	}
+	return vars, true, nil
+}
+
+func (d DirSessionStore) Save(id string, vars map[string][]byte) error {
+	contents, e := json.MarshalIndent(vars, "", "  ")
+	if e != nil {
+		return e
+	}
+	if e := os.MkdirAll(d.Dir, 0700); e != nil {
+		return e
+	}
+	return os.WriteFile(d.path(id), contents, 0600)
+}
+
+func (d DirSessionStore) Delete(id string) error {
+	e := os.Remove(d.path(id))
+	if errors.Is(e, os.ErrNotExist) {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,130 @@
+package pf
+
+// Snapshots of the global variables of a service, so that its state can outlive it, e.g. when the
+// hub rebuilds it because its script has changed, or when the hub itself is restarted. Each
+// variable is kept as the name of its type and its value in the wire format (see wire.go in the
+// compiler), which is a stable encoding so long as the types it mentions still exist. A variable
+// whose value can't be encoded, e.g. a function, is left out of the snapshot. When a snapshot is
+// restored into a service, the variables which no longer exist, or whose type has changed, are
+// dropped and reported.
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/tim-hardcastle/Pipefish/source/compiler"
+)
+
+// A snapshot of the variables of a service, by name.
+type Snapshot map[string]SnapshotVariable
+
+type SnapshotVariable struct {
+	Type  string
+	Value []byte // In the wire format.
+}
+
+// A variable which couldn't be restored from a snapshot, and why.
+type DroppedVariable struct {
+	Name   string
+	Reason string
+}
+
+// The persistence hook for snapshots, which are saved by the name of the service. The bool
+// returned by `Load` is false if there's no snapshot of the service.
+type SnapshotStore interface {
+	Load(service string) (Snapshot, bool, error)
+	Save(service string, snapshot Snapshot) error
+}
+
+// Takes a snapshot of the global variables of the service. In session mode, these are the shared
+// variables and not those of any session.
+func (sv *Service) SnapshotVariables() (Snapshot, error) {
+	if sv.IsBroken() {
+		return nil, errors.New("service is broken")
+	}
+	defer sv.lock()()
+	result := Snapshot{}
+	for name, loc := range sv.cp.GlobalVariableLocs() {
+		v := sv.cp.Vm.Mem[loc]
+		data, e := sv.cp.Vm.EncodeValue(v)
+		if e != nil {
+			continue
+		}
+		result[name] = SnapshotVariable{Type: sv.cp.Vm.DescribeType(v.T, compiler.DEFAULT), Value: data}
+	}
+	return result, nil
+}
+
+// Sets the global variables of the service from the snapshot, returning the variables which it had
+// to drop, in order of their names. Variables which aren't in the snapshot keep their values.
+func (sv *Service) RestoreVariables(snapshot Snapshot) ([]DroppedVariable, error) {
+	if sv.IsBroken() {
+		return nil, errors.New("service is broken")
+	}
+	defer sv.lock()()
+	locs := sv.cp.GlobalVariableLocs()
+	types := sv.cp.GlobalVariableTypes()
+	names := []string{}
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dropped := []DroppedVariable{}
+	for _, name := range names {
+		saved := snapshot[name]
+		loc, ok := locs[name]
+		if !ok {
+			dropped = append(dropped, DroppedVariable{name, "the variable no longer exists"})
+			continue
+		}
+		v, e := sv.cp.Vm.DecodeValue(saved.Value, "")
+		if e != nil {
+			dropped = append(dropped, DroppedVariable{name, "the value can no longer be made: " + e.Error()})
+			continue
+		}
+		if sv.cp.Vm.DescribeType(v.T, compiler.DEFAULT) != saved.Type || !types[name].Contains(v.T) {
+			dropped = append(dropped, DroppedVariable{name, "the variable can no longer have type '" + saved.Type + "'"})
+			continue
+		}
+		sv.cp.Vm.Mem[loc] = v
+	}
+	return dropped, nil
+}
+
+// A `SnapshotStore` which keeps the snapshot of each service as a JSON file in a directory.
+type DirSnapshotStore struct {
+	Dir string
+}
+
+func (d DirSnapshotStore) path(service string) string {
+	return filepath.Join(d.Dir, service+".json")
+}
+
+func (d DirSnapshotStore) Load(service string) (Snapshot, bool, error) {
+	contents, e := os.ReadFile(d.path(service))
+	if errors.Is(e, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if e != nil {
+		return nil, false, e
+	}
+	snapshot := Snapshot{}
+	if e := json.Unmarshal(contents, &snapshot); e != nil {
+		return nil, false, e
+	}
+	return snapshot, true, nil
+}
+
+func (d DirSnapshotStore) Save(service string, snapshot Snapshot) error {
+	contents, e := json.MarshalIndent(snapshot, "", "  ")
+	if e != nil {
+		return e
+	}
+	if e := os.MkdirAll(d.Dir, 0700); e != nil {
+		return e
+	}
+	return os.WriteFile(d.path(service), contents, 0600)
+}
@@ -368,7 +368,8 @@ func MakeFilepath(scriptFilepath string) string {
 	if settings.StandardLibraries.Contains(scriptFilepath) {
 		doctoredFilepath = settings.PipefishHomeDirectory + "lib/" + scriptFilepath
 	}
-	if len(scriptFilepath) >= 3 && scriptFilepath[len(scriptFilepath)-3:] != ".pf" && len(scriptFilepath) >= 4 && scriptFilepath[len(scriptFilepath)-4:] != ".hub" {
+	if len(scriptFilepath) >= 3 && scriptFilepath[len(scriptFilepath)-3:] != ".pf" && len(scriptFilepath) >= 4 && scriptFilepath[len(scriptFilepath)-4:] != ".hub" &&
+		scriptFilepath[len(scriptFilepath)-4:] != ".sql" { // ... since we import the schemas of databases too.
 		doctoredFilepath = doctoredFilepath + ".pf"
 	}
 	return doctoredFilepath
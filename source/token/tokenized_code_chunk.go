@@ -8,6 +8,7 @@ type TokenizedCodeChunk struct {
 	position int
 	code     []Token
 	Private  bool
+	Access   []string // The groups which may call it from outside the service, if it's a function or command declared under 'for'.
 }
 
 func NewCodeChunk() *TokenizedCodeChunk {